@@ -18,14 +18,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
 	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/nfs"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/quota"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/supervisor"
 
 	"k8s.io/klog/v2"
 )
@@ -38,15 +42,32 @@ var (
 	workingMountDir              = flag.String("working-mount-dir", "/tmp", "working directory for provisioner to mount nfs shares temporarily")
 	defaultOnDeletePolicy        = flag.String("default-ondelete-policy", "", "default policy for deleting subdirectory when deleting a volume")
 	volStatsCacheExpireInMinutes = flag.Int("vol-stats-cache-expire-in-minutes", 10, "The cache expire time in minutes for volume stats cache")
+	volStatsTimeout              = flag.Duration("vol-stats-timeout", 5*time.Second, "how long NodeGetVolumeStats waits for the stats of a volume before returning the last collected stats with an abnormal volume condition")
+	internalMountIdleTimeout     = flag.Duration("internal-mount-idle-timeout", 5*time.Minute, "how long the controller keeps an unused internal mount of a share for the next CreateVolume, DeleteVolume and snapshot requests; the share is mounted and unmounted by every request if 0")
+	capacityRefreshInterval      = flag.Duration("capacity-refresh-interval", time.Minute, "how often the controller collects the capacity of the shares of the driver configuration, returned by GetCapacity; collected by every GetCapacity call if 0")
+	serverPool                   = flag.String("server-pool", "", "name of the NFS server pool of the driver, reported as the topology segment of the nodes so that the external-provisioner publishes the capacity of the pool per segment. The default is empty string, which means topology is disabled")
+	quotaBackend                 = flag.String("quota-backend", quota.BackendNone, "how the controller enforces the requested capacity of the subdirectory volumes: none does not enforce it, project sets Linux project quotas on the XFS or ext4 filesystem mounted on --quota-project-root, command runs --quota-command")
+	quotaProjectRoot             = flag.String("quota-project-root", "", "directory the filesystem exported by the NFS server is mounted on in the controller, mounted with prjquota, for the project quota backend")
+	quotaCommand                 = flag.String("quota-command", "", "space-separated command of the command quota backend, run with the set or remove action as last argument and the volume in the QUOTA_VOLUME_ID, QUOTA_SERVER, QUOTA_SHARE, QUOTA_SUBDIR, QUOTA_PATH and QUOTA_BYTES environment variables")
+	mountTimeout                 = flag.Duration("mount-timeout", 90*time.Second, "how long an NFS mount may take before the mount process is killed and NodeStageVolume or NodePublishVolume fails with Unavailable, so that an unreachable server does not hold the volume lock until kubelet gives up; unlimited if 0")
+	nativeMount                  = flag.Bool("native-mount", false, "if true, the node server mounts the NFS shares with the mount(2) system call, resolving the server and setting the addr and clientaddr options itself, instead of running the mount.nfs helper. NFS versions are tried from 4.2 down to 3 when the mount options set none")
+	kubeletDir                   = flag.String("kubelet-dir", nfs.DefaultKubeletDir, "root directory of kubelet, under which the node server looks up the mounts of the driver at startup")
+	startupReconcilePolicy       = flag.String("startup-reconcile-policy", "report", "what the node server does with the NFS mounts of the driver it finds under the kubelet directory at startup: none ignores them, report reports the stale ones and the ones on an IP no longer assigned to the node as events on the node, repair also remounts them with the IP assigned to the node and checks them for stale mounts from then on")
+	subDirUsageRefreshInterval   = flag.Duration("subdir-usage-refresh-interval", 0, "how often the usage of subdirectory volumes is computed by walking them in the background, such as 10m, the usage of the whole share is reported if 0")
+	subDirUsageMaxEntries        = flag.Int64("subdir-usage-max-entries", 1000000, "number of files and directories after which the walk of a subdirectory volume is abandoned and the usage of the whole share is reported")
 	enableNodeLB                 = flag.Bool("enable-node-lb", false, "When enabled, an external load balancer will assign NFS server IPs to each node. This only works for a single NFS instance")
 	ipAddresses                  = flag.String("ip-addresses", "", "Comma-separated list of NFS server IP addresses")
 	runControllerServer          = flag.Bool("run-controller-server", false, "if true, starts the controller server")
 	runNodeServer                = flag.Bool("run-node-server", false, "if true, starts the node server")
 	runNfsServices               = flag.Bool("run-nfs-services", false, "starts NFS services")
-)
-
-const (
-	NfsServicesStartCmd = "/nfs_services_start.sh"
+	staleMountCheckInterval      = flag.Duration("stale-mount-check-interval", time.Minute, "how often the node server checks the staged volumes for stale NFS mounts and remounts them, disabled if 0")
+	loadReportInterval           = flag.Duration("load-report-interval", 0, "how often the node server publishes the NFS load of the node, computed from mountstats, on its load Lease for the load-weighted LB strategy, disabled if 0")
+	loadNamespace                = flag.String("load-namespace", "", "namespace of the Leases the node servers publish their NFS load on, read by the controller with the load-weighted LB strategy. The default is empty string, which means the namespace of the driver pod.")
+	lbStrategy                   = flag.String("lb-strategy", string(lbcontroller.StrategyLeastNodes), "how the controller selects the NFS server IP assigned to a node: least-nodes assigns the IP assigned to the fewest nodes, load-weighted the IP with the least load reported by the nodes")
+	kerberosDir                  = flag.String("kerberos-dir", "", "directory, preferably on the host, where the node server keeps the Kerberos keytabs and configuration from the secrets of the volumes mounted with sec=krb5, krb5i or krb5p, and runs rpc.gssd with them when NFS services are run. The default is empty string, which means Kerberos credentials from secrets are disabled.")
+	tlsDir                       = flag.String("tls-dir", "", "directory, preferably on the host, where the node server keeps the CA bundles and client certificates from the secrets of the volumes mounted with xprtsec=tls or mtls, and runs tlshd with them when NFS services are run. Requires Linux 6.5 or later. The default is empty string, which means TLS credentials from secrets are disabled.")
+	driverConfig                 = flag.String("driver-config", "", "path of the driver configuration file, usually a mounted ConfigMap, with the mount profiles volumes select and the mount option policies enforced in CreateVolume, NodeStageVolume and NodePublishVolume. It is reloaded when it changes. The default is empty string, which means no mount policy is enforced.")
+	httpEndpoint                 = flag.String("http-endpoint", "", "The TCP network address where the HTTP server for the /healthz and /readyz endpoints, and /metrics on the node, will listen (example: `:29653`). The default is empty string, which means the server is disabled.")
 )
 
 func main() {
@@ -59,24 +80,40 @@ func main() {
 
 	klog.V(4).Infof("runController %v, runNodeServer %v, runNfsServices %v", *runControllerServer, *runNodeServer, *runNfsServices)
 	ctx, cancel := context.WithCancel(context.Background())
+	var nfsServices *supervisor.Supervisor
+	nfsServicesStopped := make(chan struct{})
 	if *runNfsServices && !*runControllerServer {
-		// Start the NFS services in the background
-		cmd := exec.CommandContext(ctx, NfsServicesStartCmd)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Cancel = func() error {
-			klog.V(4).Infof("sending SIGTERM to nfs process: %v", cmd)
-			return cmd.Process.Signal(syscall.SIGTERM)
+		// Start and supervise the NFS services in the background
+		daemons := supervisor.NFSClientDaemons()
+		if *kerberosDir != "" {
+			gssd, err := nfs.KerberosDaemon(*kerberosDir)
+			if err != nil {
+				klog.Fatalf("failed to set up rpc.gssd: %v", err)
+			}
+			daemons = append(daemons, gssd)
 		}
-		if err := cmd.Start(); err != nil {
-			klog.Fatalf("Error starting nfs services: %v", err)
-			return
+		if *tlsDir != "" {
+			tlshd, err := nfs.TLSDaemon(*tlsDir)
+			switch {
+			case errors.Is(err, nfs.ErrTLSUnsupported):
+				klog.Warningf("not running tlshd, the xprtsec=tls and mtls volumes are rejected on this node: %v", err)
+			case err != nil:
+				klog.Fatalf("failed to set up tlshd: %v", err)
+			default:
+				daemons = append(daemons, tlshd)
+			}
 		}
-
-		klog.V(2).Infof("nfs services started in the background with PID: %d", cmd.Process.Pid)
+		nfsServices = supervisor.New(supervisor.Options{}, daemons...)
+		go func() {
+			nfsServices.Run(ctx)
+			close(nfsServicesStopped)
+		}()
+		klog.V(2).Infof("nfs services started in the background")
+	} else {
+		close(nfsServicesStopped)
 	}
 
-	go handle()
+	go handle(nfsServices)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM)
@@ -85,11 +122,12 @@ func main() {
 	<-c // blocking the process
 	klog.Info("received SIGTERM signal, calling cancel")
 	cancel()
+	<-nfsServicesStopped
 
 	os.Exit(0)
 }
 
-func handle() {
+func handle(nfsServices *supervisor.Supervisor) {
 	driverOptions := nfs.DriverOptions{
 		NodeID:                       *nodeID,
 		DriverName:                   *driverName,
@@ -98,8 +136,25 @@ func handle() {
 		WorkingMountDir:              *workingMountDir,
 		DefaultOnDeletePolicy:        *defaultOnDeletePolicy,
 		VolStatsCacheExpireInMinutes: *volStatsCacheExpireInMinutes,
+		VolStatsTimeout:              *volStatsTimeout,
+		MountTimeout:                 *mountTimeout,
+		InternalMountIdleTimeout:     *internalMountIdleTimeout,
+		CapacityRefreshInterval:      *capacityRefreshInterval,
+		ServerPool:                   *serverPool,
+		KubeletDir:                   *kubeletDir,
+		NativeMount:                  *nativeMount,
+		StartupReconcilePolicy:       *startupReconcilePolicy,
+		SubDirUsageRefreshInterval:   *subDirUsageRefreshInterval,
+		SubDirUsageMaxEntries:        *subDirUsageMaxEntries,
 		RunControllerServer:          *runControllerServer,
 		RunNodeServer:                *runNodeServer,
+		HTTPEndpoint:                 *httpEndpoint,
+		StaleMountCheckInterval:      *staleMountCheckInterval,
+		LoadReportInterval:           *loadReportInterval,
+		KerberosDir:                  *kerberosDir,
+		TLSDir:                       *tlsDir,
+		DriverConfig:                 *driverConfig,
+		NfsServices:                  nfsServices,
 	}
 
 	if *runControllerServer && *ipAddresses == "" {
@@ -107,6 +162,33 @@ func handle() {
 		return
 	}
 
+	strategy, err := lbcontroller.ParseStrategy(*lbStrategy)
+	if err != nil {
+		klog.Fatal(err)
+		return
+	}
+	driverOptions.LBStrategy = strategy
+	if *loadReportInterval > 0 || strategy == lbcontroller.StrategyLoadWeighted {
+		namespace, err := lbcontroller.LoadNamespace(*loadNamespace)
+		if err != nil {
+			klog.Fatal(err)
+			return
+		}
+		driverOptions.LoadNamespace = namespace
+	}
+
+	if *runControllerServer {
+		backend, err := quota.NewBackend(*quotaBackend, quota.Options{
+			ProjectRoot: *quotaProjectRoot,
+			Command:     strings.Fields(*quotaCommand),
+		})
+		if err != nil {
+			klog.Fatal(err)
+			return
+		}
+		driverOptions.QuotaBackend = backend
+	}
+
 	ipList := strings.Split(*ipAddresses, ",")
 	driverOptions.IPList = ipList
 	d := nfs.NewDriver(&driverOptions)
@@ -0,0 +1,158 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package driverconfig loads the configuration of the driver set by the
+// cluster admin, such as the mount option policies, from a YAML file which
+// is usually a mounted ConfigMap.
+package driverconfig
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultMountPolicy is the mount policy of the volumes which do not select
+// one.
+const DefaultMountPolicy = "default"
+
+// Config is the driver configuration.
+type Config struct {
+	// MountPolicies are the mount option policies by name.
+	MountPolicies map[string]*MountPolicy `json:"mountPolicies,omitempty"`
+	// MountProfiles are the named sets of mount options volumes can select.
+	MountProfiles map[string]*MountProfile `json:"mountProfiles,omitempty"`
+	// Shares are the NFS shares the driver provisions volumes in.
+	Shares []*Share `json:"shares,omitempty"`
+}
+
+// Parse parses a YAML configuration, unknown fields are errors.
+func Parse(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, err
+	}
+	for name, p := range c.MountPolicies {
+		if p == nil {
+			return nil, fmt.Errorf("mount policy %q is empty", name)
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("invalid mount policy %q: %v", name, err)
+		}
+	}
+	for name, p := range c.MountProfiles {
+		if p == nil || len(p.MountOptions) == 0 {
+			return nil, fmt.Errorf("mount profile %q has no mount options", name)
+		}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("invalid mount profile %q: %v", name, err)
+		}
+	}
+	for i, s := range c.Shares {
+		if s == nil {
+			return nil, fmt.Errorf("share %d is empty", i)
+		}
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("invalid share %d: %v", i, err)
+		}
+	}
+	return c, nil
+}
+
+// MountProfile returns the mount profile with the given name.
+func (c *Config) MountProfile(name string) (*MountProfile, error) {
+	p, ok := c.MountProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown mount profile %q", name)
+	}
+	return p, nil
+}
+
+// MountPolicy returns the mount policy with the given name, or the default
+// one if name is empty. It returns nil if no default mount policy is
+// configured, and an error for an unknown name.
+func (c *Config) MountPolicy(name string) (*MountPolicy, error) {
+	if name == "" {
+		return c.MountPolicies[DefaultMountPolicy], nil
+	}
+	p, ok := c.MountPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown mount policy %q", name)
+	}
+	return p, nil
+}
+
+// File is a configuration file reloaded when it changes, so that the updates
+// of a mounted ConfigMap are used without restarting the driver.
+type File struct {
+	path  string
+	mutex sync.Mutex
+	// modTime and size identify the last version of the file read
+	modTime time.Time
+	size    int64
+	config  *Config
+}
+
+// NewFile loads the configuration file at path.
+func NewFile(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Get returns the configuration, reloaded first if the file changed. An
+// invalid update is logged and the previous configuration kept.
+func (f *File) Get() *Config {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err := f.reload(); err != nil {
+		klog.Warningf("failed to reload the driver configuration, keeping the previous one: %v", err)
+	}
+	return f.config
+}
+
+// reload loads the file if it changed since it was last loaded. It must be
+// called with the mutex held.
+func (f *File) reload() error {
+	// ConfigMap updates replace a symlink, which is followed by Stat
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.config != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	// an invalid version is reported once, not on every call
+	f.modTime, f.size = info.ModTime(), info.Size()
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	config, err := Parse(data)
+	if err != nil {
+		return fmt.Errorf("invalid driver configuration %s: %v", f.path, err)
+	}
+	f.config = config
+	klog.V(2).Infof("loaded the driver configuration %s", f.path)
+	return nil
+}
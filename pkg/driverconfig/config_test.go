@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		desc        string
+		config      string
+		expectedErr string
+	}{
+		{
+			desc: "valid",
+			config: `
+mountPolicies:
+  default:
+    denied: [soft, nolock]
+    defaults: [hard]
+    ranges:
+      rsize: {min: 4096, max: 1048576}
+`,
+		},
+		{
+			desc:        "unknown field",
+			config:      "mountPolicy: {}",
+			expectedErr: `error unmarshaling JSON: while decoding JSON: json: unknown field "mountPolicy"`,
+		},
+		{
+			desc:        "empty policy",
+			config:      "mountPolicies: {default: }",
+			expectedErr: `mount policy "default" is empty`,
+		},
+		{
+			desc:        "denied default",
+			config:      "mountPolicies: {default: {denied: [soft], defaults: [soft]}}",
+			expectedErr: `invalid mount policy "default": default "soft" is denied by "soft"`,
+		},
+		{
+			desc:        "comma separated options",
+			config:      "mountPolicies: {default: {defaults: [\"hard,vers=3\"]}}",
+			expectedErr: `invalid mount policy "default": invalid mount option "hard,vers=3"`,
+		},
+		{
+			desc:        "invalid range",
+			config:      "mountPolicies: {default: {ranges: {rsize: {min: 2, max: 1}}}}",
+			expectedErr: `invalid mount policy "default": invalid range of rsize, min is greater than max`,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Parse([]byte(test.config))
+		if test.expectedErr == "" {
+			assert.NoError(t, err, test.desc)
+		} else {
+			assert.EqualError(t, err, test.expectedErr, test.desc)
+		}
+	}
+}
+
+func TestConfigMountPolicy(t *testing.T) {
+	c, err := Parse([]byte("mountPolicies: {default: {defaults: [hard]}, strict: {denied: [soft]}}"))
+	assert.NoError(t, err)
+
+	p, err := c.MountPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hard"}, p.Defaults)
+	p, err = c.MountPolicy("strict")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"soft"}, p.Denied)
+	_, err = c.MountPolicy("lax")
+	assert.EqualError(t, err, `unknown mount policy "lax"`)
+
+	// without a default policy, the volumes selecting none are not restricted
+	p, err = (&Config{}).MountPolicy("")
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+}
+
+func TestFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(config string, modTime time.Time) {
+		assert.NoError(t, os.WriteFile(path, []byte(config), 0600))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	now := time.Now()
+	write("mountPolicies: {default: {denied: [soft]}}", now)
+
+	f, err := NewFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"soft"}, f.Get().MountPolicies["default"].Denied)
+
+	write("mountPolicies: {default: {denied: [nolock]}}", now.Add(time.Second))
+	assert.Equal(t, []string{"nolock"}, f.Get().MountPolicies["default"].Denied)
+
+	// an invalid update keeps the previous configuration
+	write("mountPolicies: [", now.Add(2*time.Second))
+	assert.Equal(t, []string{"nolock"}, f.Get().MountPolicies["default"].Denied)
+
+	_, err = NewFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
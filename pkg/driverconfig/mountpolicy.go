@@ -0,0 +1,243 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MountPolicy restricts the mount options of volumes, and sets defaults for
+// the options they do not set. Options are given as a name, such as hard, or
+// name=value, such as vers=3.
+type MountPolicy struct {
+	// Allowed are the names of the options volumes may set, any if empty.
+	// ro and rw, set from the access mode, are always allowed.
+	Allowed []string `json:"allowed,omitempty"`
+	// Denied are the options volumes may not set, a name denies any value.
+	Denied []string `json:"denied,omitempty"`
+	// Required are the options volumes must have once the defaults are added,
+	// a name requires any value.
+	Required []string `json:"required,omitempty"`
+	// Defaults are added to the options of volumes which set neither the
+	// same option nor its opposite, such as soft for hard or nolock for lock.
+	Defaults []string `json:"defaults,omitempty"`
+	// Ranges are the bounds of the numeric options by name.
+	Ranges map[string]Range `json:"ranges,omitempty"`
+}
+
+// Range bounds the value of a numeric option, both ends are inclusive and
+// optional.
+type Range struct {
+	Min *int64 `json:"min,omitempty"`
+	Max *int64 `json:"max,omitempty"`
+}
+
+// contains returns true if value is within the range.
+func (r Range) contains(value int64) bool {
+	return (r.Min == nil || value >= *r.Min) && (r.Max == nil || value <= *r.Max)
+}
+
+func (r Range) String() string {
+	switch {
+	case r.Min != nil && r.Max != nil:
+		return fmt.Sprintf("between %d and %d", *r.Min, *r.Max)
+	case r.Min != nil:
+		return fmt.Sprintf("at least %d", *r.Min)
+	case r.Max != nil:
+		return fmt.Sprintf("at most %d", *r.Max)
+	}
+	return "any number"
+}
+
+var (
+	// optionAliases are the other names of options
+	optionAliases = map[string]string{"nfsvers": "vers"}
+	// optionGroups are the options which override each other, besides the
+	// ones negated with a no prefix
+	optionGroups = map[string]string{"soft": "hard", "softerr": "hard"}
+	// alwaysAllowed are the options set by the driver from the access mode
+	alwaysAllowed = map[string]bool{"ro": true, "rw": true}
+)
+
+// mountOption is a single mount option.
+type mountOption struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+func parseMountOption(opt string) mountOption {
+	name, value, hasValue := strings.Cut(opt, "=")
+	if alias, ok := optionAliases[name]; ok {
+		name = alias
+	}
+	return mountOption{name: name, value: value, hasValue: hasValue}
+}
+
+// matches returns true if o is the option of a policy entry, which matches
+// any value if it has none.
+func (o mountOption) matches(entry mountOption) bool {
+	return o.name == entry.name && (!entry.hasValue || (o.hasValue && o.value == entry.value))
+}
+
+// group returns the name shared by the options which override each other.
+func (o mountOption) group() string {
+	if g, ok := optionGroups[o.name]; ok {
+		return g
+	}
+	if !o.hasValue {
+		return strings.TrimPrefix(o.name, "no")
+	}
+	return o.name
+}
+
+// SplitMountOptions returns the single options of mount options which may
+// hold several comma separated options, such as the mountoptions volume
+// attribute.
+func SplitMountOptions(mountOptions []string) []string {
+	var options []string
+	for _, opt := range mountOptions {
+		for _, o := range strings.Split(opt, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				options = append(options, o)
+			}
+		}
+	}
+	return options
+}
+
+// addMissingOptions returns mountOptions with the options which are neither
+// set by mountOptions nor overridden by one of them.
+func addMissingOptions(mountOptions, options []string) []string {
+	groups := map[string]bool{}
+	for _, opt := range SplitMountOptions(mountOptions) {
+		groups[parseMountOption(opt).group()] = true
+	}
+	result := append([]string{}, mountOptions...)
+	for _, opt := range options {
+		if g := parseMountOption(opt).group(); !groups[g] {
+			result = append(result, opt)
+			groups[g] = true
+		}
+	}
+	return result
+}
+
+// validateMountOptions checks that the options of the configuration are
+// single options.
+func validateMountOptions(options ...[]string) error {
+	for _, entries := range options {
+		for _, e := range entries {
+			if e == "" || strings.ContainsAny(e, ", ") {
+				return fmt.Errorf("invalid mount option %q", e)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *MountPolicy) validate() error {
+	if err := validateMountOptions(p.Allowed, p.Denied, p.Required, p.Defaults); err != nil {
+		return err
+	}
+	for _, d := range p.Defaults {
+		if denied, ok := p.denied(parseMountOption(d)); ok {
+			return fmt.Errorf("default %q is denied by %q", d, denied)
+		}
+	}
+	for name, r := range p.Ranges {
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return fmt.Errorf("invalid range of %s, min is greater than max", name)
+		}
+	}
+	return nil
+}
+
+// Apply checks the mount options of a volume against the policy and returns
+// them with the defaults added.
+func (p *MountPolicy) Apply(mountOptions []string) ([]string, error) {
+	options := SplitMountOptions(mountOptions)
+	for _, opt := range options {
+		if err := p.check(opt, parseMountOption(opt)); err != nil {
+			return nil, err
+		}
+	}
+
+	result := addMissingOptions(mountOptions, p.Defaults)
+	options = SplitMountOptions(result)
+	for _, r := range p.Required {
+		required := parseMountOption(r)
+		found := false
+		for _, opt := range options {
+			if parseMountOption(opt).matches(required) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("mount option %q is required", r)
+		}
+	}
+	return result, nil
+}
+
+// check checks a single option set by a volume.
+func (p *MountPolicy) check(opt string, o mountOption) error {
+	if denied, ok := p.denied(o); ok {
+		if denied == opt {
+			return fmt.Errorf("mount option %q is denied", opt)
+		}
+		return fmt.Errorf("mount option %q is denied by %q", opt, denied)
+	}
+	if len(p.Allowed) > 0 && !alwaysAllowed[o.name] && !p.allowed(o) {
+		allowed := append([]string{}, p.Allowed...)
+		sort.Strings(allowed)
+		return fmt.Errorf("mount option %q is not allowed, the allowed options are %s", opt, strings.Join(allowed, ", "))
+	}
+	if r, ok := p.Ranges[o.name]; ok {
+		value, err := strconv.ParseInt(o.value, 10, 64)
+		if !o.hasValue || err != nil {
+			return fmt.Errorf("mount option %q must be a number %s", opt, r)
+		}
+		if !r.contains(value) {
+			return fmt.Errorf("mount option %q must be %s", opt, r)
+		}
+	}
+	return nil
+}
+
+// denied returns the entry of the denied options which matches o.
+func (p *MountPolicy) denied(o mountOption) (string, bool) {
+	for _, d := range p.Denied {
+		if o.matches(parseMountOption(d)) {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+func (p *MountPolicy) allowed(o mountOption) bool {
+	for _, a := range p.Allowed {
+		if o.name == parseMountOption(a).name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestMountPolicyApply(t *testing.T) {
+	policy := &MountPolicy{
+		Denied:   []string{"soft", "nolock", "vers=2"},
+		Required: []string{"hard", "vers"},
+		Defaults: []string{"hard", "vers=4.1", "nconnect=4"},
+		Ranges: map[string]Range{
+			"rsize":    {Min: int64Ptr(4096), Max: int64Ptr(1048576)},
+			"nconnect": {Max: int64Ptr(16)},
+		},
+	}
+	allowList := &MountPolicy{Allowed: []string{"vers", "rsize", "hard"}}
+
+	tests := []struct {
+		desc            string
+		policy          *MountPolicy
+		mountOptions    []string
+		expectedOptions []string
+		expectedErr     string
+	}{
+		{
+			desc:            "defaults added",
+			policy:          policy,
+			mountOptions:    []string{"rsize=1048576"},
+			expectedOptions: []string{"rsize=1048576", "hard", "vers=4.1", "nconnect=4"},
+		},
+		{
+			desc:            "options set by the volume are kept, aliases included",
+			policy:          policy,
+			mountOptions:    []string{"nfsvers=3,nconnect=16", "hard"},
+			expectedOptions: []string{"nfsvers=3,nconnect=16", "hard"},
+		},
+		{
+			desc:         "denied flag",
+			policy:       policy,
+			mountOptions: []string{"vers=3", "soft"},
+			expectedErr:  `mount option "soft" is denied`,
+		},
+		{
+			desc:         "denied value",
+			policy:       policy,
+			mountOptions: []string{"nfsvers=2"},
+			expectedErr:  `mount option "nfsvers=2" is denied by "vers=2"`,
+		},
+		{
+			desc:         "value out of range",
+			policy:       policy,
+			mountOptions: []string{"rsize=1024"},
+			expectedErr:  `mount option "rsize=1024" must be between 4096 and 1048576`,
+		},
+		{
+			desc:         "value over the maximum",
+			policy:       policy,
+			mountOptions: []string{"nconnect=64"},
+			expectedErr:  `mount option "nconnect=64" must be at most 16`,
+		},
+		{
+			desc:         "non numeric value",
+			policy:       policy,
+			mountOptions: []string{"rsize=1M"},
+			expectedErr:  `mount option "rsize=1M" must be a number between 4096 and 1048576`,
+		},
+		{
+			desc:            "allowed options",
+			policy:          allowList,
+			mountOptions:    []string{"nfsvers=4.1", "hard", "ro"},
+			expectedOptions: []string{"nfsvers=4.1", "hard", "ro"},
+		},
+		{
+			desc:         "option not allowed",
+			policy:       allowList,
+			mountOptions: []string{"vers=4.1,noac"},
+			expectedErr:  `mount option "noac" is not allowed, the allowed options are hard, rsize, vers`,
+		},
+		{
+			desc:         "required option missing",
+			policy:       &MountPolicy{Required: []string{"xprtsec=tls"}},
+			mountOptions: []string{"xprtsec=none"},
+			expectedErr:  `mount option "xprtsec=tls" is required`,
+		},
+	}
+
+	for _, test := range tests {
+		options, err := test.policy.Apply(test.mountOptions)
+		if test.expectedErr != "" {
+			assert.EqualError(t, err, test.expectedErr, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expectedOptions, options, test.desc)
+	}
+}
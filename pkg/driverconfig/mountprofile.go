@@ -0,0 +1,35 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+// MountProfile is a named set of mount options, such as the ones of a read
+// heavy workload, which volumes select instead of repeating them.
+type MountProfile struct {
+	// MountOptions are the options of the profile, including the special
+	// options of the driver such as read_ahead_kb.
+	MountOptions []string `json:"mountOptions"`
+}
+
+func (p *MountProfile) validate() error {
+	return validateMountOptions(p.MountOptions)
+}
+
+// Expand returns the mount options of a volume with the options of the
+// profile it neither sets nor overrides, such as soft for hard.
+func (p *MountProfile) Expand(mountOptions []string) []string {
+	return addMissingOptions(mountOptions, p.MountOptions)
+}
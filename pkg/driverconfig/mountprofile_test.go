@@ -0,0 +1,62 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountProfileExpand(t *testing.T) {
+	profile := &MountProfile{MountOptions: []string{"vers=3", "nconnect=16", "hard", "lock", "read_ahead_kb=15360"}}
+
+	tests := []struct {
+		desc            string
+		mountOptions    []string
+		expectedOptions []string
+	}{
+		{
+			desc:            "no options",
+			expectedOptions: []string{"vers=3", "nconnect=16", "hard", "lock", "read_ahead_kb=15360"},
+		},
+		{
+			desc:            "the options of the volume win",
+			mountOptions:    []string{"nfsvers=4.1,soft", "nolock", "read_ahead_kb=128", "ro"},
+			expectedOptions: []string{"nfsvers=4.1,soft", "nolock", "read_ahead_kb=128", "ro", "nconnect=16"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expectedOptions, profile.Expand(test.mountOptions), test.desc)
+	}
+}
+
+func TestParseMountProfiles(t *testing.T) {
+	c, err := Parse([]byte("mountProfiles: {ml-training-read-heavy: {mountOptions: [nconnect=16, read_ahead_kb=15360]}}"))
+	assert.NoError(t, err)
+	p, err := c.MountProfile("ml-training-read-heavy")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nconnect=16", "read_ahead_kb=15360"}, p.MountOptions)
+	_, err = c.MountProfile("checkpoint-write-heavy")
+	assert.EqualError(t, err, `unknown mount profile "checkpoint-write-heavy"`)
+
+	_, err = Parse([]byte("mountProfiles: {empty: {mountOptions: []}}"))
+	assert.EqualError(t, err, `mount profile "empty" has no mount options`)
+	_, err = Parse([]byte("mountProfiles: {joined: {mountOptions: [\"vers=3,hard\"]}}"))
+	assert.EqualError(t, err, `invalid mount profile "joined": invalid mount option "vers=3,hard"`)
+}
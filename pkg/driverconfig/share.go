@@ -0,0 +1,43 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"errors"
+)
+
+// Share is an NFS share the driver provisions volumes in, as set by the
+// server and share parameters of StorageClasses.
+type Share struct {
+	// Server is the server parameter of the StorageClasses.
+	Server string `json:"server"`
+	// Share is the share parameter of the StorageClasses.
+	Share string `json:"share"`
+	// MountOptions are the options the controller mounts the share with to
+	// look up its volumes.
+	MountOptions []string `json:"mountOptions,omitempty"`
+}
+
+func (s *Share) validate() error {
+	if s.Server == "" {
+		return errors.New("server is required")
+	}
+	if s.Share == "" {
+		return errors.New("share is required")
+	}
+	return validateMountOptions(s.MountOptions)
+}
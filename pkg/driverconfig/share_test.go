@@ -0,0 +1,54 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driverconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseShares(t *testing.T) {
+	c, err := Parse([]byte("shares: [{server: nfs-server, share: /export, mountOptions: [vers=4.1]}, {server: 10.0.0.1, share: /data}]"))
+	assert.NoError(t, err)
+	assert.Equal(t, []*Share{
+		{Server: "nfs-server", Share: "/export", MountOptions: []string{"vers=4.1"}},
+		{Server: "10.0.0.1", Share: "/data"},
+	}, c.Shares)
+
+	tests := []struct {
+		config      string
+		expectedErr string
+	}{
+		{
+			config:      "shares: [null]",
+			expectedErr: "share 0 is empty",
+		},
+		{
+			config:      "shares: [{share: /export}]",
+			expectedErr: "invalid share 0: server is required",
+		},
+		{
+			config:      "shares: [{server: nfs-server, share: /export}, {server: nfs-server}]",
+			expectedErr: "invalid share 1: share is required",
+		},
+	}
+	for _, test := range tests {
+		_, err := Parse([]byte(test.config))
+		assert.EqualError(t, err, test.expectedErr, test.config)
+	}
+}
@@ -19,6 +19,7 @@ package lbcontroller
 import (
 	"time"
 
+	coordinationv1 "k8s.io/api/coordination/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -26,25 +27,39 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 )
 
+// FakeLoadNamespace is the namespace of the load Leases of the fake LB
+// controller.
+const FakeLoadNamespace = "default"
+
 func NewFakeLBController(ipMap map[string]int, nodes []runtime.Object) *LBController {
 	client := fake.NewSimpleClientset(nodes...)
 	factory := informers.NewSharedInformerFactory(client, time.Hour /* disable resync*/)
 	nodeInformer := factory.Core().V1().Nodes()
+	leaseInformer := factory.Coordination().V1().Leases()
+	pvInformer := factory.Core().V1().PersistentVolumes()
 
 	for _, obj := range nodes {
 		switch obj.(type) {
 		case *v1.Node:
 			nodeInformer.Informer().GetStore().Add(obj)
+		case *coordinationv1.Lease:
+			leaseInformer.Informer().GetStore().Add(obj)
+		case *v1.PersistentVolume:
+			pvInformer.Informer().GetStore().Add(obj)
 		default:
 			break
 		}
 	}
 
-	return &LBController{
+	c := &LBController{
 		ipMap:      ipMap,
 		clientset:  client,
 		nodeLister: nodeInformer.Lister(),
+		pvLister:   pvInformer.Lister(),
+		loadLister: leaseInformer.Lister().Leases(FakeLoadNamespace),
 	}
+	c.synced.Store(true)
+	return c
 }
 
 type TestNode struct {
@@ -18,16 +18,19 @@ package lbcontroller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"k8s.io/apimachinery/pkg/api/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	coordinationlisters "k8s.io/client-go/listers/coordination/v1"
 	listersv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
@@ -38,14 +41,34 @@ const (
 	NodeAnnotation = "nfs.lb.csi.storage.gke.io/assigned-ip"
 )
 
+// ErrNotSynced is returned by IP assignment calls made before the node
+// informer cache has synced and the IP map has been rebuilt from it.
+var ErrNotSynced = errors.New("LB controller node cache has not synced yet")
+
 type LBController struct {
 	clientset  kubernetes.Interface
 	nodeLister listersv1.NodeLister
-	ipMap      map[string]int
-	mutex      sync.Mutex
+	// pvLister lists the PersistentVolumes of the VolumeAttachments read
+	// when the cache syncs.
+	pvLister listersv1.PersistentVolumeLister
+	ipMap    map[string]int
+	mutex    sync.Mutex
+	// synced is set once the node informer cache has synced, ipMap has been
+	// rebuilt from the existing node annotations and published from the
+	// VolumeAttachments.
+	synced   atomic.Bool
+	strategy Strategy
+	// published are the nodes the volumes are published on
+	published publishedVolumes
+	// loadLister lists the load Leases of the nodes, nil unless the strategy
+	// is StrategyLoadWeighted.
+	loadLister coordinationlisters.LeaseNamespaceLister
 }
 
-func NewLBController(ipList []string) *LBController {
+// NewLBController returns a LB controller assigning the IPs of ipList with
+// the given strategy, for the volumes of driverName. The load of the nodes is
+// read from the Leases of loadNamespace with StrategyLoadWeighted.
+func NewLBController(driverName string, ipList []string, strategy Strategy, loadNamespace string) *LBController {
 	klog.Infof("Building kube configs for running in cluster...")
 	config, err := rest.InClusterConfig()
 	if err != nil {
@@ -60,24 +83,77 @@ func NewLBController(ipList []string) *LBController {
 	ctx := signals.SetupSignalHandler()
 	sharedInformerFactory := informers.NewSharedInformerFactory(clientset, 10*time.Minute /*Resync interval of the informer*/)
 	nodeLister := sharedInformerFactory.Core().V1().Nodes().Lister()
+	pvLister := sharedInformerFactory.Core().V1().PersistentVolumes().Lister()
 	stopCh := ctx.Done()
 	sharedInformerFactory.Start(stopCh)
-	sharedInformerFactory.WaitForCacheSync(stopCh)
 
 	lbc := LBController{
 		clientset:  clientset,
 		nodeLister: nodeLister,
+		pvLister:   pvLister,
+		strategy:   strategy,
+	}
+	if strategy == StrategyLoadWeighted {
+		// the Leases are only watched in the namespace of the driver
+		leaseInformerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 10*time.Minute, informers.WithNamespace(loadNamespace))
+		lbc.loadLister = leaseInformerFactory.Coordination().V1().Leases().Lister().Leases(loadNamespace)
+		leaseInformerFactory.Start(stopCh)
 	}
 
-	ipMap, err := lbc.resyncIPMap(ipList)
+	// The cache is synced in the background so that the CSI socket can be
+	// served, and report not ready through Probe, while the sync is running.
+	go func() {
+		sharedInformerFactory.WaitForCacheSync(stopCh)
+		ipMap, err := lbc.resyncIPMap(ipList)
+		if err != nil {
+			klog.Fatalf("Failed to resync LB Controller cache: %v", err)
+		}
+		if err := lbc.retryResyncPublished(ctx, driverName); err != nil {
+			klog.Infof("Stopped resyncing LB Controller published volumes: %v", err)
+			return
+		}
 
-	if err != nil {
-		klog.Fatalf("Failed to resync LB Controller cache: %v", err)
+		lbc.mutex.Lock()
+		lbc.ipMap = ipMap
+		lbc.mutex.Unlock()
+		lbc.synced.Store(true)
+		klog.Infof("LB controller node cache synced")
+	}()
+
+	return &lbc
+}
+
+// CheckSynced returns ErrNotSynced until the node informer cache has synced,
+// the IP map has been rebuilt from the existing node annotations and the
+// published volumes from the VolumeAttachments.
+func (c *LBController) CheckSynced() error {
+	if !c.synced.Load() {
+		return ErrNotSynced
 	}
+	return nil
+}
 
-	lbc.ipMap = ipMap
+// IPsByAssignedNodes returns all the NFS server IPs, the ones assigned to the
+// fewest nodes first.
+func (c *LBController) IPsByAssignedNodes() ([]string, error) {
+	if err := c.CheckSynced(); err != nil {
+		return nil, err
+	}
 
-	return &lbc
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ips := make([]string, 0, len(c.ipMap))
+	for ip := range c.ipMap {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if c.ipMap[ips[i]] != c.ipMap[ips[j]] {
+			return c.ipMap[ips[i]] < c.ipMap[ips[j]]
+		}
+		return ips[i] < ips[j]
+	})
+	return ips, nil
 }
 
 func (c *LBController) resyncIPMap(ipList []string) (map[string]int, error) {
@@ -108,6 +184,10 @@ func (c *LBController) resyncIPMap(ipList []string) (map[string]int, error) {
 }
 
 func (c *LBController) AssignIPToNode(ctx context.Context, nodeName, volumeID string) (string, error) {
+	if err := c.CheckSynced(); err != nil {
+		return "", err
+	}
+
 	node, err := c.nodeLister.Get(nodeName)
 	if err != nil {
 		return "", err
@@ -119,20 +199,13 @@ func (c *LBController) AssignIPToNode(ctx context.Context, nodeName, volumeID st
 	if ip, exists := node.Annotations[NodeAnnotation]; exists {
 		klog.Infof("Node %q already have IP %q assigned", node.Name, ip)
 		if _, exists := c.ipMap[ip]; exists {
+			c.published.add(volumeID, nodeName)
 			return ip, nil
 		}
 		klog.V(5).Infof("IP %q not found among the NFS server IP list. Reassigning a new IP to node %q", ip, node.Name)
 	}
 
-	// Sort IPs by their current count.
-	ips := make([]string, 0, len(c.ipMap))
-	for ip := range c.ipMap {
-		ips = append(ips, ip)
-	}
-	sort.Slice(ips, func(i, j int) bool {
-		return c.ipMap[ips[i]] < c.ipMap[ips[j]]
-	})
-	selectedIP := ips[0]
+	selectedIP := c.selectIP()
 
 	nodeCopy := node.DeepCopy()
 	if node.Annotations == nil {
@@ -148,15 +221,21 @@ func (c *LBController) AssignIPToNode(ctx context.Context, nodeName, volumeID st
 	}
 
 	c.ipMap[selectedIP]++
+	c.published.add(volumeID, nodeName)
 	klog.V(6).Infof("AssignIPToNode: For volume %q, node %q, IP updated %q, LB controller IP map %v", volumeID, nodeName, selectedIP, c.ipMap)
 	return selectedIP, nil
 }
 
 func (c *LBController) RemoveIPFromNode(ctx context.Context, nodeName, volumeID string) error {
+	if err := c.CheckSynced(); err != nil {
+		return err
+	}
+
 	node, err := c.nodeLister.Get(nodeName)
 	if err != nil {
-		if errors.IsNotFound(err) {
+		if apierrors.IsNotFound(err) {
 			klog.V(5).Infof("Node %q not found, skip RemoveIPFromNode for volume %q", nodeName, volumeID)
+			c.published.remove(volumeID, nodeName)
 			return nil
 		}
 		return err
@@ -165,6 +244,7 @@ func (c *LBController) RemoveIPFromNode(ctx context.Context, nodeName, volumeID
 	ip, ok := node.Annotations[NodeAnnotation]
 	if !ok {
 		klog.V(5).Infof("Node %q does not have annotation %q, skip RemoveIPFromNode for volume %q", nodeName, NodeAnnotation, volumeID)
+		c.published.remove(volumeID, nodeName)
 		return nil
 	}
 
@@ -173,6 +253,7 @@ func (c *LBController) RemoveIPFromNode(ctx context.Context, nodeName, volumeID
 
 	if _, exists := c.ipMap[ip]; !exists {
 		klog.V(5).Infof("%q does not exist in LB controller IP map, skip RemoveIPFromNode for volume %q", ip, volumeID)
+		c.published.remove(volumeID, nodeName)
 		return nil
 	}
 
@@ -185,6 +266,7 @@ func (c *LBController) RemoveIPFromNode(ctx context.Context, nodeName, volumeID
 	}
 
 	c.ipMap[ip]--
+	c.published.remove(volumeID, nodeName)
 	klog.V(6).Infof("RemoveIPFromNode: For volume %q, node %q, IP updated %q, LB controller IP map %v", volumeID, nodeName, ip, c.ipMap)
 	return nil
 }
@@ -18,6 +18,7 @@ package lbcontroller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -332,6 +333,44 @@ func TestRemoveIPFromNode(t *testing.T) {
 	}
 }
 
+func TestNotSynced(t *testing.T) {
+	nodePool := NewNodePool([]TestNode{{Name: "node-1", AssignedIP: "127.0.0.1"}})
+	lbController := NewFakeLBController(map[string]int{"127.0.0.1": 1}, nodePool)
+	lbController.synced.Store(false)
+	ctx := context.Background()
+
+	if err := lbController.CheckSynced(); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("CheckSynced got error %v, want %v", err, ErrNotSynced)
+	}
+	if _, err := lbController.AssignIPToNode(ctx, "node-1", "vol-1"); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("AssignIPToNode got error %v, want %v", err, ErrNotSynced)
+	}
+	if err := lbController.RemoveIPFromNode(ctx, "node-1", "vol-1"); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("RemoveIPFromNode got error %v, want %v", err, ErrNotSynced)
+	}
+
+	lbController.synced.Store(true)
+	if err := lbController.CheckSynced(); err != nil {
+		t.Errorf("CheckSynced got error %v, want nil", err)
+	}
+}
+
+func TestIPsByAssignedNodes(t *testing.T) {
+	lbController := NewFakeLBController(map[string]int{"10.0.0.3": 1, "10.0.0.1": 2, "10.0.0.2": 0, "10.0.0.4": 1}, nil)
+	ips, err := lbController.IPsByAssignedNodes()
+	if err != nil {
+		t.Fatalf("IPsByAssignedNodes got error %v, want nil", err)
+	}
+	if diff := cmp.Diff([]string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.1"}, ips); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+
+	lbController.synced.Store(false)
+	if _, err := lbController.IPsByAssignedNodes(); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("IPsByAssignedNodes got error %v, want %v", err, ErrNotSynced)
+	}
+}
+
 func gotExpectedError(testFunc string, wantErr bool, err error) error {
 	if err != nil && !wantErr {
 		return fmt.Errorf("%s got error %v, want nil", testFunc, err)
@@ -0,0 +1,241 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lbcontroller
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// LoadAnnotation is the annotation of the load Lease of a node, see
+	// LoadLeaseName, the node plugins publish their NFS load on as a JSON
+	// encoded NodeLoad.
+	LoadAnnotation = "nfs.lb.csi.storage.gke.io/load"
+	// loadLeasePrefix is the prefix of the names of the load Leases.
+	loadLeasePrefix = "nfs-lb-load-"
+	// namespaceFile is the namespace of the pod, mounted with its service
+	// account token.
+	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// opCostBytes is how many bytes per second weigh as much as one
+	// operation per second in the load of a server.
+	opCostBytes = 4096
+	// StaleLoadReportIntervals is the number of report intervals after which
+	// a load report is ignored.
+	StaleLoadReportIntervals = 3
+)
+
+// Strategy is how the controller selects the IP assigned to a node.
+type Strategy string
+
+const (
+	// StrategyLeastNodes assigns the IP assigned to the fewest nodes.
+	StrategyLeastNodes Strategy = "least-nodes"
+	// StrategyLoadWeighted assigns the IP with the least load reported by the
+	// nodes, see LoadAnnotation.
+	StrategyLoadWeighted Strategy = "load-weighted"
+)
+
+// ParseStrategy returns the strategy of the given name, StrategyLeastNodes if
+// empty.
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case "":
+		return StrategyLeastNodes, nil
+	case StrategyLeastNodes, StrategyLoadWeighted:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown LB strategy %q, must be %q or %q", name, StrategyLeastNodes, StrategyLoadWeighted)
+	}
+}
+
+// NodeLoad is the NFS load of a node, averaged over the report interval.
+type NodeLoad struct {
+	ReportedAt time.Time `json:"reportedAt"`
+	// IntervalSeconds is how often the node reports its load.
+	IntervalSeconds int64 `json:"intervalSeconds"`
+	// Servers is the load by NFS server IP.
+	Servers map[string]ServerLoad `json:"servers,omitempty"`
+}
+
+// ServerLoad is the load of a node on a NFS server.
+type ServerLoad struct {
+	// Mounts is the number of NFS mounts of the server on the node.
+	Mounts         int     `json:"mounts"`
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	OpsPerSecond   float64 `json:"opsPerSecond"`
+}
+
+// Weight returns the load as bytes per second, counting every operation as
+// opCostBytes so that metadata heavy workloads are not ignored.
+func (l ServerLoad) Weight() float64 {
+	return l.BytesPerSecond + l.OpsPerSecond*opCostBytes
+}
+
+// LoadLeaseName returns the name of the Lease a node publishes its NFS load
+// on. A Lease per node, in the namespace of the driver, keeps the node plugins
+// from needing write access to the nodes.
+func LoadLeaseName(nodeName string) string {
+	return loadLeasePrefix + nodeName
+}
+
+// LoadNamespace returns the namespace of the load Leases: namespace, or the
+// namespace of the driver pod if empty.
+func LoadNamespace(namespace string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the namespace of the pod: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ParseNodeLoad parses the value of LoadAnnotation.
+func ParseNodeLoad(value string) (*NodeLoad, error) {
+	load := &NodeLoad{}
+	if err := json.Unmarshal([]byte(value), load); err != nil {
+		return nil, fmt.Errorf("invalid node load %q: %w", value, err)
+	}
+	return load, nil
+}
+
+// isStale returns true if the node has not reported its load for several
+// intervals, because the plugin is not running or reporting was turned off.
+func (l *NodeLoad) isStale(now time.Time) bool {
+	interval := time.Duration(l.IntervalSeconds) * time.Second
+	return interval <= 0 || now.Sub(l.ReportedAt) > StaleLoadReportIntervals*interval
+}
+
+// selectIP returns the IP to assign to a node. It must be called with the
+// mutex held.
+func (c *LBController) selectIP() string {
+	ips := make([]string, 0, len(c.ipMap))
+	for ip := range c.ipMap {
+		ips = append(ips, ip)
+	}
+
+	if c.strategy != StrategyLoadWeighted {
+		// Sort IPs by their current count.
+		sort.Slice(ips, func(i, j int) bool {
+			return c.ipMap[ips[i]] < c.ipMap[ips[j]]
+		})
+		return ips[0]
+	}
+
+	loads := c.ipLoads(time.Now())
+	sort.Slice(ips, func(i, j int) bool {
+		if loads[ips[i]] != loads[ips[j]] {
+			return loads[ips[i]] < loads[ips[j]]
+		}
+		if c.ipMap[ips[i]] != c.ipMap[ips[j]] {
+			return c.ipMap[ips[i]] < c.ipMap[ips[j]]
+		}
+		return ips[i] < ips[j]
+	})
+	klog.V(6).Infof("LB controller IP loads: %v", loads)
+	return ips[0]
+}
+
+// ipLoads returns the load of every IP of the IP map: the load reported by
+// the nodes on it, plus the average load of a node for every node assigned to
+// it without a recent report, so that the nodes which were just assigned an
+// IP do not all go to the least loaded one. It must be called with the mutex
+// held.
+func (c *LBController) ipLoads(now time.Time) map[string]float64 {
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		klog.Warningf("failed to list nodes, ignoring their load: %v", err)
+		nodes = nil
+	}
+
+	loads := make(map[string]float64, len(c.ipMap))
+	reporting := make(map[string]int, len(c.ipMap))
+	var total float64
+	var reports int
+	for _, node := range nodes {
+		ip, ok := node.Annotations[NodeAnnotation]
+		if !ok {
+			continue
+		}
+		value, ok := c.reportedLoad(node.Name)
+		if !ok {
+			continue
+		}
+		load, err := ParseNodeLoad(value)
+		if err != nil {
+			klog.V(5).Infof("Ignoring the load of node %q: %v", node.Name, err)
+			continue
+		}
+		if load.isStale(now) {
+			continue
+		}
+
+		// the load on servers the node is no longer assigned to is counted
+		// until its mounts of them are gone
+		var nodeLoad float64
+		for server, l := range load.Servers {
+			if _, exists := c.ipMap[server]; exists {
+				loads[server] += l.Weight()
+				nodeLoad += l.Weight()
+			}
+		}
+		if _, exists := c.ipMap[ip]; exists {
+			reporting[ip]++
+		}
+		total += nodeLoad
+		reports++
+	}
+
+	var average float64
+	if reports > 0 {
+		average = total / float64(reports)
+	}
+	for ip, count := range c.ipMap {
+		if unreported := count - reporting[ip]; unreported > 0 {
+			loads[ip] += float64(unreported) * average
+		}
+	}
+	return loads
+}
+
+// reportedLoad returns the value of the load Lease of a node, false if the
+// node has not reported its load.
+func (c *LBController) reportedLoad(nodeName string) (string, bool) {
+	if c.loadLister == nil {
+		return "", false
+	}
+	lease, err := c.loadLister.Get(LoadLeaseName(nodeName))
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			klog.V(5).Infof("Ignoring the load of node %q: %v", nodeName, err)
+		}
+		return "", false
+	}
+	value, ok := lease.Annotations[LoadAnnotation]
+	return value, ok
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lbcontroller
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestParseStrategy(t *testing.T) {
+	cases := []struct {
+		name        string
+		expected    Strategy
+		expectedErr bool
+	}{
+		{name: "", expected: StrategyLeastNodes},
+		{name: "least-nodes", expected: StrategyLeastNodes},
+		{name: "load-weighted", expected: StrategyLoadWeighted},
+		{name: "round-robin", expectedErr: true},
+	}
+
+	for _, test := range cases {
+		strategy, err := ParseStrategy(test.name)
+		if err := gotExpectedError("ParseStrategy", test.expectedErr, err); err != nil {
+			t.Errorf("strategy %q: %v", test.name, err)
+		}
+		if strategy != test.expected {
+			t.Errorf("strategy %q: got %q, want %q", test.name, strategy, test.expected)
+		}
+	}
+}
+
+// newLoadLease returns the load Lease of a node which reported the given
+// loads.
+func newLoadLease(t *testing.T, nodeName string, reportedAt time.Time, servers map[string]ServerLoad) runtime.Object {
+	value, err := json.Marshal(NodeLoad{ReportedAt: reportedAt, IntervalSeconds: 60, Servers: servers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        LoadLeaseName(nodeName),
+			Namespace:   FakeLoadNamespace,
+			Annotations: map[string]string{LoadAnnotation: string(value)},
+		},
+	}
+}
+
+func TestIPLoads(t *testing.T) {
+	now := time.Now()
+	nodePool := []runtime.Object{
+		NewNode("node-1", "10.0.0.1"),
+		newLoadLease(t, "node-1", now, map[string]ServerLoad{"10.0.0.1": {Mounts: 1, BytesPerSecond: 1000}}),
+		// the load on a server the node is no longer assigned to is counted
+		NewNode("node-2", "10.0.0.2"),
+		newLoadLease(t, "node-2", now, map[string]ServerLoad{"10.0.0.1": {Mounts: 1, OpsPerSecond: 1}, "10.0.0.2": {Mounts: 1, BytesPerSecond: 904}}),
+		// stale reports and servers outside of the IP list are ignored
+		NewNode("node-3", "10.0.0.2"),
+		newLoadLease(t, "node-3", now.Add(-time.Hour), map[string]ServerLoad{"10.0.0.2": {Mounts: 1, BytesPerSecond: 1e9}}),
+		NewNode("node-4", "10.0.0.1"),
+		newLoadLease(t, "node-4", now, map[string]ServerLoad{"10.0.0.9": {Mounts: 1, BytesPerSecond: 1e9}}),
+		NewNode("node-5", "10.0.0.3"),
+		// the Leases of nodes which are gone are ignored
+		newLoadLease(t, "node-6", now, map[string]ServerLoad{"10.0.0.3": {Mounts: 1, BytesPerSecond: 1e9}}),
+	}
+	lbController := NewFakeLBController(map[string]int{"10.0.0.1": 2, "10.0.0.2": 2, "10.0.0.3": 1}, nodePool)
+
+	// the 3 nodes with a recent report have an average load of 2000, which
+	// is the load of node-3 and node-5
+	expected := map[string]float64{
+		"10.0.0.1": 1000 + 4096,
+		"10.0.0.2": 904 + 2000,
+		"10.0.0.3": 2000,
+	}
+	if diff := cmp.Diff(expected, lbController.ipLoads(now)); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAssignIPToNodeLoadWeighted(t *testing.T) {
+	now := time.Now()
+	nodePool := []runtime.Object{
+		NewNode("node-1", "10.0.0.1"),
+		newLoadLease(t, "node-1", now, map[string]ServerLoad{"10.0.0.1": {Mounts: 1, BytesPerSecond: 100}}),
+		NewNode("node-2", "10.0.0.1"),
+		newLoadLease(t, "node-2", now, map[string]ServerLoad{"10.0.0.1": {Mounts: 1}}),
+		NewNode("node-3", "10.0.0.2"),
+		newLoadLease(t, "node-3", now, map[string]ServerLoad{"10.0.0.2": {Mounts: 1, BytesPerSecond: 1e6}}),
+		NewNode("node-4", ""),
+		NewNode("node-5", ""),
+	}
+	ipMap := map[string]int{"10.0.0.1": 2, "10.0.0.2": 1}
+	ctx := context.Background()
+
+	lbController := NewFakeLBController(ipMap, nodePool)
+	lbController.strategy = StrategyLoadWeighted
+	ip, err := lbController.AssignIPToNode(ctx, "node-4", "vol-1")
+	if err != nil {
+		t.Fatalf("AssignIPToNode got error %v, want nil", err)
+	}
+	if ip != "10.0.0.1" {
+		t.Errorf("load-weighted strategy assigned %q, want the least loaded 10.0.0.1", ip)
+	}
+
+	// the node just assigned counts as an average node until it reports
+	ip, err = lbController.AssignIPToNode(ctx, "node-5", "vol-1")
+	if err != nil {
+		t.Fatalf("AssignIPToNode got error %v, want nil", err)
+	}
+	if ip != "10.0.0.1" {
+		t.Errorf("load-weighted strategy assigned %q, want 10.0.0.1", ip)
+	}
+	if diff := cmp.Diff(map[string]int{"10.0.0.1": 4, "10.0.0.2": 1}, lbController.ipMap); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// without reports the IP assigned to the fewest nodes is selected
+	lbController = NewFakeLBController(map[string]int{"10.0.0.1": 2, "10.0.0.2": 1}, []runtime.Object{NewNode("node-4", "")})
+	lbController.strategy = StrategyLoadWeighted
+	ip, err = lbController.AssignIPToNode(ctx, "node-4", "vol-1")
+	if err != nil {
+		t.Fatalf("AssignIPToNode got error %v, want nil", err)
+	}
+	if ip != "10.0.0.2" {
+		t.Errorf("load-weighted strategy without reports assigned %q, want 10.0.0.2", ip)
+	}
+}
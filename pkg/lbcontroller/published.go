@@ -0,0 +1,192 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lbcontroller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// resyncBackoff is the backoff of the retries of resyncPublished, whose
+// delay stays at its cap once it is reached.
+var resyncBackoff = wait.Backoff{Duration: time.Second, Factor: 2, Jitter: 0.1, Steps: 7, Cap: time.Minute}
+
+// publishedVolumes tracks the nodes the volumes are published on. The node
+// annotations only record the IP of the nodes, the volumes published before
+// the controller started are found from the VolumeAttachments of the driver
+// when the cache syncs.
+type publishedVolumes struct {
+	mutex sync.Mutex
+	// nodes are the nodes of every volume
+	nodes map[string]map[string]bool
+}
+
+func (p *publishedVolumes) add(volumeID, nodeName string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.nodes == nil {
+		p.nodes = make(map[string]map[string]bool)
+	}
+	if p.nodes[volumeID] == nil {
+		p.nodes[volumeID] = make(map[string]bool)
+	}
+	p.nodes[volumeID][nodeName] = true
+}
+
+func (p *publishedVolumes) remove(volumeID, nodeName string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.nodes[volumeID], nodeName)
+	if len(p.nodes[volumeID]) == 0 {
+		delete(p.nodes, volumeID)
+	}
+}
+
+// volumeNodes returns the nodes a volume is published on.
+func (p *publishedVolumes) volumeNodes(volumeID string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	nodes := make([]string, 0, len(p.nodes[volumeID]))
+	for node := range p.nodes[volumeID] {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// list returns the sorted nodes of every volume.
+func (p *publishedVolumes) list() map[string][]string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	volumes := make(map[string][]string, len(p.nodes))
+	for volumeID, nodes := range p.nodes {
+		for node := range nodes {
+			volumes[volumeID] = append(volumes[volumeID], node)
+		}
+		sort.Strings(volumes[volumeID])
+	}
+	return volumes
+}
+
+// retryResyncPublished runs resyncPublished until it succeeds, retrying with
+// resyncBackoff on errors, or until ctx is done.
+func (c *LBController) retryResyncPublished(ctx context.Context, driverName string) error {
+	return resyncBackoff.DelayFunc().Until(ctx, true, false, func(ctx context.Context) (bool, error) {
+		if err := c.resyncPublished(ctx, driverName); err != nil {
+			klog.Warningf("Failed to resync LB Controller published volumes, retrying: %v", err)
+			return false, nil
+		}
+		return true, nil
+	})
+}
+
+// resyncPublished adds the nodes the volumes of the driver are attached to
+// by the external-attacher, from their VolumeAttachments. Their
+// PersistentVolumes are read from the informer cache.
+func (c *LBController) resyncPublished(ctx context.Context, driverName string) error {
+	attachments, err := c.clientset.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list volume attachments: %w", err)
+	}
+	for i := range attachments.Items {
+		va := &attachments.Items[i]
+		if va.Spec.Attacher != driverName || !va.Status.Attached {
+			continue
+		}
+		volumeID, err := c.attachedVolumeID(va)
+		if err != nil {
+			return err
+		}
+		if volumeID == "" {
+			continue
+		}
+		klog.V(5).Infof("Volume %q is published on node %q", volumeID, va.Spec.NodeName)
+		c.published.add(volumeID, va.Spec.NodeName)
+	}
+	return nil
+}
+
+// attachedVolumeID returns the ID of the volume of a VolumeAttachment, empty
+// if its PersistentVolume is gone.
+func (c *LBController) attachedVolumeID(va *storagev1.VolumeAttachment) (string, error) {
+	if spec := va.Spec.Source.InlineVolumeSpec; spec != nil && spec.CSI != nil {
+		return spec.CSI.VolumeHandle, nil
+	}
+	if va.Spec.Source.PersistentVolumeName == nil {
+		return "", nil
+	}
+	pv, err := c.pvLister.Get(*va.Spec.Source.PersistentVolumeName)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get the persistent volume of volume attachment %q: %w", va.Name, err)
+	}
+	if pv.Spec.CSI == nil {
+		return "", nil
+	}
+	return pv.Spec.CSI.VolumeHandle, nil
+}
+
+// PublishedNodes returns the nodes every volume is published on, by volume
+// ID.
+func (c *LBController) PublishedNodes() (map[string][]string, error) {
+	if err := c.CheckSynced(); err != nil {
+		return nil, err
+	}
+	return c.published.list(), nil
+}
+
+// VolumeIPs returns the NFS server IPs assigned to the nodes a volume is
+// published on.
+func (c *LBController) VolumeIPs(volumeID string) ([]string, error) {
+	if err := c.CheckSynced(); err != nil {
+		return nil, err
+	}
+
+	assigned := map[string]bool{}
+	for _, nodeName := range c.published.volumeNodes(volumeID) {
+		node, err := c.nodeLister.Get(nodeName)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if ip, ok := node.Annotations[NodeAnnotation]; ok {
+			assigned[ip] = true
+		}
+	}
+	ips := make([]string, 0, len(assigned))
+	for ip := range assigned {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lbcontroller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPublishedNodes(t *testing.T) {
+	nodePool := NewNodePool([]TestNode{{Name: "node-1"}, {Name: "node-2"}, {Name: "node-3", AssignedIP: "127.0.0.1"}})
+	lbController := NewFakeLBController(map[string]int{"127.0.0.1": 1, "127.0.0.2": 0}, nodePool)
+	ctx := context.Background()
+
+	for _, p := range []struct{ node, volume string }{
+		{"node-1", "vol-1"},
+		{"node-2", "vol-1"},
+		{"node-3", "vol-1"},
+		{"node-3", "vol-2"},
+	} {
+		if _, err := lbController.AssignIPToNode(ctx, p.node, p.volume); err != nil {
+			t.Fatalf("AssignIPToNode(%q, %q) got error %v, want nil", p.node, p.volume, err)
+		}
+	}
+	for _, p := range []struct{ node, volume string }{
+		{"node-2", "vol-1"},
+		{"node-3", "vol-2"},
+		{"node-4", "vol-3"},
+	} {
+		if err := lbController.RemoveIPFromNode(ctx, p.node, p.volume); err != nil {
+			t.Fatalf("RemoveIPFromNode(%q, %q) got error %v, want nil", p.node, p.volume, err)
+		}
+	}
+
+	published, err := lbController.PublishedNodes()
+	if err != nil {
+		t.Fatalf("PublishedNodes got error %v, want nil", err)
+	}
+	expected := map[string][]string{"vol-1": {"node-1", "node-3"}}
+	if diff := cmp.Diff(expected, published); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+
+	lbController.synced.Store(false)
+	if _, err := lbController.PublishedNodes(); !errors.Is(err, ErrNotSynced) {
+		t.Errorf("PublishedNodes got error %v, want %v", err, ErrNotSynced)
+	}
+}
+
+func TestVolumeIPs(t *testing.T) {
+	nodePool := NewNodePool([]TestNode{{Name: "node-1", AssignedIP: "127.0.0.1"}, {Name: "node-2", AssignedIP: "127.0.0.2"}, {Name: "node-3", AssignedIP: "127.0.0.1"}})
+	lbController := NewFakeLBController(map[string]int{"127.0.0.1": 2, "127.0.0.2": 1}, nodePool)
+	ctx := context.Background()
+
+	for _, p := range []struct{ node, volume string }{
+		{"node-1", "vol-1"},
+		{"node-3", "vol-1"},
+		{"node-2", "vol-2"},
+	} {
+		if _, err := lbController.AssignIPToNode(ctx, p.node, p.volume); err != nil {
+			t.Fatalf("AssignIPToNode(%q, %q) got error %v, want nil", p.node, p.volume, err)
+		}
+	}
+
+	for volumeID, expected := range map[string][]string{
+		"vol-1": {"127.0.0.1"},
+		"vol-2": {"127.0.0.2"},
+		"vol-3": {},
+	} {
+		ips, err := lbController.VolumeIPs(volumeID)
+		if err != nil {
+			t.Fatalf("VolumeIPs(%q) got error %v, want nil", volumeID, err)
+		}
+		if diff := cmp.Diff(expected, ips); diff != "" {
+			t.Errorf("VolumeIPs(%q) unexpected diff (-want +got):\n%s", volumeID, diff)
+		}
+	}
+}
+
+// newVolumeAttachment returns a VolumeAttachment of the PersistentVolume pv
+// to a node.
+func newVolumeAttachment(name, attacher, pv, nodeName string, attached bool) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: attacher,
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pv},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: attached},
+	}
+}
+
+// newCSIPersistentVolume returns a PersistentVolume of a CSI volume.
+func newCSIPersistentVolume(name, driver, volumeHandle string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeHandle},
+			},
+		},
+	}
+}
+
+func TestResyncPublished(t *testing.T) {
+	driver := "nfs.lb.csi.storage.gke.io"
+	objects := []runtime.Object{
+		NewNode("node-1", "127.0.0.1"),
+		NewNode("node-2", "127.0.0.2"),
+		newCSIPersistentVolume("pv-1", driver, "vol-1"),
+		newCSIPersistentVolume("pv-2", driver, "vol-2"),
+		newCSIPersistentVolume("pv-other", "other.csi.k8s.io", "vol-other"),
+		newVolumeAttachment("va-1", driver, "pv-1", "node-1", true),
+		newVolumeAttachment("va-2", driver, "pv-1", "node-2", true),
+		newVolumeAttachment("va-3", driver, "pv-2", "node-2", true),
+		// attachments not attached yet, of other drivers, or of deleted
+		// volumes are skipped
+		newVolumeAttachment("va-4", driver, "pv-2", "node-1", false),
+		newVolumeAttachment("va-5", "other.csi.k8s.io", "pv-other", "node-1", true),
+		newVolumeAttachment("va-6", driver, "pv-deleted", "node-1", true),
+	}
+	lbController := NewFakeLBController(map[string]int{"127.0.0.1": 1, "127.0.0.2": 1}, objects)
+
+	if err := lbController.resyncPublished(context.Background(), driver); err != nil {
+		t.Fatalf("resyncPublished got error %v, want nil", err)
+	}
+	published, err := lbController.PublishedNodes()
+	if err != nil {
+		t.Fatalf("PublishedNodes got error %v, want nil", err)
+	}
+	expected := map[string][]string{
+		"vol-1": {"node-1", "node-2"},
+		"vol-2": {"node-2"},
+	}
+	if diff := cmp.Diff(expected, published); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+	ips, err := lbController.VolumeIPs("vol-1")
+	if err != nil {
+		t.Fatalf("VolumeIPs got error %v, want nil", err)
+	}
+	if diff := cmp.Diff([]string{"127.0.0.1", "127.0.0.2"}, ips); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestRetryResyncPublished(t *testing.T) {
+	driver := "nfs.lb.csi.storage.gke.io"
+	objects := []runtime.Object{
+		NewNode("node-1", "127.0.0.1"),
+		newCSIPersistentVolume("pv-1", driver, "vol-1"),
+		newVolumeAttachment("va-1", driver, "pv-1", "node-1", true),
+	}
+	lbController := NewFakeLBController(map[string]int{"127.0.0.1": 1}, objects)
+	backoff := resyncBackoff
+	resyncBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2, Steps: 3, Cap: 4 * time.Millisecond}
+	defer func() { resyncBackoff = backoff }()
+
+	// the VolumeAttachments fail to be listed twice
+	lists := 0
+	lbController.clientset.(*fake.Clientset).PrependReactor("list", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		lists++
+		if lists <= 2 {
+			return true, nil, errors.New("connection refused")
+		}
+		return false, nil, nil
+	})
+	if err := lbController.retryResyncPublished(context.Background(), driver); err != nil {
+		t.Fatalf("retryResyncPublished got error %v, want nil", err)
+	}
+	if lists != 3 {
+		t.Errorf("retryResyncPublished listed the volume attachments %d times, want 3", lists)
+	}
+	published, err := lbController.PublishedNodes()
+	if err != nil {
+		t.Fatalf("PublishedNodes got error %v, want nil", err)
+	}
+	if diff := cmp.Diff(map[string][]string{"vol-1": {"node-1"}}, published); diff != "" {
+		t.Errorf("unexpected diff (-want +got):\n%s", diff)
+	}
+
+	// the retries stop with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	lbController.clientset.(*fake.Clientset).PrependReactor("list", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		cancel()
+		return true, nil, errors.New("connection refused")
+	})
+	if err := lbController.retryResyncPublished(ctx, driver); !errors.Is(err, context.Canceled) {
+		t.Errorf("retryResyncPublished got error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mountstats parses the NFS client statistics of the mounts listed in
+// /proc/self/mountstats.
+package mountstats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPath is the mountstats file of the current process.
+const DefaultPath = "/proc/self/mountstats"
+
+// Mount is a mount listed in mountstats.
+type Mount struct {
+	Device     string
+	MountPoint string
+	FSType     string
+	// Stats are the NFS client statistics, nil for mounts which are not NFS.
+	Stats *NFSStats
+}
+
+// NFSStats are the statistics of a NFS mount.
+type NFSStats struct {
+	StatVersion string
+	// Age is how long the NFS superblock has been mounted.
+	Age        time.Duration
+	Bytes      Bytes
+	Transport  *Transport
+	Operations []Operation
+}
+
+// Bytes are the byte counters of a NFS mount.
+type Bytes struct {
+	// NormalRead and NormalWrite are read and written by applications through
+	// the page cache, DirectRead and DirectWrite with O_DIRECT.
+	NormalRead  uint64
+	NormalWrite uint64
+	DirectRead  uint64
+	DirectWrite uint64
+	// ServerRead and ServerWrite are read from and written to the server.
+	ServerRead  uint64
+	ServerWrite uint64
+	ReadPages   uint64
+	WritePages  uint64
+}
+
+// Transport are the RPC transport statistics of a NFS mount.
+type Transport struct {
+	Protocol string
+	Port     uint64
+	Binds    uint64
+	Connects uint64
+	// ConnectTime is the cumulative time spent waiting for connections.
+	ConnectTime time.Duration
+	// IdleTime is how long the transport has been idle.
+	IdleTime time.Duration
+	Sends    uint64
+	Receives uint64
+	BadXIDs  uint64
+	// CumulativeActiveRequests and CumulativeBacklog are sampled on every send.
+	CumulativeActiveRequests uint64
+	CumulativeBacklog        uint64
+}
+
+// Operation are the statistics of a NFS operation on a mount.
+type Operation struct {
+	Name          string
+	Requests      uint64
+	Transmissions uint64
+	MajorTimeouts uint64
+	BytesSent     uint64
+	BytesReceived uint64
+	// QueueTime, RTT and ExecuteTime are cumulative over all requests.
+	QueueTime   time.Duration
+	RTT         time.Duration
+	ExecuteTime time.Duration
+	// Errors is only reported from statvers 1.1 on.
+	Errors uint64
+}
+
+// Retransmissions returns the number of requests which were sent again.
+func (o Operation) Retransmissions() uint64 {
+	if o.Transmissions < o.Requests {
+		return 0
+	}
+	return o.Transmissions - o.Requests
+}
+
+// Server returns the server of a server:/export NFS device.
+func Server(device string) string {
+	i := strings.LastIndex(device, ":/")
+	if i <= 0 {
+		return ""
+	}
+	return strings.Trim(device[:i], "[]")
+}
+
+// ParseFile parses a mountstats file.
+func ParseFile(path string) ([]Mount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses the content of a mountstats file.
+func Parse(r io.Reader) ([]Mount, error) {
+	var mounts []Mount
+	var stats *NFSStats
+	inOperations := false
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "device" {
+			m, err := parseDevice(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			stats, inOperations = m.Stats, false
+			mounts = append(mounts, m)
+			continue
+		}
+		if stats == nil {
+			continue
+		}
+
+		var err error
+		switch {
+		case inOperations:
+			var op Operation
+			if op, err = parseOperation(fields); err == nil {
+				stats.Operations = append(stats.Operations, op)
+			}
+		case fields[0] == "age:":
+			var age uint64
+			if age, err = parseUint(fields, 1); err == nil {
+				stats.Age = time.Duration(age) * time.Second
+			}
+		case fields[0] == "bytes:":
+			stats.Bytes, err = parseBytes(fields)
+		case fields[0] == "xprt:":
+			stats.Transport, err = parseTransport(fields)
+		case strings.TrimSpace(text) == "per-op statistics":
+			inOperations = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// parseDevice parses a "device <device> mounted on <mount point> with fstype
+// <fstype> [statvers=<version>]" line.
+func parseDevice(fields []string) (Mount, error) {
+	if len(fields) < 8 || fields[2] != "mounted" || fields[3] != "on" || fields[5] != "with" || fields[6] != "fstype" {
+		return Mount{}, fmt.Errorf("invalid device line %q", strings.Join(fields, " "))
+	}
+	m := Mount{
+		Device:     unescape(fields[1]),
+		MountPoint: unescape(fields[4]),
+		FSType:     fields[7],
+	}
+	if len(fields) > 8 && strings.HasPrefix(fields[8], "statvers=") {
+		m.Stats = &NFSStats{StatVersion: strings.TrimPrefix(fields[8], "statvers=")}
+	}
+	return m, nil
+}
+
+func parseBytes(fields []string) (Bytes, error) {
+	values, err := parseUints(fields[1:], 8)
+	if err != nil {
+		return Bytes{}, fmt.Errorf("invalid bytes: %w", err)
+	}
+	return Bytes{
+		NormalRead:  values[0],
+		NormalWrite: values[1],
+		DirectRead:  values[2],
+		DirectWrite: values[3],
+		ServerRead:  values[4],
+		ServerWrite: values[5],
+		ReadPages:   values[6],
+		WritePages:  values[7],
+	}, nil
+}
+
+// parseTransport parses a "xprt: <protocol> <counters>" line. The counters
+// of the tcp and rdma transports start with the connection counters, which
+// udp does not have.
+func parseTransport(fields []string) (*Transport, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid xprt line %q", strings.Join(fields, " "))
+	}
+	t := &Transport{Protocol: fields[1]}
+	switch t.Protocol {
+	case "tcp", "rdma":
+		values, err := parseUints(fields[2:], 10)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s xprt: %w", t.Protocol, err)
+		}
+		t.Port, t.Binds, t.Connects = values[0], values[1], values[2]
+		t.ConnectTime = time.Duration(values[3]) * time.Second / 100 // jiffies
+		t.IdleTime = time.Duration(values[4]) * time.Second
+		t.Sends, t.Receives, t.BadXIDs = values[5], values[6], values[7]
+		t.CumulativeActiveRequests, t.CumulativeBacklog = values[8], values[9]
+	case "udp":
+		values, err := parseUints(fields[2:], 7)
+		if err != nil {
+			return nil, fmt.Errorf("invalid udp xprt: %w", err)
+		}
+		t.Port, t.Binds = values[0], values[1]
+		t.Sends, t.Receives, t.BadXIDs = values[2], values[3], values[4]
+		t.CumulativeActiveRequests, t.CumulativeBacklog = values[5], values[6]
+	default:
+		return nil, fmt.Errorf("unknown xprt protocol %q", t.Protocol)
+	}
+	return t, nil
+}
+
+// parseOperation parses a "<OPERATION>: <counters>" line of the per-op
+// statistics, with 8 counters, or 9 from statvers 1.1 on.
+func parseOperation(fields []string) (Operation, error) {
+	if !strings.HasSuffix(fields[0], ":") {
+		return Operation{}, fmt.Errorf("invalid operation line %q", strings.Join(fields, " "))
+	}
+	values, err := parseUints(fields[1:], 8)
+	if err != nil {
+		return Operation{}, fmt.Errorf("invalid operation %s: %w", fields[0], err)
+	}
+	op := Operation{
+		Name:          strings.TrimSuffix(fields[0], ":"),
+		Requests:      values[0],
+		Transmissions: values[1],
+		MajorTimeouts: values[2],
+		BytesSent:     values[3],
+		BytesReceived: values[4],
+		QueueTime:     time.Duration(values[5]) * time.Millisecond,
+		RTT:           time.Duration(values[6]) * time.Millisecond,
+		ExecuteTime:   time.Duration(values[7]) * time.Millisecond,
+	}
+	if len(values) > 8 {
+		op.Errors = values[8]
+	}
+	return op, nil
+}
+
+// parseUints parses at least min unsigned integers.
+func parseUints(fields []string, min int) ([]uint64, error) {
+	if len(fields) < min {
+		return nil, fmt.Errorf("expected at least %d values, got %d", min, len(fields))
+	}
+	values := make([]uint64, 0, len(fields))
+	for _, f := range fields {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func parseUint(fields []string, i int) (uint64, error) {
+	if len(fields) <= i {
+		return 0, fmt.Errorf("missing value in %q", strings.Join(fields, " "))
+	}
+	return strconv.ParseUint(fields[i], 10, 64)
+}
+
+// unescape replaces the octal escapes of spaces, tabs, newlines and
+// backslashes in the paths of mountstats.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountstats
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFile(t *testing.T) {
+	tests := []struct {
+		desc           string
+		file           string
+		expectedMounts int
+		expectedMount  Mount
+	}{
+		{
+			desc:           "NFSv4.1 over tcp",
+			file:           "testdata/mountstats-nfs4",
+			expectedMounts: 4,
+			expectedMount: Mount{
+				Device:     "10.0.0.2:/share",
+				MountPoint: "/var/lib/kubelet/plugins/kubernetes.io/csi/nfs.lb.csi.storage.gke.io/1a2b3c/globalmount",
+				FSType:     "nfs4",
+				Stats: &NFSStats{
+					StatVersion: "1.1",
+					Age:         time.Hour,
+					Bytes: Bytes{
+						NormalRead:  1048576,
+						NormalWrite: 524288,
+						DirectWrite: 4096,
+						ServerRead:  1052672,
+						ServerWrite: 528384,
+						ReadPages:   257,
+						WritePages:  129,
+					},
+					Transport: &Transport{
+						Protocol:                 "tcp",
+						Port:                     917,
+						Binds:                    1,
+						Connects:                 2,
+						IdleTime:                 11 * time.Second,
+						Sends:                    1538,
+						Receives:                 1536,
+						CumulativeActiveRequests: 1980,
+					},
+					Operations: []Operation{
+						{Name: "NULL", Requests: 1, Transmissions: 1, BytesSent: 44, BytesReceived: 24},
+						{Name: "READ", Requests: 256, Transmissions: 258, BytesSent: 38912, BytesReceived: 1089536, QueueTime: 12 * time.Millisecond, RTT: 2048 * time.Millisecond, ExecuteTime: 2210 * time.Millisecond},
+						{Name: "WRITE", Requests: 128, Transmissions: 128, BytesSent: 552960, BytesReceived: 20480, QueueTime: 4 * time.Millisecond, RTT: 1024 * time.Millisecond, ExecuteTime: 1102 * time.Millisecond},
+						{Name: "COMMIT", Requests: 4, Transmissions: 4, BytesSent: 704, BytesReceived: 512, RTT: 8 * time.Millisecond, ExecuteTime: 8 * time.Millisecond},
+						{Name: "OPEN", Requests: 10, Transmissions: 10, BytesSent: 2680, BytesReceived: 3520, RTT: 30 * time.Millisecond, ExecuteTime: 31 * time.Millisecond, Errors: 2},
+						{Name: "GETATTR", Requests: 1000, Transmissions: 1001, MajorTimeouts: 1, BytesSent: 184000, BytesReceived: 264000, QueueTime: 8 * time.Millisecond, RTT: 500 * time.Millisecond, ExecuteTime: 560 * time.Millisecond},
+					},
+				},
+			},
+		},
+		{
+			desc:           "NFSv3 over udp with an escaped mount point",
+			file:           "testdata/mountstats-nfs3",
+			expectedMounts: 2,
+			expectedMount: Mount{
+				Device:     "10.0.0.3:/export/dir",
+				MountPoint: "/var/lib/kubelet/pods/0c1d/volumes/kubernetes.io~csi/pv with spaces/mount",
+				FSType:     "nfs",
+				Stats: &NFSStats{
+					StatVersion: "1.0",
+					Age:         2 * time.Minute,
+					Bytes:       Bytes{NormalRead: 100, NormalWrite: 200, ServerRead: 100, ServerWrite: 200, ReadPages: 1, WritePages: 1},
+					Transport: &Transport{
+						Protocol:                 "udp",
+						Port:                     832,
+						Sends:                    40,
+						Receives:                 40,
+						CumulativeActiveRequests: 40,
+					},
+					Operations: []Operation{
+						{Name: "NULL"},
+						{Name: "GETATTR", Requests: 30, Transmissions: 32, MajorTimeouts: 2, BytesSent: 3840, BytesReceived: 3360, QueueTime: time.Millisecond, RTT: 60 * time.Millisecond, ExecuteTime: 62 * time.Millisecond},
+						{Name: "LOOKUP", Requests: 10, Transmissions: 10, BytesSent: 1400, BytesReceived: 1200, RTT: 20 * time.Millisecond, ExecuteTime: 21 * time.Millisecond},
+					},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		mounts, err := ParseFile(test.file)
+		assert.NoError(t, err, test.desc)
+		assert.Len(t, mounts, test.expectedMounts, test.desc)
+		var nfsMounts []Mount
+		for _, m := range mounts {
+			if m.Stats != nil {
+				nfsMounts = append(nfsMounts, m)
+			}
+		}
+		if assert.Len(t, nfsMounts, 1, test.desc) {
+			assert.Equal(t, test.expectedMount, nfsMounts[0], test.desc)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		desc    string
+		content string
+	}{
+		{
+			desc:    "invalid device line",
+			content: "device 10.0.0.2:/share mounted /mnt\n",
+		},
+		{
+			desc:    "truncated bytes",
+			content: "device 10.0.0.2:/share mounted on /mnt with fstype nfs4 statvers=1.1\n\tbytes:\t1 2 3\n",
+		},
+		{
+			desc:    "unknown transport",
+			content: "device 10.0.0.2:/share mounted on /mnt with fstype nfs4 statvers=1.1\n\txprt:\tsctp 1 2 3\n",
+		},
+		{
+			desc:    "invalid operation counter",
+			content: "device 10.0.0.2:/share mounted on /mnt with fstype nfs4 statvers=1.1\n\tper-op statistics\n\tREAD: 1 2 3 4 5 6 7 x\n",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader(test.content))
+		assert.Error(t, err, test.desc)
+	}
+}
+
+func TestRetransmissions(t *testing.T) {
+	assert.Equal(t, uint64(2), Operation{Requests: 256, Transmissions: 258}.Retransmissions())
+	// requests still in flight are counted before their transmission
+	assert.Equal(t, uint64(0), Operation{Requests: 3, Transmissions: 2}.Retransmissions())
+}
+
+func TestServer(t *testing.T) {
+	tests := []struct {
+		device   string
+		expected string
+	}{
+		{device: "10.0.0.2:/share", expected: "10.0.0.2"},
+		{device: "[fd00::2]:/share/dir", expected: "fd00::2"},
+		{device: "nfs-server.default.svc:/", expected: "nfs-server.default.svc"},
+		{device: "/dev/sda1", expected: ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, Server(test.device), test.device)
+	}
+}
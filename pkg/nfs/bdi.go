@@ -0,0 +1,167 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+const defaultSysfsRoot = "/sys"
+
+// bdiKnob is a setting of the backing device info of a mount in
+// /sys/class/bdi/<major>:<minor>/, which is set from the special mount flag
+// <name>=<value> instead of being passed to mount.
+type bdiKnob struct {
+	name string
+	// max is the largest value accepted, unbounded if zero
+	max int64
+}
+
+// bdiKnobs are the supported knobs, in the order they are applied.
+var bdiKnobs = []bdiKnob{
+	// the read ahead window of the page cache, in KiB
+	{name: "read_ahead_kb"},
+	// the share of the dirty page cache the device may use, in percent
+	{name: "min_ratio", max: 100},
+	{name: "max_ratio", max: 100},
+	// whether max_ratio is enforced even below the global dirty threshold
+	{name: "strict_limit", max: 1},
+}
+
+// bdiSetting is a value of a bdiKnob.
+type bdiSetting struct {
+	knob  string
+	value int64
+}
+
+// extractBDIMountFlags returns the mount flags which are passed to mount, and
+// the BDI settings of the other ones.
+func extractBDIMountFlags(mountFlags []string) ([]string, []bdiSetting, error) {
+	var options []string
+	values := map[string]int64{}
+	for _, flag := range mountFlags {
+		knob, ok := findBDIKnob(flag)
+		if !ok {
+			options = append(options, flag)
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimPrefix(flag, knob.name+"="), 10, 0)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s mount flag %q: %v", knob.name, flag, err)
+		}
+		if value < 0 {
+			return nil, nil, fmt.Errorf("invalid negative value for %s mount flag: %q", knob.name, flag)
+		}
+		if knob.max > 0 && value > knob.max {
+			return nil, nil, fmt.Errorf("invalid value for %s mount flag: %q, must be at most %d", knob.name, flag, knob.max)
+		}
+		values[knob.name] = value
+	}
+
+	var settings []bdiSetting
+	for _, knob := range bdiKnobs {
+		if value, ok := values[knob.name]; ok {
+			settings = append(settings, bdiSetting{knob: knob.name, value: value})
+		}
+	}
+	return options, settings, nil
+}
+
+func findBDIKnob(flag string) (bdiKnob, bool) {
+	for _, knob := range bdiKnobs {
+		if strings.HasPrefix(flag, knob.name+"=") {
+			return knob, true
+		}
+	}
+	return bdiKnob{}, false
+}
+
+// bdiTuner applies BDI settings to mounts by writing to sysfs.
+type bdiTuner struct {
+	// sysfsRoot is where sysfs is mounted, a fake directory in tests
+	sysfsRoot string
+}
+
+func newBDITuner(sysfsRoot string) *bdiTuner {
+	return &bdiTuner{sysfsRoot: sysfsRoot}
+}
+
+// apply applies the settings to the backing device of the mount at path,
+// found from its device number in mountinfo so that a hung mount is not
+// accessed.
+func (t *bdiTuner) apply(path string, settings []bdiSetting) error {
+	if len(settings) == 0 {
+		return nil
+	}
+	info, err := findMountInfo(path)
+	if err != nil {
+		return fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+	if info == nil {
+		return fmt.Errorf("%s is not a mount point", path)
+	}
+
+	dir := filepath.Join(t.sysfsRoot, "class", "bdi", fmt.Sprintf("%d:%d", info.Major, info.Minor))
+	for _, s := range settings {
+		if err := t.write(dir, s); err != nil {
+			return err
+		}
+		klog.V(2).Infof("set %s to %d for mount %s", s.knob, s.value, path)
+	}
+	return nil
+}
+
+// write writes a setting and reads it back, as the kernel may round it or
+// ignore it.
+func (t *bdiTuner) write(dir string, s bdiSetting) error {
+	file := filepath.Join(dir, s.knob)
+	// sysfs attributes are written in place, never created
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to set %s: %s does not exist, the kernel may not support it", s.knob, file)
+		}
+		return fmt.Errorf("failed to set %s: %v", s.knob, err)
+	}
+	_, err = f.WriteString(strconv.FormatInt(s.value, 10))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %v", s.knob, err)
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s back: %v", s.knob, err)
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 0)
+	if err != nil {
+		return fmt.Errorf("invalid %s %v", s.knob, err)
+	}
+	if value != s.value {
+		return fmt.Errorf("mismatch in %s, expected %d, got %d", s.knob, s.value, value)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractBDIMountFlags(t *testing.T) {
+	tests := []struct {
+		desc             string
+		mountFlags       []string
+		expectedOptions  []string
+		expectedSettings []bdiSetting
+		expectedErr      error
+	}{
+		{
+			desc:            "no BDI flags",
+			mountFlags:      []string{"nfsvers=4.1", "hard"},
+			expectedOptions: []string{"nfsvers=4.1", "hard"},
+		},
+		{
+			desc:            "all BDI flags, applied in the knob order",
+			mountFlags:      []string{"strict_limit=1", "nfsvers=3", "max_ratio=20", "read_ahead_kb=15360", "min_ratio=5"},
+			expectedOptions: []string{"nfsvers=3"},
+			expectedSettings: []bdiSetting{
+				{knob: "read_ahead_kb", value: 15360},
+				{knob: "min_ratio", value: 5},
+				{knob: "max_ratio", value: 20},
+				{knob: "strict_limit", value: 1},
+			},
+		},
+		{
+			desc:             "the last value of a flag wins",
+			mountFlags:       []string{"read_ahead_kb=128", "read_ahead_kb=256"},
+			expectedSettings: []bdiSetting{{knob: "read_ahead_kb", value: 256}},
+		},
+		{
+			desc:            "flags with a knob name prefix are passed to mount",
+			mountFlags:      []string{"read_ahead_kb_max=1"},
+			expectedOptions: []string{"read_ahead_kb_max=1"},
+		},
+		{
+			desc:        "non int value",
+			mountFlags:  []string{"max_ratio=a"},
+			expectedErr: errors.New("invalid max_ratio mount flag \"max_ratio=a\": strconv.ParseInt: parsing \"a\": invalid syntax"),
+		},
+		{
+			desc:        "negative value",
+			mountFlags:  []string{"min_ratio=-1"},
+			expectedErr: errors.New("invalid negative value for min_ratio mount flag: \"min_ratio=-1\""),
+		},
+		{
+			desc:        "value over the maximum",
+			mountFlags:  []string{"strict_limit=2"},
+			expectedErr: errors.New("invalid value for strict_limit mount flag: \"strict_limit=2\", must be at most 1"),
+		},
+	}
+
+	for _, test := range tests {
+		options, settings, err := extractBDIMountFlags(test.mountFlags)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		assert.Equal(t, test.expectedOptions, options, test.desc)
+		assert.Equal(t, test.expectedSettings, settings, test.desc)
+	}
+}
+
+func TestBDITunerApply(t *testing.T) {
+	dir := t.TempDir()
+	mountPath := filepath.Join(dir, "mount")
+	mountInfoFile := filepath.Join(dir, "mountinfo")
+	mountInfo := fmt.Sprintf("100 25 0:53 / %s rw,relatime shared:1 - nfs 127.0.0.1:/share rw,vers=3\n", mountPath)
+	assert.NoError(t, os.WriteFile(mountInfoFile, []byte(mountInfo), 0600))
+	origMountInfoPath := mountInfoPath
+	mountInfoPath = mountInfoFile
+	defer func() { mountInfoPath = origMountInfoPath }()
+
+	sysfsRoot := filepath.Join(dir, "sys")
+	bdiDir := filepath.Join(sysfsRoot, "class", "bdi", "0:53")
+	assert.NoError(t, os.MkdirAll(bdiDir, 0750))
+	for _, knob := range []string{"read_ahead_kb", "max_ratio"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(bdiDir, knob), []byte("15360\n"), 0600))
+	}
+	tuner := newBDITuner(sysfsRoot)
+
+	settings := []bdiSetting{{knob: "read_ahead_kb", value: 128}, {knob: "max_ratio", value: 20}}
+	assert.NoError(t, tuner.apply(mountPath, settings))
+	for _, s := range settings {
+		content, err := os.ReadFile(filepath.Join(bdiDir, s.knob))
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprint(s.value), string(content))
+	}
+
+	// nothing is looked up without settings
+	assert.NoError(t, tuner.apply(filepath.Join(dir, "notmounted"), nil))
+
+	err := tuner.apply(filepath.Join(dir, "notmounted"), settings)
+	assert.EqualError(t, err, filepath.Join(dir, "notmounted")+" is not a mount point")
+
+	// knobs missing from sysfs are not supported by the kernel
+	err = tuner.apply(mountPath, []bdiSetting{{knob: "strict_limit", value: 1}})
+	assert.ErrorContains(t, err, "the kernel may not support it")
+}
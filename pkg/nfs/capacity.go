@@ -0,0 +1,228 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/driverconfig"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog/v2"
+)
+
+// shareCapacity is the capacity of a share, or the error collecting it.
+type shareCapacity struct {
+	available int64
+	total     int64
+	err       error
+}
+
+// capacityCache keeps the capacity of the shares of the driver configuration,
+// refreshed in the background so that GetCapacity does not mount every share
+// each time it is called.
+type capacityCache struct {
+	mutex sync.Mutex
+	// capacities are the capacities of the shares by shareName
+	capacities map[string]*shareCapacity
+	// refreshInterval is how often the capacities are refreshed, they are
+	// collected by every GetCapacity call if zero
+	refreshInterval time.Duration
+	// getUsage returns the usage of the share mounted at path
+	getUsage func(path string) ([]*csi.VolumeUsage, error)
+}
+
+func newCapacityCache(refreshInterval time.Duration) *capacityCache {
+	return &capacityCache{
+		capacities:      map[string]*shareCapacity{},
+		refreshInterval: refreshInterval,
+		getUsage:        getVolumeUsage,
+	}
+}
+
+// shareName returns the name of a share in the logs and the capacity cache.
+func shareName(share *driverconfig.Share) string {
+	return share.Server + ":" + share.Share
+}
+
+// topologyKey is the key of the topology segment of the server pool of the
+// driver on the nodes.
+func (n *Driver) topologyKey() string {
+	return "topology." + n.name + "/server-pool"
+}
+
+// topology returns the topology segment of the server pool of the driver, nil
+// if topology is disabled.
+func (n *Driver) topology() *csi.Topology {
+	if n.serverPool == "" {
+		return nil
+	}
+	return &csi.Topology{Segments: map[string]string{n.topologyKey(): n.serverPool}}
+}
+
+// GetCapacity returns the capacity available to new volumes in the share
+// named by the server and share parameters, or in all the shares of the
+// driver configuration if the parameters name none. The capacity of a
+// topology segment of another server pool is zero.
+func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	if segments := req.GetAccessibleTopology().GetSegments(); segments != nil && cs.Driver.serverPool != "" {
+		if segments[cs.Driver.topologyKey()] != cs.Driver.serverPool {
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+
+	shares, err := cs.selectShares(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	resp := &csi.GetCapacityResponse{MaximumVolumeSize: wrapperspb.Int64(0)}
+	for _, share := range shares {
+		c, err := cs.shareCapacity(ctx, share)
+		if err != nil {
+			return nil, err
+		}
+		// a volume may use all the available capacity of its share
+		resp.AvailableCapacity += c.available
+		if c.available > resp.MaximumVolumeSize.GetValue() {
+			resp.MaximumVolumeSize = wrapperspb.Int64(c.available)
+		}
+	}
+	return resp, nil
+}
+
+// selectShares returns the shares of the driver configuration named by the
+// server and share parameters of a storage class, all of them if the
+// parameters name none.
+func (cs *ControllerServer) selectShares(parameters map[string]string) ([]*driverconfig.Share, error) {
+	var server, baseDir string
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case paramServer:
+			server = v
+		case paramShare:
+			baseDir = v
+		}
+	}
+
+	all := cs.Driver.shares()
+	if len(all) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "no share in the driver configuration")
+	}
+	if server == "" && baseDir == "" {
+		return all, nil
+	}
+	for _, share := range all {
+		if (server == "" || share.Server == server) && strings.Trim(share.Share, "/") == strings.Trim(baseDir, "/") {
+			return []*driverconfig.Share{share}, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "share %s:%s is not in the driver configuration", server, baseDir)
+}
+
+// shareCapacity returns the cached capacity of a share, collecting it if it
+// is not cached yet or the cache is disabled.
+func (cs *ControllerServer) shareCapacity(ctx context.Context, share *driverconfig.Share) (*shareCapacity, error) {
+	c := cs.capacity
+	c.mutex.Lock()
+	cached := c.capacities[shareName(share)]
+	c.mutex.Unlock()
+
+	if cached == nil || c.refreshInterval == 0 {
+		for i, s := range cs.Driver.shares() {
+			if shareName(s) == shareName(share) {
+				cached = cs.collectCapacity(ctx, i, share)
+				break
+			}
+		}
+	}
+	if cached == nil {
+		return nil, status.Errorf(codes.NotFound, "share %s is not in the driver configuration", shareName(share))
+	}
+	if status.Code(cached.err) == codes.Aborted {
+		return nil, cached.err
+	}
+	if cached.err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to get the capacity of share %s: %v", shareName(share), cached.err)
+	}
+	return cached, nil
+}
+
+// collectCapacity collects the capacity of the i-th share of the driver
+// configuration and caches it, unless the share is being collected already.
+func (cs *ControllerServer) collectCapacity(ctx context.Context, i int, share *driverconfig.Share) *shareCapacity {
+	c := &shareCapacity{}
+	sharePath, unmount, err := cs.mountConfiguredShare(ctx, "capacity", i, share)
+	if err == nil {
+		var usage []*csi.VolumeUsage
+		if usage, err = cs.capacity.getUsage(sharePath); err == nil {
+			c.available, c.total = usage[0].GetAvailable(), usage[0].GetTotal()
+		}
+		unmount()
+	}
+	c.err = err
+	if status.Code(err) == codes.Aborted {
+		return c
+	}
+
+	cs.capacity.mutex.Lock()
+	defer cs.capacity.mutex.Unlock()
+	cs.capacity.capacities[shareName(share)] = c
+	return c
+}
+
+// refreshCapacities collects the capacity of every share of the driver
+// configuration, and forgets the shares no longer in it.
+func (cs *ControllerServer) refreshCapacities(ctx context.Context) {
+	shares := cs.Driver.shares()
+	names := make(map[string]bool, len(shares))
+	for i, share := range shares {
+		names[shareName(share)] = true
+		if c := cs.collectCapacity(ctx, i, share); c.err != nil {
+			klog.Warningf("failed to refresh the capacity of share %s: %v", shareName(share), c.err)
+		} else {
+			klog.V(4).Infof("share %s has %d bytes available out of %d", shareName(share), c.available, c.total)
+		}
+	}
+
+	cs.capacity.mutex.Lock()
+	defer cs.capacity.mutex.Unlock()
+	for name := range cs.capacity.capacities {
+		if !names[name] {
+			delete(cs.capacity.capacities, name)
+		}
+	}
+}
+
+// runCapacityRefresh refreshes the capacities of the shares every refresh
+// interval until ctx is done.
+func (cs *ControllerServer) runCapacityRefresh(ctx context.Context) {
+	ticker := time.NewTicker(cs.capacity.refreshInterval)
+	defer ticker.Stop()
+	for {
+		cs.refreshCapacities(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// initTestCapacityController returns a controller with the shares of
+// testSharesConfig, the first one with 100 bytes available and the second
+// one with 300, and the number of times their capacity was collected.
+func initTestCapacityController(t *testing.T, refreshInterval time.Duration) (*ControllerServer, *int) {
+	cs := initTestListVolumesController(t)
+	cs.capacity = newCapacityCache(refreshInterval)
+	collected := 0
+	cs.capacity.getUsage = func(path string) ([]*csi.VolumeUsage, error) {
+		collected++
+		available := map[string]int64{"capacity-0": 100, "capacity-1": 300}[filepath.Base(path)]
+		return []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Available: available, Total: 1000}}, nil
+	}
+	return cs, &collected
+}
+
+func TestGetCapacity(t *testing.T) {
+	tests := []struct {
+		desc              string
+		serverPool        string
+		req               *csi.GetCapacityRequest
+		expectedAvailable int64
+		expectedMaximum   int64
+		expectedCode      codes.Code
+	}{
+		{
+			desc:              "all shares",
+			req:               &csi.GetCapacityRequest{},
+			expectedAvailable: 400,
+			expectedMaximum:   300,
+		},
+		{
+			desc:              "share of the storage class",
+			req:               &csi.GetCapacityRequest{Parameters: map[string]string{"server": "test-server", "share": "/share1"}},
+			expectedAvailable: 100,
+			expectedMaximum:   100,
+		},
+		{
+			desc:              "share without server",
+			req:               &csi.GetCapacityRequest{Parameters: map[string]string{"Share": "share2/"}},
+			expectedAvailable: 300,
+			expectedMaximum:   300,
+		},
+		{
+			desc:         "share not in the configuration",
+			req:          &csi.GetCapacityRequest{Parameters: map[string]string{"server": "other-server", "share": "/share1"}},
+			expectedCode: codes.NotFound,
+		},
+		{
+			desc:       "segment of the server pool",
+			serverPool: "pool-a",
+			req: &csi.GetCapacityRequest{
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{"topology." + DefaultDriverName + "/server-pool": "pool-a"}},
+			},
+			expectedAvailable: 400,
+			expectedMaximum:   300,
+		},
+		{
+			desc:       "segment of another server pool",
+			serverPool: "pool-a",
+			req: &csi.GetCapacityRequest{
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{"topology." + DefaultDriverName + "/server-pool": "pool-b"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			cs, _ := initTestCapacityController(t, time.Minute)
+			cs.Driver.name = DefaultDriverName
+			cs.Driver.serverPool = test.serverPool
+			resp, err := cs.GetCapacity(context.Background(), test.req)
+			if test.expectedCode != codes.OK {
+				assert.Equal(t, test.expectedCode, status.Code(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedAvailable, resp.GetAvailableCapacity())
+			assert.Equal(t, test.expectedMaximum, resp.GetMaximumVolumeSize().GetValue())
+		})
+	}
+}
+
+func TestGetCapacityCache(t *testing.T) {
+	ctx := context.Background()
+	req := &csi.GetCapacityRequest{}
+
+	cs, collected := initTestCapacityController(t, time.Minute)
+	_, err := cs.GetCapacity(ctx, req)
+	assert.NoError(t, err)
+	_, err = cs.GetCapacity(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *collected, "cached capacities collected again")
+	cs.refreshCapacities(ctx)
+	assert.Equal(t, 4, *collected)
+
+	// the capacity is collected by every call without cache
+	cs, collected = initTestCapacityController(t, 0)
+	_, err = cs.GetCapacity(ctx, req)
+	assert.NoError(t, err)
+	_, err = cs.GetCapacity(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, *collected)
+
+	cs.capacity.getUsage = func(_ string) ([]*csi.VolumeUsage, error) { return nil, errors.New("stale file handle") }
+	_, err = cs.GetCapacity(ctx, req)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	cs.Driver.config = nil
+	_, err = cs.GetCapacity(ctx, req)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
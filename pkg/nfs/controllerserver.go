@@ -17,6 +17,7 @@ limitations under the License.
 package nfs
 
 import (
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -26,8 +27,9 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/quota"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -40,6 +42,15 @@ import (
 type ControllerServer struct {
 	Driver       *Driver
 	LBController *lbcontroller.LBController
+	// provisioner mounts the shares of the volumes internally
+	provisioner *provisionMounter
+	// sharedMounts shares the internal mounts between requests, nil if each
+	// request mounts the share
+	sharedMounts *sharedMounts
+	// capacity caches the capacity of the shares for GetCapacity
+	capacity *capacityCache
+	// metadata caches the metadata of the volumes
+	metadata *metadataCache
 }
 
 // nfsVolume is an internal representation of a volume
@@ -61,6 +72,8 @@ type nfsVolume struct {
 	uuid string
 	// on delete action
 	onDelete string
+	// server pool of the driver that provisioned the volume
+	serverPool string
 }
 
 // nfsSnapshot is an internal representation of a volume snapshot
@@ -84,12 +97,11 @@ func (snap nfsSnapshot) archiveName() string {
 	return fmt.Sprintf("%v.tar.gz", snap.src)
 }
 
-// Ordering of elements in the CSI volume id.
-// ID is of the form {server}/{baseDir}/{subDir}.
-// TODO: This volume id format limits baseDir and
-// subDir to only be one directory deep.
-// Adding a new element should always go at the end
-// before totalIDElements
+// Ordering of elements in the legacy CSI volume id.
+// ID is of the form {server}#{baseDir}#{subDir}#{uuid}#{onDelete}.
+// The volumes are now provisioned with the versioned
+// volume id, see getVolumeIDFromNfsVol, the legacy
+// ones are still parsed.
 const (
 	idServer = iota
 	idBaseDir
@@ -124,6 +136,7 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	mountPermissions := cs.Driver.mountPermissions
+	mountProfile, mountPolicy := "", ""
 	reqCapacity := req.GetCapacityRange().GetRequiredBytes()
 	parameters := req.GetParameters()
 	if parameters == nil {
@@ -140,6 +153,14 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		case pvcNameKey:
 		case pvNameKey:
 			// no op
+		case paramXprtsec:
+			if err := validateXprtsec(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+		case paramMountProfile:
+			mountProfile = v
+		case paramMountPolicy:
+			mountPolicy = v
 		case mountPermissionsField:
 			if v != "" {
 				var err error
@@ -151,8 +172,16 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid parameter %q in storage class", k))
 		}
 	}
+	// the mount options of the storage class are checked before the volume
+	// is created, the profile and defaults of the policy are added again
+	// when it is mounted
+	for _, c := range req.GetVolumeCapabilities() {
+		if _, err := cs.Driver.resolveMountOptions(mountProfile, mountPolicy, c.GetMount().GetMountFlags()); err != nil {
+			return nil, err
+		}
+	}
 
-	nfsVol, err := newNFSVolume(name, reqCapacity, parameters, cs.Driver.defaultOnDeletePolicy)
+	nfsVol, err := newNFSVolume(name, reqCapacity, parameters, cs.Driver.defaultOnDeletePolicy, cs.Driver.serverPool)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
@@ -162,17 +191,18 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		volCap = req.GetVolumeCapabilities()[0]
 	}
 	// Mount nfs base share so we can create a subdirectory
-	if err = cs.internalMount(ctx, nfsVol, parameters, volCap); err != nil {
+	sharePath, err := cs.internalMount(ctx, nfsVol, parameters, volCap)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to mount nfs server: %v", err.Error())
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, nfsVol); err != nil {
+		if err = cs.internalUnmount(ctx, nfsVol, sharePath); err != nil {
 			klog.Warningf("failed to unmount nfs server: %v", err.Error())
 		}
 	}()
 
 	// Create subdirectory under base-dir
-	internalVolumePath := getInternalVolumePath(cs.Driver.workingMountDir, nfsVol)
+	internalVolumePath := getInternalVolumePath(sharePath, nfsVol)
 	if err = os.MkdirAll(internalVolumePath, 0777); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to make subdirectory: %v", err.Error())
 	}
@@ -184,6 +214,19 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		}
 	}
 
+	// the quota is set before the content is copied, so that the copied
+	// files are accounted to it
+	capacityBytes := int64(0) // by setting it to zero, Provisioner will use PVC requested size as PV size
+	if cs.Driver.quota != nil && reqCapacity > 0 {
+		if err = cs.Driver.quota.SetQuota(ctx, quotaVolume(nfsVol, internalVolumePath), reqCapacity); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set the quota of volume %s: %v", nfsVol.id, err)
+		}
+		capacityBytes = reqCapacity
+	}
+	if err = cs.recordVolumeMetadata(sharePath, nfsVol, &volumeMetadata{CapacityBytes: reqCapacity}); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record the metadata of volume %s: %v", nfsVol.id, err)
+	}
+
 	if req.GetVolumeContentSource() != nil {
 		if err := cs.copyVolume(ctx, req, nfsVol); err != nil {
 			return nil, err
@@ -191,14 +234,18 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	setKeyValueInMap(parameters, paramSubDir, nfsVol.subDir)
-	return &csi.CreateVolumeResponse{
+	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      nfsVol.id,
-			CapacityBytes: 0, // by setting it to zero, Provisioner will use PVC requested size as PV size
+			CapacityBytes: capacityBytes,
 			VolumeContext: parameters,
 			ContentSource: req.GetVolumeContentSource(),
 		},
-	}, nil
+	}
+	if topology := cs.Driver.topology(); topology != nil {
+		resp.Volume.AccessibleTopology = []*csi.Topology{topology}
+	}
+	return resp, nil
 }
 
 // DeleteVolume delete a volume
@@ -230,22 +277,43 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	if nfsVol.onDelete == "" {
 		nfsVol.onDelete = cs.Driver.defaultOnDeletePolicy
 	}
+	// mount nfs base share so we can read the metadata and delete the
+	// subdirectory
+	sharePath, err := cs.internalMount(ctx, nfsVol, nil, volCap)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to mount nfs server: %v", err.Error())
+	}
+	defer func() {
+		if err = cs.internalUnmount(ctx, nfsVol, sharePath); err != nil {
+			klog.Warningf("failed to unmount nfs server: %v", err.Error())
+		}
+	}()
+
+	// the ondelete policy may have been changed by ControllerModifyVolume. It
+	// is read from the metadata in the share, the cache may miss the change
+	// after a restart of the controller.
+	metadata, err := readVolumeMetadata(sharePath, nfsVol)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to read the metadata of volume %s: %v", volumeID, err)
+	}
+	if metadata.OnDelete != "" {
+		nfsVol.onDelete = metadata.OnDelete
+	}
 
 	if !strings.EqualFold(nfsVol.onDelete, retain) {
-		// mount nfs base share so we can delete the subdirectory
-		if err = cs.internalMount(ctx, nfsVol, nil, volCap); err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to mount nfs server: %v", err.Error())
-		}
-		defer func() {
-			if err = cs.internalUnmount(ctx, nfsVol); err != nil {
-				klog.Warningf("failed to unmount nfs server: %v", err.Error())
-			}
-		}()
+		internalVolumePath := getInternalVolumePath(sharePath, nfsVol)
 
-		internalVolumePath := getInternalVolumePath(cs.Driver.workingMountDir, nfsVol)
+		if cs.Driver.quota != nil {
+			if err = cs.Driver.quota.RemoveQuota(ctx, quotaVolume(nfsVol, internalVolumePath)); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to remove the quota of volume %s: %v", volumeID, err)
+			}
+		}
+		if err = cs.forgetVolumeMetadata(sharePath, nfsVol); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove the metadata of volume %s: %v", volumeID, err)
+		}
 
 		if strings.EqualFold(nfsVol.onDelete, archive) {
-			archivedInternalVolumePath := filepath.Join(getInternalMountPath(cs.Driver.workingMountDir, nfsVol), "archived-"+nfsVol.subDir)
+			archivedInternalVolumePath := filepath.Join(sharePath, "archived-"+nfsVol.subDir)
 			if strings.Contains(nfsVol.subDir, "/") {
 				parentDir := filepath.Dir(archivedInternalVolumePath)
 				klog.V(2).Infof("DeleteVolume: subdirectory(%s) contains '/', make sure the parent directory(%s) exists", nfsVol.subDir, parentDir)
@@ -271,6 +339,10 @@ func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		}
 	} else {
 		klog.V(2).Infof("DeleteVolume: volume(%s) is set to retain, not deleting/archiving subdirectory", volumeID)
+		// the retained subdirectory is no longer listed as a volume
+		if err = cs.forgetVolumeMetadata(sharePath, nfsVol); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove the metadata of volume %s: %v", volumeID, err)
+		}
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
@@ -296,13 +368,26 @@ func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 	}
 	defer cs.Driver.volumeLocks.Release(lockingVolumeID)
 
+	// the modified attributes are looked up before an IP is assigned to the
+	// node, the CO retries while they are read
+	modified, err := cs.modifiedPublishContext(volumeID)
+	if err != nil {
+		return nil, err
+	}
 	ip, err := cs.LBController.AssignIPToNode(ctx, nodeID, volumeID)
 	if err != nil {
+		if errors.Is(err, lbcontroller.ErrNotSynced) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
 		return nil, status.Errorf(codes.Internal, "failed to assign a NFS server IP to node %s: %v", nodeID, err)
 	}
 
+	publishContext := map[string]string{lbcontroller.NodeAnnotation: ip}
+	for k, v := range modified {
+		publishContext[k] = v
+	}
 	return &csi.ControllerPublishVolumeResponse{
-		PublishContext: map[string]string{lbcontroller.NodeAnnotation: ip},
+		PublishContext: publishContext,
 	}, nil
 }
 
@@ -324,6 +409,9 @@ func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	defer cs.Driver.volumeLocks.Release(lockingVolumeID)
 
 	if err := cs.LBController.RemoveIPFromNode(ctx, nodeID, volumeID); err != nil {
+		if errors.Is(err, lbcontroller.ErrNotSynced) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
 		return nil, status.Errorf(codes.Internal, "failed to remove IP annotation from node %s: %v", nodeID, err)
 	}
 
@@ -331,8 +419,41 @@ func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
-func (cs *ControllerServer) ControllerGetVolume(_ context.Context, _ *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// ControllerGetVolume reports the condition of the NFS servers serving the
+// volume: the IPs assigned by the LB controller to the nodes the volume is
+// published on, or the server in the volume ID without a LB controller.
+func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume Volume ID must be provided")
+	}
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to get volume %s: %v", volumeID, err)
+	}
+
+	servers := []string{nfsVol.server}
+	if cs.LBController != nil {
+		ips, err := cs.LBController.VolumeIPs(volumeID)
+		if err != nil {
+			if errors.Is(err, lbcontroller.ErrNotSynced) {
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		servers = ips
+	}
+
+	condition := &csi.VolumeCondition{Message: volumeNotPublishedMsg}
+	if len(servers) > 0 {
+		condition = getServersCondition(ctx, servers)
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{VolumeId: volumeID},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}, nil
 }
 
 func (cs *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -351,14 +472,6 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 	}, nil
 }
 
-func (cs *ControllerServer) ListVolumes(_ context.Context, _ *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
-
-func (cs *ControllerServer) GetCapacity(_ context.Context, _ *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
-
 // ControllerGetCapabilities implements the default GRPC callout.
 // Default supports all capabilities
 func (cs *ControllerServer) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -384,15 +497,16 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return nil, status.Errorf(codes.NotFound, "failed to create nfsSnapshot: %v", err)
 	}
 	snapVol := volumeFromSnapshot(snapshot)
-	if err = cs.internalMount(ctx, snapVol, nil, nil); err != nil {
+	snapSharePath, err := cs.internalMount(ctx, snapVol, nil, nil)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to mount snapshot nfs server: %v", err)
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, snapVol); err != nil {
+		if err = cs.internalUnmount(ctx, snapVol, snapSharePath); err != nil {
 			klog.Warningf("failed to unmount snapshot nfs server: %v", err)
 		}
 	}()
-	snapInternalVolPath := getInternalVolumePath(cs.Driver.workingMountDir, snapVol)
+	snapInternalVolPath := getInternalVolumePath(snapSharePath, snapVol)
 	if err = os.MkdirAll(snapInternalVolPath, 0777); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to make subdirectory: %v", err)
 	}
@@ -400,16 +514,17 @@ func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return nil, err
 	}
 
-	if err = cs.internalMount(ctx, srcVol, nil, nil); err != nil {
+	srcSharePath, err := cs.internalMount(ctx, srcVol, nil, nil)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to mount src nfs server: %v", err)
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, srcVol); err != nil {
+		if err = cs.internalUnmount(ctx, srcVol, srcSharePath); err != nil {
 			klog.Warningf("failed to unmount src nfs server: %v", err)
 		}
 	}()
 
-	srcPath := getInternalVolumePath(cs.Driver.workingMountDir, srcVol)
+	srcPath := getInternalVolumePath(srcSharePath, srcVol)
 	dstPath := filepath.Join(snapInternalVolPath, snapshot.archiveName())
 	klog.V(2).Infof("archiving %v -> %v", srcPath, dstPath)
 	out, err := exec.Command("tar", "-C", srcPath, "-czvf", dstPath, ".").CombinedOutput()
@@ -460,17 +575,18 @@ func (cs *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		}
 	}
 	vol := volumeFromSnapshot(snap)
-	if err = cs.internalMount(ctx, vol, nil, volCap); err != nil {
+	sharePath, err := cs.internalMount(ctx, vol, nil, volCap)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to mount nfs server for snapshot deletion: %v", err)
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, vol); err != nil {
+		if err = cs.internalUnmount(ctx, vol, sharePath); err != nil {
 			klog.Warningf("failed to unmount nfs server after snapshot deletion: %v", err)
 		}
 	}()
 
 	// delete snapshot archive
-	internalVolumePath := getInternalVolumePath(cs.Driver.workingMountDir, vol)
+	internalVolumePath := getInternalVolumePath(sharePath, vol)
 	klog.V(2).Infof("Removing snapshot archive at %v", internalVolumePath)
 	if err = os.RemoveAll(internalVolumePath); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to delete subdirectory: %v", err.Error())
@@ -483,30 +599,13 @@ func (cs *ControllerServer) ListSnapshots(_ context.Context, _ *csi.ListSnapshot
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (cs *ControllerServer) ControllerExpandVolume(_ context.Context, _ *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
-
-func (cs *ControllerServer) ControllerModifyVolume(_ context.Context, _ *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "ControllerModifyVolume unsupported")
-}
-
-// Mount nfs server at base-dir
-func (cs *ControllerServer) internalMount(ctx context.Context, vol *nfsVolume, volumeContext map[string]string, volCap *csi.VolumeCapability) error {
-	if volCap == nil {
-		volCap = &csi.VolumeCapability{
-			AccessType: &csi.VolumeCapability_Mount{
-				Mount: &csi.VolumeCapability_MountVolume{},
-			},
-		}
-	}
-
+// Mount nfs server at base-dir, or take a reference on its shared mount, and
+// return where it is mounted
+func (cs *ControllerServer) internalMount(ctx context.Context, vol *nfsVolume, volumeContext map[string]string, volCap *csi.VolumeCapability) (string, error) {
 	sharePath := filepath.Join(string(filepath.Separator) + vol.baseDir)
-	targetPath := getInternalMountPath(cs.Driver.workingMountDir, vol)
 
 	volContext := map[string]string{
-		paramServer: vol.server,
-		paramShare:  sharePath,
+		paramShare: sharePath,
 	}
 	for k, v := range volumeContext {
 		// don't set subDir field since only nfs-server:/share should be mounted in CreateVolume/DeleteVolume
@@ -514,28 +613,37 @@ func (cs *ControllerServer) internalMount(ctx context.Context, vol *nfsVolume, v
 			volContext[k] = v
 		}
 	}
+	params, err := cs.Driver.parseVolumeContext(volContext, volCap.GetMount().GetMountFlags())
+	if err != nil {
+		return "", err
+	}
+
+	if cs.sharedMounts != nil {
+		m, err := cs.sharedMounts.acquire(ctx, vol.id, vol.server, params)
+		if err != nil {
+			return "", err
+		}
+		return m.path, nil
+	}
 
+	targetPath := getInternalMountPath(cs.Driver.workingMountDir, vol)
 	klog.V(2).Infof("internally mounting %s:%s at %s", vol.server, sharePath, targetPath)
-	_, err := cs.Driver.ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
-		TargetPath:       targetPath,
-		VolumeContext:    volContext,
-		VolumeCapability: volCap,
-		VolumeId:         vol.id,
-	})
-	return err
+	if _, err := cs.provisioner.mountShare(ctx, vol.id, vol.server, targetPath, params); err != nil {
+		return "", err
+	}
+	return targetPath, nil
 }
 
-// Unmount nfs server at base-dir
-func (cs *ControllerServer) internalUnmount(ctx context.Context, vol *nfsVolume) error {
-	targetPath := getInternalMountPath(cs.Driver.workingMountDir, vol)
+// Unmount nfs server at base-dir mounted at targetPath, or release the
+// reference on its shared mount
+func (cs *ControllerServer) internalUnmount(_ context.Context, vol *nfsVolume, targetPath string) error {
+	if cs.sharedMounts != nil {
+		return cs.sharedMounts.release(targetPath)
+	}
 
 	// Unmount nfs server at base-dir
 	klog.V(4).Infof("internally unmounting %v", targetPath)
-	_, err := cs.Driver.ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
-		VolumeId:   vol.id,
-		TargetPath: targetPath,
-	})
-	return err
+	return cs.provisioner.unmount(vol.id, targetPath)
 }
 
 func (cs *ControllerServer) copyFromSnapshot(ctx context.Context, req *csi.CreateVolumeRequest, dstVol *nfsVolume) error {
@@ -550,26 +658,28 @@ func (cs *ControllerServer) copyFromSnapshot(ctx context.Context, req *csi.Creat
 		volCap = req.GetVolumeCapabilities()[0]
 	}
 
-	if err = cs.internalMount(ctx, snapVol, nil, volCap); err != nil {
+	snapSharePath, err := cs.internalMount(ctx, snapVol, nil, volCap)
+	if err != nil {
 		return status.Errorf(codes.Internal, "failed to mount src nfs server for snapshot volume copy: %v", err)
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, snapVol); err != nil {
+		if err = cs.internalUnmount(ctx, snapVol, snapSharePath); err != nil {
 			klog.Warningf("failed to unmount src nfs server after snapshot volume copy: %v", err)
 		}
 	}()
-	if err = cs.internalMount(ctx, dstVol, nil, volCap); err != nil {
+	dstSharePath, err := cs.internalMount(ctx, dstVol, nil, volCap)
+	if err != nil {
 		return status.Errorf(codes.Internal, "failed to mount dst nfs server for snapshot volume copy: %v", err)
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, dstVol); err != nil {
+		if err = cs.internalUnmount(ctx, dstVol, dstSharePath); err != nil {
 			klog.Warningf("failed to unmount dst nfs server after snapshot volume copy: %v", err)
 		}
 	}()
 
 	// untar snapshot archive to dst path
-	snapPath := filepath.Join(getInternalVolumePath(cs.Driver.workingMountDir, snapVol), snap.archiveName())
-	dstPath := getInternalVolumePath(cs.Driver.workingMountDir, dstVol)
+	snapPath := filepath.Join(getInternalVolumePath(snapSharePath, snapVol), snap.archiveName())
+	dstPath := getInternalVolumePath(dstSharePath, dstVol)
 	klog.V(2).Infof("copy volume from snapshot %v -> %v", snapPath, dstPath)
 	out, err := exec.Command("tar", "-xzvf", snapPath, "-C", dstPath).CombinedOutput()
 	if err != nil {
@@ -584,32 +694,34 @@ func (cs *ControllerServer) copyFromVolume(ctx context.Context, req *csi.CreateV
 	if err != nil {
 		return status.Error(codes.NotFound, err.Error())
 	}
-	// Note that the source path must include trailing '/.', can't use 'filepath.Join()' as it performs path cleaning
-	srcPath := fmt.Sprintf("%v/.", getInternalVolumePath(cs.Driver.workingMountDir, srcVol))
-	dstPath := getInternalVolumePath(cs.Driver.workingMountDir, dstVol)
-	klog.V(2).Infof("copy volume from volume %v -> %v", srcPath, dstPath)
-
 	var volCap *csi.VolumeCapability
 	if len(req.GetVolumeCapabilities()) > 0 {
 		volCap = req.GetVolumeCapabilities()[0]
 	}
-	if err = cs.internalMount(ctx, srcVol, nil, volCap); err != nil {
+	srcSharePath, err := cs.internalMount(ctx, srcVol, nil, volCap)
+	if err != nil {
 		return status.Errorf(codes.Internal, "failed to mount src nfs server: %v", err)
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, srcVol); err != nil {
+		if err = cs.internalUnmount(ctx, srcVol, srcSharePath); err != nil {
 			klog.Warningf("failed to unmount nfs server: %v", err)
 		}
 	}()
-	if err = cs.internalMount(ctx, dstVol, nil, volCap); err != nil {
+	dstSharePath, err := cs.internalMount(ctx, dstVol, nil, volCap)
+	if err != nil {
 		return status.Errorf(codes.Internal, "failed to mount dst nfs server: %v", err)
 	}
 	defer func() {
-		if err = cs.internalUnmount(ctx, dstVol); err != nil {
+		if err = cs.internalUnmount(ctx, dstVol, dstSharePath); err != nil {
 			klog.Warningf("failed to unmount dst nfs server: %v", err)
 		}
 	}()
 
+	// Note that the source path must include trailing '/.', can't use 'filepath.Join()' as it performs path cleaning
+	srcPath := fmt.Sprintf("%v/.", getInternalVolumePath(srcSharePath, srcVol))
+	dstPath := getInternalVolumePath(dstSharePath, dstVol)
+	klog.V(2).Infof("copy volume from volume %v -> %v", srcPath, dstPath)
+
 	// recursive 'cp' with '-a' to handle symlinks
 	out, err := exec.Command("cp", "-a", srcPath, dstPath).CombinedOutput()
 	if err != nil {
@@ -668,7 +780,7 @@ func newNFSSnapshot(name string, params map[string]string, vol *nfsVolume) (*nfs
 }
 
 // newNFSVolume Convert VolumeCreate parameters to an nfsVolume
-func newNFSVolume(name string, size int64, params map[string]string, defaultOnDeletePolicy string) (*nfsVolume, error) {
+func newNFSVolume(name string, size int64, params map[string]string, defaultOnDeletePolicy, serverPool string) (*nfsVolume, error) {
 	var server, baseDir, subDir, onDelete string
 	subDirReplaceMap := map[string]string{}
 
@@ -697,9 +809,10 @@ func newNFSVolume(name string, size int64, params map[string]string, defaultOnDe
 	}
 
 	vol := &nfsVolume{
-		server:  server,
-		baseDir: baseDir,
-		size:    size,
+		server:     server,
+		baseDir:    baseDir,
+		size:       size,
+		serverPool: serverPool,
 	}
 	if subDir == "" {
 		// use pv name by default if not specified
@@ -710,6 +823,12 @@ func newNFSVolume(name string, size int64, params map[string]string, defaultOnDe
 		// make volume id unique if subDir is provided
 		vol.uuid = name
 	}
+	// the volume IDs do not record the leading and trailing slashes
+	for _, p := range []string{vol.baseDir, vol.subDir} {
+		if err := checkVolumePath(strings.Trim(p, "/")); err != nil {
+			return nil, err
+		}
+	}
 
 	if err := validateOnDeleteValue(onDelete); err != nil {
 		return nil, err
@@ -736,19 +855,32 @@ func getInternalMountPath(workingMountDir string, vol *nfsVolume) string {
 	return filepath.Join(workingMountDir, mountDir)
 }
 
-// Get internal path where the volume is created
-// The reason why the internal path is "workingDir/subDir/subDir" is because:
+// Get internal path where the volume is created in its share mounted at
+// sharePath
+// The reason why the internal path is "workingDir/subDir/subDir" when the
+// mounts are not shared is because:
 //   - the semantic is actually "workingDir/volId/subDir" and volId == subDir.
 //   - we need a mount directory per volId because you can have multiple
 //     CreateVolume calls in parallel and they may use the same underlying share.
-//     Instead of refcounting how many CreateVolume calls are using the same
-//     share, it's simpler to just do a mount per request.
-func getInternalVolumePath(workingMountDir string, vol *nfsVolume) string {
-	return filepath.Join(getInternalMountPath(workingMountDir, vol), vol.subDir)
+//     The shared mounts are refcounted instead, see sharedMounts.
+func getInternalVolumePath(sharePath string, vol *nfsVolume) string {
+	return filepath.Join(sharePath, vol.subDir)
+}
+
+// quotaVolume returns the volume of the quota backend of a volume whose
+// subdirectory is at path in the share mounted by the controller.
+func quotaVolume(vol *nfsVolume, path string) *quota.Volume {
+	return &quota.Volume{
+		ID:     vol.id,
+		Server: vol.server,
+		Share:  vol.baseDir,
+		SubDir: vol.subDir,
+		Path:   path,
+	}
 }
 
-// Given a nfsVolume, return a CSI volume id
-func getVolumeIDFromNfsVol(vol *nfsVolume) string {
+// Given a nfsVolume, return a legacy CSI volume id
+func getLegacyVolumeIDFromNfsVol(vol *nfsVolume) string {
 	idElements := make([]string, totalIDElements)
 	idElements[idServer] = strings.Trim(vol.server, "/")
 	idElements[idBaseDir] = strings.Trim(vol.baseDir, "/")
@@ -775,11 +907,16 @@ func getSnapshotIDFromNfsSnapshot(snap *nfsSnapshot) string {
 // Given a CSI volume id, return a nfsVolume
 // sample volume Id:
 //
-//	  new volumeID:
+//	  versioned volumeID:
+//		    v2:s=nfs-server.default.svc.cluster.local#b=share#d=pvc-4bcbf944-b6f7-4bd0-b50f-3c3dd00efc64
+//	  legacy volumeID:
 //		    nfs-server.default.svc.cluster.local#share#pvc-4bcbf944-b6f7-4bd0-b50f-3c3dd00efc64
 //		    nfs-server.default.svc.cluster.local#share#subdir#pvc-4bcbf944-b6f7-4bd0-b50f-3c3dd00efc64#retain
 //	  old volumeID: nfs-server.default.svc.cluster.local/share/pvc-4bcbf944-b6f7-4bd0-b50f-3c3dd00efc64
 func getNfsVolFromID(id string) (*nfsVolume, error) {
+	if strings.HasPrefix(id, volumeIDPrefix) {
+		return parseVolumeID(id)
+	}
 	var server, baseDir, subDir, uuid, onDelete string
 	segments := strings.Split(id, separator)
 	if len(segments) < 3 {
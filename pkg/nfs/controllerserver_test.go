@@ -20,6 +20,7 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -30,6 +31,7 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/quota"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -51,6 +53,8 @@ const (
 	newTestVolumeOnDeleteRetain  = "test-server#test-base-dir#volume-name#uuid#retain"
 	newTestVolumeOnDeleteDelete  = "test-server#test-base-dir#volume-name#uuid#delete"
 	newTestVolumeOnDeleteArchive = "test-server#test-base-dir#volume-name##archive"
+	v2TestVolumeID               = "v2:s=test-server#b=test-base-dir#d=volume-name"
+	v2TestVolumeWithVolumeID     = "v2:s=test-server#b=test-base-dir#d=volume-name#u=volume-name"
 )
 
 func initTestController(_ *testing.T) *ControllerServer {
@@ -59,8 +63,8 @@ func initTestController(_ *testing.T) *ControllerServer {
 		WorkingMountDir:  "/tmp",
 		MountPermissions: 0777,
 	})
-	driver.ns = NewNodeServer(driver, mounter)
 	cs := NewControllerServer(driver)
+	cs.provisioner = newProvisionMounter(mounter, 0, cs.serverIPs)
 	return cs
 }
 
@@ -83,7 +87,7 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-func CreateVolume(t *testing.T) {
+func TestCreateVolume(t *testing.T) {
 	cases := []struct {
 		name      string
 		req       *csi.CreateVolumeRequest
@@ -112,7 +116,7 @@ func CreateVolume(t *testing.T) {
 			},
 			resp: &csi.CreateVolumeResponse{
 				Volume: &csi.Volume{
-					VolumeId: newTestVolumeID,
+					VolumeId: v2TestVolumeID,
 					VolumeContext: map[string]string{
 						paramServer:           testServer,
 						paramShare:            testBaseDir,
@@ -144,7 +148,7 @@ func CreateVolume(t *testing.T) {
 			},
 			resp: &csi.CreateVolumeResponse{
 				Volume: &csi.Volume{
-					VolumeId: newTestVolumeWithVolumeID,
+					VolumeId: v2TestVolumeWithVolumeID,
 					VolumeContext: map[string]string{
 						paramServer: testServer,
 						paramShare:  testBaseDir,
@@ -248,7 +252,7 @@ func CreateVolume(t *testing.T) {
 	}
 }
 
-func DeleteVolume(t *testing.T) {
+func TestDeleteVolume(t *testing.T) {
 	cases := []struct {
 		desc                 string
 		testOnWindows        bool
@@ -386,6 +390,48 @@ func TestControllerGetCapabilities(t *testing.T) {
 							},
 						},
 					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+							},
+						},
+					},
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+							},
+						},
+					},
 				},
 			},
 			expectedErr: nil,
@@ -415,6 +461,26 @@ func TestControllerGetCapabilities(t *testing.T) {
 	}
 }
 
+func TestControllerGetCapabilitiesWithQuota(t *testing.T) {
+	expand := &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			},
+		},
+	}
+
+	cs := NewControllerServer(NewDriver(&DriverOptions{WorkingMountDir: "/tmp"}))
+	resp, err := cs.ControllerGetCapabilities(context.TODO(), &csi.ControllerGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.NotContains(t, resp.GetCapabilities(), expand)
+
+	cs = NewControllerServer(NewDriver(&DriverOptions{WorkingMountDir: "/tmp", QuotaBackend: quota.NewFake()}))
+	resp, err = cs.ControllerGetCapabilities(context.TODO(), &csi.ControllerGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	assert.Contains(t, resp.GetCapabilities(), expand)
+}
+
 func NfsVolFromId(t *testing.T) {
 	cases := []struct {
 		name      string
@@ -631,7 +697,7 @@ func GetInternalMountPath(t *testing.T) {
 	}
 }
 
-func NewNFSVolume(t *testing.T) {
+func TestNewNFSVolume(t *testing.T) {
 	cases := []struct {
 		desc      string
 		name      string
@@ -650,7 +716,7 @@ func NewNFSVolume(t *testing.T) {
 				paramSubDir: "subdir",
 			},
 			expectVol: &nfsVolume{
-				id:       "nfs-server.default.svc.cluster.local#share#subdir#pv-name#",
+				id:       "v2:s=nfs-server.default.svc.cluster.local#b=share#d=subdir#u=pv-name",
 				server:   "//nfs-server.default.svc.cluster.local",
 				baseDir:  "share",
 				subDir:   "subdir",
@@ -672,7 +738,7 @@ func NewNFSVolume(t *testing.T) {
 				pvNameKey:       "pvname",
 			},
 			expectVol: &nfsVolume{
-				id:       "nfs-server.default.svc.cluster.local#share#subdir-pvcname-pvcnamespace-pvname#pv-name#",
+				id:       "v2:s=nfs-server.default.svc.cluster.local#b=share#d=subdir-pvcname-pvcnamespace-pvname#u=pv-name",
 				server:   "//nfs-server.default.svc.cluster.local",
 				baseDir:  "share",
 				subDir:   "subdir-pvcname-pvcnamespace-pvname",
@@ -690,7 +756,7 @@ func NewNFSVolume(t *testing.T) {
 				paramShare:  "share",
 			},
 			expectVol: &nfsVolume{
-				id:       "nfs-server.default.svc.cluster.local#share#pv-name##",
+				id:       "v2:s=nfs-server.default.svc.cluster.local#b=share#d=pv-name",
 				server:   "//nfs-server.default.svc.cluster.local",
 				baseDir:  "share",
 				subDir:   "pv-name",
@@ -705,6 +771,17 @@ func NewNFSVolume(t *testing.T) {
 			expectVol: nil,
 			expectErr: fmt.Errorf("%s is a required parameter", paramServer),
 		},
+		{
+			desc: "subDir with a parent directory",
+			name: "pv-name",
+			params: map[string]string{
+				paramServer: "//nfs-server.default.svc.cluster.local",
+				paramShare:  "share",
+				paramSubDir: "../other-share",
+			},
+			expectVol: nil,
+			expectErr: fmt.Errorf("path %q has a %q element", "../other-share", ".."),
+		},
 		{
 			desc: "invalid onDelete value",
 			params: map[string]string{
@@ -718,7 +795,7 @@ func NewNFSVolume(t *testing.T) {
 	}
 
 	for _, test := range cases {
-		vol, err := newNFSVolume(test.name, test.size, test.params, "delete")
+		vol, err := newNFSVolume(test.name, test.size, test.params, "delete", "")
 		if !reflect.DeepEqual(err, test.expectErr) {
 			t.Errorf("[test: %s] Unexpected error: %v, expected error: %v", test.desc, err, test.expectErr)
 		}
@@ -728,7 +805,7 @@ func NewNFSVolume(t *testing.T) {
 	}
 }
 
-func CopyVolume(t *testing.T) {
+func TestCopyVolume(t *testing.T) {
 	cases := []struct {
 		desc      string
 		req       *csi.CreateVolumeRequest
@@ -926,7 +1003,7 @@ func CopyVolume(t *testing.T) {
 	}
 }
 
-func CreateSnapshot(t *testing.T) {
+func TestCreateSnapshot(t *testing.T) {
 	cases := []struct {
 		desc      string
 		req       *csi.CreateSnapshotRequest
@@ -986,7 +1063,7 @@ func CreateSnapshot(t *testing.T) {
 	}
 }
 
-func DeleteSnapshot(t *testing.T) {
+func TestDeleteSnapshot(t *testing.T) {
 	cases := []struct {
 		desc      string
 		req       *csi.DeleteSnapshotRequest
@@ -1253,3 +1330,120 @@ func TestControllerUnpublishVolume(t *testing.T) {
 		})
 	}
 }
+
+func TestControllerGetVolume(t *testing.T) {
+	stop := fakeNFSServer(t)
+	defer stop()
+
+	nodes := []lbcontroller.TestNode{
+		{Name: "node-1", AssignedIP: "127.0.0.1"},
+		{Name: "node-2", AssignedIP: "127.0.0.2"},
+		{Name: "node-3", AssignedIP: "127.0.0.2"},
+	}
+	cases := []struct {
+		name           string
+		req            *csi.ControllerGetVolumeRequest
+		publishedNodes []string
+		condition      *csi.VolumeCondition
+		expectErr      codes.Code
+	}{
+		{
+			name:      "missing volume ID",
+			req:       &csi.ControllerGetVolumeRequest{},
+			expectErr: codes.InvalidArgument,
+		},
+		{
+			name:      "invalid volume ID",
+			req:       &csi.ControllerGetVolumeRequest{VolumeId: "vol-1"},
+			expectErr: codes.NotFound,
+		},
+		{
+			name:      "volume not published",
+			req:       &csi.ControllerGetVolumeRequest{VolumeId: testVolumeID},
+			condition: &csi.VolumeCondition{Message: volumeNotPublishedMsg},
+		},
+		{
+			name:           "servers of the published nodes reachable",
+			req:            &csi.ControllerGetVolumeRequest{VolumeId: testVolumeID},
+			publishedNodes: []string{"node-1"},
+			condition:      &csi.VolumeCondition{Message: volumeHealthyMsg},
+		},
+		{
+			name:           "server of a published node unreachable",
+			req:            &csi.ControllerGetVolumeRequest{VolumeId: testVolumeID},
+			publishedNodes: []string{"node-1", "node-2", "node-3"},
+			condition:      &csi.VolumeCondition{Abnormal: true, Message: "1 of 2 NFS servers unreachable: 127.0.0.2"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cs := initTestControllerWithFakeLBController(t, map[string]int{"127.0.0.1": 1, "127.0.0.2": 2}, nodes)
+			for _, node := range tc.publishedNodes {
+				_, err := cs.LBController.AssignIPToNode(context.TODO(), node, tc.req.GetVolumeId())
+				assert.NoError(t, err)
+			}
+			resp, err := cs.ControllerGetVolume(context.TODO(), tc.req)
+			assert.Equal(t, tc.expectErr, status.Code(err))
+			if tc.condition != nil {
+				assert.Equal(t, tc.req.GetVolumeId(), resp.GetVolume().GetVolumeId())
+				assert.Equal(t, tc.condition, resp.GetStatus().GetVolumeCondition())
+			}
+		})
+	}
+}
+
+func TestVolumeQuota(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	backend := quota.NewFake()
+	cs.Driver.quota = backend
+	ctx := context.Background()
+
+	createReq := func(name string, bytes int64, onDelete string) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: bytes},
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+			},
+			Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir, paramOnDelete: onDelete},
+		}
+	}
+
+	resp, err := cs.CreateVolume(ctx, createReq("pvc-a", 1<<30, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<30), resp.GetVolume().GetCapacityBytes())
+	bytes, ok := backend.Get(resp.GetVolume().GetVolumeId())
+	assert.True(t, ok)
+	assert.Equal(t, int64(1<<30), bytes)
+
+	// no quota without requested capacity
+	noCapacity, err := cs.CreateVolume(ctx, createReq("pvc-b", 0, ""))
+	assert.NoError(t, err)
+	assert.Zero(t, noCapacity.GetVolume().GetCapacityBytes())
+	_, ok = backend.Get(noCapacity.GetVolume().GetVolumeId())
+	assert.False(t, ok)
+
+	// a retained volume keeps its quota
+	retained, err := cs.CreateVolume(ctx, createReq("pvc-c", 1<<30, retain))
+	assert.NoError(t, err)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: retained.GetVolume().GetVolumeId()})
+	assert.NoError(t, err)
+	_, ok = backend.Get(retained.GetVolume().GetVolumeId())
+	assert.True(t, ok)
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+	assert.NoError(t, err)
+	_, ok = backend.Get(resp.GetVolume().GetVolumeId())
+	assert.False(t, ok)
+
+	backend.Err = errors.New("quota exceeded for fileset")
+	_, err = cs.CreateVolume(ctx, createReq("pvc-d", 1<<30, ""))
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: noCapacity.GetVolume().GetVolumeId()})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultSubDirUsageMaxEntries = 1000000
+	defaultSubDirUsageMaxWalks   = 2
+)
+
+// errWalkLimitExceeded stops a walk that went over its entry or time limit.
+var errWalkLimitExceeded = errors.New("directory walk limit exceeded")
+
+// dirUsage is the space and inodes used under a directory.
+type dirUsage struct {
+	bytes       int64
+	inodes      int64
+	collectedAt time.Time
+}
+
+// usageSource reports the usage of the subdirectory of a share backing a
+// volume, which the statfs of the mount does not give.
+type usageSource interface {
+	// usage returns the usage under path, false if it is not known yet. The
+	// usage is kept under key until it is forgotten.
+	usage(key, path string) (dirUsage, bool)
+	// forget drops what is known under key.
+	forget(key string)
+}
+
+// dirUsageWalker is a usageSource walking the directories in the background.
+// A walk is started when the usage of a path is older than the refresh
+// interval, and is abandoned when it goes over the entry or time limit.
+type dirUsageWalker struct {
+	mutex   sync.Mutex
+	entries map[string]*dirUsageEntry
+
+	refreshInterval time.Duration
+	maxEntries      int64
+	maxDuration     time.Duration
+	// walks limits the number of concurrent walks
+	walks chan struct{}
+	// walk returns the usage under path, stopping after maxEntries entries
+	// or once the deadline is passed.
+	walk func(path string, maxEntries int64, deadline time.Time) (dirUsage, error)
+}
+
+type dirUsageEntry struct {
+	usage   *dirUsage
+	walking bool
+	// lastWalk is when the last walk, successful or not, finished
+	lastWalk time.Time
+}
+
+func newDirUsageWalker(refreshInterval time.Duration, maxEntries int64) *dirUsageWalker {
+	if maxEntries <= 0 {
+		maxEntries = defaultSubDirUsageMaxEntries
+	}
+	return &dirUsageWalker{
+		entries:         map[string]*dirUsageEntry{},
+		refreshInterval: refreshInterval,
+		maxEntries:      maxEntries,
+		// a walk must not run into the next one
+		maxDuration: refreshInterval,
+		walks:       make(chan struct{}, defaultSubDirUsageMaxWalks),
+		walk:        walkDirUsage,
+	}
+}
+
+func (w *dirUsageWalker) usage(key, path string) (dirUsage, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	e, ok := w.entries[key]
+	if !ok {
+		e = &dirUsageEntry{}
+		w.entries[key] = e
+	}
+	if !e.walking && time.Since(e.lastWalk) >= w.refreshInterval {
+		e.walking = true
+		go w.refresh(path, e)
+	}
+	if e.usage == nil {
+		return dirUsage{}, false
+	}
+	return *e.usage, true
+}
+
+func (w *dirUsageWalker) refresh(path string, e *dirUsageEntry) {
+	w.walks <- struct{}{}
+	defer func() { <-w.walks }()
+
+	start := time.Now()
+	usage, err := w.walk(path, w.maxEntries, start.Add(w.maxDuration))
+	if err != nil {
+		klog.Warningf("failed to get the usage of %s, reporting the usage of the share instead: %v", path, err)
+	} else {
+		klog.V(4).Infof("usage of %s is %d bytes and %d inodes, walked in %v", path, usage.bytes, usage.inodes, time.Since(start))
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	e.walking = false
+	e.lastWalk = time.Now()
+	if err != nil {
+		e.usage = nil
+	} else {
+		e.usage = &usage
+	}
+}
+
+func (w *dirUsageWalker) forget(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.entries, key)
+}
+
+// walkDirUsage returns the space allocated to and the number of inodes under
+// path, like du, counting hard links once.
+func walkDirUsage(path string, maxEntries int64, deadline time.Time) (dirUsage, error) {
+	type inode struct{ dev, ino uint64 }
+	seen := map[inode]struct{}{}
+	var usage dirUsage
+	var entries int64
+
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// files removed during the walk are skipped
+			if errors.Is(err, fs.ErrNotExist) && p != path {
+				return nil
+			}
+			return err
+		}
+		entries++
+		if entries > maxEntries {
+			return fmt.Errorf("%w: more than %d entries", errWalkLimitExceeded, maxEntries)
+		}
+		if entries%1000 == 0 && time.Now().After(deadline) {
+			return fmt.Errorf("%w: walk took longer than the deadline", errWalkLimitExceeded)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			usage.bytes += info.Size()
+			usage.inodes++
+			return nil
+		}
+		if stat.Nlink > 1 {
+			key := inode{dev: uint64(stat.Dev), ino: stat.Ino} //nolint:unconvert
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+		}
+		usage.bytes += stat.Blocks * 512
+		usage.inodes++
+		return nil
+	})
+	if err != nil {
+		return dirUsage{}, err
+	}
+	usage.collectedAt = time.Now()
+	return usage, nil
+}
+
+// withSubDirUsage returns the usage of a subdirectory volume published at
+// path: the bytes and inodes used under the subdirectory in its staging path
+// if they are known, else the usage of the share from statfs. The total and
+// available amounts of the share do not apply to the subdirectory, they are
+// left unset.
+func (ns *NodeServer) withSubDirUsage(volumeID, path string, usage []*csi.VolumeUsage) []*csi.VolumeUsage {
+	if ns.subDirUsage == nil {
+		return usage
+	}
+	// the volumes published before the plugin started are not known to be
+	// subdirectories, the usage of their share is reported
+	stagingPath, t, ok := ns.stagedVolumes.getStagedTarget(path)
+	if !ok || t.subDir == "" {
+		return usage
+	}
+	du, ok := ns.subDirUsage.usage(subDirUsageKey(volumeID, stagingPath), filepath.Join(stagingPath, t.subDir))
+	if !ok {
+		return usage
+	}
+
+	result := make([]*csi.VolumeUsage, 0, len(usage))
+	for _, u := range usage {
+		switch u.GetUnit() {
+		case csi.VolumeUsage_BYTES:
+			result = append(result, &csi.VolumeUsage{Unit: u.GetUnit(), Used: du.bytes})
+		case csi.VolumeUsage_INODES:
+			result = append(result, &csi.VolumeUsage{Unit: u.GetUnit(), Used: du.inodes})
+		default:
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// subDirUsageKey returns the key of the usage of a subdirectory volume
+// staged at stagingPath, shared by all the paths it is published on.
+func subDirUsageKey(volumeID, stagingPath string) string {
+	return fmt.Sprintf("%s#%s", volumeID, stagingPath)
+}
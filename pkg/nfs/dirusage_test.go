@@ -0,0 +1,144 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalkDirUsage(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0750))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a", "file"), make([]byte, 8192), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a", "b", "file"), make([]byte, 4096), 0600))
+	// hard links are counted once
+	assert.NoError(t, os.Link(filepath.Join(dir, "a", "file"), filepath.Join(dir, "link")))
+
+	usage, err := walkDirUsage(dir, 100, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	// dir, a, a/b, a/file, a/b/file
+	assert.Equal(t, int64(5), usage.inodes)
+	assert.GreaterOrEqual(t, usage.bytes, int64(8192+4096))
+
+	_, err = walkDirUsage(dir, 3, time.Now().Add(time.Minute))
+	assert.True(t, errors.Is(err, errWalkLimitExceeded))
+
+	_, err = walkDirUsage(filepath.Join(dir, "missing"), 100, time.Now().Add(time.Minute))
+	assert.Error(t, err)
+}
+
+func TestDirUsageWalker(t *testing.T) {
+	w := newDirUsageWalker(time.Hour, 0)
+	walks := make(chan string, 10)
+	w.walk = func(path string, _ int64, _ time.Time) (dirUsage, error) {
+		walks <- path
+		if path == "/error" {
+			return dirUsage{}, errors.New("fake error")
+		}
+		return dirUsage{bytes: 100, inodes: 10, collectedAt: time.Now()}, nil
+	}
+
+	// the usage is unknown until the first walk returns
+	_, ok := w.usage("vol_1#/staging", "/path")
+	assert.False(t, ok)
+	assert.Equal(t, "/path", <-walks)
+	assert.Eventually(t, func() bool {
+		_, ok := w.usage("vol_1#/staging", "/path")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	usage, _ := w.usage("vol_1#/staging", "/path")
+	assert.Equal(t, int64(100), usage.bytes)
+	assert.Equal(t, int64(10), usage.inodes)
+	// no walk is started again before the refresh interval
+	assert.Empty(t, walks)
+
+	_, ok = w.usage("vol_2#/staging", "/error")
+	assert.False(t, ok)
+	assert.Equal(t, "/error", <-walks)
+	time.Sleep(10 * time.Millisecond)
+	_, ok = w.usage("vol_2#/staging", "/error")
+	assert.False(t, ok)
+
+	// a forgotten key is walked again
+	w.forget("vol_1#/staging")
+	_, ok = w.usage("vol_1#/staging", "/path")
+	assert.False(t, ok)
+	assert.Equal(t, "/path", <-walks)
+}
+
+// fakeUsageSource reports a fixed usage for every path, and records the
+// paths it is asked about.
+type fakeUsageSource struct {
+	dirUsage
+	paths []string
+}
+
+func (f *fakeUsageSource) usage(_, path string) (dirUsage, bool) {
+	f.paths = append(f.paths, path)
+	return f.dirUsage, true
+}
+func (f *fakeUsageSource) forget(_ string) {}
+
+func TestNodeGetVolumeStatsPerPath(t *testing.T) {
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	ns.volumeStats.getUsage = func(path string) ([]*csi.VolumeUsage, error) {
+		total := int64(1000)
+		if path == "/path/2" {
+			total = 2000
+		}
+		return []*csi.VolumeUsage{
+			{Unit: csi.VolumeUsage_BYTES, Total: total, Used: 500, Available: total - 500},
+			{Unit: csi.VolumeUsage_INODES, Total: 100, Used: 50, Available: 50},
+		}, nil
+	}
+	source := &fakeUsageSource{dirUsage: dirUsage{bytes: 10, inodes: 2}}
+	ns.subDirUsage = source
+	ns.stagedVolumes.stage(&stagedVolume{volumeID: "vol_1", stagingPath: "/staging"})
+	ns.stagedVolumes.publish("/staging", "/path/1", publishedTarget{})
+	ns.stagedVolumes.publish("/staging", "/path/2", publishedTarget{subDir: "subdir"})
+
+	// the stats of a path are not returned for another path of the volume
+	for _, path := range []string{"/path/1", "/path/2", "/path/1", "/path/3"} {
+		resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: path})
+		assert.NoError(t, err)
+		if path == "/path/2" {
+			// the usage of a subdirectory volume comes from the usage source,
+			// without the capacity of the share
+			assert.Equal(t, int64(0), resp.Usage[0].Total)
+			assert.Equal(t, int64(0), resp.Usage[0].Available)
+			assert.Equal(t, int64(10), resp.Usage[0].Used)
+			assert.Equal(t, int64(2), resp.Usage[1].Used)
+		} else {
+			// the usage of a volume not known to be a subdirectory is the
+			// one of the share
+			assert.Equal(t, int64(1000), resp.Usage[0].Total)
+			assert.Equal(t, int64(500), resp.Usage[0].Used)
+			assert.Equal(t, int64(50), resp.Usage[1].Used)
+		}
+	}
+	// the subdirectory is walked in the staging path
+	assert.Equal(t, []string{"/staging/subdir"}, source.paths)
+}
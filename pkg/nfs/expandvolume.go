@@ -0,0 +1,100 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// ControllerExpandVolume raises the quota of a volume to the requested
+// capacity and records it in the metadata of the volume. Volumes cannot be
+// expanded without a quota backend. A volume cannot be shrunk below its recorded
+// capacity. The volume is expanded online, the nodes have nothing to do.
+func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Volume ID must be provided")
+	}
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+	if capacityBytes <= 0 {
+		capacityBytes = req.GetCapacityRange().GetLimitBytes()
+	}
+	if capacityBytes <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Capacity range must be provided")
+	}
+	if cs.Driver.quota == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s cannot be expanded, the driver has no quota backend", volumeID)
+	}
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "invalid volume ID %s: %v", volumeID, err)
+	}
+
+	if acquired := cs.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.Driver.volumeLocks.Release(volumeID)
+
+	sharePath, err := cs.internalMount(ctx, nfsVol, nil, req.GetVolumeCapability())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, nfsVol, sharePath); err != nil {
+			klog.Warningf("failed to unmount nfs server: %v", err)
+		}
+	}()
+
+	internalVolumePath := getInternalVolumePath(sharePath, nfsVol)
+	if _, err := os.Stat(internalVolumePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat subdirectory %s: %v", internalVolumePath, err)
+	}
+	metadata, err := readVolumeMetadata(sharePath, nfsVol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read the metadata of volume %s: %v", volumeID, err)
+	}
+	if capacityBytes < metadata.CapacityBytes {
+		return nil, status.Errorf(codes.OutOfRange, "volume %s cannot be shrunk from %d to %d bytes", volumeID, metadata.CapacityBytes, capacityBytes)
+	}
+
+	// the quota is raised before the capacity is recorded, a failed
+	// expansion is retried
+	if capacityBytes > metadata.CapacityBytes {
+		if err := cs.Driver.quota.SetQuota(ctx, quotaVolume(nfsVol, internalVolumePath), capacityBytes); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set the quota of volume %s: %v", volumeID, err)
+		}
+		metadata.CapacityBytes = capacityBytes
+		if err := cs.recordVolumeMetadata(sharePath, nfsVol, metadata); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record the capacity of volume %s: %v", volumeID, err)
+		}
+		klog.V(2).Infof("expanded volume %s to %d bytes", volumeID, capacityBytes)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacityBytes,
+		NodeExpansionRequired: false,
+	}, nil
+}
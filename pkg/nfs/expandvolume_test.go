@@ -0,0 +1,129 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/quota"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestControllerExpandVolume(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	ctx := context.Background()
+
+	// the size of a volume is only enforced by a quota backend
+	_, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: "test-server#test-base-dir#pvc-a##", CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30}})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	backend := quota.NewFake()
+	cs.Driver.quota = backend
+
+	created, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "pvc-a",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir},
+	})
+	assert.NoError(t, err)
+	volumeID := created.GetVolume().GetVolumeId()
+	expandReq := func(bytes int64) *csi.ControllerExpandVolumeRequest {
+		return &csi.ControllerExpandVolumeRequest{VolumeId: volumeID, CapacityRange: &csi.CapacityRange{RequiredBytes: bytes}}
+	}
+	capacity := func() int64 {
+		nfsVol, err := getNfsVolFromID(volumeID)
+		assert.NoError(t, err)
+		metadata, err := readVolumeMetadata(filepath.Join(cs.Driver.workingMountDir, nfsVol.subDir), nfsVol)
+		assert.NoError(t, err)
+		return metadata.CapacityBytes
+	}
+	assert.Equal(t, int64(1<<30), capacity())
+
+	tests := []struct {
+		desc             string
+		req              *csi.ControllerExpandVolumeRequest
+		quotaErr         error
+		expectedCode     codes.Code
+		expectedCapacity int64
+	}{
+		{
+			desc:             "expansion",
+			req:              expandReq(2 << 30),
+			expectedCapacity: 2 << 30,
+		},
+		{
+			desc:             "same size",
+			req:              expandReq(2 << 30),
+			quotaErr:         errors.New("quota set again"),
+			expectedCapacity: 2 << 30,
+		},
+		{
+			desc:             "shrink",
+			req:              expandReq(1 << 30),
+			expectedCode:     codes.OutOfRange,
+			expectedCapacity: 2 << 30,
+		},
+		{
+			desc:             "quota failure",
+			req:              expandReq(4 << 30),
+			quotaErr:         errors.New("mmsetquota failed"),
+			expectedCode:     codes.Internal,
+			expectedCapacity: 2 << 30,
+		},
+		{
+			desc:             "missing capacity",
+			req:              &csi.ControllerExpandVolumeRequest{VolumeId: volumeID},
+			expectedCode:     codes.InvalidArgument,
+			expectedCapacity: 2 << 30,
+		},
+		{
+			desc:             "missing volume",
+			req:              &csi.ControllerExpandVolumeRequest{VolumeId: "test-server#test-base-dir#pvc-b##", CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30}},
+			expectedCode:     codes.NotFound,
+			expectedCapacity: 2 << 30,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			backend.Err = test.quotaErr
+			resp, err := cs.ControllerExpandVolume(ctx, test.req)
+			assert.Equal(t, test.expectedCode, status.Code(err))
+			if test.expectedCode == codes.OK {
+				assert.Equal(t, test.req.GetCapacityRange().GetRequiredBytes(), resp.GetCapacityBytes())
+				assert.False(t, resp.GetNodeExpansionRequired())
+			}
+			assert.Equal(t, test.expectedCapacity, capacity())
+			backend.Err = nil
+			bytes, _ := backend.Get(volumeID)
+			assert.Equal(t, test.expectedCapacity, bytes)
+		})
+	}
+}
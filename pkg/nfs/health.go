@@ -0,0 +1,143 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	healthCheckGRPCServing    = "grpc-serving"
+	healthCheckLBCacheSynced  = "lb-controller-synced"
+	healthCheckNFSServices    = "nfs-services"
+	healthzPath               = "/healthz"
+	readyzPath                = "/readyz"
+	healthCheckFailedResponse = "health check failed"
+)
+
+// healthCheck is a named check aggregated by Probe and the HTTP health endpoints.
+type healthCheck struct {
+	name string
+	// liveness checks detect failures that a restart of the plugin can fix.
+	// They are served on /healthz, all checks are served on /readyz and Probe.
+	liveness bool
+	check    func() error
+}
+
+// healthChecks is the set of checks registered for a driver.
+type healthChecks struct {
+	mutex  sync.RWMutex
+	checks []healthCheck
+}
+
+// healthCheckResult is the outcome of a single health check.
+type healthCheckResult struct {
+	name     string
+	liveness bool
+	err      error
+}
+
+func (h *healthChecks) add(name string, liveness bool, check func() error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checks = append(h.checks, healthCheck{name: name, liveness: liveness, check: check})
+}
+
+// run runs the registered checks, only the liveness checks if livenessOnly is set.
+func (h *healthChecks) run(livenessOnly bool) []healthCheckResult {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var results []healthCheckResult
+	for _, c := range h.checks {
+		if livenessOnly && !c.liveness {
+			continue
+		}
+		results = append(results, healthCheckResult{name: c.name, liveness: c.liveness, err: c.check()})
+	}
+	return results
+}
+
+// failedHealthChecks returns an error listing every failed check, or nil.
+func failedHealthChecks(results []healthCheckResult) error {
+	var errs []error
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.name, r.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// healthHandler serves the result of the health checks in the format used by
+// the Kubernetes components: "ok" when all checks pass, otherwise one line per
+// check. The per check lines are also returned on success with ?verbose.
+func (h *healthChecks) healthHandler(livenessOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results := h.run(livenessOnly)
+		failed := failedHealthChecks(results) != nil
+		_, verbose := r.URL.Query()["verbose"]
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if !failed && !verbose {
+			fmt.Fprint(w, "ok")
+			return
+		}
+
+		var b strings.Builder
+		for _, r := range results {
+			if r.err != nil {
+				fmt.Fprintf(&b, "[-]%s failed: %v\n", r.name, r.err)
+			} else {
+				fmt.Fprintf(&b, "[+]%s ok\n", r.name)
+			}
+		}
+		if failed {
+			klog.V(4).Infof("%s %s:\n%s", r.URL.Path, healthCheckFailedResponse, b.String())
+			fmt.Fprintf(&b, "%s %s\n", r.URL.Path, healthCheckFailedResponse)
+		} else {
+			fmt.Fprintf(&b, "%s check passed\n", r.URL.Path)
+		}
+		fmt.Fprint(w, b.String())
+	}
+}
+
+// serveHealth serves /healthz and /readyz on the given address, and /metrics
+// if a metrics handler is given.
+func (h *healthChecks) serveHealth(endpoint string, metrics http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle(healthzPath, h.healthHandler(true))
+	mux.Handle(readyzPath, h.healthHandler(false))
+	if metrics != nil {
+		mux.Handle(metricsPath, metrics)
+	}
+
+	klog.Infof("Serving health checks on %q", endpoint)
+	if err := http.ListenAndServe(endpoint, mux); err != nil {
+		klog.Fatalf("Failed to serve health checks on %q: %v", endpoint, err)
+	}
+}
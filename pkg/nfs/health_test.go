@@ -0,0 +1,68 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthHandler(t *testing.T) {
+	var h healthChecks
+	h.add("live", true, func() error { return nil })
+	h.add("ready", false, func() error { return errors.New("cache not synced") })
+
+	tests := []struct {
+		desc           string
+		path           string
+		livenessOnly   bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			desc:           "liveness checks pass",
+			path:           healthzPath,
+			livenessOnly:   true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "ok",
+		},
+		{
+			desc:           "liveness checks pass verbose",
+			path:           healthzPath + "?verbose",
+			livenessOnly:   true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "[+]live ok\n/healthz check passed\n",
+		},
+		{
+			desc:           "readiness check fails",
+			path:           readyzPath,
+			expectedStatus: http.StatusInternalServerError,
+			expectedBody:   "[+]live ok\n[-]ready failed: cache not synced\n/readyz health check failed\n",
+		},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.healthHandler(test.livenessOnly).ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+		assert.Equal(t, test.expectedStatus, w.Code, test.desc)
+		assert.Equal(t, test.expectedBody, w.Body.String(), test.desc)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/klog/v2"
 )
 
 type IdentityServer struct {
@@ -43,16 +44,31 @@ func (ids *IdentityServer) GetPluginInfo(_ context.Context, _ *csi.GetPluginInfo
 	}, nil
 }
 
-// Probe check whether the plugin is running or not.
-// This method does not need to return anything.
-// Currently the spec does not dictate what you should return either.
-// Hence, return an empty response
+// Probe aggregates the driver health checks.
+// A failed liveness check, such as a dead NFS helper daemon, is returned as
+// FailedPrecondition. Any other failed check, such as the LB controller cache
+// still syncing, is reported as not ready.
 func (ids *IdentityServer) Probe(_ context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	results := ids.Driver.health.run(false)
+
+	var liveness []healthCheckResult
+	for _, r := range results {
+		if r.liveness {
+			liveness = append(liveness, r)
+		}
+	}
+	if err := failedHealthChecks(liveness); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "driver is unhealthy: %v", err)
+	}
+	if err := failedHealthChecks(results); err != nil {
+		klog.V(4).Infof("Probe: driver is not ready: %v", err)
+		return &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: false}}, nil
+	}
 	return &csi.ProbeResponse{Ready: &wrapperspb.BoolValue{Value: true}}, nil
 }
 
 func (ids *IdentityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	return &csi.GetPluginCapabilitiesResponse{
+	resp := &csi.GetPluginCapabilitiesResponse{
 		Capabilities: []*csi.PluginCapability{
 			{
 				Type: &csi.PluginCapability_Service_{
@@ -62,5 +78,27 @@ func (ids *IdentityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPl
 				},
 			},
 		},
-	}, nil
+	}
+	// the volumes are expanded by raising their quota
+	if ids.Driver.quota != nil {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_VolumeExpansion_{
+				VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+					Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+				},
+			},
+		})
+	}
+	// the volumes are only accessible from the nodes of the server pool of
+	// the driver
+	if ids.Driver.serverPool != "" {
+		resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
+	return resp, nil
 }
@@ -18,9 +18,11 @@ package nfs
 
 import (
 	"context"
+	"errors"
 	"reflect"
 	"testing"
 
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/quota"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
@@ -77,6 +79,54 @@ func TestProbe(t *testing.T) {
 	assert.Equal(t, resp.Ready.Value, true)
 }
 
+func TestProbeHealthChecks(t *testing.T) {
+	passing := func() error { return nil }
+	failing := func() error { return errors.New("fake failure") }
+
+	tests := []struct {
+		desc          string
+		liveness      func() error
+		readiness     func() error
+		expectedReady bool
+		expectedErr   error
+	}{
+		{
+			desc:          "All checks pass",
+			liveness:      passing,
+			readiness:     passing,
+			expectedReady: true,
+		},
+		{
+			desc:          "Readiness check fails",
+			liveness:      passing,
+			readiness:     failing,
+			expectedReady: false,
+		},
+		{
+			desc:        "Liveness check fails",
+			liveness:    failing,
+			readiness:   passing,
+			expectedErr: status.Error(codes.FailedPrecondition, "driver is unhealthy: live: fake failure"),
+		},
+	}
+
+	for _, test := range tests {
+		d := NewEmptyDriver("")
+		d.health.add("live", true, test.liveness)
+		d.health.add("ready", false, test.readiness)
+		fakeIdentityServer := IdentityServer{
+			Driver: d,
+		}
+		resp, err := fakeIdentityServer.Probe(context.Background(), &csi.ProbeRequest{})
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("desc: %v, expected error: %v, actual error: %v", test.desc, test.expectedErr, err)
+		}
+		if err == nil {
+			assert.Equal(t, test.expectedReady, resp.Ready.Value, test.desc)
+		}
+	}
+}
+
 func TestGetPluginCapabilities(t *testing.T) {
 	expectedCap := []*csi.PluginCapability{
 		{
@@ -99,4 +149,28 @@ func TestGetPluginCapabilities(t *testing.T) {
 	assert.Equal(t, resp.XXX_sizecache, int32(0))
 	assert.Equal(t, resp.Capabilities, expectedCap)
 
+	// with a quota backend
+	d.quota = quota.NewFake()
+	expectedCap = append(expectedCap, &csi.PluginCapability{
+		Type: &csi.PluginCapability_VolumeExpansion_{
+			VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+				Type: csi.PluginCapability_VolumeExpansion_ONLINE,
+			},
+		},
+	})
+	resp, err = fakeIdentityServer.GetPluginCapabilities(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedCap, resp.Capabilities)
+
+	// with topology
+	d.serverPool = "pool-a"
+	resp, err = fakeIdentityServer.GetPluginCapabilities(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, append(expectedCap, &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	}), resp.Capabilities)
 }
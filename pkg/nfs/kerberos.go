@@ -0,0 +1,501 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/supervisor"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// keys of the node stage or publish secrets of Kerberos volumes
+	kerberosSecretKeytab   = "keytab"
+	kerberosSecretKrb5Conf = "krb5.conf"
+
+	// rpc.gssd stores the machine credentials of a realm in
+	// <ccache dir>/krb5ccmachine_<REALM>.
+	machineCCachePrefix = "krb5ccmachine_"
+	rpcPipefsPath       = "/var/lib/nfs/rpc_pipefs"
+)
+
+// the keytab format version written by MIT Kerberos since 1.0
+var keytabVersion = []byte{0x05, 0x02}
+
+// keytabEntry is a key of a principal in a keytab.
+type keytabEntry struct {
+	principal string
+	realm     string
+	// raw is the entry with its size prefix, as written in a keytab
+	raw []byte
+}
+
+// parseKeytab returns the entries of a keytab.
+func parseKeytab(data []byte) ([]keytabEntry, error) {
+	if len(data) < len(keytabVersion) || !bytes.Equal(data[:len(keytabVersion)], keytabVersion) {
+		return nil, errors.New("unsupported keytab format, expected version 0x0502")
+	}
+
+	var entries []keytabEntry
+	for off := len(keytabVersion); off < len(data); {
+		if off+4 > len(data) {
+			return nil, fmt.Errorf("keytab truncated at offset %d", off)
+		}
+		size := int(int32(binary.BigEndian.Uint32(data[off:])))
+		start := off
+		off += 4
+		if size < 0 {
+			// a hole left by a deleted entry
+			off -= size
+			continue
+		}
+		if off+size > len(data) {
+			return nil, fmt.Errorf("keytab entry at offset %d is truncated", start)
+		}
+		principal, realm, err := parseKeytabPrincipal(data[off : off+size])
+		if err != nil {
+			return nil, fmt.Errorf("invalid keytab entry at offset %d: %w", start, err)
+		}
+		off += size
+		entries = append(entries, keytabEntry{principal: principal, realm: realm, raw: data[start:off]})
+	}
+	return entries, nil
+}
+
+// parseKeytabPrincipal returns the principal and realm of a keytab entry.
+func parseKeytabPrincipal(entry []byte) (string, string, error) {
+	off := 0
+	readString := func() (string, error) {
+		if off+2 > len(entry) {
+			return "", errors.New("truncated")
+		}
+		n := int(binary.BigEndian.Uint16(entry[off:]))
+		off += 2
+		if off+n > len(entry) {
+			return "", errors.New("truncated")
+		}
+		s := string(entry[off : off+n])
+		off += n
+		return s, nil
+	}
+
+	if len(entry) < 2 {
+		return "", "", errors.New("truncated")
+	}
+	components := int(binary.BigEndian.Uint16(entry))
+	off += 2
+	realm, err := readString()
+	if err != nil {
+		return "", "", err
+	}
+	names := make([]string, 0, components)
+	for i := 0; i < components; i++ {
+		name, err := readString()
+		if err != nil {
+			return "", "", err
+		}
+		names = append(names, name)
+	}
+	if realm == "" || len(names) == 0 {
+		return "", "", errors.New("empty principal")
+	}
+	return strings.Join(names, "/") + "@" + realm, realm, nil
+}
+
+// kerberosFlavor returns the first Kerberos security flavor of the sec mount
+// option, false if the volume is not mounted with Kerberos.
+func kerberosFlavor(mountOptions []string) (string, bool) {
+	for _, opt := range mountOptions {
+		for _, o := range strings.Split(opt, ",") {
+			if !strings.HasPrefix(o, "sec=") {
+				continue
+			}
+			for _, flavor := range strings.Split(strings.TrimPrefix(o, "sec="), ":") {
+				switch flavor {
+				case "krb5", "krb5i", "krb5p":
+					return flavor, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// kerberosVolume are the Kerberos credentials of a volume mounted at path.
+type kerberosVolume struct {
+	path     string
+	entries  []keytabEntry
+	krb5Conf []byte
+}
+
+// principals returns the principals of the volume by realm.
+func (v *kerberosVolume) principals() map[string]string {
+	byRealm := map[string][]string{}
+	for _, e := range v.entries {
+		byRealm[e.realm] = append(byRealm[e.realm], e.principal)
+	}
+	principals := make(map[string]string, len(byRealm))
+	for realm, p := range byRealm {
+		sort.Strings(p)
+		principals[realm] = strings.Join(uniqueStrings(p), ",")
+	}
+	return principals
+}
+
+func uniqueStrings(sorted []string) []string {
+	var unique []string
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
+
+// kerberosCredentials manage the Kerberos credentials of the volumes mounted
+// on the node, from the keytab and krb5.conf of their secrets, in a directory
+// shared with rpc.gssd:
+//
+//	krb5.conf          the configuration of rpc.gssd, including conf.d
+//	conf.d/<key>       the krb5.conf of a volume
+//	krb5.keytab        the keytab of rpc.gssd, the keytab of the volumes
+//	ccache/            the machine credentials obtained by rpc.gssd
+//	volumes/<key>/     the path, keytab and krb5.conf of a volume, to
+//	                   restore them when the plugin restarts
+//
+// rpc.gssd selects the machine credentials of a mount by the realm of the
+// server, not by volume, so a volume could be mounted with the credentials
+// of another volume of the node. The Kerberos volumes staged on a node must
+// therefore use the same keytab, a volume with other principals or keys is
+// refused until the volumes of the node using the previous ones are
+// unstaged.
+type kerberosCredentials struct {
+	dir     string
+	mutex   sync.Mutex
+	volumes map[string]*kerberosVolume
+}
+
+func newKerberosCredentials(dir string) (*kerberosCredentials, error) {
+	if err := ensureKerberosDir(dir); err != nil {
+		return nil, err
+	}
+	k := &kerberosCredentials{dir: dir, volumes: map[string]*kerberosVolume{}}
+
+	volumeDirs, err := os.ReadDir(filepath.Join(dir, "volumes"))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range volumeDirs {
+		v, err := loadKerberosVolume(filepath.Join(dir, "volumes", d.Name()))
+		if err != nil {
+			klog.Warningf("failed to restore the Kerberos credentials in %s: %v", d.Name(), err)
+			continue
+		}
+		k.volumes[v.path] = v
+	}
+	if err := k.writeKeytab(); err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("restored the Kerberos credentials of %d volume(s) from %s", len(k.volumes), dir)
+	return k, nil
+}
+
+// ensureKerberosDir creates the directories and the configuration of
+// rpc.gssd, and an empty keytab if there is none.
+func ensureKerberosDir(dir string) error {
+	for _, d := range []string{"conf.d", "ccache", "volumes"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return err
+		}
+	}
+	conf := fmt.Sprintf("includedir %s\n", filepath.Join(dir, "conf.d"))
+	if err := writeFileAtomic(filepath.Join(dir, "krb5.conf"), []byte(conf), 0644); err != nil {
+		return err
+	}
+	keytab := filepath.Join(dir, "krb5.keytab")
+	if _, err := os.Stat(keytab); os.IsNotExist(err) {
+		return writeFileAtomic(keytab, keytabVersion, 0600)
+	}
+	return nil
+}
+
+func loadKerberosVolume(dir string) (*kerberosVolume, error) {
+	path, err := os.ReadFile(filepath.Join(dir, "path"))
+	if err != nil {
+		return nil, err
+	}
+	keytab, err := os.ReadFile(filepath.Join(dir, kerberosSecretKeytab))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseKeytab(keytab)
+	if err != nil {
+		return nil, err
+	}
+	krb5Conf, err := os.ReadFile(filepath.Join(dir, kerberosSecretKrb5Conf))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &kerberosVolume{path: string(path), entries: entries, krb5Conf: krb5Conf}, nil
+}
+
+// credentialsKey returns the name of the files of the volume mounted at path.
+func credentialsKey(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:16])
+}
+
+// install installs the credentials of the volume mounted at path from its
+// secrets, before it is mounted.
+func (k *kerberosCredentials) install(path string, secrets map[string]string) error {
+	entries, err := parseKeytab([]byte(secrets[kerberosSecretKeytab]))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid %s secret: %v", kerberosSecretKeytab, err)
+	}
+	if len(entries) == 0 {
+		return status.Errorf(codes.InvalidArgument, "the %s secret has no keys", kerberosSecretKeytab)
+	}
+	v := &kerberosVolume{path: path, entries: entries, krb5Conf: []byte(secrets[kerberosSecretKrb5Conf])}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	principals := v.principals()
+	for p, other := range k.volumes {
+		if p == path || sameKeys(other.entries, v.entries) {
+			continue
+		}
+		return status.Errorf(codes.FailedPrecondition, "the Kerberos volume mounted at %s on this node uses the keytab of %v, not of %v: the Kerberos volumes of a node must use the same keytab", p, other.principals(), principals)
+	}
+
+	key := credentialsKey(path)
+	volumeDir := filepath.Join(k.dir, "volumes", key)
+	if err := os.MkdirAll(volumeDir, 0700); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	files := map[string][]byte{
+		"path":                 []byte(path),
+		kerberosSecretKeytab:   []byte(secrets[kerberosSecretKeytab]),
+		kerberosSecretKrb5Conf: v.krb5Conf,
+	}
+	for name, content := range files {
+		if err := writeFileAtomic(filepath.Join(volumeDir, name), content, 0600); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(k.dir, "conf.d", key), v.krb5Conf, 0644); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	previous := k.volumes[path]
+	k.volumes[path] = v
+	if err := k.writeKeytab(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if previous != nil && !sameKeys(previous.entries, v.entries) {
+		// rotated keys are used once the machine credentials are obtained again
+		k.removeMachineCCaches(previous.principals())
+	}
+	klog.V(2).Infof("installed the Kerberos credentials of %v for %s", principals, path)
+	return nil
+}
+
+// uninstall removes the credentials of the volume mounted at path, and the
+// machine credentials of the realms no other volume uses.
+func (k *kerberosCredentials) uninstall(path string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	v, ok := k.volumes[path]
+	if !ok {
+		return nil
+	}
+	delete(k.volumes, path)
+	if err := k.writeKeytab(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	key := credentialsKey(path)
+	if err := os.RemoveAll(filepath.Join(k.dir, "volumes", key)); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := os.Remove(filepath.Join(k.dir, "conf.d", key)); err != nil && !os.IsNotExist(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	inUse := map[string]bool{}
+	for _, other := range k.volumes {
+		for realm := range other.principals() {
+			inUse[realm] = true
+		}
+	}
+	unused := map[string]string{}
+	for realm, p := range v.principals() {
+		if !inUse[realm] {
+			unused[realm] = p
+		}
+	}
+	k.removeMachineCCaches(unused)
+	klog.V(2).Infof("removed the Kerberos credentials of %s", path)
+	return nil
+}
+
+// writeKeytab writes the keytab of rpc.gssd with the keys of the volumes,
+// which are the same for all the volumes restored after a restart or
+// installed since. It must be called with the mutex held.
+func (k *kerberosCredentials) writeKeytab() error {
+	paths := make([]string, 0, len(k.volumes))
+	for p := range k.volumes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	keytab := append([]byte{}, keytabVersion...)
+	written := map[string]bool{}
+	for _, p := range paths {
+		for _, e := range k.volumes[p].entries {
+			if !written[string(e.raw)] {
+				written[string(e.raw)] = true
+				keytab = append(keytab, e.raw...)
+			}
+		}
+	}
+	return writeFileAtomic(filepath.Join(k.dir, "krb5.keytab"), keytab, 0600)
+}
+
+// removeMachineCCaches removes the machine credentials of the realms, so that
+// rpc.gssd obtains them again from the keytab.
+func (k *kerberosCredentials) removeMachineCCaches(realms map[string]string) {
+	for realm := range realms {
+		ccache := filepath.Join(k.dir, "ccache", machineCCachePrefix+realm)
+		if err := os.Remove(ccache); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("failed to remove the machine credentials of realm %s: %v", realm, err)
+		}
+	}
+}
+
+func sameKeys(a, b []keytabEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].raw, b[i].raw) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes a file through a temporary file renamed over it, so
+// that the daemons reading it, such as rpc.gssd, never read a partial file.
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// setupKerberos installs the Kerberos credentials from the secrets of a
+// volume mounted at path.
+func (ns *NodeServer) setupKerberos(path string, mountOptions []string, secrets map[string]string) error {
+	flavor, isKerberos := kerberosFlavor(mountOptions)
+	if _, ok := secrets[kerberosSecretKeytab]; !ok {
+		if isKerberos && ns.kerberos != nil {
+			return status.Errorf(codes.InvalidArgument, "sec=%s requires a %q in the node stage or publish secrets", flavor, kerberosSecretKeytab)
+		}
+		// the node may be configured for Kerberos by other means
+		return nil
+	}
+	if !isKerberos {
+		return status.Errorf(codes.InvalidArgument, "a %q secret requires the sec=krb5, krb5i or krb5p mount option", kerberosSecretKeytab)
+	}
+	if ns.kerberos == nil {
+		return status.Errorf(codes.FailedPrecondition, "Kerberos credentials from secrets are not enabled on node %s", ns.Driver.nodeID)
+	}
+	return ns.kerberos.install(path, secrets)
+}
+
+// cleanupKerberos removes the Kerberos credentials of a volume mounted at path.
+func (ns *NodeServer) cleanupKerberos(path string) error {
+	if ns.kerberos == nil {
+		return nil
+	}
+	return ns.kerberos.uninstall(path)
+}
+
+// cleanupKerberosAfterFailure removes the Kerberos credentials of a volume
+// which failed to mount at path, unless it was already mounted.
+func (ns *NodeServer) cleanupKerberosAfterFailure(path string) {
+	if ns.kerberos == nil {
+		return
+	}
+	if notMnt, err := ns.mounter.IsLikelyNotMountPoint(path); err == nil && !notMnt {
+		return
+	}
+	if err := ns.kerberos.uninstall(path); err != nil {
+		klog.Warningf("failed to remove the Kerberos credentials of %s: %v", path, err)
+	}
+}
+
+// KerberosDaemon prepares the directory of the Kerberos credentials of the
+// volumes and returns the rpc.gssd daemon using them.
+func KerberosDaemon(dir string) (supervisor.Daemon, error) {
+	if err := ensureKerberosDir(dir); err != nil {
+		return supervisor.Daemon{}, err
+	}
+	if err := os.MkdirAll(rpcPipefsPath, 0755); err != nil {
+		return supervisor.Daemon{}, err
+	}
+	mounter := mount.New("")
+	notMnt, err := mounter.IsLikelyNotMountPoint(rpcPipefsPath)
+	if err != nil {
+		return supervisor.Daemon{}, err
+	}
+	if notMnt {
+		if err := mounter.Mount("sunrpc", rpcPipefsPath, "rpc_pipefs", nil); err != nil {
+			return supervisor.Daemon{}, fmt.Errorf("failed to mount rpc_pipefs: %w", err)
+		}
+	}
+	return supervisor.GSSDaemon(filepath.Join(dir, "krb5.keytab"), filepath.Join(dir, "ccache"), filepath.Join(dir, "krb5.conf")), nil
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// buildKeytab returns a keytab with an aes256 key for each principal, with
+// the key derived from the principal and kvno.
+func buildKeytab(kvno byte, principals ...string) []byte {
+	keytab := append([]byte{}, keytabVersion...)
+	for _, p := range principals {
+		name, realm, _ := strings.Cut(p, "@")
+		components := strings.Split(name, "/")
+
+		var entry []byte
+		appendString := func(s string) {
+			entry = binary.BigEndian.AppendUint16(entry, uint16(len(s)))
+			entry = append(entry, s...)
+		}
+		entry = binary.BigEndian.AppendUint16(entry, uint16(len(components)))
+		appendString(realm)
+		for _, c := range components {
+			appendString(c)
+		}
+		entry = binary.BigEndian.AppendUint32(entry, 1) // KRB5_NT_PRINCIPAL
+		entry = binary.BigEndian.AppendUint32(entry, 0) // timestamp
+		entry = append(entry, kvno)
+		entry = binary.BigEndian.AppendUint16(entry, 18) // aes256-cts-hmac-sha1-96
+		appendString(strings.Repeat(string(kvno), 32))
+
+		keytab = binary.BigEndian.AppendUint32(keytab, uint32(len(entry)))
+		keytab = append(keytab, entry...)
+	}
+	return keytab
+}
+
+func TestParseKeytab(t *testing.T) {
+	keytab := buildKeytab(1, "nfs/client.example.com@EXAMPLE.COM", "svc@OTHER.ORG")
+	// a hole left by a deleted entry
+	withHole := append(append([]byte{}, keytab...), 0xff, 0xff, 0xff, 0xfc, 0, 0, 0, 0)
+
+	tests := []struct {
+		desc               string
+		keytab             []byte
+		expectedPrincipals []string
+		expectedErr        bool
+	}{
+		{
+			desc:               "two entries",
+			keytab:             keytab,
+			expectedPrincipals: []string{"nfs/client.example.com@EXAMPLE.COM", "svc@OTHER.ORG"},
+		},
+		{
+			desc:               "hole",
+			keytab:             withHole,
+			expectedPrincipals: []string{"nfs/client.example.com@EXAMPLE.COM", "svc@OTHER.ORG"},
+		},
+		{
+			desc:   "no entries",
+			keytab: keytabVersion,
+		},
+		{
+			desc:        "unsupported version",
+			keytab:      []byte{0x05, 0x01},
+			expectedErr: true,
+		},
+		{
+			desc:        "truncated entry",
+			keytab:      keytab[:len(keytab)-1],
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		entries, err := parseKeytab(test.keytab)
+		if test.expectedErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		var principals []string
+		for _, e := range entries {
+			principals = append(principals, e.principal)
+		}
+		assert.Equal(t, test.expectedPrincipals, principals, test.desc)
+	}
+}
+
+func TestKerberosFlavor(t *testing.T) {
+	tests := []struct {
+		mountOptions   []string
+		expectedFlavor string
+		expectedOK     bool
+	}{
+		{mountOptions: []string{"nfsvers=4.1", "sec=krb5p"}, expectedFlavor: "krb5p", expectedOK: true},
+		{mountOptions: []string{"hard,sec=sys:krb5i"}, expectedFlavor: "krb5i", expectedOK: true},
+		{mountOptions: []string{"sec=sys"}},
+		{mountOptions: nil},
+	}
+
+	for _, test := range tests {
+		flavor, ok := kerberosFlavor(test.mountOptions)
+		assert.Equal(t, test.expectedFlavor, flavor, "%v", test.mountOptions)
+		assert.Equal(t, test.expectedOK, ok, "%v", test.mountOptions)
+	}
+}
+
+func TestKerberosCredentials(t *testing.T) {
+	dir := t.TempDir()
+	k, err := newKerberosCredentials(dir)
+	assert.NoError(t, err)
+	keytabPath := filepath.Join(dir, "krb5.keytab")
+	readKeytab := func() []string {
+		keytab, err := os.ReadFile(keytabPath)
+		assert.NoError(t, err)
+		entries, err := parseKeytab(keytab)
+		assert.NoError(t, err)
+		var principals []string
+		for _, e := range entries {
+			principals = append(principals, e.principal)
+		}
+		return principals
+	}
+	assert.Empty(t, readKeytab())
+
+	secrets := map[string]string{
+		kerberosSecretKeytab:   string(buildKeytab(1, "nfs/client@EXAMPLE.COM")),
+		kerberosSecretKrb5Conf: "[realms]\nEXAMPLE.COM = {\n  kdc = kdc.example.com\n}\n",
+	}
+	assert.NoError(t, k.install("/staging/1", secrets))
+	assert.NoError(t, k.install("/staging/2", map[string]string{kerberosSecretKeytab: secrets[kerberosSecretKeytab]}))
+	assert.Equal(t, []string{"nfs/client@EXAMPLE.COM"}, readKeytab())
+	conf, err := os.ReadFile(filepath.Join(dir, "conf.d", credentialsKey("/staging/1")))
+	assert.NoError(t, err)
+	assert.Equal(t, secrets[kerberosSecretKrb5Conf], string(conf))
+
+	// another keytab than the one of the volumes of the node is refused
+	for _, keytab := range [][]byte{
+		buildKeytab(1, "nfs/other@EXAMPLE.COM"),
+		buildKeytab(1, "svc@OTHER.ORG"),
+		buildKeytab(1, "nfs/client@EXAMPLE.COM", "svc@OTHER.ORG"),
+		buildKeytab(2, "nfs/client@EXAMPLE.COM"),
+	} {
+		err = k.install("/staging/3", map[string]string{kerberosSecretKeytab: string(keytab)})
+		assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+	err = k.install("/staging/3", map[string]string{kerberosSecretKeytab: "not a keytab"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the credentials are restored after a restart
+	k, err = newKerberosCredentials(dir)
+	assert.NoError(t, err)
+	assert.Len(t, k.volumes, 2)
+
+	// the machine credentials are kept while a volume uses the realm
+	ccache := filepath.Join(dir, "ccache", machineCCachePrefix+"EXAMPLE.COM")
+	assert.NoError(t, os.WriteFile(ccache, nil, 0600))
+	assert.NoError(t, k.uninstall("/staging/1"))
+	assert.FileExists(t, ccache)
+	assert.NoFileExists(t, filepath.Join(dir, "conf.d", credentialsKey("/staging/1")))
+	assert.NoDirExists(t, filepath.Join(dir, "volumes", credentialsKey("/staging/1")))
+	assert.Equal(t, []string{"nfs/client@EXAMPLE.COM"}, readKeytab())
+
+	// rotated keys drop the machine credentials of their realm
+	assert.NoError(t, k.install("/staging/2", map[string]string{kerberosSecretKeytab: string(buildKeytab(2, "nfs/client@EXAMPLE.COM"))}))
+	assert.NoFileExists(t, ccache)
+
+	assert.NoError(t, os.WriteFile(ccache, nil, 0600))
+	assert.NoError(t, k.uninstall("/staging/2"))
+	assert.NoFileExists(t, ccache)
+	assert.Empty(t, readKeytab())
+	// unknown paths are ignored
+	assert.NoError(t, k.uninstall("/staging/2"))
+
+	// the node is free again for another keytab
+	assert.NoError(t, k.install("/staging/3", map[string]string{kerberosSecretKeytab: string(buildKeytab(1, "nfs/other@EXAMPLE.COM"))}))
+}
+
+func TestSetupKerberos(t *testing.T) {
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	keytab := map[string]string{kerberosSecretKeytab: string(buildKeytab(1, "nfs/client@EXAMPLE.COM"))}
+	krb5p := []string{"nfsvers=4.1", "sec=krb5p"}
+
+	// without Kerberos credentials from secrets, the node may be set up for
+	// Kerberos by other means
+	assert.NoError(t, ns.setupKerberos("/target", krb5p, nil))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(ns.setupKerberos("/target", krb5p, keytab)))
+
+	ns.kerberos, err = newKerberosCredentials(t.TempDir())
+	assert.NoError(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(ns.setupKerberos("/target", krb5p, nil)))
+	assert.Equal(t, codes.InvalidArgument, status.Code(ns.setupKerberos("/target", []string{"sec=sys"}, keytab)))
+	assert.NoError(t, ns.setupKerberos("/target", nil, nil))
+	assert.NoError(t, ns.setupKerberos("/target", krb5p, keytab))
+	assert.Contains(t, ns.kerberos.volumes, "/target")
+	assert.NoError(t, ns.cleanupKerberos("/target"))
+	assert.NotContains(t, ns.kerberos.volumes, "/target")
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/driverconfig"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListVolumes lists the volumes provisioned in the shares of the driver
+// configuration, from the metadata recorded in the shares, and the volumes published by the LB
+// controller, with the nodes they are published on. The volumes are sorted by
+// ID and the starting token is the index of the first volume returned.
+func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid max entries %d", req.GetMaxEntries())
+	}
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil || start < 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+
+	published := map[string][]string{}
+	if cs.LBController != nil {
+		var err error
+		if published, err = cs.LBController.PublishedNodes(); err != nil {
+			if errors.Is(err, lbcontroller.ErrNotSynced) {
+				return nil, status.Error(codes.Unavailable, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	ids := map[string]bool{}
+	for id := range published {
+		ids[id] = true
+	}
+	for i, share := range cs.Driver.shares() {
+		shareIDs, err := cs.listShareVolumes(ctx, i, share)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range shareIDs {
+			ids[id] = true
+		}
+	}
+	volumeIDs := make([]string, 0, len(ids))
+	for id := range ids {
+		volumeIDs = append(volumeIDs, id)
+	}
+	sort.Strings(volumeIDs)
+
+	if start > len(volumeIDs) {
+		return nil, status.Errorf(codes.Aborted, "starting token %q is past the %d volumes", req.GetStartingToken(), len(volumeIDs))
+	}
+	end := len(volumeIDs)
+	nextToken := ""
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && start+maxEntries < end {
+		end = start + maxEntries
+		nextToken = strconv.Itoa(end)
+	}
+
+	resp := &csi.ListVolumesResponse{NextToken: nextToken}
+	for _, id := range volumeIDs[start:end] {
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{VolumeId: id},
+			Status: &csi.ListVolumesResponse_VolumeStatus{PublishedNodeIds: published[id]},
+		})
+	}
+	return resp, nil
+}
+
+// listShareVolumes returns the IDs of the volumes provisioned in the i-th
+// share of the driver configuration, as recorded in their metadata. The
+// subdirectories without metadata, of the volumes provisioned before it was
+// recorded, of the archived volumes or of the snapshots, are skipped.
+func (cs *ControllerServer) listShareVolumes(ctx context.Context, i int, share *driverconfig.Share) ([]string, error) {
+	sharePath, unmount, err := cs.mountConfiguredShare(ctx, "list-volumes", i, share)
+	if err != nil {
+		return nil, err
+	}
+	defer unmount()
+
+	list, err := listVolumeMetadata(sharePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list the volumes of %s:%s: %v", share.Server, share.Share, err)
+	}
+	var ids []string
+	for _, metadata := range list {
+		if metadata.VolumeID != "" {
+			ids = append(ids, metadata.VolumeID)
+		}
+	}
+	return ids, nil
+}
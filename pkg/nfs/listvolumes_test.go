@@ -0,0 +1,205 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/driverconfig"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+const testSharesConfig = `
+shares:
+- server: test-server
+  share: /share1
+- server: test-server
+  share: /share2
+`
+
+// initTestListVolumesController returns a controller listing the shares of
+// testSharesConfig, with the volumes of the first share: pvc-a and pvc-b, and
+// of the second one: pvc-c, besides a volume without metadata, an archived
+// volume, a snapshot and files which are not metadata.
+func initTestListVolumesController(t *testing.T) *ControllerServer {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(testSharesConfig), 0600))
+	config, err := driverconfig.NewFile(path)
+	assert.NoError(t, err)
+
+	cs := initTestController(t)
+	cs.Driver.config = config
+	cs.Driver.workingMountDir = t.TempDir()
+	for _, dir := range []string{
+		"list-volumes-0/pvc-a",
+		"list-volumes-0/pvc-b",
+		"list-volumes-0/pvc-legacy",
+		"list-volumes-0/archived-pvc-x",
+		"list-volumes-0/snapshot-1",
+		"list-volumes-1/pvc-c",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(cs.Driver.workingMountDir, dir), 0750))
+	}
+	for i, id := range []string{
+		"test-server#share1#pvc-a##",
+		"test-server#share1#pvc-b##",
+		"test-server#share2#pvc-c##retain",
+	} {
+		writeTestVolumeMetadata(t, cs, fmt.Sprintf("list-volumes-%d", i/2), id)
+	}
+	for _, file := range []string{
+		"list-volumes-0/snapshot-1/pvc-a.tar.gz",
+		"list-volumes-0/file",
+		"list-volumes-0/.nfs-lb-csi/invalid.json",
+		"list-volumes-0/.nfs-lb-csi/pvc-x.json.tmp",
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(cs.Driver.workingMountDir, file), nil, 0600))
+	}
+	return cs
+}
+
+// writeTestVolumeMetadata records the metadata of a volume in the share
+// mounted at dir of the working mount directory of cs.
+func writeTestVolumeMetadata(t *testing.T, cs *ControllerServer, dir, volumeID string) {
+	vol, err := getNfsVolFromID(volumeID)
+	assert.NoError(t, err)
+	assert.NoError(t, writeVolumeMetadata(filepath.Join(cs.Driver.workingMountDir, dir), vol, &volumeMetadata{VolumeID: volumeID}))
+}
+
+func TestListVolumes(t *testing.T) {
+	volumeA := "test-server#share1#pvc-a##"
+	volumeB := "test-server#share1#pvc-b##"
+	volumeC := "test-server#share2#pvc-c##retain"
+
+	tests := []struct {
+		desc              string
+		req               *csi.ListVolumesRequest
+		expectedIDs       []string
+		expectedNextToken string
+		expectedCode      codes.Code
+	}{
+		{
+			desc:        "all volumes",
+			req:         &csi.ListVolumesRequest{},
+			expectedIDs: []string{volumeA, volumeB, volumeC},
+		},
+		{
+			desc:              "first page",
+			req:               &csi.ListVolumesRequest{MaxEntries: 2},
+			expectedIDs:       []string{volumeA, volumeB},
+			expectedNextToken: "2",
+		},
+		{
+			desc:        "last page",
+			req:         &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: "2"},
+			expectedIDs: []string{volumeC},
+		},
+		{
+			desc: "token past the volumes",
+			req:  &csi.ListVolumesRequest{StartingToken: "3"},
+		},
+		{
+			desc:         "invalid token",
+			req:          &csi.ListVolumesRequest{StartingToken: "next"},
+			expectedCode: codes.Aborted,
+		},
+		{
+			desc:         "token out of range",
+			req:          &csi.ListVolumesRequest{StartingToken: "4"},
+			expectedCode: codes.Aborted,
+		},
+		{
+			desc:         "negative max entries",
+			req:          &csi.ListVolumesRequest{MaxEntries: -1},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			cs := initTestListVolumesController(t)
+			resp, err := cs.ListVolumes(context.Background(), test.req)
+			if test.expectedCode != codes.OK {
+				assert.Equal(t, test.expectedCode, status.Code(err))
+				return
+			}
+			assert.NoError(t, err)
+			var ids []string
+			for _, entry := range resp.GetEntries() {
+				ids = append(ids, entry.GetVolume().GetVolumeId())
+			}
+			assert.Equal(t, test.expectedIDs, ids)
+			assert.Equal(t, test.expectedNextToken, resp.GetNextToken())
+			// the shares are unmounted once listed
+			assert.Empty(t, cs.provisioner.mounter.(*mount.FakeMounter).MountPoints)
+		})
+	}
+}
+
+func TestListVolumesPublishedNodes(t *testing.T) {
+	cs := initTestListVolumesController(t)
+	nodePool := lbcontroller.NewNodePool([]lbcontroller.TestNode{{Name: "node-1"}, {Name: "node-2"}})
+	cs.LBController = lbcontroller.NewFakeLBController(map[string]int{"10.0.0.1": 0}, nodePool)
+	ctx := context.Background()
+
+	staticVolume := "other-server#static###"
+	for _, p := range []struct{ node, volume string }{
+		{"node-1", "test-server#share1#pvc-a##"},
+		{"node-2", "test-server#share1#pvc-a##"},
+		{"node-1", staticVolume},
+	} {
+		_, err := cs.LBController.AssignIPToNode(ctx, p.node, p.volume)
+		assert.NoError(t, err)
+	}
+
+	resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	published := map[string][]string{}
+	for _, entry := range resp.GetEntries() {
+		published[entry.GetVolume().GetVolumeId()] = entry.GetStatus().GetPublishedNodeIds()
+	}
+	assert.Equal(t, map[string][]string{
+		"test-server#share1#pvc-a##":       {"node-1", "node-2"},
+		"test-server#share1#pvc-b##":       nil,
+		"test-server#share2#pvc-c##retain": nil,
+		staticVolume:                       {"node-1"},
+	}, published)
+}
+
+func TestListVolumesRecordedIDs(t *testing.T) {
+	cs := initTestListVolumesController(t)
+	// pvc-d was provisioned with a versioned ID, recorded in its metadata
+	volumeD := "v2:s=test-server#b=share1#d=pvc-d"
+	writeTestVolumeMetadata(t, cs, "list-volumes-0", volumeD)
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	var ids []string
+	for _, entry := range resp.GetEntries() {
+		ids = append(ids, entry.GetVolume().GetVolumeId())
+	}
+	assert.Equal(t, []string{"test-server#share1#pvc-a##", "test-server#share1#pvc-b##", "test-server#share2#pvc-c##retain", volumeD}, ids)
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/mountstats"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// mountCounters are the counters of a NFS mount the load is computed from.
+type mountCounters struct {
+	server string
+	bytes  uint64
+	ops    uint64
+}
+
+// loadReporter publishes the NFS load of the node, computed from the
+// mountstats counters between two reports, on the LoadAnnotation of the load
+// Lease of the node for the load-weighted strategy of the LB controller.
+type loadReporter struct {
+	clientset kubernetes.Interface
+	nodeName  string
+	namespace string
+	interval  time.Duration
+	// last are the counters of the previous report by NFS device, the bind
+	// mounts of a device share its counters
+	last   map[string]mountCounters
+	lastAt time.Time
+}
+
+func newLoadReporter(clientset kubernetes.Interface, nodeName, namespace string, interval time.Duration) *loadReporter {
+	return &loadReporter{
+		clientset: clientset,
+		nodeName:  nodeName,
+		namespace: namespace,
+		interval:  interval,
+	}
+}
+
+// readCounters returns the counters of the NFS mounts by device.
+func readCounters(mounts []mountstats.Mount) map[string]mountCounters {
+	counters := map[string]mountCounters{}
+	for _, m := range mounts {
+		if m.Stats == nil {
+			continue
+		}
+		if _, ok := counters[m.Device]; ok {
+			continue
+		}
+		server := mountstats.Server(m.Device)
+		if server == "" {
+			continue
+		}
+		c := mountCounters{server: server, bytes: m.Stats.Bytes.ServerRead + m.Stats.Bytes.ServerWrite}
+		for _, op := range m.Stats.Operations {
+			c.ops += op.Requests
+		}
+		counters[m.Device] = c
+	}
+	return counters
+}
+
+// computeLoad returns the load since the previous call, nil on the first call.
+func (r *loadReporter) computeLoad(mounts []mountstats.Mount, now time.Time) *lbcontroller.NodeLoad {
+	counters := readCounters(mounts)
+	last, lastAt := r.last, r.lastAt
+	r.last, r.lastAt = counters, now
+	if last == nil {
+		return nil
+	}
+
+	elapsed := now.Sub(lastAt).Seconds()
+	load := &lbcontroller.NodeLoad{
+		ReportedAt:      now.UTC().Truncate(time.Second),
+		IntervalSeconds: int64(r.interval.Seconds()),
+		Servers:         map[string]lbcontroller.ServerLoad{},
+	}
+	for device, c := range counters {
+		l := load.Servers[c.server]
+		l.Mounts++
+		// a device mounted since the last report, or mounted again and so
+		// with its counters reset, is reported from the next report on
+		if p, ok := last[device]; ok && elapsed > 0 && c.bytes >= p.bytes && c.ops >= p.ops {
+			l.BytesPerSecond += float64(c.bytes-p.bytes) / elapsed
+			l.OpsPerSecond += float64(c.ops-p.ops) / elapsed
+		}
+		load.Servers[c.server] = l
+	}
+	return load
+}
+
+// report publishes the load of the node since the previous report.
+func (r *loadReporter) report(ctx context.Context) error {
+	mounts, err := mountstats.ParseFile(mountStatsPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the NFS mount stats: %w", err)
+	}
+	load := r.computeLoad(mounts, time.Now())
+	if load == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(load)
+	if err != nil {
+		return err
+	}
+	if err := r.updateLease(ctx, string(value)); err != nil {
+		return fmt.Errorf("failed to publish the load of node %q: %w", r.nodeName, err)
+	}
+	klog.V(5).Infof("reported the load of node %q: %s", r.nodeName, value)
+	return nil
+}
+
+// updateLease sets the load of the node on its load Lease, created on the
+// first report. The Lease is owned by the node so that it is deleted along
+// with it.
+func (r *loadReporter) updateLease(ctx context.Context, value string) error {
+	leases := r.clientset.CoordinationV1().Leases(r.namespace)
+	name := lbcontroller.LoadLeaseName(r.nodeName)
+	renewTime := metav1.NewMicroTime(time.Now())
+	duration := int32(lbcontroller.StaleLoadReportIntervals * r.interval.Seconds())
+
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		node, err := r.clientset.CoreV1().Nodes().Get(ctx, r.nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       r.namespace,
+				Annotations:     map[string]string{lbcontroller.LoadAnnotation: value},
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "Node", Name: node.Name, UID: node.UID}},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &r.nodeName,
+				LeaseDurationSeconds: &duration,
+				RenewTime:            &renewTime,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	lease = lease.DeepCopy()
+	if lease.Annotations == nil {
+		lease.Annotations = map[string]string{}
+	}
+	lease.Annotations[lbcontroller.LoadAnnotation] = value
+	lease.Spec.HolderIdentity = &r.nodeName
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &renewTime
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return err
+}
+
+// run reports the load of the node every interval until ctx is done.
+func (r *loadReporter) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.report(ctx); err != nil {
+			klog.Warningf("failed to report the NFS load of the node: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/mountstats"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func nfsMount(device, mountPoint string, bytes, ops uint64) mountstats.Mount {
+	return mountstats.Mount{
+		Device:     device,
+		MountPoint: mountPoint,
+		FSType:     "nfs4",
+		Stats: &mountstats.NFSStats{
+			Bytes:      mountstats.Bytes{ServerRead: bytes / 2, ServerWrite: bytes - bytes/2},
+			Operations: []mountstats.Operation{{Name: "READ", Requests: ops / 2}, {Name: "WRITE", Requests: ops - ops/2}},
+		},
+	}
+}
+
+func TestComputeLoad(t *testing.T) {
+	r := newLoadReporter(nil, "node-1", "default", time.Minute)
+	now := time.Now()
+
+	// the first call has nothing to compare with
+	load := r.computeLoad([]mountstats.Mount{
+		nfsMount("10.0.0.1:/share", "/staging/1", 1000, 10),
+		{Device: "/dev/sda1", MountPoint: "/var/lib/kubelet", FSType: "ext4"},
+	}, now)
+	assert.Nil(t, load)
+
+	load = r.computeLoad([]mountstats.Mount{
+		nfsMount("10.0.0.1:/share", "/staging/1", 7000, 70),
+		// bind mounts share the counters of their device
+		nfsMount("10.0.0.1:/share", "/target/1", 7000, 70),
+		// a mount since the last report is counted from the next one
+		nfsMount("10.0.0.2:/share", "/staging/2", 5000, 5),
+		{Device: "/dev/sda1", MountPoint: "/var/lib/kubelet", FSType: "ext4"},
+	}, now.Add(time.Minute))
+	assert.Equal(t, &lbcontroller.NodeLoad{
+		ReportedAt:      now.Add(time.Minute).UTC().Truncate(time.Second),
+		IntervalSeconds: 60,
+		Servers: map[string]lbcontroller.ServerLoad{
+			"10.0.0.1": {Mounts: 1, BytesPerSecond: 100, OpsPerSecond: 1},
+			"10.0.0.2": {Mounts: 1},
+		},
+	}, load)
+
+	// counters reset by a remount are not reported
+	load = r.computeLoad([]mountstats.Mount{
+		nfsMount("10.0.0.1:/share", "/staging/1", 100, 1),
+		nfsMount("10.0.0.2:/share", "/staging/2", 11000, 65),
+	}, now.Add(2*time.Minute))
+	assert.Equal(t, map[string]lbcontroller.ServerLoad{
+		"10.0.0.1": {Mounts: 1},
+		"10.0.0.2": {Mounts: 1, BytesPerSecond: 100, OpsPerSecond: 1},
+	}, load.Servers)
+}
+
+func TestLoadReporterReport(t *testing.T) {
+	defer func(path string) { mountStatsPath = path }(mountStatsPath)
+	mountStatsPath = "../mountstats/testdata/mountstats-nfs4"
+
+	clientset := fake.NewSimpleClientset(lbcontroller.NewNode("node-1", "10.0.0.2"))
+	r := newLoadReporter(clientset, "node-1", "default", time.Minute)
+	ctx := context.Background()
+	leaseName := lbcontroller.LoadLeaseName("node-1")
+
+	// the Lease is created from the second report on
+	assert.NoError(t, r.report(ctx))
+	_, err := clientset.CoordinationV1().Leases("default").Get(ctx, leaseName, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, r.report(ctx))
+		lease, err := clientset.CoordinationV1().Leases("default").Get(ctx, leaseName, metav1.GetOptions{})
+		assert.NoError(t, err)
+		load, err := lbcontroller.ParseNodeLoad(lease.Annotations[lbcontroller.LoadAnnotation])
+		assert.NoError(t, err)
+		assert.Equal(t, int64(60), load.IntervalSeconds)
+		assert.Equal(t, map[string]lbcontroller.ServerLoad{"10.0.0.2": {Mounts: 1}}, load.Servers)
+		assert.Equal(t, "node-1", *lease.Spec.HolderIdentity)
+		assert.Equal(t, int32(180), *lease.Spec.LeaseDurationSeconds)
+		// the Lease is deleted along with the node
+		assert.Equal(t, "Node", lease.OwnerReferences[0].Kind)
+		assert.Equal(t, "node-1", lease.OwnerReferences[0].Name)
+	}
+
+	// the node is not written to
+	node, err := clientset.CoreV1().Nodes().Get(ctx, "node-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, node.Annotations, lbcontroller.LoadAnnotation)
+
+	// a node which does not exist fails the report
+	r = newLoadReporter(clientset, "missing", "default", time.Minute)
+	assert.NoError(t, r.report(ctx))
+	assert.Error(t, r.report(ctx))
+}
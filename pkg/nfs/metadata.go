@@ -0,0 +1,131 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+)
+
+// metadataDir is the directory of the metadata of the volumes in their
+// share, next to their subdirectories.
+const metadataDir = ".nfs-lb-csi"
+
+// volumeMetadata is what the controller records about a volume in its share.
+type volumeMetadata struct {
+	// VolumeID is the ID of the volume, in the format it was provisioned
+	// with.
+	VolumeID string `json:"volumeID,omitempty"`
+	// CapacityBytes is the capacity of the volume, as created or expanded.
+	CapacityBytes int64 `json:"capacityBytes"`
+	// MountProfile is the mount profile the volume is modified to use,
+	// overriding the one of its volume context.
+	MountProfile string `json:"mountProfile,omitempty"`
+	// OnDelete is the ondelete policy the volume is modified to use,
+	// overriding the one of its volume ID.
+	OnDelete string `json:"onDelete,omitempty"`
+}
+
+// metadataPath returns the file of the metadata of a volume in its share
+// mounted at sharePath, named after a hash of the volume ID: volumes of a
+// share may have the same subdirectory with other IDs, or a nested one.
+func metadataPath(sharePath string, vol *nfsVolume) string {
+	sum := sha256.Sum256([]byte(vol.id))
+	return filepath.Join(sharePath, metadataDir, hex.EncodeToString(sum[:16])+".json")
+}
+
+// listVolumeMetadata returns the metadata recorded in a share mounted at
+// sharePath, one per volume. The files which cannot be read are skipped.
+func listVolumeMetadata(sharePath string) ([]*volumeMetadata, error) {
+	entries, err := os.ReadDir(filepath.Join(sharePath, metadataDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*volumeMetadata
+	for _, e := range entries {
+		if !e.Type().IsRegular() || filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(sharePath, metadataDir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			klog.Warningf("failed to read the metadata in %s: %v", path, err)
+			continue
+		}
+		metadata := &volumeMetadata{}
+		if err := json.Unmarshal(data, metadata); err != nil {
+			klog.Warningf("invalid metadata in %s: %v", path, err)
+			continue
+		}
+		list = append(list, metadata)
+	}
+	return list, nil
+}
+
+// readVolumeMetadata returns the metadata of a volume in its share mounted at
+// sharePath, empty if none was recorded.
+func readVolumeMetadata(sharePath string, vol *nfsVolume) (*volumeMetadata, error) {
+	path := metadataPath(sharePath, vol)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &volumeMetadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata := &volumeMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("invalid metadata in %s: %v", path, err)
+	}
+	return metadata, nil
+}
+
+// writeVolumeMetadata records the metadata of a volume in its share mounted
+// at sharePath. The file is replaced atomically.
+func writeVolumeMetadata(sharePath string, vol *nfsVolume, metadata *volumeMetadata) error {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	path := metadataPath(sharePath, vol)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeVolumeMetadata removes the metadata of a volume from its share
+// mounted at sharePath.
+func removeVolumeMetadata(sharePath string, vol *nfsVolume) error {
+	if err := os.Remove(metadataPath(sharePath, vol)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
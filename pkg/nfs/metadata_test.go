@@ -0,0 +1,60 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeMetadataSameSubDir(t *testing.T) {
+	sharePath := t.TempDir()
+	// the volumes of the subDir parameter have the same subdirectory, or a
+	// nested one, with other IDs
+	ids := []string{
+		"v2:s=test-server#b=share#d=data#u=pv-1",
+		"v2:s=test-server#b=share#d=data#u=pv-2#o=retain",
+		"v2:s=test-server#b=share#d=data/nested#u=pv-3",
+	}
+	for i, id := range ids {
+		vol, err := getNfsVolFromID(id)
+		assert.NoError(t, err)
+		assert.NoError(t, writeVolumeMetadata(sharePath, vol, &volumeMetadata{VolumeID: id, CapacityBytes: int64(i + 1)}))
+		assert.Equal(t, filepath.Join(sharePath, metadataDir), filepath.Dir(metadataPath(sharePath, vol)))
+	}
+	for i, id := range ids {
+		vol, err := getNfsVolFromID(id)
+		assert.NoError(t, err)
+		metadata, err := readVolumeMetadata(sharePath, vol)
+		assert.NoError(t, err)
+		assert.Equal(t, &volumeMetadata{VolumeID: id, CapacityBytes: int64(i + 1)}, metadata)
+	}
+
+	// removing the metadata of a volume keeps the others
+	vol, err := getNfsVolFromID(ids[0])
+	assert.NoError(t, err)
+	assert.NoError(t, removeVolumeMetadata(sharePath, vol))
+	list, err := listVolumeMetadata(sharePath)
+	assert.NoError(t, err)
+	var listed []string
+	for _, metadata := range list {
+		listed = append(listed, metadata.VolumeID)
+	}
+	assert.ElementsMatch(t, ids[1:], listed)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/mountstats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "nfs_lb_csi"
+	metricsSubsystem = "mount"
+)
+
+// mountStatsPath is a variable so that tests can read a sample file instead.
+var mountStatsPath = mountstats.DefaultPath
+
+var (
+	volumeLabels    = []string{"volume_id", "staging_path", "server_ip"}
+	operationLabels = append(append([]string{}, volumeLabels...), "operation")
+
+	readBytesDesc = newMountDesc("read_bytes_total",
+		"Bytes read from the NFS server.", volumeLabels)
+	writeBytesDesc = newMountDesc("write_bytes_total",
+		"Bytes written to the NFS server.", volumeLabels)
+	transportSendsDesc = newMountDesc("transport_sends_total",
+		"RPC requests sent on the transport to the NFS server.", volumeLabels)
+	transportReceivesDesc = newMountDesc("transport_receives_total",
+		"RPC replies received on the transport from the NFS server.", volumeLabels)
+	transportConnectsDesc = newMountDesc("transport_connects_total",
+		"Connections made by the transport to the NFS server.", volumeLabels)
+	operationsDesc = newMountDesc("operations_total",
+		"NFS operations requested.", operationLabels)
+	retransmissionsDesc = newMountDesc("operation_retransmissions_total",
+		"NFS operations sent again because the server did not reply in time.", operationLabels)
+	majorTimeoutsDesc = newMountDesc("operation_major_timeouts_total",
+		"NFS operations which timed out after all their retransmissions.", operationLabels)
+	operationErrorsDesc = newMountDesc("operation_errors_total",
+		"NFS operations which completed with an error, from statvers 1.1 on.", operationLabels)
+	rttDesc = newMountDesc("operation_rtt_seconds_total",
+		"Cumulative time between sending NFS operations and receiving their replies.", operationLabels)
+	executeDesc = newMountDesc("operation_execute_seconds_total",
+		"Cumulative time between queueing NFS operations and completing them.", operationLabels)
+	operationSentBytesDesc = newMountDesc("operation_sent_bytes_total",
+		"Bytes sent for NFS operations, including RPC headers.", operationLabels)
+	operationReceivedBytesDesc = newMountDesc("operation_received_bytes_total",
+		"Bytes received for NFS operations, including RPC headers.", operationLabels)
+
+	startupMountsDesc = newMountDesc("startup_mounts",
+		"NFS mounts of the driver found at startup, by state: healthy, stale or reassigned to another IP.", []string{"state"})
+)
+
+func newMountDesc(name, help string, labels []string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, metricsSubsystem, name), help, labels, nil)
+}
+
+// mountStatsCollector exports the NFS client statistics of the volumes staged
+// on the node, read from mountstats on every scrape. The statistics are kept
+// per NFS mount, the bind mounts of the targets share the ones of their
+// staging path, so the series are labeled with the staging path.
+type mountStatsCollector struct {
+	ns *NodeServer
+}
+
+// newMetricsHandler returns the handler serving the metrics of the node server.
+func newMetricsHandler(ns *NodeServer) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&mountStatsCollector{ns: ns}, &startupMountsCollector{ns: ns})
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func (c *mountStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		readBytesDesc, writeBytesDesc,
+		transportSendsDesc, transportReceivesDesc, transportConnectsDesc,
+		operationsDesc, retransmissionsDesc, majorTimeoutsDesc, operationErrorsDesc,
+		rttDesc, executeDesc, operationSentBytesDesc, operationReceivedBytesDesc,
+	} {
+		ch <- d
+	}
+}
+
+func (c *mountStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	volumes := map[string]string{}
+	for _, v := range c.ns.stagedVolumes.list() {
+		volumes[v.stagingPath] = v.volumeID
+	}
+	if len(volumes) == 0 {
+		return
+	}
+
+	mounts, err := mountstats.ParseFile(mountStatsPath)
+	if err != nil {
+		klog.Errorf("failed to read the NFS mount stats from %s: %v", mountStatsPath, err)
+		return
+	}
+	for _, m := range mounts {
+		volumeID, ok := volumes[m.MountPoint]
+		if !ok || m.Stats == nil {
+			continue
+		}
+		collectMountStats(ch, m.Stats, volumeID, m.MountPoint, mountstats.Server(m.Device))
+	}
+}
+
+func collectMountStats(ch chan<- prometheus.Metric, stats *mountstats.NFSStats, labels ...string) {
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+
+	counter(readBytesDesc, float64(stats.Bytes.ServerRead), labels...)
+	counter(writeBytesDesc, float64(stats.Bytes.ServerWrite), labels...)
+	if t := stats.Transport; t != nil {
+		counter(transportSendsDesc, float64(t.Sends), labels...)
+		counter(transportReceivesDesc, float64(t.Receives), labels...)
+		counter(transportConnectsDesc, float64(t.Connects), labels...)
+	}
+	for _, op := range stats.Operations {
+		opLabels := append(append([]string{}, labels...), op.Name)
+		counter(operationsDesc, float64(op.Requests), opLabels...)
+		counter(retransmissionsDesc, float64(op.Retransmissions()), opLabels...)
+		counter(majorTimeoutsDesc, float64(op.MajorTimeouts), opLabels...)
+		counter(operationErrorsDesc, float64(op.Errors), opLabels...)
+		counter(rttDesc, op.RTT.Seconds(), opLabels...)
+		counter(executeDesc, op.ExecuteTime.Seconds(), opLabels...)
+		counter(operationSentBytesDesc, float64(op.BytesSent), opLabels...)
+		counter(operationReceivedBytesDesc, float64(op.BytesReceived), opLabels...)
+	}
+}
+
+// startupMountsCollector exports the number of mounts found at startup by
+// state, once the mounts are reconciled.
+type startupMountsCollector struct {
+	ns *NodeServer
+}
+
+func (c *startupMountsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- startupMountsDesc
+}
+
+func (c *startupMountsCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := c.ns.startupMounts.get()
+	if counts == nil {
+		return
+	}
+	for _, state := range mountStates {
+		ch <- prometheus.MustNewConstMetric(startupMountsDesc, prometheus.GaugeValue, float64(counts[state]), string(state))
+	}
+}
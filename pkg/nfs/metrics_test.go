@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const sampleStagingPath = "/var/lib/kubelet/plugins/kubernetes.io/csi/nfs.lb.csi.storage.gke.io/1a2b3c/globalmount"
+
+func TestMountStatsCollector(t *testing.T) {
+	defer func(path string) { mountStatsPath = path }(mountStatsPath)
+	mountStatsPath = "../mountstats/testdata/mountstats-nfs4"
+
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	c := &mountStatsCollector{ns: ns}
+
+	// mounts which are not staged volumes are not exported
+	assert.Equal(t, 0, testutil.CollectAndCount(c))
+
+	ns.stagedVolumes.stage(&stagedVolume{volumeID: "vol_1", stagingPath: sampleStagingPath})
+	labels := `server_ip="10.0.0.2",staging_path="` + sampleStagingPath + `",volume_id="vol_1"`
+	expected := `
+# HELP nfs_lb_csi_mount_read_bytes_total Bytes read from the NFS server.
+# TYPE nfs_lb_csi_mount_read_bytes_total counter
+nfs_lb_csi_mount_read_bytes_total{` + labels + `} 1.052672e+06
+# HELP nfs_lb_csi_mount_operation_retransmissions_total NFS operations sent again because the server did not reply in time.
+# TYPE nfs_lb_csi_mount_operation_retransmissions_total counter
+nfs_lb_csi_mount_operation_retransmissions_total{operation="COMMIT",` + labels + `} 0
+nfs_lb_csi_mount_operation_retransmissions_total{operation="GETATTR",` + labels + `} 1
+nfs_lb_csi_mount_operation_retransmissions_total{operation="NULL",` + labels + `} 0
+nfs_lb_csi_mount_operation_retransmissions_total{operation="OPEN",` + labels + `} 0
+nfs_lb_csi_mount_operation_retransmissions_total{operation="READ",` + labels + `} 2
+nfs_lb_csi_mount_operation_retransmissions_total{operation="WRITE",` + labels + `} 0
+# HELP nfs_lb_csi_mount_operation_rtt_seconds_total Cumulative time between sending NFS operations and receiving their replies.
+# TYPE nfs_lb_csi_mount_operation_rtt_seconds_total counter
+nfs_lb_csi_mount_operation_rtt_seconds_total{operation="COMMIT",` + labels + `} 0.008
+nfs_lb_csi_mount_operation_rtt_seconds_total{operation="GETATTR",` + labels + `} 0.5
+nfs_lb_csi_mount_operation_rtt_seconds_total{operation="NULL",` + labels + `} 0
+nfs_lb_csi_mount_operation_rtt_seconds_total{operation="OPEN",` + labels + `} 0.03
+nfs_lb_csi_mount_operation_rtt_seconds_total{operation="READ",` + labels + `} 2.048
+nfs_lb_csi_mount_operation_rtt_seconds_total{operation="WRITE",` + labels + `} 1.024
+`
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected),
+		"nfs_lb_csi_mount_read_bytes_total",
+		"nfs_lb_csi_mount_operation_retransmissions_total",
+		"nfs_lb_csi_mount_operation_rtt_seconds_total"))
+
+	// nothing is exported when mountstats cannot be read
+	mountStatsPath = "/does/not/exist"
+	assert.Equal(t, 0, testutil.CollectAndCount(c))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	defer func(path string) { mountStatsPath = path }(mountStatsPath)
+	mountStatsPath = "../mountstats/testdata/mountstats-nfs4"
+
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	ns.stagedVolumes.stage(&stagedVolume{volumeID: "vol_1", stagingPath: sampleStagingPath})
+
+	w := httptest.NewRecorder()
+	newMetricsHandler(ns).ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `nfs_lb_csi_mount_operations_total{operation="READ",server_ip="10.0.0.2"`)
+}
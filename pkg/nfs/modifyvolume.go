@@ -0,0 +1,322 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// the mutable parameters of a VolumeAttributesClass besides the mount
+	// profile and the ondelete policy
+	paramServerPool = "serverpool"
+	paramQuota      = "quota"
+	// publishContextMountProfile passes the mount profile of a modified
+	// volume to the nodes, overriding the one of its volume context
+	publishContextMountProfile = "mountProfile"
+)
+
+// volumeModification are the mutable parameters of a ControllerModifyVolume
+// request, empty if unchanged.
+type volumeModification struct {
+	mountProfile string
+	onDelete     string
+	quotaBytes   int64
+}
+
+// parseMutableParameters validates the mutable parameters of a
+// ControllerModifyVolume request.
+func (cs *ControllerServer) parseMutableParameters(vol *nfsVolume, parameters map[string]string) (*volumeModification, error) {
+	// the volumes provisioned before the server pool was recorded in their
+	// ID are in the server pool of the driver
+	serverPool := vol.serverPool
+	if serverPool == "" {
+		serverPool = cs.Driver.serverPool
+	}
+	m := &volumeModification{}
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case paramServerPool:
+			// moving a volume to another pool is not supported: the pool is
+			// part of the volume ID, its IPs are assigned by the controller
+			// of the pool and its data is on the servers of the pool. Only
+			// the current pool is accepted, so that a VolumeAttributesClass
+			// can name it.
+			if v != serverPool {
+				return nil, status.Errorf(codes.InvalidArgument, "moving volumes between server pools is not supported, volume is in server pool %q, not %q", serverPool, v)
+			}
+		case paramMountProfile:
+			if cs.Driver.config == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "mount profile %q is selected but the driver has no configuration", v)
+			}
+			if _, err := cs.Driver.config.Get().MountProfile(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			m.mountProfile = v
+		case paramOnDelete:
+			if err := validateOnDeleteValue(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			m.onDelete = v
+		case paramQuota:
+			q, err := resource.ParseQuantity(v)
+			if err != nil || q.Value() <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid quota %q, must be a positive quantity such as 10Gi", v)
+			}
+			if cs.Driver.quota == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "quota %q is set but the driver has no quota backend", v)
+			}
+			m.quotaBytes = q.Value()
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "parameter %q is not mutable", k)
+		}
+	}
+	return m, nil
+}
+
+// ControllerModifyVolume changes the mutable parameters of a volume, from
+// its VolumeAttributesClass: its quota is set right away, the mount profile
+// and ondelete policy are recorded in its metadata. The quota cannot shrink a
+// volume below its recorded capacity. The new mount profile applies to the
+// nodes the volume is published on next, it is passed in the publish context.
+func (cs *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerModifyVolume Volume ID must be provided")
+	}
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "invalid volume ID %s: %v", volumeID, err)
+	}
+	modification, err := cs.parseMutableParameters(nfsVol, req.GetMutableParameters())
+	if err != nil {
+		return nil, err
+	}
+
+	if acquired := cs.Driver.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer cs.Driver.volumeLocks.Release(volumeID)
+
+	sharePath, err := cs.internalMount(ctx, nfsVol, nil, nil)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, nfsVol, sharePath); err != nil {
+			klog.Warningf("failed to unmount nfs server: %v", err)
+		}
+	}()
+
+	internalVolumePath := getInternalVolumePath(sharePath, nfsVol)
+	if _, err := os.Stat(internalVolumePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat subdirectory %s: %v", internalVolumePath, err)
+	}
+	metadata, err := readVolumeMetadata(sharePath, nfsVol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read the metadata of volume %s: %v", volumeID, err)
+	}
+
+	if modification.quotaBytes > 0 {
+		if modification.quotaBytes < metadata.CapacityBytes {
+			return nil, status.Errorf(codes.OutOfRange, "volume %s cannot be shrunk from %d to %d bytes", volumeID, metadata.CapacityBytes, modification.quotaBytes)
+		}
+		if err := cs.Driver.quota.SetQuota(ctx, quotaVolume(nfsVol, internalVolumePath), modification.quotaBytes); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set the quota of volume %s: %v", volumeID, err)
+		}
+		metadata.CapacityBytes = modification.quotaBytes
+	}
+	if modification.mountProfile != "" && modification.mountProfile != metadata.MountProfile {
+		klog.V(2).Infof("volume %s uses mount profile %s from its next publication, the nodes it is staged on keep their mount until it is unstaged", volumeID, modification.mountProfile)
+		metadata.MountProfile = modification.mountProfile
+	}
+	if modification.onDelete != "" {
+		metadata.OnDelete = modification.onDelete
+	}
+	if err := cs.recordVolumeMetadata(sharePath, nfsVol, metadata); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record the metadata of volume %s: %v", volumeID, err)
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
+
+// metadataCache keeps the metadata of the volumes read or recorded by the
+// controller, so that publishing a volume does not read it from its share.
+type metadataCache struct {
+	mutex   sync.Mutex
+	volumes map[string]*volumeMetadata
+	// fetching are the volumes whose metadata is being read in the
+	// background
+	fetching map[string]bool
+}
+
+func newMetadataCache() *metadataCache {
+	return &metadataCache{volumes: map[string]*volumeMetadata{}, fetching: map[string]bool{}}
+}
+
+func (c *metadataCache) get(volumeID string) *volumeMetadata {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.volumes[volumeID]
+}
+
+func (c *metadataCache) set(volumeID string, metadata *volumeMetadata) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.volumes[volumeID] = metadata
+}
+
+func (c *metadataCache) forget(volumeID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.volumes, volumeID)
+}
+
+// startFetch returns false if the metadata of a volume is already being
+// fetched.
+func (c *metadataCache) startFetch(volumeID string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.fetching[volumeID] {
+		return false
+	}
+	c.fetching[volumeID] = true
+	return true
+}
+
+func (c *metadataCache) endFetch(volumeID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.fetching, volumeID)
+}
+
+// recordVolumeMetadata records the metadata of a volume in its share mounted
+// at sharePath, along with its ID, and caches it.
+func (cs *ControllerServer) recordVolumeMetadata(sharePath string, vol *nfsVolume, metadata *volumeMetadata) error {
+	metadata.VolumeID = vol.id
+	if err := writeVolumeMetadata(sharePath, vol, metadata); err != nil {
+		return err
+	}
+	cs.metadata.set(vol.id, metadata)
+	return nil
+}
+
+// forgetVolumeMetadata removes the metadata of a volume from its share
+// mounted at sharePath, and from the cache.
+func (cs *ControllerServer) forgetVolumeMetadata(sharePath string, vol *nfsVolume) error {
+	if err := removeVolumeMetadata(sharePath, vol); err != nil {
+		return err
+	}
+	cs.metadata.forget(vol.id)
+	return nil
+}
+
+// volumeMetadata returns the cached metadata of a volume, reading it from its
+// share if it is not cached.
+func (cs *ControllerServer) volumeMetadata(ctx context.Context, vol *nfsVolume, volCap *csi.VolumeCapability) (*volumeMetadata, error) {
+	if metadata := cs.metadata.get(vol.id); metadata != nil {
+		return metadata, nil
+	}
+	sharePath, err := cs.internalMount(ctx, vol, nil, volCap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount nfs server: %v", err)
+	}
+	defer func() {
+		if err := cs.internalUnmount(ctx, vol, sharePath); err != nil {
+			klog.Warningf("failed to unmount nfs server: %v", err)
+		}
+	}()
+	metadata, err := readVolumeMetadata(sharePath, vol)
+	if err != nil {
+		return nil, err
+	}
+	cs.metadata.set(vol.id, metadata)
+	return metadata, nil
+}
+
+// fetchVolumeMetadata reads the metadata of a volume into the cache in the
+// background. It is skipped while another operation holds the lock of the
+// volume, that operation caches the metadata itself.
+func (cs *ControllerServer) fetchVolumeMetadata(vol *nfsVolume) {
+	if !cs.metadata.startFetch(vol.id) {
+		return
+	}
+	go func() {
+		defer cs.metadata.endFetch(vol.id)
+		if acquired := cs.Driver.volumeLocks.TryAcquire(vol.id); !acquired {
+			return
+		}
+		defer cs.Driver.volumeLocks.Release(vol.id)
+		if _, err := cs.volumeMetadata(context.Background(), vol, nil); err != nil {
+			klog.Warningf("failed to read the metadata of volume %s: %v", vol.id, err)
+		}
+	}()
+}
+
+// modifiedPublishContext returns the publish context of the attributes of a
+// volume changed by ControllerModifyVolume, from the cached metadata of the
+// volume. Publishing a volume does not wait for the controller to reach its
+// server: a volume whose metadata is not cached yet, after a restart of the
+// controller, fails with Unavailable while its metadata is read in the
+// background, so that it is not published with a stale mount profile.
+func (cs *ControllerServer) modifiedPublishContext(volumeID string) (map[string]string, error) {
+	// only the volumes provisioned by the driver have metadata
+	if !isProvisionedVolumeID(volumeID) {
+		return nil, nil
+	}
+	nfsVol, err := getNfsVolFromID(volumeID)
+	if err != nil {
+		return nil, nil
+	}
+	metadata := cs.metadata.get(volumeID)
+	if metadata == nil {
+		cs.fetchVolumeMetadata(nfsVol)
+		return nil, status.Errorf(codes.Unavailable, "metadata of volume %s is being read", volumeID)
+	}
+	if metadata.MountProfile == "" {
+		return nil, nil
+	}
+	return map[string]string{publishContextMountProfile: metadata.MountProfile}, nil
+}
+
+// withModifiedAttributes returns the volume context of a volume with the
+// attributes changed by ControllerModifyVolume passed in its publish context.
+func withModifiedAttributes(volumeContext, publishContext map[string]string) map[string]string {
+	profile, ok := publishContext[publishContextMountProfile]
+	if !ok {
+		return volumeContext
+	}
+	modified := map[string]string{paramMountProfile: profile}
+	for k, v := range volumeContext {
+		if strings.ToLower(k) != paramMountProfile {
+			modified[k] = v
+		}
+	}
+	return modified
+}
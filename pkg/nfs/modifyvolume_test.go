@@ -0,0 +1,227 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/quota"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseMutableParameters(t *testing.T) {
+	tests := []struct {
+		desc                 string
+		parameters           map[string]string
+		noQuota              bool
+		expectedModification *volumeModification
+		expectedCode         codes.Code
+	}{
+		{
+			desc:                 "no parameters",
+			expectedModification: &volumeModification{},
+		},
+		{
+			desc: "all parameters",
+			parameters: map[string]string{
+				"serverPool":   "pool-a",
+				"mountProfile": "read-heavy",
+				"onDelete":     "retain",
+				"quota":        "10Gi",
+			},
+			expectedModification: &volumeModification{mountProfile: "read-heavy", onDelete: "retain", quotaBytes: 10 << 30},
+		},
+		{
+			desc:         "other server pool",
+			parameters:   map[string]string{"serverPool": "pool-b"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "unknown mount profile",
+			parameters:   map[string]string{"mountProfile": "write-heavy"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "invalid ondelete policy",
+			parameters:   map[string]string{"onDelete": "shred"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "invalid quota",
+			parameters:   map[string]string{"quota": "ten"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "zero quota",
+			parameters:   map[string]string{"quota": "0"},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "quota without backend",
+			parameters:   map[string]string{"quota": "10Gi"},
+			noQuota:      true,
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			desc:         "immutable parameter",
+			parameters:   map[string]string{"server": "other-server"},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			cs := initTestController(t)
+			cs.Driver.serverPool = "pool-a"
+			cs.Driver.config = newTestDriverConfig(t)
+			if !test.noQuota {
+				cs.Driver.quota = quota.NewFake()
+			}
+			modification, err := cs.parseMutableParameters(&nfsVolume{}, test.parameters)
+			assert.Equal(t, test.expectedCode, status.Code(err))
+			assert.Equal(t, test.expectedModification, modification)
+		})
+	}
+}
+
+func TestControllerModifyVolume(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	cs.Driver.config = newTestDriverConfig(t)
+	backend := quota.NewFake()
+	cs.Driver.quota = backend
+	cs.LBController = lbcontroller.NewFakeLBController(map[string]int{"10.0.0.1": 0}, lbcontroller.NewNodePool([]lbcontroller.TestNode{{Name: "node-1"}}))
+	ctx := context.Background()
+
+	created, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "pvc-a",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{paramServer: testServer, paramShare: testBaseDir},
+	})
+	assert.NoError(t, err)
+	volumeID := created.GetVolume().GetVolumeId()
+	nfsVol, err := getNfsVolFromID(volumeID)
+	assert.NoError(t, err)
+	sharePath := filepath.Join(cs.Driver.workingMountDir, nfsVol.subDir)
+
+	_, err = cs.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{"mountProfile": "read-heavy", "onDelete": "retain", "quota": "2Gi"},
+	})
+	assert.NoError(t, err)
+	metadata, err := readVolumeMetadata(sharePath, nfsVol)
+	assert.NoError(t, err)
+	assert.Equal(t, &volumeMetadata{VolumeID: volumeID, CapacityBytes: 2 << 30, MountProfile: "read-heavy", OnDelete: "retain"}, metadata)
+	bytes, _ := backend.Get(volumeID)
+	assert.Equal(t, int64(2<<30), bytes)
+
+	// the quota cannot shrink the volume
+	_, err = cs.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          volumeID,
+		MutableParameters: map[string]string{"quota": "1Gi"},
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	bytes, _ = backend.Get(volumeID)
+	assert.Equal(t, int64(2<<30), bytes)
+
+	// the nodes mount the volume with its new mount profile
+	publishReq := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "node-1",
+		VolumeCapability: &csi.VolumeCapability{},
+	}
+	published, err := cs.ControllerPublishVolume(ctx, publishReq)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{lbcontroller.NodeAnnotation: "10.0.0.1", publishContextMountProfile: "read-heavy"}, published.GetPublishContext())
+
+	// without cached metadata the volume is not published with a stale mount
+	// profile, the CO retries while its metadata is read in the background
+	cs.metadata.forget(volumeID)
+	_, err = cs.ControllerPublishVolume(ctx, publishReq)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Eventually(t, func() bool { return cs.metadata.get(volumeID) != nil }, 5*time.Second, 10*time.Millisecond)
+	published, err = cs.ControllerPublishVolume(ctx, publishReq)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{lbcontroller.NodeAnnotation: "10.0.0.1", publishContextMountProfile: "read-heavy"}, published.GetPublishContext())
+
+	// the volume is retained by its new ondelete policy, read from its
+	// metadata in the share rather than from the cache, and is no longer
+	// listed
+	cs.metadata.forget(volumeID)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.NoError(t, err)
+	_, err = os.Stat(getInternalVolumePath(sharePath, nfsVol))
+	assert.NoError(t, err)
+	list, err := listVolumeMetadata(sharePath)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+
+	// a volume whose metadata cannot be read is not deleted
+	assert.NoError(t, os.WriteFile(metadataPath(sharePath, nfsVol), []byte("{"), 0644))
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = os.Stat(getInternalVolumePath(sharePath, nfsVol))
+	assert.NoError(t, err)
+
+	_, err = cs.ControllerModifyVolume(ctx, &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "test-server#test-base-dir#pvc-b##",
+		MutableParameters: map[string]string{"onDelete": "retain"},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestWithModifiedAttributes(t *testing.T) {
+	tests := []struct {
+		desc            string
+		volumeContext   map[string]string
+		publishContext  map[string]string
+		expectedContext map[string]string
+	}{
+		{
+			desc:            "unmodified",
+			volumeContext:   map[string]string{paramShare: "/share", "mountProfile": "read-heavy"},
+			publishContext:  map[string]string{lbcontroller.NodeAnnotation: "10.0.0.1"},
+			expectedContext: map[string]string{paramShare: "/share", "mountProfile": "read-heavy"},
+		},
+		{
+			desc:            "modified mount profile",
+			volumeContext:   map[string]string{paramShare: "/share", "mountProfile": "read-heavy"},
+			publishContext:  map[string]string{lbcontroller.NodeAnnotation: "10.0.0.1", publishContextMountProfile: "unsafe"},
+			expectedContext: map[string]string{paramShare: "/share", paramMountProfile: "unsafe"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			assert.Equal(t, test.expectedContext, withModifiedAttributes(test.volumeContext, test.publishContext))
+		})
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+var (
+	// mountCommand is the mount binary, a fake one in tests
+	mountCommand = "mount"
+	// mountWaitDelay is how long the output of a killed mount is waited for,
+	// in case a process of its group is stuck in the kernel
+	mountWaitDelay = 5 * time.Second
+)
+
+// mountFunc mounts source on target and returns once the mount completes or
+// ctx is done.
+type mountFunc func(ctx context.Context, source, target, fstype string, options []string) error
+
+// newMountFunc returns the mount function of a mounter. The mount command of
+// the real mounter is killed when ctx is done, other mounters, such as the
+// native mounter or the fake ones of tests, are left running in the
+// background.
+func newMountFunc(mounter mount.Interface) mountFunc {
+	if _, ok := mounter.(*mount.Mounter); ok {
+		return execMount
+	}
+	return func(ctx context.Context, source, target, fstype string, options []string) error {
+		done := make(chan error, 1)
+		go func() {
+			done <- mounter.Mount(source, target, fstype, options)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// execMount runs mount in its own process group, which is killed when ctx is
+// done so that a mount.nfs helper blocked on an unreachable server does not
+// outlive it. A mount completing while it is killed is found mounted on the
+// next attempt.
+func execMount(ctx context.Context, source, target, fstype string, options []string) error {
+	args := []string{"-t", fstype}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	args = append(args, source, target)
+
+	cmd := exec.CommandContext(ctx, mountCommand, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		klog.Warningf("killing mount of %s on %s (PID %d): %v", source, target, cmd.Process.Pid, ctx.Err())
+		// the negative PID signals the process group
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = mountWaitDelay
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	klog.V(4).Infof("Mounting cmd (%s) with arguments (%s)", mountCommand, args)
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("mount failed: %v\nMounting command: %s\nMounting arguments: %s\nOutput: %s",
+			err, mountCommand, strings.Join(args, " "), output.String())
+	}
+	return nil
+}
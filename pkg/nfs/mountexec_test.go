@@ -0,0 +1,192 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setMountCommand makes execMount run a shell script instead of mount, the
+// arguments of mount are written to args in dir.
+func setMountCommand(t *testing.T, dir, script string) {
+	file := filepath.Join(dir, "mount")
+	assert.NoError(t, os.WriteFile(file, []byte("#!/bin/sh\necho \"$@\" > "+filepath.Join(dir, "args")+"\n"+script), 0700))
+	origMountCommand := mountCommand
+	mountCommand = file
+	t.Cleanup(func() { mountCommand = origMountCommand })
+}
+
+func TestExecMount(t *testing.T) {
+	tests := []struct {
+		desc        string
+		script      string
+		options     []string
+		expectedErr string
+		expectArgs  string
+	}{
+		{
+			desc:       "[Success] Mount with options",
+			script:     "exit 0",
+			options:    []string{"vers=4.1", "hard"},
+			expectArgs: "-t nfs -o vers=4.1,hard 1.2.3.4:/share /target",
+		},
+		{
+			desc:       "[Success] Mount without options",
+			script:     "exit 0",
+			expectArgs: "-t nfs 1.2.3.4:/share /target",
+		},
+		{
+			desc:        "[Error] Mount failed",
+			script:      "echo 'mount.nfs: access denied by server' >&2\nexit 32",
+			expectedErr: "mount failed: exit status 32",
+			expectArgs:  "-t nfs 1.2.3.4:/share /target",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			setMountCommand(t, dir, test.script)
+			err := execMount(context.Background(), "1.2.3.4:/share", "/target", "nfs", test.options)
+			if test.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.expectedErr)
+				assert.ErrorContains(t, err, "access denied by server")
+			}
+			args, err := os.ReadFile(filepath.Join(dir, "args"))
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectArgs, strings.TrimSpace(string(args)))
+		})
+	}
+}
+
+func TestExecMountKilled(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "pid")
+	// the helper stands for mount.nfs blocked on an unreachable server
+	setMountCommand(t, dir, "sleep 60 &\necho $! > "+pidFile+"\nwait")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := execMount(ctx, "1.2.3.4:/share", "/target", "nfs", nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), mountWaitDelay)
+
+	data, err := os.ReadFile(pidFile)
+	assert.NoError(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return processGone(pid)
+	}, 5*time.Second, 10*time.Millisecond, "the helper of the killed mount is still running")
+}
+
+// processGone returns true if the process has exited, possibly waiting to be
+// reaped by init.
+func processGone(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	// the state follows the command name in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestMountNFSTimeout(t *testing.T) {
+	blockingMount := func(ctx context.Context, _, _, _ string, _ []string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	tests := []struct {
+		desc         string
+		mountTimeout time.Duration
+		ctxTimeout   time.Duration
+		mount        mountFunc
+		expectedCode codes.Code
+	}{
+		{
+			desc:         "[Success] Mount within the timeout",
+			mountTimeout: time.Minute,
+			mount: func(_ context.Context, _, _, _ string, _ []string) error {
+				return nil
+			},
+			expectedCode: codes.OK,
+		},
+		{
+			desc:         "[Error] Mount timeout expired",
+			mountTimeout: 50 * time.Millisecond,
+			mount:        blockingMount,
+			expectedCode: codes.Unavailable,
+		},
+		{
+			desc:         "[Error] Request deadline exceeded before the mount timeout",
+			mountTimeout: time.Minute,
+			ctxTimeout:   50 * time.Millisecond,
+			mount:        blockingMount,
+			expectedCode: codes.DeadlineExceeded,
+		},
+		{
+			desc:         "[Error] Request deadline exceeded without mount timeout",
+			ctxTimeout:   50 * time.Millisecond,
+			mount:        blockingMount,
+			expectedCode: codes.DeadlineExceeded,
+		},
+		{
+			desc:         "[Error] Mount failed before the timeout",
+			mountTimeout: time.Minute,
+			mount: func(_ context.Context, _, _, _ string, _ []string) error {
+				return errors.New("mount failed: exit status 32")
+			},
+			expectedCode: codes.Internal,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ns, err := getTestNodeServer()
+			assert.NoError(t, err)
+			ns.Driver.mountTimeout = test.mountTimeout
+			ns.mount = test.mount
+			ctx := context.Background()
+			if test.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.ctxTimeout)
+				defer cancel()
+			}
+			err = ns.mountNFS(ctx, "vol", "1.2.3.4:/share", filepath.Join(t.TempDir(), "target"), nil, 0)
+			assert.Equal(t, test.expectedCode, status.Code(err), "%v", err)
+		})
+	}
+}
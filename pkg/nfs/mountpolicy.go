@@ -0,0 +1,72 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/driverconfig"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// the storage class parameters and volume attributes selecting the mount
+	// profile and policy of the driver configuration
+	paramMountProfile = "mountprofile"
+	paramMountPolicy  = "mountpolicy"
+)
+
+// resolveMountOptions returns the mount options of a volume expanded with the
+// mount profile with the given name, if any, once checked against the mount
+// policy with the given name, or the default one if empty, and with the
+// defaults of the policy. The configuration is read on every call, so that
+// its changes apply to the next mount.
+func (n *Driver) resolveMountOptions(profile, policy string, mountOptions []string) ([]string, error) {
+	if n.config == nil {
+		if profile != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "mount profile %q is selected but the driver has no configuration", profile)
+		}
+		if policy != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "mount policy %q is selected but the driver has no configuration", policy)
+		}
+		return mountOptions, nil
+	}
+	config := n.config.Get()
+
+	if profile != "" {
+		p, err := config.MountProfile(profile)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		mountOptions = p.Expand(mountOptions)
+	}
+
+	p, err := config.MountPolicy(policy)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if p == nil {
+		return mountOptions, nil
+	}
+	options, err := p.Apply(mountOptions)
+	if err != nil {
+		if policy == "" {
+			policy = driverconfig.DefaultMountPolicy
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "mount policy %q: %v", policy, err)
+	}
+	return options, nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/driverconfig"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testDriverConfig = `
+mountPolicies:
+  default:
+    denied: [soft, nolock]
+    defaults: [hard]
+  strict:
+    allowed: [vers, hard]
+    required: [vers]
+mountProfiles:
+  read-heavy:
+    mountOptions: [vers=3, nconnect=16, read_ahead_kb=15360]
+  unsafe:
+    mountOptions: [soft]
+`
+
+func newTestDriverConfig(t *testing.T) *driverconfig.File {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(testDriverConfig), 0600))
+	config, err := driverconfig.NewFile(path)
+	assert.NoError(t, err)
+	return config
+}
+
+func TestParseVolumeContextMountOptions(t *testing.T) {
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		desc            string
+		config          bool
+		volumeContext   map[string]string
+		mountOptions    []string
+		expectedOptions []string
+		expectedErr     error
+	}{
+		{
+			desc:            "no driver configuration",
+			volumeContext:   map[string]string{paramShare: "/share"},
+			mountOptions:    []string{"soft"},
+			expectedOptions: []string{"soft"},
+		},
+		{
+			desc:          "policy selected without driver configuration",
+			volumeContext: map[string]string{paramShare: "/share", "mountPolicy": "strict"},
+			expectedErr:   status.Error(codes.InvalidArgument, `mount policy "strict" is selected but the driver has no configuration`),
+		},
+		{
+			desc:            "default policy",
+			config:          true,
+			volumeContext:   map[string]string{paramShare: "/share", mountOptionsField: "vers=3"},
+			mountOptions:    []string{"nconnect=8"},
+			expectedOptions: []string{"nconnect=8", "vers=3", "hard"},
+		},
+		{
+			desc:          "denied by the default policy",
+			config:        true,
+			volumeContext: map[string]string{paramShare: "/share", mountOptionsField: "vers=3,nolock"},
+			expectedErr:   status.Error(codes.InvalidArgument, `mount policy "default": mount option "nolock" is denied`),
+		},
+		{
+			desc:          "selected policy",
+			config:        true,
+			volumeContext: map[string]string{paramShare: "/share", "mountPolicy": "strict"},
+			mountOptions:  []string{"hard"},
+			expectedErr:   status.Error(codes.InvalidArgument, `mount policy "strict": mount option "vers" is required`),
+		},
+		{
+			desc:          "unknown policy",
+			config:        true,
+			volumeContext: map[string]string{paramShare: "/share", "mountPolicy": "lax"},
+			expectedErr:   status.Error(codes.InvalidArgument, `unknown mount policy "lax"`),
+		},
+		{
+			desc:            "profile",
+			config:          true,
+			volumeContext:   map[string]string{paramShare: "/share", "mountProfile": "read-heavy"},
+			mountOptions:    []string{"nconnect=4"},
+			expectedOptions: []string{"nconnect=4", "vers=3", "read_ahead_kb=15360", "hard"},
+		},
+		{
+			desc:          "profile checked against the policy",
+			config:        true,
+			volumeContext: map[string]string{paramShare: "/share", "mountProfile": "unsafe"},
+			expectedErr:   status.Error(codes.InvalidArgument, `mount policy "default": mount option "soft" is denied`),
+		},
+		{
+			desc:          "unknown profile",
+			config:        true,
+			volumeContext: map[string]string{paramShare: "/share", "mountProfile": "write-heavy"},
+			expectedErr:   status.Error(codes.InvalidArgument, `unknown mount profile "write-heavy"`),
+		},
+		{
+			desc:          "profile selected without driver configuration",
+			volumeContext: map[string]string{paramShare: "/share", "mountProfile": "read-heavy"},
+			expectedErr:   status.Error(codes.InvalidArgument, `mount profile "read-heavy" is selected but the driver has no configuration`),
+		},
+	}
+
+	for _, test := range tests {
+		ns.Driver.config = nil
+		if test.config {
+			ns.Driver.config = newTestDriverConfig(t)
+		}
+		params, err := ns.Driver.parseVolumeContext(test.volumeContext, test.mountOptions)
+		assert.Equal(t, test.expectedErr, err, test.desc)
+		if err == nil {
+			assert.Equal(t, test.expectedOptions, params.mountOptions, test.desc)
+		}
+	}
+}
+
+func TestCreateVolumeMountPolicy(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.config = newTestDriverConfig(t)
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "volume-name",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=4.1", "nconnect=16"}},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			},
+		},
+		Parameters: map[string]string{
+			paramServer:   "nfs-server.default.svc.cluster.local",
+			paramShare:    "share",
+			"mountPolicy": "strict",
+		},
+	})
+	assert.Equal(t, status.Error(codes.InvalidArgument, `mount policy "strict": mount option "nconnect=16" is not allowed, the allowed options are hard, vers`), err)
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// nativeMountVersions are the NFS versions tried in order when a mount does
+// not set one, as mount.nfs does.
+var nativeMountVersions = []string{"4.2", "4.1", "4.0", "3"}
+
+// mountFlagOptions are the options passed to mount(2) as flags, the ones
+// clearing a flag have a zero set value.
+var mountFlagOptions = map[string]struct{ set, clear uintptr }{
+	"ro":          {set: unix.MS_RDONLY},
+	"rw":          {clear: unix.MS_RDONLY},
+	"nosuid":      {set: unix.MS_NOSUID},
+	"suid":        {clear: unix.MS_NOSUID},
+	"nodev":       {set: unix.MS_NODEV},
+	"dev":         {clear: unix.MS_NODEV},
+	"noexec":      {set: unix.MS_NOEXEC},
+	"exec":        {clear: unix.MS_NOEXEC},
+	"sync":        {set: unix.MS_SYNCHRONOUS},
+	"async":       {clear: unix.MS_SYNCHRONOUS},
+	"dirsync":     {set: unix.MS_DIRSYNC},
+	"noatime":     {set: unix.MS_NOATIME},
+	"atime":       {clear: unix.MS_NOATIME},
+	"nodiratime":  {set: unix.MS_NODIRATIME},
+	"diratime":    {clear: unix.MS_NODIRATIME},
+	"relatime":    {set: unix.MS_RELATIME},
+	"norelatime":  {clear: unix.MS_RELATIME},
+	"strictatime": {set: unix.MS_STRICTATIME},
+	"lazytime":    {set: unix.MS_LAZYTIME},
+	"nolazytime":  {clear: unix.MS_LAZYTIME},
+}
+
+// helperOnlyOptions are handled by mount or mount.nfs and not passed to the
+// kernel.
+var helperOnlyOptions = map[string]bool{
+	"defaults": true, "auto": true, "noauto": true, "_netdev": true, "nofail": true,
+	"user": true, "nouser": true, "users": true, "owner": true, "group": true,
+	"bg": true, "fg": true, "retry": true, "sloppy": true, "comment": true,
+}
+
+// nativeMount is a mount(2) call of an NFS share.
+type nativeMount struct {
+	source string
+	fstype string
+	flags  uintptr
+	data   string
+}
+
+// buildNativeMount returns the mount(2) call of the NFS share at source with
+// the mount options of mount.nfs, with the addr and clientaddr options
+// mount.nfs adds. version is used if the options do not set one.
+func buildNativeMount(source string, options []string, version string, serverIP, clientIP net.IP) (*nativeMount, error) {
+	if i := strings.LastIndex(source, ":/"); i <= 0 {
+		return nil, fmt.Errorf("invalid NFS source %q, must be server:/path", source)
+	}
+
+	m := &nativeMount{source: source}
+	var data []string
+	var hasAddr, hasClientAddr bool
+	for _, opt := range options {
+		for _, o := range strings.Split(opt, ",") {
+			if o = strings.TrimSpace(o); o == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(o, "=")
+			if f, ok := mountFlagOptions[name]; ok {
+				m.flags = m.flags&^f.clear | f.set
+				continue
+			}
+			switch {
+			case helperOnlyOptions[name] || strings.HasPrefix(name, "x-"):
+				continue
+			case name == "bind" || name == "rbind" || name == "remount":
+				return nil, fmt.Errorf("mount option %q is not supported by the native mounter", o)
+			case name == "vers" || name == "nfsvers":
+				version = value
+				continue
+			case name == "addr":
+				hasAddr = true
+			case name == "clientaddr":
+				hasClientAddr = true
+			}
+			data = append(data, o)
+		}
+	}
+
+	switch {
+	case version == "2" || version == "3":
+		m.fstype = "nfs"
+	case version == "4" || strings.HasPrefix(version, "4."):
+		m.fstype = "nfs4"
+	default:
+		return nil, fmt.Errorf("unsupported NFS version %q", version)
+	}
+	data = append([]string{"vers=" + version}, data...)
+	if !hasAddr {
+		data = append(data, "addr="+serverIP.String())
+	}
+	if m.fstype == "nfs4" && !hasClientAddr && clientIP != nil {
+		data = append(data, "clientaddr="+clientIP.String())
+	}
+	m.data = strings.Join(data, ",")
+	return m, nil
+}
+
+// nativeMounter mounts NFS shares with mount(2) instead of the mount.nfs
+// helper, and leaves the other mounts, such as bind mounts, and the unmounts
+// to the mounter it wraps. A mount(2) blocked on an unreachable server cannot
+// be killed, it returns once the kernel gives up on the server.
+type nativeMounter struct {
+	mount.Interface
+	// resolve returns the IPs of the NFS server
+	resolve func(ctx context.Context, host string) ([]net.IP, error)
+	// clientAddr returns the local IP used to reach the NFS server
+	clientAddr func(server net.IP) (net.IP, error)
+	// mount is mount(2)
+	mount func(source, target, fstype string, flags uintptr, data string) error
+}
+
+func newNativeMounter(mounter mount.Interface) *nativeMounter {
+	return &nativeMounter{
+		Interface: mounter,
+		resolve: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		clientAddr: localAddrTo,
+		mount:      unix.Mount,
+	}
+}
+
+// localAddrTo returns the local IP of the route to server. No packet is sent
+// by connecting a UDP socket.
+func localAddrTo(server net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(server.String(), nfsServerPort))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// UnmountWithForce force unmounts target with the wrapped mounter, if it
+// supports it.
+func (m *nativeMounter) UnmountWithForce(target string, umountTimeout time.Duration) error {
+	if f, ok := m.Interface.(mount.MounterForceUnmounter); ok {
+		return f.UnmountWithForce(target, umountTimeout)
+	}
+	return m.Interface.Unmount(target)
+}
+
+func (m *nativeMounter) Mount(source, target, fstype string, options []string) error {
+	return m.MountSensitive(source, target, fstype, options, nil)
+}
+
+func (m *nativeMounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	if fstype != "nfs" && fstype != "nfs4" {
+		return m.Interface.MountSensitive(source, target, fstype, options, sensitiveOptions)
+	}
+	return m.mountNFS(source, target, fstype, append(append([]string{}, options...), sensitiveOptions...))
+}
+
+func (m *nativeMounter) MountSensitiveWithoutSystemd(source, target, fstype string, options, sensitiveOptions []string) error {
+	return m.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+func (m *nativeMounter) MountSensitiveWithoutSystemdWithMountFlags(source, target, fstype string, options, sensitiveOptions, mountFlags []string) error {
+	if fstype != "nfs" && fstype != "nfs4" {
+		return m.Interface.MountSensitiveWithoutSystemdWithMountFlags(source, target, fstype, options, sensitiveOptions, mountFlags)
+	}
+	return m.MountSensitive(source, target, fstype, append(append([]string{}, options...), mountFlags...), sensitiveOptions)
+}
+
+// mountNFS resolves the NFS server and mounts the share, trying the NFS
+// versions in order until the server supports one if the options do not set
+// any.
+func (m *nativeMounter) mountNFS(source, target, fstype string, options []string) error {
+	host, ok := getServerFromMountSource(source)
+	if !ok {
+		return fmt.Errorf("invalid NFS source %q, must be server:/path", source)
+	}
+	serverIP := net.ParseIP(host)
+	if serverIP == nil {
+		ips, err := m.resolve(context.Background(), host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve NFS server %s: %w", host, err)
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("NFS server %s has no address", host)
+		}
+		serverIP = ips[0]
+	}
+	clientIP, err := m.clientAddr(serverIP)
+	if err != nil {
+		return fmt.Errorf("failed to find the local address to NFS server %s: %w", serverIP, err)
+	}
+
+	versions := nativeMountVersions
+	if version := nfsVersion(options); version != "" {
+		versions = []string{version}
+	} else if fstype == "nfs4" {
+		versions = []string{"4"}
+	}
+	var nm *nativeMount
+	for _, version := range versions {
+		if nm, err = buildNativeMount(source, options, version, serverIP, clientIP); err != nil {
+			return err
+		}
+		klog.V(4).Infof("Mounting %s on %s with mount(2), type %s, flags %#x, options (%s)", nm.source, target, nm.fstype, nm.flags, nm.data)
+		if err = m.mount(nm.source, target, nm.fstype, nm.flags, nm.data); err == nil {
+			return nil
+		}
+		// the server does not support the version, try the next one
+		if !errors.Is(err, unix.EPROTONOSUPPORT) {
+			break
+		}
+	}
+	return fmt.Errorf("mount failed: %w\nMounting arguments: -t %s -o %s %s %s", err, nm.fstype, nm.data, nm.source, target)
+}
+
+// nfsVersion returns the NFS version set by the mount options, if any.
+func nfsVersion(options []string) string {
+	var version string
+	for _, opt := range options {
+		for _, o := range strings.Split(opt, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(o), "=")
+			if name == "vers" || name == "nfsvers" {
+				version = value
+			}
+		}
+	}
+	return version
+}
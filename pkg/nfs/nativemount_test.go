@@ -0,0 +1,260 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	mount "k8s.io/mount-utils"
+)
+
+func TestBuildNativeMount(t *testing.T) {
+	serverIP := net.ParseIP("10.0.0.1")
+	clientIP := net.ParseIP("10.128.0.2")
+	tests := []struct {
+		desc        string
+		source      string
+		options     []string
+		version     string
+		serverIP    net.IP
+		expected    *nativeMount
+		expectedErr string
+	}{
+		{
+			desc:     "NFSv4.1 with flags",
+			source:   "10.0.0.1:/share",
+			options:  []string{"vers=4.1", "hard", "ro", "nosuid", "noatime", "rsize=1048576"},
+			expected: &nativeMount{source: "10.0.0.1:/share", fstype: "nfs4", flags: unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NOATIME, data: "vers=4.1,hard,rsize=1048576,addr=10.0.0.1,clientaddr=10.128.0.2"},
+		},
+		{
+			desc:     "NFSv3 has no clientaddr",
+			source:   "nfs-server:/share",
+			options:  []string{"nfsvers=3,nolock", "sec=sys"},
+			expected: &nativeMount{source: "nfs-server:/share", fstype: "nfs", data: "vers=3,nolock,sec=sys,addr=10.0.0.1"},
+		},
+		{
+			desc:     "version of the caller",
+			source:   "10.0.0.1:/share",
+			options:  []string{"hard"},
+			version:  "4.2",
+			expected: &nativeMount{source: "10.0.0.1:/share", fstype: "nfs4", data: "vers=4.2,hard,addr=10.0.0.1,clientaddr=10.128.0.2"},
+		},
+		{
+			desc:     "version of the options overrides the caller",
+			source:   "10.0.0.1:/share",
+			options:  []string{"vers=3"},
+			version:  "4.2",
+			expected: &nativeMount{source: "10.0.0.1:/share", fstype: "nfs", data: "vers=3,addr=10.0.0.1"},
+		},
+		{
+			desc:     "last flag wins",
+			source:   "10.0.0.1:/share",
+			options:  []string{"ro", "rw", "noexec"},
+			version:  "4",
+			expected: &nativeMount{source: "10.0.0.1:/share", fstype: "nfs4", flags: unix.MS_NOEXEC, data: "vers=4,addr=10.0.0.1,clientaddr=10.128.0.2"},
+		},
+		{
+			desc:     "helper options are dropped",
+			source:   "10.0.0.1:/share",
+			options:  []string{"vers=4.1", "_netdev", "retry=2", "bg", "x-systemd.automount", "defaults"},
+			expected: &nativeMount{source: "10.0.0.1:/share", fstype: "nfs4", data: "vers=4.1,addr=10.0.0.1,clientaddr=10.128.0.2"},
+		},
+		{
+			desc:     "addr and clientaddr of the options are kept",
+			source:   "10.0.0.1:/share",
+			options:  []string{"vers=4.0", "addr=10.0.0.5", "clientaddr=10.128.0.9"},
+			expected: &nativeMount{source: "10.0.0.1:/share", fstype: "nfs4", data: "vers=4.0,addr=10.0.0.5,clientaddr=10.128.0.9"},
+		},
+		{
+			desc:     "IPv6 server",
+			source:   "[fd00::1]:/share",
+			options:  []string{"vers=4.2"},
+			serverIP: net.ParseIP("fd00::1"),
+			expected: &nativeMount{source: "[fd00::1]:/share", fstype: "nfs4", data: "vers=4.2,addr=fd00::1,clientaddr=10.128.0.2"},
+		},
+		{
+			desc:        "invalid source",
+			source:      "10.0.0.1",
+			options:     []string{"vers=4.1"},
+			expectedErr: `invalid NFS source "10.0.0.1", must be server:/path`,
+		},
+		{
+			desc:        "unsupported version",
+			source:      "10.0.0.1:/share",
+			options:     []string{"vers=5"},
+			expectedErr: `unsupported NFS version "5"`,
+		},
+		{
+			desc:        "bind mount",
+			source:      "10.0.0.1:/share",
+			options:     []string{"bind"},
+			version:     "4.1",
+			expectedErr: `mount option "bind" is not supported by the native mounter`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			ip := serverIP
+			if test.serverIP != nil {
+				ip = test.serverIP
+			}
+			m, err := buildNativeMount(test.source, test.options, test.version, ip, clientIP)
+			if test.expectedErr != "" {
+				assert.EqualError(t, err, test.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, m)
+		})
+	}
+}
+
+// mountCall is a mount(2) call made by the native mounter in tests.
+type mountCall struct {
+	source, target, fstype string
+	flags                  uintptr
+	data                   string
+}
+
+func TestNativeMounterMount(t *testing.T) {
+	tests := []struct {
+		desc          string
+		source        string
+		fstype        string
+		options       []string
+		mountErrs     []error
+		expectedCalls []string
+		expectedErr   error
+	}{
+		{
+			desc:          "version set by the options",
+			source:        "10.0.0.1:/share",
+			fstype:        "nfs",
+			options:       []string{"vers=4.1", "hard"},
+			expectedCalls: []string{"nfs4 vers=4.1,hard,addr=10.0.0.1,clientaddr=10.128.0.2"},
+		},
+		{
+			desc:          "hostname resolved",
+			source:        "nfs-server:/share",
+			fstype:        "nfs",
+			options:       []string{"vers=3"},
+			expectedCalls: []string{"nfs vers=3,addr=10.0.0.7"},
+		},
+		{
+			desc:      "versions negotiated",
+			source:    "10.0.0.1:/share",
+			fstype:    "nfs",
+			mountErrs: []error{unix.EPROTONOSUPPORT, unix.EPROTONOSUPPORT},
+			expectedCalls: []string{
+				"nfs4 vers=4.2,addr=10.0.0.1,clientaddr=10.128.0.2",
+				"nfs4 vers=4.1,addr=10.0.0.1,clientaddr=10.128.0.2",
+				"nfs4 vers=4.0,addr=10.0.0.1,clientaddr=10.128.0.2",
+			},
+		},
+		{
+			desc:          "nfs4 type without version",
+			source:        "10.0.0.1:/share",
+			fstype:        "nfs4",
+			expectedCalls: []string{"nfs4 vers=4,addr=10.0.0.1,clientaddr=10.128.0.2"},
+		},
+		{
+			desc:          "version set by the options is not negotiated",
+			source:        "10.0.0.1:/share",
+			fstype:        "nfs",
+			options:       []string{"vers=4.2"},
+			mountErrs:     []error{unix.EPROTONOSUPPORT},
+			expectedCalls: []string{"nfs4 vers=4.2,addr=10.0.0.1,clientaddr=10.128.0.2"},
+			expectedErr:   unix.EPROTONOSUPPORT,
+		},
+		{
+			desc:          "permission denied",
+			source:        "10.0.0.1:/share",
+			fstype:        "nfs",
+			mountErrs:     []error{unix.EACCES},
+			expectedCalls: []string{"nfs4 vers=4.2,addr=10.0.0.1,clientaddr=10.128.0.2"},
+			expectedErr:   fs.ErrPermission,
+		},
+		{
+			desc:        "unknown host",
+			source:      "unknown:/share",
+			fstype:      "nfs",
+			expectedErr: errNoSuchHost,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			var calls []mountCall
+			m := newNativeMounter(mount.NewFakeMounter(nil))
+			m.resolve = fakeResolve
+			m.clientAddr = func(_ net.IP) (net.IP, error) { return net.ParseIP("10.128.0.2"), nil }
+			m.mount = func(source, target, fstype string, flags uintptr, data string) error {
+				calls = append(calls, mountCall{source, target, fstype, flags, data})
+				if len(calls) <= len(test.mountErrs) {
+					return test.mountErrs[len(calls)-1]
+				}
+				return nil
+			}
+
+			err := m.Mount(test.source, "/target", test.fstype, test.options)
+			if test.expectedErr != nil {
+				assert.ErrorIs(t, err, test.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			var got []string
+			for _, c := range calls {
+				assert.Equal(t, test.source, c.source)
+				assert.Equal(t, "/target", c.target)
+				got = append(got, c.fstype+" "+c.data)
+			}
+			assert.Equal(t, test.expectedCalls, got)
+		})
+	}
+}
+
+var errNoSuchHost = errors.New("no such host")
+
+func fakeResolve(_ context.Context, host string) ([]net.IP, error) {
+	if host == "nfs-server" {
+		return []net.IP{net.ParseIP("10.0.0.7")}, nil
+	}
+	return nil, fmt.Errorf("lookup %s: %w", host, errNoSuchHost)
+}
+
+func TestNativeMounterDelegates(t *testing.T) {
+	fake := mount.NewFakeMounter(nil)
+	m := newNativeMounter(fake)
+	m.mount = func(_, _, _ string, _ uintptr, _ string) error {
+		return errors.New("unexpected mount(2) call")
+	}
+
+	assert.NoError(t, m.Mount("/staging/subdir", "/target", "", []string{"bind", "ro"}))
+	assert.NoError(t, m.UnmountWithForce("/target", 0))
+	assert.Equal(t, []mount.FakeAction{
+		{Action: mount.FakeActionMount, Target: "/target", Source: "/staging/subdir"},
+		{Action: mount.FakeActionUnmount, Target: "/target"},
+	}, fake.GetLog())
+}
@@ -17,10 +17,16 @@ limitations under the License.
 package nfs
 
 import (
+	"context"
+	"net/http"
 	"runtime"
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/driverconfig"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/quota"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/supervisor"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog/v2"
 	mount "k8s.io/mount-utils"
@@ -37,9 +43,67 @@ type DriverOptions struct {
 	WorkingMountDir              string
 	DefaultOnDeletePolicy        string
 	VolStatsCacheExpireInMinutes int
+	VolStatsTimeout              time.Duration
 	IPList                       []string
 	RunControllerServer          bool
 	RunNodeServer                bool
+	HTTPEndpoint                 string
+	// SubDirUsageRefreshInterval is how often the usage of subdirectory
+	// volumes is computed by walking them, disabled if zero.
+	SubDirUsageRefreshInterval time.Duration
+	// SubDirUsageMaxEntries is the number of files and directories after
+	// which a walk is abandoned.
+	SubDirUsageMaxEntries int64
+	// StaleMountCheckInterval is how often the node server checks the staged
+	// volumes for stale mounts, disabled if zero.
+	StaleMountCheckInterval time.Duration
+	// LoadReportInterval is how often the node server publishes its NFS load
+	// on its node, disabled if zero.
+	LoadReportInterval time.Duration
+	// NativeMount mounts the NFS shares with mount(2) instead of the
+	// mount.nfs helper.
+	NativeMount bool
+	// KubeletDir is the root directory of kubelet, where the mounts of the
+	// volumes are looked up at startup.
+	KubeletDir string
+	// StartupReconcilePolicy is what the node server does with the mounts of
+	// the driver it finds at startup: none, report or repair.
+	StartupReconcilePolicy string
+	// MountTimeout is how long a mount may take before it is killed and
+	// reported as unavailable, unlimited if zero.
+	MountTimeout time.Duration
+	// InternalMountIdleTimeout is how long the controller keeps an unused
+	// internal mount of a share for the next requests, each request mounts
+	// the share if zero.
+	InternalMountIdleTimeout time.Duration
+	// CapacityRefreshInterval is how often the controller collects the
+	// capacity of the shares of the driver configuration for GetCapacity,
+	// which collects it itself if zero.
+	CapacityRefreshInterval time.Duration
+	// ServerPool is the name of the NFS server pool of the driver, reported
+	// as the topology segment of the nodes, topology is disabled if empty.
+	ServerPool string
+	// QuotaBackend enforces the capacity of the subdirectory volumes, it is
+	// not enforced if nil.
+	QuotaBackend quota.Backend
+	// KerberosDir is where the node server keeps the Kerberos credentials of
+	// the volumes for rpc.gssd, Kerberos credentials from secrets are disabled
+	// if empty.
+	KerberosDir string
+	// TLSDir is where the node server keeps the TLS credentials of the
+	// volumes for tlshd, TLS credentials from secrets are disabled if empty.
+	TLSDir string
+	// DriverConfig is the path of the driver configuration file with the
+	// mount profiles and policies, none are available if empty.
+	DriverConfig string
+	// LBStrategy is how the LB controller selects the IP assigned to a node.
+	LBStrategy lbcontroller.Strategy
+	// LoadNamespace is the namespace of the Leases the node servers publish
+	// their NFS load on.
+	LoadNamespace string
+	// NfsServices supervises the NFS client helper daemons, nil if they are
+	// not run by the driver.
+	NfsServices *supervisor.Supervisor
 }
 
 type Driver struct {
@@ -61,11 +125,43 @@ type Driver struct {
 	// a timed cache storing volume stats <volumeID, volumeStats>
 	volStatsCache                azcache.Resource
 	volStatsCacheExpireInMinutes int
+	volStatsTimeout              time.Duration
+	// mountTimeout bounds each mount attempt, unlimited if zero
+	mountTimeout time.Duration
+	// the internal mounts of the controller are not shared if zero
+	internalMountIdleTimeout time.Duration
+	// GetCapacity collects the capacity of the shares if zero
+	capacityRefreshInterval time.Duration
+	// topology is disabled if empty
+	serverPool string
+	// the capacity of the volumes is not enforced if nil
+	quota quota.Backend
+	// the usage of subdirectory volumes is disabled if the interval is zero
+	subDirUsageRefreshInterval time.Duration
+	subDirUsageMaxEntries      int64
 
-	ipList []string
+	ipList        []string
+	lbStrategy    lbcontroller.Strategy
+	loadNamespace string
 
 	runControllerServer bool
 	runNodeServer       bool
+	nfsServices         *supervisor.Supervisor
+
+	staleMountCheckInterval time.Duration
+	loadReportInterval      time.Duration
+	kerberosDir             string
+	tlsDir                  string
+	kubeletDir              string
+	nativeMount             bool
+	startupReconcilePolicy  string
+
+	// config is the driver configuration set by the admin, nil if none
+	config *driverconfig.File
+
+	// address to serve the /healthz and /readyz endpoints on, disabled if empty
+	httpEndpoint string
+	health       healthChecks
 }
 
 const (
@@ -100,22 +196,54 @@ func NewDriver(options *DriverOptions) *Driver {
 		mountPermissions:             options.MountPermissions,
 		workingMountDir:              options.WorkingMountDir,
 		volStatsCacheExpireInMinutes: options.VolStatsCacheExpireInMinutes,
+		volStatsTimeout:              options.VolStatsTimeout,
+		mountTimeout:                 options.MountTimeout,
+		internalMountIdleTimeout:     options.InternalMountIdleTimeout,
+		capacityRefreshInterval:      options.CapacityRefreshInterval,
+		serverPool:                   options.ServerPool,
+		quota:                        options.QuotaBackend,
+		subDirUsageRefreshInterval:   options.SubDirUsageRefreshInterval,
+		subDirUsageMaxEntries:        options.SubDirUsageMaxEntries,
 		ipList:                       options.IPList,
 		runControllerServer:          options.RunControllerServer,
 		runNodeServer:                options.RunNodeServer,
+		nfsServices:                  options.NfsServices,
+		httpEndpoint:                 options.HTTPEndpoint,
+		staleMountCheckInterval:      options.StaleMountCheckInterval,
+		loadReportInterval:           options.LoadReportInterval,
+		lbStrategy:                   options.LBStrategy,
+		loadNamespace:                options.LoadNamespace,
+		kerberosDir:                  options.KerberosDir,
+		tlsDir:                       options.TLSDir,
+		kubeletDir:                   options.KubeletDir,
+		nativeMount:                  options.NativeMount,
+		startupReconcilePolicy:       options.StartupReconcilePolicy,
 	}
 
-	n.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+	controllerCapabilities := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-	})
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+	}
+	// the size of a volume is only enforced by a quota backend
+	if n.quota != nil {
+		controllerCapabilities = append(controllerCapabilities, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+	}
+	n.AddControllerServiceCapabilities(controllerCapabilities)
 
 	n.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
 		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
 		csi.NodeServiceCapability_RPC_UNKNOWN,
 	})
@@ -130,14 +258,37 @@ func NewDriver(options *DriverOptions) *Driver {
 	if n.volStatsCache, err = azcache.NewTimedCache(time.Duration(options.VolStatsCacheExpireInMinutes)*time.Minute, getter, false); err != nil {
 		klog.Fatalf("%v", err)
 	}
+	if n.kubeletDir == "" {
+		n.kubeletDir = DefaultKubeletDir
+	}
+	if n.startupReconcilePolicy == "" {
+		n.startupReconcilePolicy = reconcilePolicyNone
+	}
+	if err := validateReconcilePolicy(n.startupReconcilePolicy); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if options.DriverConfig != "" {
+		if n.config, err = driverconfig.NewFile(options.DriverConfig); err != nil {
+			klog.Fatalf("failed to load the driver configuration: %v", err)
+		}
+	}
 	return n
 }
 
 func NewNodeServer(n *Driver, mounter mount.Interface) *NodeServer {
-	return &NodeServer{
-		Driver:  n,
-		mounter: mounter,
+	ns := &NodeServer{
+		Driver:        n,
+		mounter:       mounter,
+		mount:         newMountFunc(mounter),
+		stagedVolumes: newStagedVolumes(),
+		volumeStats:   newVolumeStatsCollector(),
+		startupMounts: &startupMounts{},
+		bdi:           newBDITuner(defaultSysfsRoot),
+	}
+	if n.subDirUsageRefreshInterval > 0 {
+		ns.subDirUsage = newDirUsageWalker(n.subDirUsageRefreshInterval, n.subDirUsageMaxEntries)
 	}
+	return ns
 }
 
 func (n *Driver) Run(testMode bool) {
@@ -152,15 +303,63 @@ func (n *Driver) Run(testMode bool) {
 		// MounterForceUnmounter is only implemented on Linux now
 		mounter = mounter.(mount.MounterForceUnmounter)
 	}
+	if n.nativeMount {
+		klog.V(2).Infof("mounting NFS shares with mount(2) instead of mount.nfs")
+		mounter = newNativeMounter(mounter)
+	}
 
 	if n.runNodeServer {
 		n.ns = NewNodeServer(n, mounter)
+		if n.kerberosDir != "" {
+			if n.ns.kerberos, err = newKerberosCredentials(n.kerberosDir); err != nil {
+				klog.Fatalf("failed to set up the Kerberos credentials in %s: %v", n.kerberosDir, err)
+			}
+		}
+		if n.tlsDir != "" {
+			if n.ns.tls, err = newTLSCredentials(n.tlsDir); err != nil {
+				klog.Fatalf("failed to set up the TLS credentials in %s: %v", n.tlsDir, err)
+			}
+		}
+		if clientset, err := newInClusterClient(); err != nil {
+			klog.Warningf("stale mounts will be remounted with their previous IP and not reported as events: %v", err)
+		} else {
+			n.ns.getNodeIP = nodeIPGetter(clientset, n.nodeID)
+			n.ns.recorder = newNodeEventRecorder(clientset, n.name, n.nodeID)
+			if n.loadReportInterval > 0 {
+				go newLoadReporter(clientset, n.nodeID, n.loadNamespace, n.loadReportInterval).run(context.Background())
+			}
+		}
+		go n.ns.reconcileMounts(context.Background(), n.kubeletDir, n.startupReconcilePolicy)
+		if n.staleMountCheckInterval > 0 {
+			go n.ns.runStaleMountChecks(context.Background(), n.staleMountCheckInterval)
+		}
 	}
 	if n.runControllerServer {
 		n.cs = NewControllerServer(n)
+		if n.cs.sharedMounts != nil {
+			go n.cs.sharedMounts.run(context.Background(), sharedMountCheckInterval)
+		}
+		if n.capacityRefreshInterval > 0 {
+			go n.cs.runCapacityRefresh(context.Background())
+		}
 	}
 
 	s := NewNonBlockingGRPCServer()
+	n.health.add(healthCheckGRPCServing, true, s.CheckServing)
+	if n.cs != nil && n.cs.LBController != nil {
+		n.health.add(healthCheckLBCacheSynced, false, n.cs.LBController.CheckSynced)
+	}
+	if n.nfsServices != nil {
+		n.health.add(healthCheckNFSServices, true, n.nfsServices.Check)
+	}
+	if n.httpEndpoint != "" {
+		var metrics http.Handler
+		if n.ns != nil {
+			metrics = newMetricsHandler(n.ns)
+		}
+		go n.health.serveHealth(n.httpEndpoint, metrics)
+	}
+
 	s.Start(n.endpoint,
 		NewDefaultIdentityServer(n),
 		n.cs,
@@ -17,10 +17,11 @@ limitations under the License.
 package nfs
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
-	"regexp"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -30,29 +31,47 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
-	"k8s.io/kubernetes/pkg/volume"
 	mount "k8s.io/mount-utils"
 
 	azcache "sigs.k8s.io/cloud-provider-azure/pkg/cache"
 )
 
-const (
-	readAheadKBMountFlagRegexPattern = "^read_ahead_kb=(.+)$"
-)
-
-var (
-	readAheadKBMountFlagRegex = regexp.MustCompile(readAheadKBMountFlagRegexPattern)
-)
-
 // NodeServer driver
 type NodeServer struct {
 	Driver  *Driver
 	mounter mount.Interface
+	// mount mounts with the mounter until the context is done
+	mount mountFunc
+	// stagedVolumes tracks the staged volumes to repair their stale mounts
+	stagedVolumes *stagedVolumes
+	// bdi applies the BDI mount flags such as read_ahead_kb
+	bdi *bdiTuner
+	// kerberos manages the Kerberos credentials from the volume secrets, nil
+	// if they are not enabled.
+	kerberos *kerberosCredentials
+	// tls manages the TLS credentials from the volume secrets, nil if they
+	// are not enabled.
+	tls *tlsCredentials
+	// getNodeIP returns the NFS server IP currently assigned to the node,
+	// nil if no kube client is available.
+	getNodeIP func(ctx context.Context) (string, error)
+	// volumeStats collects the volume stats in the background
+	volumeStats *volumeStatsCollector
+	// subDirUsage reports the usage of subdirectory volumes, nil to report
+	// the usage of the whole share.
+	subDirUsage usageSource
+	// startupMounts counts the mounts of the driver found at startup
+	startupMounts *startupMounts
+	// recorder reports stale mount repairs as events on the node, nil if no
+	// kube client is available.
+	recorder record.EventRecorder
 }
 
 // NodePublishVolume mount the volume
-func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volCap := req.GetVolumeCapability()
 	if volCap == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
@@ -66,6 +85,20 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
 	}
 
+	// The mounts are checked before taking the lock, a check hung on an
+	// unreachable server must not block the other operations on the target.
+	targetCorrupted, err := checkCorruptedDir(targetPath, corruptedDirTimeout)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	stagingPath := req.GetStagingTargetPath()
+	var stagingCorrupted bool
+	if stagingPath != "" {
+		if stagingCorrupted, err = checkCorruptedDir(stagingPath, corruptedDirTimeout); err != nil {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+
 	lockKey := fmt.Sprintf("%s-%s", volumeID, targetPath)
 	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
 		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
@@ -77,110 +110,239 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 		mountOptions = append(mountOptions, "ro")
 	}
 
-	var server, baseDir, subDir string
-	subDirReplaceMap := map[string]string{}
+	params, err := ns.Driver.parseVolumeContext(withModifiedAttributes(req.GetVolumeContext(), req.GetPublishContext()), mountOptions)
+	if err != nil {
+		return nil, err
+	}
 
-	mountPermissions := ns.Driver.mountPermissions
-	for k, v := range req.GetVolumeContext() {
-		switch strings.ToLower(k) {
-		case paramServer:
-			server = v
-		case paramShare:
-			baseDir = v
-		case paramSubDir:
-			subDir = v
-		case pvcNamespaceKey:
-			subDirReplaceMap[pvcNamespaceMetadata] = v
-		case pvcNameKey:
-			subDirReplaceMap[pvcNameMetadata] = v
-		case pvNameKey:
-			subDirReplaceMap[pvNameMetadata] = v
-		case mountOptionsField:
-			if v != "" {
-				mountOptions = append(mountOptions, v)
-			}
-		case mountPermissionsField:
-			if v != "" {
-				var err error
-				if mountPermissions, err = strconv.ParseUint(v, 8, 32); err != nil {
-					return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid mountPermissions %s", v))
-				}
-			}
+	if stagingPath != "" {
+		return ns.publishFromStagingPath(ctx, volumeID, stagingPath, targetPath, stagingCorrupted, targetCorrupted, req.GetReadonly(), params)
+	}
+
+	// Without a staging path, as for the internal mounts of the controller,
+	// the share is mounted directly at the target path.
+	ip, err := getAssignedIP(req.GetPublishContext(), volumeID)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("NodePublishVolume found IP %q from PublishContext for volume %q", ip, volumeID)
+
+	if targetCorrupted {
+		klog.Warningf("NodePublishVolume: target path %s of volume %s is corrupted, unmounting it", targetPath, volumeID)
+		if err := ns.cleanupMountPoint(volumeID, targetPath); err != nil {
+			return nil, err
 		}
 	}
 
-	if baseDir == "" {
-		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", paramShare))
+	if err := ns.setupCredentials(targetPath, params.mountOptions, req.GetSecrets()); err != nil {
+		return nil, err
+	}
+	source := getNFSSource(ip, params.baseDir, params.subDir)
+	if err := ns.mountNFS(ctx, volumeID, source, targetPath, params.mountOptions, params.mountPermissions); err != nil {
+		ns.cleanupCredentialsAfterFailure(targetPath)
+		return nil, err
+	}
+	if err := chmodTargetPath(targetPath, params.mountPermissions); err != nil {
+		return nil, err
 	}
 
-	pc := req.GetPublishContext()
-	ip, ok := pc[lbcontroller.NodeAnnotation]
-	if !ok {
-		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("NFS server IP not found in PublishContext %v for volume %q", pc, volumeID))
+	klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, source, targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishFromStagingPath bind mounts the volume subdirectory of the share
+// mounted at the staging path on the target path, remounting the staging path
+// and the target path if they were found corrupted.
+func (ns *NodeServer) publishFromStagingPath(ctx context.Context, volumeID, stagingPath, targetPath string, stagingCorrupted, targetCorrupted, readOnly bool, params *nodeVolumeParams) (*csi.NodePublishVolumeResponse, error) {
+	if stagingCorrupted {
+		klog.Warningf("NodePublishVolume: staging path %s of volume %s is corrupted", stagingPath, volumeID)
+		v, ok := ns.stagedVolumes.get(stagingPath)
+		if !ok {
+			return nil, status.Errorf(codes.FailedPrecondition, "staging path %s of volume %s is corrupted", stagingPath, volumeID)
+		}
+		// The staging path lock serializes the remount with the periodic checks.
+		lockKey := fmt.Sprintf("%s-%s", volumeID, stagingPath)
+		if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+			return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+		}
+		err := ns.remountStagedVolume(ctx, v)
+		ns.Driver.volumeLocks.Release(lockKey)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	klog.Infof("NodePublishVolume found IP %q from PublishContext for volume %q", ip, volumeID)
-	server = ip
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if notMnt || os.IsNotExist(err) {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not staged at %s", volumeID, stagingPath)
+	}
 
-	source := fmt.Sprintf("%s:%s", server, baseDir)
-	if subDir != "" {
-		// replace pv/pvc name namespace metadata in subDir
-		subDir = replaceWithMap(subDir, subDirReplaceMap)
+	if targetCorrupted {
+		klog.Warningf("NodePublishVolume: target path %s of volume %s is corrupted, unmounting it", targetPath, volumeID)
+		if err := ns.cleanupMountPoint(volumeID, targetPath); err != nil {
+			return nil, err
+		}
+	}
 
-		source = strings.TrimRight(source, "/")
-		source = fmt.Sprintf("%s/%s", source, subDir)
+	t := publishedTarget{subDir: params.subDir, readOnly: readOnly, mountPermissions: params.mountPermissions}
+	if err := ns.bindMount(volumeID, stagingPath, targetPath, t); err != nil {
+		return nil, err
+	}
+	ns.stagedVolumes.publish(stagingPath, targetPath, t)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// bindMount bind mounts the subdirectory of the share mounted at the staging
+// path on the target path, unless the target path is already a mount point.
+func (ns *NodeServer) bindMount(volumeID, stagingPath, targetPath string, t publishedTarget) error {
+	source := stagingPath
+	if t.subDir != "" {
+		source = filepath.Join(stagingPath, t.subDir)
+	}
+	if _, err := os.Stat(source); err != nil {
+		if os.IsNotExist(err) {
+			return status.Errorf(codes.NotFound, "subdirectory %s of volume %s does not exist", t.subDir, volumeID)
+		}
+		return status.Error(codes.Internal, err.Error())
 	}
 
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			if err := os.MkdirAll(targetPath, os.FileMode(mountPermissions)); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			notMnt = true
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+		if !os.IsNotExist(err) {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := os.MkdirAll(targetPath, os.FileMode(t.mountPermissions)); err != nil {
+			return status.Error(codes.Internal, err.Error())
 		}
+		notMnt = true
 	}
 	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+		return nil
 	}
 
+	mountOptions := []string{"bind"}
+	if t.readOnly {
+		mountOptions = append(mountOptions, "ro")
+	}
 	klog.V(2).Infof("NodePublishVolume: volumeID(%v) source(%s) targetPath(%s) mountflags(%v)", volumeID, source, targetPath, mountOptions)
-	// parse read ahead mount option
-	filteredMountOptions := collectMountOptions(mountOptions)
-	err = ns.mounter.Mount(source, targetPath, "nfs", filteredMountOptions)
+	if err := ns.mounter.Mount(source, targetPath, "", mountOptions); err != nil {
+		return status.Errorf(codes.Internal, "failed to bind mount %s on %s: %v", source, targetPath, err)
+	}
+	if err := chmodTargetPath(targetPath, t.mountPermissions); err != nil {
+		return err
+	}
+
+	klog.V(2).Infof("volume(%s) bind mount %s on %s succeeded", volumeID, source, targetPath)
+	return nil
+}
+
+// NodeStageVolume mounts the share of the volume at the staging path, using
+// the NFS server IP assigned to the node. The pods using the volume on the
+// node share this mount through bind mounts made by NodePublishVolume.
+func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path not provided")
+	}
+
+	// The staging path is checked before taking the lock, a check hung on an
+	// unreachable server must not block the other operations on the volume.
+	stagingCorrupted, err := checkCorruptedDir(stagingPath, corruptedDirTimeout)
 	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
-		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
-		}
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.Unavailable, err.Error())
 	}
 
-	if mountPermissions > 0 {
-		if err := chmodIfPermissionMismatch(targetPath, os.FileMode(mountPermissions)); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
-	} else {
-		klog.V(2).Infof("skip chmod on targetPath(%s) since mountPermissions is set as 0", targetPath)
+	lockKey := fmt.Sprintf("%s-%s", volumeID, stagingPath)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
 	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
 
-	readAheadKB, shouldUpdateReadAhead, err := extractReadAheadKBMountFlag(mountOptions)
+	params, err := ns.Driver.parseVolumeContext(withModifiedAttributes(req.GetVolumeContext(), req.GetPublishContext()), volCap.GetMount().GetMountFlags())
 	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, err.Error())
+		return nil, err
 	}
+	ip, err := getAssignedIP(req.GetPublishContext(), volumeID)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("NodeStageVolume found IP %q from PublishContext for volume %q", ip, volumeID)
 
-	if shouldUpdateReadAhead {
-		if err := updateReadAhead(targetPath, readAheadKB); err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+	// After a restart kubelet stages the volumes of running pods again. A
+	// healthy mount is kept, a corrupted one is replaced.
+	if stagingCorrupted {
+		ns.recordNodeEvent(v1.EventTypeWarning, staleMountDetectedReason, "staging path %s of volume %s is corrupted, remounting it", stagingPath, volumeID)
+		if err := ns.cleanupMountPoint(volumeID, stagingPath); err != nil {
+			return nil, err
 		}
 	}
 
-	klog.V(2).Infof("volume(%s) mount %s on %s succeeded", volumeID, source, targetPath)
-	return &csi.NodePublishVolumeResponse{}, nil
+	if err := ns.setupCredentials(stagingPath, params.mountOptions, req.GetSecrets()); err != nil {
+		return nil, err
+	}
+	// The subdirectory and read only options are applied when publishing.
+	source := getNFSSource(ip, params.baseDir, "")
+	if err := ns.mountNFS(ctx, volumeID, source, stagingPath, params.mountOptions, stagingPathPermissions); err != nil {
+		ns.cleanupCredentialsAfterFailure(stagingPath)
+		return nil, err
+	}
+
+	ns.stagedVolumes.stage(&stagedVolume{
+		volumeID:     volumeID,
+		stagingPath:  stagingPath,
+		ip:           ip,
+		baseDir:      params.baseDir,
+		mountOptions: params.mountOptions,
+	})
+
+	klog.V(2).Infof("volume(%s) staging mount %s on %s succeeded", volumeID, source, stagingPath)
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume unmounts the share of the volume from the staging path.
+func (ns *NodeServer) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	lockKey := fmt.Sprintf("%s-%s", volumeID, stagingPath)
+	if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.Driver.volumeLocks.Release(lockKey)
+
+	// An already unmounted or removed staging path, for example when the
+	// call is retried by kubelet after a restart, is not an error.
+	klog.V(2).Infof("NodeUnstageVolume: unmounting volume %s on %s", volumeID, stagingPath)
+	if err := ns.cleanupMountPoint(volumeID, stagingPath); err != nil {
+		return nil, err
+	}
+	ns.stagedVolumes.unstage(stagingPath)
+	if err := ns.cleanupCredentials(stagingPath); err != nil {
+		return nil, err
+	}
+	if ns.subDirUsage != nil {
+		ns.subDirUsage.forget(subDirUsageKey(volumeID, stagingPath))
+	}
+	klog.V(2).Infof("NodeUnstageVolume: unmount volume %s on %s successfully", volumeID, stagingPath)
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 // NodeUnpublishVolume unmount the volume
@@ -201,18 +363,14 @@ func (ns *NodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubl
 	defer ns.Driver.volumeLocks.Release(lockKey)
 
 	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
-	var err error
-	extensiveMountPointCheck := true
-	forceUnmounter, ok := ns.mounter.(mount.MounterForceUnmounter)
-	if ok {
-		klog.V(2).Infof("force unmount %s on %s", volumeID, targetPath)
-		err = mount.CleanupMountWithForce(targetPath, forceUnmounter, extensiveMountPointCheck, 30*time.Second)
-	} else {
-		err = mount.CleanupMountPoint(targetPath, ns.mounter, extensiveMountPointCheck)
+	if err := ns.cleanupMountPoint(volumeID, targetPath); err != nil {
+		return nil, err
 	}
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
+	ns.stagedVolumes.unpublish(targetPath)
+	if err := ns.cleanupCredentials(targetPath); err != nil {
+		return nil, err
 	}
+	ns.volumeStats.forget(volumeStatsKey(volumeID, targetPath))
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -221,7 +379,8 @@ func (ns *NodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubl
 // NodeGetInfo return info of the node on which this plugin is running
 func (ns *NodeServer) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	return &csi.NodeGetInfoResponse{
-		NodeId: ns.Driver.nodeID,
+		NodeId:             ns.Driver.nodeID,
+		AccessibleTopology: ns.Driver.topology(),
 	}, nil
 }
 
@@ -233,7 +392,7 @@ func (ns *NodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapab
 }
 
 // NodeGetVolumeStats get volume stats
-func (ns *NodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	if len(req.VolumeId) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume ID was empty")
 	}
@@ -241,174 +400,273 @@ func (ns *NodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolu
 		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path was empty")
 	}
 
+	condition := ns.getVolumeCondition(ctx, req.VolumePath)
+
 	// check if the volume stats is cached
-	cache, err := ns.Driver.volStatsCache.Get(req.VolumeId, azcache.CacheReadTypeDefault)
+	key := volumeStatsKey(req.VolumeId, req.VolumePath)
+	cache, err := ns.Driver.volStatsCache.Get(key, azcache.CacheReadTypeDefault)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 	if cache != nil {
-		resp := cache.(csi.NodeGetVolumeStatsResponse)
+		stats := cache.(*volumeStats)
 		klog.V(6).Infof("NodeGetVolumeStats: volume stats for volume %s path %s is cached", req.VolumeId, req.VolumePath)
-		return &resp, nil
+		return &csi.NodeGetVolumeStatsResponse{Usage: ns.withSubDirUsage(req.VolumeId, req.VolumePath, stats.usage), VolumeCondition: withStatsAge(condition, stats)}, nil
+	}
+
+	// statfs blocks on a hard mount whose server is gone, the stats are
+	// collected in the background and the last ones are returned on timeout.
+	stats, err := ns.volumeStats.collect(ctx, key, req.VolumePath, ns.Driver.getVolStatsTimeout())
+	switch {
+	case errors.Is(err, errVolumeStatsTimeout):
+		condition = abnormalCondition("%v", err)
+		if stats == nil {
+			klog.Warningf("NodeGetVolumeStats: volume %s path %s: %v", req.VolumeId, req.VolumePath, err)
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
+		klog.Warningf("NodeGetVolumeStats: volume %s path %s: %v, returning stats collected at %v", req.VolumeId, req.VolumePath, err, stats.collectedAt)
+		return &csi.NodeGetVolumeStatsResponse{Usage: ns.withSubDirUsage(req.VolumeId, req.VolumePath, stats.usage), VolumeCondition: withStatsAge(condition, stats)}, nil
+	case errors.Is(err, errStaleVolume):
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: abnormalCondition("stale NFS file handle on %s", req.VolumePath)}, nil
+	case err != nil:
+		return nil, err
 	}
 
-	if _, err := os.Lstat(req.VolumePath); err != nil {
-		if os.IsNotExist(err) {
-			return nil, status.Errorf(codes.NotFound, "path %s does not exist", req.VolumePath)
-		}
-		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.VolumePath, err)
+	// cache the volume stats per volume and path
+	ns.Driver.volStatsCache.Set(key, stats)
+	return &csi.NodeGetVolumeStatsResponse{Usage: ns.withSubDirUsage(req.VolumeId, req.VolumePath, stats.usage), VolumeCondition: condition}, nil
+}
+
+// NodeExpandVolume node expand volume
+func (ns *NodeServer) NodeExpandVolume(_ context.Context, _ *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// nodeVolumeParams are the volume context parameters used by the node server
+type nodeVolumeParams struct {
+	baseDir          string
+	subDir           string
+	mountOptions     []string
+	mountPermissions uint64
+}
+
+// parseVolumeContext parses the volume context of a node request, or of an
+// internal mount of the controller. The mount options from the volume context
+// are appended to mountOptions.
+func (n *Driver) parseVolumeContext(volumeContext map[string]string, mountOptions []string) (*nodeVolumeParams, error) {
+	params := &nodeVolumeParams{
+		mountOptions:     append([]string{}, mountOptions...),
+		mountPermissions: n.mountPermissions,
 	}
+	subDirReplaceMap := map[string]string{}
+	mountProfile, mountPolicy := "", ""
 
-	volumeMetrics, err := volume.NewMetricsStatFS(req.VolumePath).GetMetrics()
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get metrics: %v", err)
+	for k, v := range volumeContext {
+		switch strings.ToLower(k) {
+		case paramShare:
+			params.baseDir = v
+		case paramSubDir:
+			params.subDir = v
+		case pvcNamespaceKey:
+			subDirReplaceMap[pvcNamespaceMetadata] = v
+		case pvcNameKey:
+			subDirReplaceMap[pvcNameMetadata] = v
+		case pvNameKey:
+			subDirReplaceMap[pvNameMetadata] = v
+		case mountOptionsField:
+			if v != "" {
+				params.mountOptions = append(params.mountOptions, v)
+			}
+		case paramXprtsec:
+			if err := validateXprtsec(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			if v != "" && v != xprtsecNone {
+				params.mountOptions = append(params.mountOptions, paramXprtsec+"="+v)
+			}
+		case paramMountProfile:
+			mountProfile = v
+		case paramMountPolicy:
+			mountPolicy = v
+		case mountPermissionsField:
+			if v != "" {
+				var err error
+				if params.mountPermissions, err = strconv.ParseUint(v, 8, 32); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid mountPermissions %s", v))
+				}
+			}
+		}
 	}
 
-	available, ok := volumeMetrics.Available.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume available size(%v)", volumeMetrics.Available)
+	if params.baseDir == "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%v is a required parameter", paramShare))
 	}
-	capacity, ok := volumeMetrics.Capacity.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume capacity size(%v)", volumeMetrics.Capacity)
+	if params.subDir != "" {
+		// replace pv/pvc name namespace metadata in subDir
+		params.subDir = replaceWithMap(params.subDir, subDirReplaceMap)
 	}
-	used, ok := volumeMetrics.Used.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform volume used size(%v)", volumeMetrics.Used)
+	var err error
+	if params.mountOptions, err = n.resolveMountOptions(mountProfile, mountPolicy, params.mountOptions); err != nil {
+		return nil, err
 	}
+	return params, nil
+}
 
-	inodesFree, ok := volumeMetrics.InodesFree.AsInt64()
+// getAssignedIP returns the NFS server IP assigned to the node by the
+// controller in ControllerPublishVolume.
+func getAssignedIP(publishContext map[string]string, volumeID string) (string, error) {
+	ip, ok := publishContext[lbcontroller.NodeAnnotation]
 	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes free(%v)", volumeMetrics.InodesFree)
+		return "", status.Errorf(codes.InvalidArgument, fmt.Sprintf("NFS server IP not found in PublishContext %v for volume %q", publishContext, volumeID))
 	}
-	inodes, ok := volumeMetrics.Inodes.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes(%v)", volumeMetrics.Inodes)
+	return ip, nil
+}
+
+// getNFSSource returns the server:/share[/subdir] mount source
+func getNFSSource(server, baseDir, subDir string) string {
+	source := fmt.Sprintf("%s:%s", server, baseDir)
+	if subDir != "" {
+		source = strings.TrimRight(source, "/")
+		source = fmt.Sprintf("%s/%s", source, subDir)
 	}
-	inodesUsed, ok := volumeMetrics.InodesUsed.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
-	}
-
-	resp := csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			{
-				Unit:      csi.VolumeUsage_BYTES,
-				Available: available,
-				Total:     capacity,
-				Used:      used,
-			},
-			{
-				Unit:      csi.VolumeUsage_INODES,
-				Available: inodesFree,
-				Total:     inodes,
-				Used:      inodesUsed,
-			},
-		},
-	}
-
-	// cache the volume stats per volume
-	ns.Driver.volStatsCache.Set(req.VolumeId, resp)
-	return &resp, err
+	return source
 }
 
-// NodeUnstageVolume unstage volume
-func (ns *NodeServer) NodeUnstageVolume(_ context.Context, _ *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// setupCredentials installs the Kerberos and TLS credentials from the secrets
+// of a volume mounted at path.
+func (ns *NodeServer) setupCredentials(path string, mountOptions []string, secrets map[string]string) error {
+	if err := ns.setupKerberos(path, mountOptions, secrets); err != nil {
+		return err
+	}
+	if err := ns.setupTLS(path, mountOptions, secrets); err != nil {
+		ns.cleanupKerberosAfterFailure(path)
+		return err
+	}
+	return nil
 }
 
-// NodeStageVolume stage volume
-func (ns *NodeServer) NodeStageVolume(_ context.Context, _ *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// cleanupCredentials removes the Kerberos and TLS credentials of a volume
+// mounted at path.
+func (ns *NodeServer) cleanupCredentials(path string) error {
+	if err := ns.cleanupKerberos(path); err != nil {
+		return err
+	}
+	return ns.cleanupTLS(path)
 }
 
-// NodeExpandVolume node expand volume
-func (ns *NodeServer) NodeExpandVolume(_ context.Context, _ *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// cleanupCredentialsAfterFailure removes the Kerberos and TLS credentials of
+// a volume which failed to mount at path, unless it was already mounted.
+func (ns *NodeServer) cleanupCredentialsAfterFailure(path string) {
+	ns.cleanupKerberosAfterFailure(path)
+	ns.cleanupTLSAfterFailure(path)
 }
 
-func makeDir(pathname string) error {
-	err := os.MkdirAll(pathname, os.FileMode(0755))
+// stagingPathPermissions are the permissions of the staging path when the
+// node plugin creates it, the permissions of the volume apply to the target
+// paths.
+const stagingPathPermissions = 0750
+
+// mountNFS mounts the NFS source on targetPath, unless targetPath is already
+// a mount point, and applies the BDI mount flags. The mount is killed once ctx
+// is done or the mount timeout expires.
+func (ns *NodeServer) mountNFS(ctx context.Context, volumeID, source, targetPath string, mountOptions []string, mountPermissions uint64) error {
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	if err != nil {
-		if !os.IsExist(err) {
-			return err
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(targetPath, os.FileMode(mountPermissions)); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else {
+			return status.Error(codes.Internal, err.Error())
 		}
 	}
-	return nil
-}
+	if !notMnt {
+		return nil
+	}
 
-func collectMountOptions(mntFlags []string) []string {
-	var options []string
-	for _, opt := range mntFlags {
-		if readAheadKBMountFlagRegex.FindString(opt) != "" {
-			// The read_ahead_kb flag is a special flag that isn't
-			// passed directly as an option to the mount command.
-			continue
-		}
-		options = append(options, opt)
+	klog.V(2).Infof("NodePublishVolume: volumeID(%v) source(%s) targetPath(%s) mountflags(%v)", volumeID, source, targetPath, mountOptions)
+	// the BDI mount flags are applied through sysfs once mounted
+	filteredMountOptions, bdiSettings, err := extractBDIMountFlags(mountOptions)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	mountCtx := ctx
+	if ns.Driver.mountTimeout > 0 {
+		var cancel context.CancelFunc
+		mountCtx, cancel = context.WithTimeout(ctx, ns.Driver.mountTimeout)
+		defer cancel()
 	}
-	return options
+	if err = ns.mount(mountCtx, source, targetPath, "nfs", filteredMountOptions); err != nil {
+		return mountError(ctx, mountCtx, err, source, targetPath, ns.Driver.mountTimeout)
+	}
+
+	if err := ns.bdi.apply(targetPath, bdiSettings); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
 }
 
-func extractReadAheadKBMountFlag(mountFlags []string) (int64, bool, error) {
-	for _, mountFlag := range mountFlags {
-		if readAheadKB := readAheadKBMountFlagRegex.FindStringSubmatch(mountFlag); len(readAheadKB) == 2 {
-			// There is only one matching pattern in readAheadKBMountFlagRegex
-			// If found, it will be at index 1
-			readAheadKBInt, err := strconv.ParseInt(readAheadKB[1], 10, 0)
-			if err != nil {
-				return -1, false, fmt.Errorf("invalid read_ahead_kb mount flag %q: %v", mountFlag, err)
-			}
-			if readAheadKBInt < 0 {
-				return -1, false, fmt.Errorf("invalid negative value for read_ahead_kb mount flag: %q", mountFlag)
-			}
-			return readAheadKBInt, true, nil
-		}
+// mountError returns the status of a failed mount of source on targetPath,
+// Unavailable if the mount did not complete within timeout.
+func mountError(ctx, mountCtx context.Context, err error, source, targetPath string, timeout time.Duration) error {
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if mountCtx.Err() != nil {
+		return status.Errorf(codes.Unavailable, "mount of %s on %s did not complete within %v, the NFS server may be unreachable", source, targetPath, timeout)
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if strings.Contains(err.Error(), "invalid argument") {
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
-	return -1, false, nil
+	return status.Error(codes.Internal, err.Error())
 }
 
-func updateReadAhead(targetMountPath string, readAheadKB int64) error {
-	cmd := exec.Command("mountpoint", "-d", targetMountPath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		klog.Errorf("Error executing mountpoint command on target path %s", targetMountPath)
-		if exitError, ok := err.(*exec.ExitError); ok {
-			fmt.Printf("Exit code: %d\n", exitError.ExitCode())
+// chmodTargetPath applies the mount permissions to the published volume
+func chmodTargetPath(targetPath string, mountPermissions uint64) error {
+	if mountPermissions > 0 {
+		if err := chmodIfPermissionMismatch(targetPath, os.FileMode(mountPermissions)); err != nil {
+			return status.Error(codes.Internal, err.Error())
 		}
-		return status.Error(codes.Internal, err.Error())
+	} else {
+		klog.V(2).Infof("skip chmod on targetPath(%s) since mountPermissions is set as 0", targetPath)
 	}
+	return nil
+}
 
-	outputStr := strings.TrimSpace(string(output))
-	klog.Infof("output of mountpoint for target mount path %s: %s", targetMountPath, output)
+// cleanupMountPoint unmounts and removes a target or staging path, force
+// unmounting it when the mounter supports it.
+func (ns *NodeServer) cleanupMountPoint(volumeID, path string) error {
+	return cleanupMount(ns.mounter, volumeID, path)
+}
 
-	// Update the target value
-	sysClassEchoCmd := fmt.Sprintf("echo %d > /sys/class/bdi/%s/read_ahead_kb", readAheadKB, outputStr)
-	klog.V(2).Infof("Executing command %s", sysClassEchoCmd)
-	cmd = exec.Command("sh", "-c", sysClassEchoCmd)
-	_, err = cmd.CombinedOutput()
-	if err != nil {
-		return status.Error(codes.Internal, err.Error())
+// cleanupMount unmounts and removes path with mounter, force unmounting it
+// when the mounter supports it.
+func cleanupMount(mounter mount.Interface, volumeID, path string) error {
+	var err error
+	extensiveMountPointCheck := true
+	forceUnmounter, ok := mounter.(mount.MounterForceUnmounter)
+	if ok {
+		klog.V(2).Infof("force unmount %s on %s", volumeID, path)
+		err = mount.CleanupMountWithForce(path, forceUnmounter, extensiveMountPointCheck, 30*time.Second)
+	} else {
+		err = mount.CleanupMountPoint(path, mounter, extensiveMountPointCheck)
 	}
-
-	// Verify updated value
-	sysClassCatCmd := fmt.Sprintf("cat /sys/class/bdi/%s/read_ahead_kb", outputStr)
-	klog.V(2).Infof("Executing command %s", sysClassCatCmd)
-	cmd = exec.Command("sh", "-c", sysClassCatCmd)
-	op, err := cmd.CombinedOutput()
 	if err != nil {
-		return status.Error(codes.Internal, err.Error())
+		return status.Errorf(codes.Internal, "failed to unmount target %q: %v", path, err)
 	}
-	klog.V(2).Infof("Output of %q : %s", sysClassCatCmd, op)
+	return nil
+}
 
-	opStr := strings.TrimSpace(string(op))
-	updatedVal, err := strconv.ParseInt(opStr, 10, 0)
+func makeDir(pathname string) error {
+	err := os.MkdirAll(pathname, os.FileMode(0755))
 	if err != nil {
-		return fmt.Errorf("invalid read_ahead_kb %v", err)
-	}
-	if updatedVal != readAheadKB {
-		return fmt.Errorf("mismatch in read_ahead_kb, expected %d, got %d", readAheadKB, updatedVal)
+		if !os.IsExist(err) {
+			return err
+		}
 	}
-
 	return nil
 }
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -74,6 +75,7 @@ func TestNodePublishVolume(t *testing.T) {
 	volumeCap := csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
 	alreadyMountedTarget := testutil.GetWorkDirPath("false_is_likely_exist_target", t)
 	targetTest := testutil.GetWorkDirPath("target_test", t)
+	stagedPath := testutil.GetWorkDirPath("false_is_likely_staged", t)
 	lockKey := fmt.Sprintf("%s-%s", "vol_1", targetTest)
 
 	tests := []struct {
@@ -248,6 +250,37 @@ func TestNodePublishVolume(t *testing.T) {
 				Readonly:   true},
 			expectedErr: status.Error(codes.InvalidArgument, "invalid negative value for read_ahead_kb mount flag: \"read_ahead_kb=-1\""),
 		},
+		{
+			desc: "[Error] Volume not staged",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:     params,
+				VolumeCapability:  &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				StagingTargetPath: testutil.GetWorkDirPath("staging_test", t),
+				TargetPath:        targetTest},
+			expectedErr: status.Errorf(codes.FailedPrecondition, "volume vol_1 is not staged at %s", testutil.GetWorkDirPath("staging_test", t)),
+		},
+		{
+			desc: "[Error] Subdirectory missing in staged volume",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:     map[string]string{"share": "share", paramSubDir: "missing"},
+				VolumeCapability:  &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				StagingTargetPath: stagedPath,
+				TargetPath:        targetTest},
+			expectedErr: status.Error(codes.NotFound, "subdirectory missing of volume vol_1 does not exist"),
+		},
+		{
+			desc: "[Success] Bind mount from staging path",
+			req: csi.NodePublishVolumeRequest{
+				VolumeContext:     map[string]string{"share": "share", paramSubDir: "subdir"},
+				VolumeCapability:  &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				StagingTargetPath: stagedPath,
+				TargetPath:        targetTest,
+				Readonly:          true},
+			expectedErr: nil,
+		},
 		{
 			desc: "[Success] Valid request with params without server IP",
 			req: csi.NodePublishVolumeRequest{
@@ -265,6 +298,7 @@ func TestNodePublishVolume(t *testing.T) {
 	// setup
 	_ = makeDir(alreadyMountedTarget)
 	_ = makeDir(targetTest)
+	_ = os.MkdirAll(filepath.Join(stagedPath, "subdir"), 0750)
 
 	for _, tc := range tests {
 		if tc.setup != nil {
@@ -284,9 +318,202 @@ func TestNodePublishVolume(t *testing.T) {
 	assert.NoError(t, err)
 	err = os.RemoveAll(alreadyMountedTarget)
 	assert.NoError(t, err)
+	err = os.RemoveAll(stagedPath)
+	assert.NoError(t, err)
 
 }
 
+func TestNodeStageVolume(t *testing.T) {
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	params := map[string]string{
+		"share":     "share",
+		paramSubDir: "subdir",
+	}
+	publishContext := map[string]string{
+		lbcontroller.NodeAnnotation: "10.10.10.10",
+	}
+	volumeCap := csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER}
+	stagingTest := testutil.GetWorkDirPath("staging_test", t)
+	alreadyStaged := testutil.GetWorkDirPath("false_is_likely_staging", t)
+	errorStaging := testutil.GetWorkDirPath("error_mount_staging", t)
+	lockKey := fmt.Sprintf("%s-%s", "vol_1", stagingTest)
+
+	tests := []struct {
+		desc        string
+		setup       func()
+		req         csi.NodeStageVolumeRequest
+		expectedErr error
+		cleanup     func()
+	}{
+		{
+			desc:        "[Error] Volume capabilities missing",
+			req:         csi.NodeStageVolumeRequest{},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume capability missing in request"),
+		},
+		{
+			desc:        "[Error] Volume ID missing",
+			req:         csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap}},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			desc: "[Error] Staging target path missing",
+			req: csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId: "vol_1"},
+			expectedErr: status.Error(codes.InvalidArgument, "Staging target path not provided"),
+		},
+		{
+			desc: "[Error] Volume operation in progress",
+			setup: func() {
+				ns.Driver.volumeLocks.TryAcquire(lockKey)
+			},
+			req: csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				VolumeContext:     params,
+				PublishContext:    publishContext,
+				StagingTargetPath: stagingTest},
+			expectedErr: status.Error(codes.Aborted, fmt.Sprintf(volumeOperationAlreadyExistsFmt, "vol_1")),
+			cleanup: func() {
+				ns.Driver.volumeLocks.Release(lockKey)
+			},
+		},
+		{
+			desc: "[Error] NFS server IP missing in PublishContext",
+			req: csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				VolumeContext:     params,
+				StagingTargetPath: stagingTest},
+			expectedErr: status.Error(codes.InvalidArgument, "NFS server IP not found in PublishContext map[] for volume \"vol_1\""),
+		},
+		{
+			desc: "[Error] Invalid xprtsec",
+			req: csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				VolumeContext:     map[string]string{"share": "share", paramXprtsec: "ssl"},
+				PublishContext:    publishContext,
+				StagingTargetPath: stagingTest},
+			expectedErr: status.Error(codes.InvalidArgument, "invalid xprtsec \"ssl\", must be none, tls or mtls"),
+		},
+		{
+			desc: "[Error] Mount error mocked by Mount",
+			req: csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				VolumeContext:     params,
+				PublishContext:    publishContext,
+				StagingTargetPath: errorStaging},
+			expectedErr: status.Error(codes.Internal, "fake Mount: target error"),
+		},
+		{
+			desc: "[Success] Valid request",
+			req: csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				VolumeContext:     params,
+				PublishContext:    publishContext,
+				StagingTargetPath: stagingTest},
+		},
+		{
+			desc: "[Success] Volume already staged",
+			req: csi.NodeStageVolumeRequest{VolumeCapability: &csi.VolumeCapability{AccessMode: &volumeCap},
+				VolumeId:          "vol_1",
+				VolumeContext:     params,
+				PublishContext:    publishContext,
+				StagingTargetPath: alreadyStaged},
+		},
+	}
+
+	// setup
+	_ = makeDir(alreadyStaged)
+
+	for _, tc := range tests {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		_, err := ns.NodeStageVolume(context.Background(), &tc.req)
+		if !reflect.DeepEqual(err, tc.expectedErr) {
+			t.Errorf("Desc:%v\nUnexpected error: %v\nExpected: %v", tc.desc, err, tc.expectedErr)
+		}
+		if tc.cleanup != nil {
+			tc.cleanup()
+		}
+	}
+
+	// Clean up
+	for _, path := range []string{stagingTest, alreadyStaged, errorStaging} {
+		err = os.RemoveAll(path)
+		assert.NoError(t, err)
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	ns, err := getTestNodeServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	stagingTest := testutil.GetWorkDirPath("staging_test", t)
+	lockKey := fmt.Sprintf("%s-%s", "vol_1", stagingTest)
+
+	tests := []struct {
+		desc        string
+		setup       func()
+		req         csi.NodeUnstageVolumeRequest
+		expectedErr error
+		cleanup     func()
+	}{
+		{
+			desc:        "[Error] Volume ID missing",
+			req:         csi.NodeUnstageVolumeRequest{StagingTargetPath: stagingTest},
+			expectedErr: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+		},
+		{
+			desc:        "[Error] Staging target path missing",
+			req:         csi.NodeUnstageVolumeRequest{VolumeId: "vol_1"},
+			expectedErr: status.Error(codes.InvalidArgument, "Staging target path missing in request"),
+		},
+		{
+			desc: "[Error] Volume operation in progress",
+			setup: func() {
+				ns.Driver.volumeLocks.TryAcquire(lockKey)
+			},
+			req:         csi.NodeUnstageVolumeRequest{StagingTargetPath: stagingTest, VolumeId: "vol_1"},
+			expectedErr: status.Error(codes.Aborted, fmt.Sprintf(volumeOperationAlreadyExistsFmt, "vol_1")),
+			cleanup: func() {
+				ns.Driver.volumeLocks.Release(lockKey)
+			},
+		},
+		{
+			desc: "[Success] Volume staged",
+			setup: func() {
+				_ = makeDir(stagingTest)
+			},
+			req: csi.NodeUnstageVolumeRequest{StagingTargetPath: stagingTest, VolumeId: "vol_1"},
+		},
+		{
+			desc: "[Success] Staging path already removed",
+			req:  csi.NodeUnstageVolumeRequest{StagingTargetPath: stagingTest, VolumeId: "vol_1"},
+		},
+	}
+
+	for _, tc := range tests {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		_, err := ns.NodeUnstageVolume(context.Background(), &tc.req)
+		if !reflect.DeepEqual(err, tc.expectedErr) {
+			t.Errorf("Desc:%v\nUnexpected error: %v\nExpected: %v", tc.desc, err, tc.expectedErr)
+		}
+		if tc.cleanup != nil {
+			tc.cleanup()
+		}
+	}
+
+	_, err = os.Stat(stagingTest)
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestNodeUnpublishVolume(t *testing.T) {
 	ns, err := getTestNodeServer()
 	if err != nil {
@@ -366,6 +593,13 @@ func TestNodeGetInfo(t *testing.T) {
 	resp, err := ns.NodeGetInfo(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.Equal(t, resp.GetNodeId(), fakeNodeID)
+	assert.Nil(t, resp.GetAccessibleTopology())
+
+	// Test topology
+	ns.Driver.serverPool = "pool-a"
+	resp, err = ns.NodeGetInfo(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"topology." + ns.Driver.name + "/server-pool": "pool-a"}, resp.GetAccessibleTopology().GetSegments())
 }
 
 func TestNodeGetCapabilities(t *testing.T) {
@@ -393,16 +627,13 @@ func TestNodeGetCapabilities(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func getTestNodeServer() (NodeServer, error) {
+func getTestNodeServer() (*NodeServer, error) {
 	d := NewEmptyDriver("")
 	mounter, err := NewFakeMounter()
 	if err != nil {
-		return NodeServer{}, errors.New("failed to get fake mounter")
+		return nil, errors.New("failed to get fake mounter")
 	}
-	return NodeServer{
-		Driver:  d,
-		mounter: mounter,
-	}, nil
+	return NewNodeServer(d, mounter), nil
 }
 
 func TestNodeGetVolumeStats(t *testing.T) {
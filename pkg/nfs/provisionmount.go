@@ -0,0 +1,134 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+// provisionMounter mounts the shares the controller creates, deletes and
+// snapshots volumes in. It does not depend on the node server, which does not
+// run with the controller, and mounts the shares from a reachable IP of the
+// NFS server pool rather than from the server parameter of the volumes.
+type provisionMounter struct {
+	mounter mount.Interface
+	mount   mountFunc
+	// timeout bounds each mount attempt, unlimited if zero
+	timeout time.Duration
+	// ips returns the NFS server IPs of the pool in order of preference,
+	// none if the driver has no pool
+	ips func() []string
+	// probe checks that a NFS server can be reached
+	probe func(ctx context.Context, server string) error
+}
+
+func newProvisionMounter(mounter mount.Interface, timeout time.Duration, ips func() []string) *provisionMounter {
+	return &provisionMounter{
+		mounter: mounter,
+		mount:   newMountFunc(mounter),
+		timeout: timeout,
+		ips:     ips,
+		probe:   probeNFSServer,
+	}
+}
+
+// selectServer returns the server to mount a share of server from: the first
+// reachable IP of the pool, or server itself if the driver has no pool.
+func (p *provisionMounter) selectServer(ctx context.Context, server string) (string, error) {
+	ips := p.ips()
+	if len(ips) == 0 {
+		return server, nil
+	}
+	var unreachable []string
+	for _, ip := range ips {
+		if err := p.probe(ctx, ip); err != nil {
+			klog.V(4).Infof("NFS server %s is unreachable: %v", ip, err)
+			unreachable = append(unreachable, ip)
+			continue
+		}
+		return ip, nil
+	}
+	return "", status.Errorf(codes.Unavailable, "none of the %d NFS server IPs is reachable: %s", len(ips), strings.Join(unreachable, ", "))
+}
+
+// mountShare mounts the share of a volume served by server on targetPath,
+// unless targetPath is already a mount point, and returns the server IP it is
+// mounted from, empty if it was already mounted. The BDI mount flags are
+// ignored, they tune the page cache of the node for the volume and not of the
+// controller.
+func (p *provisionMounter) mountShare(ctx context.Context, volumeID, server, targetPath string, params *nodeVolumeParams) (string, error) {
+	notMnt, err := p.mounter.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		if err := os.MkdirAll(targetPath, os.FileMode(params.mountPermissions)); err != nil {
+			return "", status.Error(codes.Internal, err.Error())
+		}
+		notMnt = true
+	}
+	if !notMnt {
+		return "", nil
+	}
+
+	mountOptions, _, err := extractBDIMountFlags(params.mountOptions)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	ip, err := p.selectServer(ctx, server)
+	if err != nil {
+		return "", err
+	}
+	source := getNFSSource(ip, params.baseDir, "")
+	klog.V(2).Infof("internally mounting volume %s: source(%s) targetPath(%s) mountflags(%v)", volumeID, source, targetPath, mountOptions)
+
+	mountCtx := ctx
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		mountCtx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	if err := p.mount(mountCtx, source, targetPath, "nfs", mountOptions); err != nil {
+		return "", mountError(ctx, mountCtx, err, source, targetPath, p.timeout)
+	}
+	return ip, chmodTargetPath(targetPath, params.mountPermissions)
+}
+
+// unmount unmounts and removes targetPath.
+func (p *provisionMounter) unmount(volumeID, targetPath string) error {
+	return cleanupMount(p.mounter, volumeID, targetPath)
+}
+
+// serverIPs returns the NFS server IPs to mount the shares of the volumes
+// from, the ones assigned to the fewest nodes first once the LB controller has
+// synced.
+func (cs *ControllerServer) serverIPs() []string {
+	if cs.LBController != nil {
+		if ips, err := cs.LBController.IPsByAssignedNodes(); err == nil {
+			return ips
+		}
+	}
+	return cs.Driver.ipList
+}
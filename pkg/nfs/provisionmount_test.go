@@ -0,0 +1,130 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+// newTestProvisionMounter returns a provision mounter with a fake mounter and
+// a pool of ips, of which the unreachable ones fail to be probed.
+func newTestProvisionMounter(ips []string, unreachable ...string) (*provisionMounter, *mount.FakeMounter) {
+	fake := mount.NewFakeMounter(nil)
+	p := newProvisionMounter(fake, 0, func() []string { return ips })
+	p.probe = func(_ context.Context, server string) error {
+		for _, ip := range unreachable {
+			if ip == server {
+				return errors.New("connection refused")
+			}
+		}
+		return nil
+	}
+	return p, fake
+}
+
+func TestSelectServer(t *testing.T) {
+	tests := []struct {
+		desc         string
+		ips          []string
+		unreachable  []string
+		expectedIP   string
+		expectedCode codes.Code
+	}{
+		{
+			desc:       "no pool",
+			expectedIP: testServer,
+		},
+		{
+			desc:       "first IP",
+			ips:        []string{"10.0.0.1", "10.0.0.2"},
+			expectedIP: "10.0.0.1",
+		},
+		{
+			desc:        "unreachable IP skipped",
+			ips:         []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			unreachable: []string{"10.0.0.1", "10.0.0.2"},
+			expectedIP:  "10.0.0.3",
+		},
+		{
+			desc:         "no reachable IP",
+			ips:          []string{"10.0.0.1", "10.0.0.2"},
+			unreachable:  []string{"10.0.0.1", "10.0.0.2"},
+			expectedCode: codes.Unavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			p, _ := newTestProvisionMounter(test.ips, test.unreachable...)
+			ip, err := p.selectServer(context.Background(), testServer)
+			if test.expectedCode != codes.OK {
+				assert.Equal(t, test.expectedCode, status.Code(err))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedIP, ip)
+		})
+	}
+}
+
+func TestProvisionMounterMountShare(t *testing.T) {
+	p, fake := newTestProvisionMounter([]string{"10.0.0.1", "10.0.0.2"}, "10.0.0.1")
+	targetPath := filepath.Join(t.TempDir(), "share")
+	params := &nodeVolumeParams{
+		baseDir:          "/share",
+		mountOptions:     []string{"vers=4.1", "read_ahead_kb=15360"},
+		mountPermissions: 0750,
+	}
+
+	ip, err := p.mountShare(context.Background(), "vol_a", testServer, targetPath, params)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2", ip)
+	assert.Equal(t, []mount.MountPoint{{Device: "10.0.0.2:/share", Path: targetPath, Type: "nfs", Opts: []string{"vers=4.1"}}}, fake.MountPoints)
+
+	// already mounted
+	ip, err = p.mountShare(context.Background(), "vol_a", testServer, targetPath, params)
+	assert.NoError(t, err)
+	assert.Empty(t, ip)
+	assert.Len(t, fake.MountPoints, 1)
+
+	assert.NoError(t, p.unmount("vol_a", targetPath))
+	assert.Empty(t, fake.MountPoints)
+	assert.NoDirExists(t, targetPath)
+
+	p.ips = func() []string { return []string{"10.0.0.1"} }
+	_, err = p.mountShare(context.Background(), "vol_a", testServer, targetPath, params)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Empty(t, fake.MountPoints)
+}
+
+func TestServerIPs(t *testing.T) {
+	driver := NewDriver(&DriverOptions{IPList: []string{"10.0.0.1", "10.0.0.2"}})
+	cs := &ControllerServer{Driver: driver}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, cs.serverIPs())
+
+	cs.LBController = lbcontroller.NewFakeLBController(map[string]int{"10.0.0.1": 2, "10.0.0.2": 1}, nil)
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.1"}, cs.serverIPs())
+}
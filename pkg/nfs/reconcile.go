@@ -0,0 +1,339 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// the policies applied to the mounts found at startup
+	reconcilePolicyNone   = "none"
+	reconcilePolicyReport = "report"
+	reconcilePolicyRepair = "repair"
+
+	// DefaultKubeletDir is the root directory of kubelet
+	DefaultKubeletDir = "/var/lib/kubelet"
+	// volDataFile is written by kubelet next to the staging and target paths
+	// of CSI volumes
+	volDataFile = "vol_data.json"
+
+	// event reasons reported on the node for the mounts found at startup
+	startupMountsFoundReason    = "NFSMountsFoundAtStartup"
+	reassignedIPMountReason     = "NFSMountOnReassignedIP"
+	startupMountsRepairedReason = "NFSMountsRepairedAtStartup"
+)
+
+// checkCorruptedMount is a variable so that tests can report stale and hung
+// mounts.
+var checkCorruptedMount = IsCorruptedDir
+
+// mountState is the state of a mount found at startup.
+type mountState string
+
+const (
+	mountHealthy    mountState = "healthy"
+	mountStale      mountState = "stale"
+	mountReassigned mountState = "reassigned"
+)
+
+var mountStates = []mountState{mountHealthy, mountStale, mountReassigned}
+
+// validateReconcilePolicy checks the policy applied to the mounts found at
+// startup.
+func validateReconcilePolicy(policy string) error {
+	switch policy {
+	case reconcilePolicyNone, reconcilePolicyReport, reconcilePolicyRepair:
+		return nil
+	}
+	return fmt.Errorf("invalid startup reconcile policy %q, must be %s, %s or %s", policy, reconcilePolicyNone, reconcilePolicyReport, reconcilePolicyRepair)
+}
+
+// existingMount is an NFS mount of a volume of the driver found in mountinfo,
+// either the staging mount of a volume or the bind mount of a pod target.
+type existingMount struct {
+	volumeID string
+	info     mount.MountInfo
+	staging  bool
+	server   string
+	state    mountState
+}
+
+// volData is the part of the vol_data.json file of kubelet identifying a
+// volume.
+type volData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// readVolData returns the volume ID recorded by kubelet for the staging or
+// target path, if it is a volume of the driver.
+func readVolData(path, driverName string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(path), volDataFile))
+	if err != nil {
+		return "", false
+	}
+	var v volData
+	if err := json.Unmarshal(data, &v); err != nil {
+		klog.Warningf("failed to parse the %s of %s: %v", volDataFile, path, err)
+		return "", false
+	}
+	return v.VolumeHandle, v.DriverName == driverName && v.VolumeHandle != ""
+}
+
+// findExistingMounts returns the NFS mounts of the volumes of the driver at
+// the staging and pod target paths of kubelet.
+func findExistingMounts(kubeletDir, driverName string) ([]*existingMount, error) {
+	infos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	podsDir := filepath.Join(kubeletDir, "pods") + "/"
+	stagingDir := filepath.Join(kubeletDir, "plugins", "kubernetes.io", "csi") + "/"
+
+	// the last entry is the visible one when mounts are stacked
+	visible := map[string]mount.MountInfo{}
+	for _, info := range infos {
+		if info.FsType == "nfs" || info.FsType == "nfs4" {
+			visible[info.MountPoint] = info
+		}
+	}
+	var mounts []*existingMount
+	for path, info := range visible {
+		staging := strings.HasPrefix(path, stagingDir)
+		if !staging && !strings.HasPrefix(path, podsDir) {
+			continue
+		}
+		volumeID, ok := readVolData(path, driverName)
+		if !ok {
+			continue
+		}
+		server, _ := getServerFromMountSource(info.Source)
+		mounts = append(mounts, &existingMount{volumeID: volumeID, info: info, staging: staging, server: server})
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].info.MountPoint < mounts[j].info.MountPoint })
+	return mounts, nil
+}
+
+// classify sets the state of a mount: stale if it is corrupted, for example
+// with ESTALE, on a reassigned IP if its server is not the IP assigned to the
+// node, which is unknown if empty, and healthy otherwise.
+func (m *existingMount) classify(assignedIP string) {
+	switch {
+	case checkCorruptedMount(m.info.MountPoint):
+		m.state = mountStale
+	case assignedIP != "" && m.server != "" && m.server != assignedIP:
+		m.state = mountReassigned
+	default:
+		m.state = mountHealthy
+	}
+}
+
+// startupMounts counts the mounts found at startup by state, for the metrics.
+type startupMounts struct {
+	mutex  sync.Mutex
+	counts map[mountState]int
+}
+
+func (s *startupMounts) set(counts map[mountState]int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counts = counts
+}
+
+// get returns the counts by state, nil if the mounts were not reconciled.
+func (s *startupMounts) get() map[mountState]int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.counts == nil {
+		return nil
+	}
+	counts := make(map[mountState]int, len(s.counts))
+	for state, n := range s.counts {
+		counts[state] = n
+	}
+	return counts
+}
+
+// reconcileMounts finds the NFS mounts the driver made before it started,
+// which it does not track, reports the stale ones and the ones on an IP
+// which is no longer assigned to the node, and repairs them if the policy is
+// repair. The mounts are checked in the background since a stat of a hung
+// mount blocks.
+func (ns *NodeServer) reconcileMounts(ctx context.Context, kubeletDir, policy string) {
+	if policy == reconcilePolicyNone {
+		return
+	}
+	mounts, err := findExistingMounts(kubeletDir, ns.Driver.name)
+	if err != nil {
+		klog.Warningf("failed to look up the NFS mounts of the driver at startup: %v", err)
+		return
+	}
+
+	var assignedIP string
+	if ns.getNodeIP != nil {
+		if assignedIP, err = ns.getNodeIP(ctx); err != nil {
+			klog.Warningf("failed to get the NFS server IP assigned to node %s, mounts on a reassigned IP are not detected: %v", ns.Driver.nodeID, err)
+		}
+	}
+
+	counts := map[mountState]int{}
+	for _, m := range mounts {
+		m.classify(assignedIP)
+		counts[m.state]++
+		switch m.state {
+		case mountStale:
+			ns.recordNodeEvent(v1.EventTypeWarning, staleMountDetectedReason, "found stale mount of volume %s from %s on %s at startup", m.volumeID, m.info.Source, m.info.MountPoint)
+		case mountReassigned:
+			ns.recordNodeEvent(v1.EventTypeWarning, reassignedIPMountReason, "found mount of volume %s on %s at startup with IP %s, the node is assigned IP %s", m.volumeID, m.info.MountPoint, m.server, assignedIP)
+		}
+	}
+	ns.startupMounts.set(counts)
+	if len(mounts) == 0 {
+		klog.V(2).Infof("found no NFS mount of the driver at startup")
+		return
+	}
+	ns.recordNodeEvent(v1.EventTypeNormal, startupMountsFoundReason, "found %d NFS mount(s) of the driver at startup: %d healthy, %d stale, %d on a reassigned IP",
+		len(mounts), counts[mountHealthy], counts[mountStale], counts[mountReassigned])
+
+	if policy == reconcilePolicyRepair {
+		ns.repairExistingMounts(ctx, mounts)
+	}
+}
+
+// repairExistingMounts tracks the staging mounts found at startup, with the
+// bind mounts of their targets, so that they are checked for stale mounts
+// from then on, remounts the stale ones and the ones on a reassigned IP, and
+// bind mounts them again on their stale targets. The targets mounted without
+// a staging mount are left to kubelet.
+func (ns *NodeServer) repairExistingMounts(ctx context.Context, mounts []*existingMount) {
+	var repaired, failed int
+	// the targets bind mounted from a staging mount
+	covered := map[string]bool{}
+	for _, s := range mounts {
+		if !s.staging {
+			continue
+		}
+		v := newStagedVolumeFromMounts(s, mounts)
+		for targetPath := range v.targets {
+			covered[targetPath] = true
+		}
+		if !ns.stagedVolumes.adopt(v) {
+			// staged again by kubelet since the driver started
+			continue
+		}
+		needsRepair := s.state != mountHealthy
+		for _, m := range mounts {
+			if _, ok := v.targets[m.info.MountPoint]; ok && m.state == mountStale {
+				needsRepair = true
+			}
+		}
+		if !needsRepair {
+			continue
+		}
+
+		lockKey := fmt.Sprintf("%s-%s", v.volumeID, v.stagingPath)
+		if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+			continue
+		}
+		if s.state != mountHealthy {
+			if err := ns.remountStagedVolume(ctx, v); err != nil {
+				failed++
+			} else {
+				repaired++
+			}
+		} else {
+			ns.rebindStaleTargets(v)
+			repaired++
+		}
+		ns.Driver.volumeLocks.Release(lockKey)
+	}
+
+	for _, m := range mounts {
+		if !m.staging && m.state != mountHealthy && !covered[m.info.MountPoint] {
+			klog.Warningf("mount of volume %s on %s is %s but has no staging mount, it is left to kubelet", m.volumeID, m.info.MountPoint, m.state)
+		}
+	}
+	if repaired > 0 || failed > 0 {
+		ns.recordNodeEvent(v1.EventTypeNormal, startupMountsRepairedReason, "repaired %d staged volume(s) found at startup, %d failed", repaired, failed)
+	}
+}
+
+// serverSpecificOptions are the options shown in mountinfo which are set by
+// the kernel for the server of the mount, and not kept on remount. The ports
+// and the mountd version and protocol of an NFSv3 mount are the ones the
+// portmapper of the previous server returned, the new server is asked again.
+var serverSpecificOptions = map[string]bool{
+	"addr":       true,
+	"clientaddr": true,
+	"mountaddr":  true,
+	"mountport":  true,
+	"mountproto": true,
+	"mountvers":  true,
+	"namlen":     true,
+	"port":       true,
+}
+
+// newStagedVolumeFromMounts returns the staged volume of a staging mount
+// found at startup, with the mount options shown in mountinfo and the bind
+// mounts of its targets, which share its device.
+func newStagedVolumeFromMounts(s *existingMount, mounts []*existingMount) *stagedVolume {
+	v := &stagedVolume{
+		volumeID:    s.volumeID,
+		stagingPath: s.info.MountPoint,
+		ip:          s.server,
+		targets:     map[string]publishedTarget{},
+	}
+	if i := strings.LastIndex(s.info.Source, ":/"); i > 0 {
+		v.baseDir = s.info.Source[i+1:]
+	}
+	for _, opt := range s.info.SuperOptions {
+		name, _, _ := strings.Cut(opt, "=")
+		if name != "rw" && name != "ro" && !serverSpecificOptions[name] {
+			v.mountOptions = append(v.mountOptions, opt)
+		}
+	}
+
+	for _, m := range mounts {
+		if m.staging || m.volumeID != s.volumeID || m.info.Major != s.info.Major || m.info.Minor != s.info.Minor {
+			continue
+		}
+		subDir, ok := strings.CutPrefix(m.info.Root, s.info.Root)
+		if !ok {
+			continue
+		}
+		t := publishedTarget{subDir: strings.Trim(subDir, "/")}
+		for _, opt := range m.info.MountOptions {
+			if opt == "ro" {
+				t.readOnly = true
+			}
+		}
+		v.targets[m.info.MountPoint] = t
+	}
+	return v
+}
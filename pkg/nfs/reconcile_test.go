@@ -0,0 +1,275 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
+)
+
+// kubeletMounts are the paths of the mounts of a fake kubelet directory.
+type kubeletMounts struct {
+	dir        string
+	healthy    string
+	target     string
+	stale      string
+	reassigned string
+	other      string
+}
+
+// setupKubeletMounts creates a kubelet directory with the vol_data.json of the
+// volumes of the driver and of another driver, and makes mountInfoPath list
+// their mounts.
+func setupKubeletMounts(t *testing.T) kubeletMounts {
+	dir := t.TempDir()
+	stagingDir := filepath.Join(dir, "plugins", "kubernetes.io", "csi", DefaultDriverName)
+	m := kubeletMounts{
+		dir:        dir,
+		healthy:    filepath.Join(stagingDir, "1a", "globalmount"),
+		target:     filepath.Join(dir, "pods", "uid-1", "volumes", "kubernetes.io~csi", "pv-a", "mount"),
+		stale:      filepath.Join(stagingDir, "2b", "globalmount"),
+		reassigned: filepath.Join(stagingDir, "3c", "globalmount"),
+		other:      filepath.Join(dir, "plugins", "kubernetes.io", "csi", "other.csi.k8s.io", "4d", "globalmount"),
+	}
+	volumes := map[string]string{
+		m.healthy:    `{"driverName":"` + DefaultDriverName + `","volumeHandle":"vol_a"}`,
+		m.target:     `{"driverName":"` + DefaultDriverName + `","volumeHandle":"vol_a","specVolID":"pv-a"}`,
+		m.stale:      `{"driverName":"` + DefaultDriverName + `","volumeHandle":"vol_b"}`,
+		m.reassigned: `{"driverName":"` + DefaultDriverName + `","volumeHandle":"vol_c"}`,
+		m.other:      `{"driverName":"other.csi.k8s.io","volumeHandle":"vol_d"}`,
+	}
+	for path, data := range volumes {
+		assert.NoError(t, os.MkdirAll(path, 0750))
+		assert.NoError(t, os.WriteFile(filepath.Join(filepath.Dir(path), volDataFile), []byte(data), 0600))
+	}
+
+	mountInfo := fmt.Sprintf(`100 25 0:50 / %s rw,relatime shared:1 - nfs4 10.0.0.1:/share rw,vers=4.1,rsize=1048576,namlen=255,hard,proto=tcp,clientaddr=10.128.0.2,addr=10.0.0.1
+101 25 0:50 /subdir %s ro,relatime shared:1 - nfs4 10.0.0.1:/share rw,vers=4.1,rsize=1048576,namlen=255,hard,proto=tcp,clientaddr=10.128.0.2,addr=10.0.0.1
+102 25 0:51 / %s rw,relatime shared:1 - nfs4 10.0.0.1:/share2 rw,vers=4.1,hard,addr=10.0.0.1
+103 25 0:52 / %s rw,relatime shared:1 - nfs 10.0.0.9:/share3 rw,vers=3,hard,proto=tcp,port=2049,mountaddr=10.0.0.9,mountvers=3,mountport=20048,mountproto=udp,local_lock=none,addr=10.0.0.9
+104 25 0:53 / %s rw,relatime shared:1 - nfs4 10.0.0.1:/share4 rw,vers=4.1
+105 25 8:1 / %s rw,relatime shared:1 - ext4 /dev/sda1 rw
+106 25 0:54 / /mnt/nfs rw,relatime shared:1 - nfs4 10.0.0.1:/share rw,vers=4.1
+`, m.healthy, m.target, m.stale, m.reassigned, m.other, filepath.Join(dir, "pods", "uid-2", "volumes", "kubernetes.io~empty-dir", "cache"))
+	mountInfoFile := filepath.Join(dir, "mountinfo")
+	assert.NoError(t, os.WriteFile(mountInfoFile, []byte(mountInfo), 0600))
+	origMountInfoPath := mountInfoPath
+	mountInfoPath = mountInfoFile
+	t.Cleanup(func() { mountInfoPath = origMountInfoPath })
+
+	origCheckCorruptedMount := checkCorruptedMount
+	checkCorruptedMount = func(path string) bool { return path == m.stale }
+	t.Cleanup(func() { checkCorruptedMount = origCheckCorruptedMount })
+	return m
+}
+
+func TestValidateReconcilePolicy(t *testing.T) {
+	for _, policy := range []string{"none", "report", "repair"} {
+		assert.NoError(t, validateReconcilePolicy(policy), policy)
+	}
+	assert.EqualError(t, validateReconcilePolicy("fix"), `invalid startup reconcile policy "fix", must be none, report or repair`)
+}
+
+func TestFindExistingMounts(t *testing.T) {
+	m := setupKubeletMounts(t)
+
+	mounts, err := findExistingMounts(m.dir, DefaultDriverName)
+	assert.NoError(t, err)
+	var found []string
+	for _, e := range mounts {
+		found = append(found, fmt.Sprintf("%s %s %v %s", e.volumeID, e.info.MountPoint, e.staging, e.server))
+	}
+	expected := []string{
+		"vol_a " + m.healthy + " true 10.0.0.1",
+		"vol_b " + m.stale + " true 10.0.0.1",
+		"vol_c " + m.reassigned + " true 10.0.0.9",
+		"vol_a " + m.target + " false 10.0.0.1",
+	}
+	sort.Strings(found)
+	sort.Strings(expected)
+	assert.Equal(t, expected, found)
+
+	mountInfoPath = "/does/not/exist"
+	_, err = findExistingMounts(m.dir, DefaultDriverName)
+	assert.Error(t, err)
+}
+
+func TestNewStagedVolumeFromMounts(t *testing.T) {
+	m := setupKubeletMounts(t)
+	mounts, err := findExistingMounts(m.dir, DefaultDriverName)
+	assert.NoError(t, err)
+
+	var staging *existingMount
+	for _, e := range mounts {
+		if e.info.MountPoint == m.healthy {
+			staging = e
+		}
+	}
+	v := newStagedVolumeFromMounts(staging, mounts)
+	assert.Equal(t, "vol_a", v.volumeID)
+	assert.Equal(t, m.healthy, v.stagingPath)
+	assert.Equal(t, "10.0.0.1", v.ip)
+	assert.Equal(t, "/share", v.baseDir)
+	assert.Equal(t, []string{"vers=4.1", "rsize=1048576", "hard", "proto=tcp"}, v.mountOptions)
+	assert.Equal(t, map[string]publishedTarget{m.target: {subDir: "subdir", readOnly: true}}, v.targets)
+}
+
+func TestReconcileMounts(t *testing.T) {
+	tests := []struct {
+		desc           string
+		policy         string
+		getNodeIP      func(ctx context.Context) (string, error)
+		expectedCounts map[mountState]int
+		expectedEvents []string
+		expectedStaged map[string]string
+		// expectedOptions are the mount options of staged volumes
+		expectedOptions map[string][]string
+	}{
+		{
+			desc:   "none",
+			policy: reconcilePolicyNone,
+		},
+		{
+			desc:           "report without kube client",
+			policy:         reconcilePolicyReport,
+			expectedCounts: map[mountState]int{mountHealthy: 3, mountStale: 1},
+			expectedEvents: []string{
+				"Warning StaleNFSMountDetected found stale mount of volume vol_b",
+				"Normal NFSMountsFoundAtStartup found 4 NFS mount(s) of the driver at startup: 3 healthy, 1 stale, 0 on a reassigned IP",
+			},
+			expectedStaged: map[string]string{},
+		},
+		{
+			desc:           "report",
+			policy:         reconcilePolicyReport,
+			getNodeIP:      func(_ context.Context) (string, error) { return "10.0.0.1", nil },
+			expectedCounts: map[mountState]int{mountHealthy: 2, mountStale: 1, mountReassigned: 1},
+			expectedEvents: []string{
+				"Warning StaleNFSMountDetected found stale mount of volume vol_b",
+				"Warning NFSMountOnReassignedIP found mount of volume vol_c",
+				"Normal NFSMountsFoundAtStartup found 4 NFS mount(s) of the driver at startup: 2 healthy, 1 stale, 1 on a reassigned IP",
+			},
+			expectedStaged: map[string]string{},
+		},
+		{
+			desc:           "repair",
+			policy:         reconcilePolicyRepair,
+			getNodeIP:      func(_ context.Context) (string, error) { return "10.0.0.1", nil },
+			expectedCounts: map[mountState]int{mountHealthy: 2, mountStale: 1, mountReassigned: 1},
+			expectedEvents: []string{
+				"Warning StaleNFSMountDetected found stale mount of volume vol_b",
+				"Warning NFSMountOnReassignedIP found mount of volume vol_c",
+				"Normal NFSMountsFoundAtStartup found 4 NFS mount(s) of the driver at startup: 2 healthy, 1 stale, 1 on a reassigned IP",
+				"Normal StaleNFSMountRemounted remounted stale volume vol_b",
+				"Normal StaleNFSMountRemounted remounted stale volume vol_c",
+				"Normal NFSMountsRepairedAtStartup repaired 2 staged volume(s) found at startup, 0 failed",
+			},
+			expectedStaged: map[string]string{"vol_a": "10.0.0.1", "vol_b": "10.0.0.1", "vol_c": "10.0.0.1"},
+			// the NFSv3 volume is remounted without the ports of the
+			// previous server
+			expectedOptions: map[string][]string{
+				"vol_a": {"vers=4.1", "rsize=1048576", "hard", "proto=tcp"},
+				"vol_c": {"vers=3", "hard", "proto=tcp", "local_lock=none"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			m := setupKubeletMounts(t)
+			ns, err := getTestNodeServer()
+			assert.NoError(t, err)
+			ns.Driver.volumeLocks = NewVolumeLocks()
+			recorder := record.NewFakeRecorder(20)
+			ns.recorder = recorder
+			ns.getNodeIP = test.getNodeIP
+
+			ns.reconcileMounts(context.Background(), m.dir, test.policy)
+			assert.Equal(t, test.expectedCounts, ns.startupMounts.get())
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Len(t, events, len(test.expectedEvents), "%v", events)
+			for i := range test.expectedEvents {
+				if i < len(events) {
+					assert.True(t, strings.HasPrefix(events[i], test.expectedEvents[i]), "unexpected event %q", events[i])
+				}
+			}
+
+			if test.expectedStaged != nil {
+				staged := map[string]string{}
+				for _, v := range ns.stagedVolumes.list() {
+					staged[v.volumeID] = v.ip
+				}
+				assert.Equal(t, test.expectedStaged, staged)
+			}
+			for volumeID, options := range test.expectedOptions {
+				for _, v := range ns.stagedVolumes.list() {
+					if v.volumeID == volumeID {
+						assert.Equal(t, options, v.mountOptions, volumeID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileMountsKeepsStagedVolumes(t *testing.T) {
+	m := setupKubeletMounts(t)
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	ns.Driver.volumeLocks = NewVolumeLocks()
+	// staged again by kubelet before the mounts are reconciled
+	ns.stagedVolumes.stage(&stagedVolume{volumeID: "vol_b", stagingPath: m.stale, ip: "10.0.0.2", mountOptions: []string{"vers=3"}})
+
+	ns.reconcileMounts(context.Background(), m.dir, reconcilePolicyRepair)
+	v, ok := ns.stagedVolumes.get(m.stale)
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2", v.ip)
+	assert.Equal(t, []string{"vers=3"}, v.mountOptions)
+}
+
+func TestStartupMountsCollector(t *testing.T) {
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	c := &startupMountsCollector{ns: ns}
+
+	// nothing is exported before the mounts are reconciled
+	assert.Equal(t, 0, testutil.CollectAndCount(c))
+
+	ns.startupMounts.set(map[mountState]int{mountHealthy: 2, mountStale: 1})
+	expected := `
+# HELP nfs_lb_csi_mount_startup_mounts NFS mounts of the driver found at startup, by state: healthy, stale or reassigned to another IP.
+# TYPE nfs_lb_csi_mount_startup_mounts gauge
+nfs_lb_csi_mount_startup_mounts{state="healthy"} 2
+nfs_lb_csi_mount_startup_mounts{state="reassigned"} 0
+nfs_lb_csi_mount_startup_mounts{state="stale"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(expected)))
+}
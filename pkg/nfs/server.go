@@ -17,6 +17,8 @@ limitations under the License.
 package nfs
 
 import (
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"sync"
@@ -37,6 +39,8 @@ type NonBlockingGRPCServer interface {
 	Stop()
 	// Stops the service forcefully
 	ForceStop()
+	// Returns an error if the service is not accepting connections
+	CheckServing() error
 }
 
 func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
@@ -47,6 +51,10 @@ func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
 type nonBlockingGRPCServer struct {
 	wg     sync.WaitGroup
 	server *grpc.Server
+
+	mutex sync.Mutex
+	// address the server is serving on, nil when not serving
+	listenerAddr net.Addr
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, testMode bool) {
@@ -68,6 +76,29 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
+func (s *nonBlockingGRPCServer) CheckServing() error {
+	s.mutex.Lock()
+	addr := s.listenerAddr
+	s.mutex.Unlock()
+	if addr == nil {
+		return errors.New("gRPC server is not serving")
+	}
+
+	// Connect to the endpoint to also catch a socket file that was removed
+	// from under the running server.
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	return conn.Close()
+}
+
+func (s *nonBlockingGRPCServer) setListenerAddr(addr net.Addr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listenerAddr = addr
+}
+
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, testMode bool) {
 
 	proto, addr, err := ParseEndpoint(endpoint)
@@ -116,7 +147,9 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 
 	klog.Infof("Listening for connections on address: %#v", listener.Addr())
 
+	s.setListenerAddr(listener.Addr())
 	err = server.Serve(listener)
+	s.setListenerAddr(nil)
 	if err != nil {
 		klog.Fatalf("Failed to serve grpc server: %v", err)
 	}
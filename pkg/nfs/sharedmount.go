@@ -0,0 +1,271 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// sharedMountsDir is the directory of the shared mounts in the working
+	// mount directory
+	sharedMountsDir = ".shared"
+	// sharedMountCheckInterval is how often the shared mounts are checked for
+	// idleness and health
+	sharedMountCheckInterval = 30 * time.Second
+)
+
+// shareKey identifies the mounts of a share which can be shared.
+type shareKey struct {
+	server  string
+	baseDir string
+	options string
+}
+
+func (k shareKey) String() string {
+	return k.server + ":" + k.baseDir
+}
+
+// shareMount is an internal mount of a share shared by the controller
+// requests.
+type shareMount struct {
+	key  shareKey
+	path string
+	// ip is the server IP the share is mounted from
+	ip string
+	// mounted is closed once the mount attempt completes, with err set if it
+	// failed
+	mounted chan struct{}
+	err     error
+	// the fields below are guarded by the mutex of sharedMounts
+	refs     int
+	lastUsed time.Time
+	// dropped is set once the mount is no longer handed out, because it
+	// failed or is unhealthy, it is unmounted with its last reference
+	dropped bool
+}
+
+// isMounted returns whether the mount attempt of m succeeded.
+func (m *shareMount) isMounted() bool {
+	select {
+	case <-m.mounted:
+		return m.err == nil
+	default:
+		return false
+	}
+}
+
+// sharedMounts keeps the internal mounts of the shares of the controller
+// across requests, so that the requests on volumes of the same share do not
+// each mount and unmount it. A mount is reference counted by the requests
+// using it, unmounted once unused for the idle timeout, and dropped once its
+// server is unreachable or the mount is corrupted.
+type sharedMounts struct {
+	mutex       sync.Mutex
+	provisioner *provisionMounter
+	// dir is the directory the shares are mounted in
+	dir         string
+	idleTimeout time.Duration
+	mounts      []*shareMount
+	// seq numbers the mounts, so that the mount replacing a dropped one is
+	// not on the same path
+	seq int
+}
+
+func newSharedMounts(provisioner *provisionMounter, workingMountDir string, idleTimeout time.Duration) *sharedMounts {
+	return &sharedMounts{
+		provisioner: provisioner,
+		dir:         filepath.Join(workingMountDir, sharedMountsDir),
+		idleTimeout: idleTimeout,
+	}
+}
+
+// acquire takes a reference on the mount of the share of a volume served by
+// server, mounting it if needed, and returns it. The reference is released
+// with release.
+func (s *sharedMounts) acquire(ctx context.Context, volumeID, server string, params *nodeVolumeParams) (*shareMount, error) {
+	key := shareKey{server: server, baseDir: params.baseDir, options: strings.Join(params.mountOptions, ",")}
+
+	s.mutex.Lock()
+	m := s.find(func(m *shareMount) bool { return m.key == key && !m.dropped })
+	owner := m == nil
+	if owner {
+		s.seq++
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s\x00%s\x00%s", key.server, key.baseDir, key.options)
+		m = &shareMount{
+			key:     key,
+			path:    filepath.Join(s.dir, fmt.Sprintf("%016x-%d", h.Sum64(), s.seq)),
+			mounted: make(chan struct{}),
+		}
+		s.mounts = append(s.mounts, m)
+	}
+	m.refs++
+	s.mutex.Unlock()
+
+	if owner {
+		m.ip, m.err = s.provisioner.mountShare(ctx, volumeID, server, m.path, params)
+		if m.err != nil {
+			s.mutex.Lock()
+			m.dropped = true
+			s.mutex.Unlock()
+		} else {
+			klog.V(2).Infof("mounted shared internal mount of %s on %s", key, m.path)
+		}
+		close(m.mounted)
+	}
+
+	select {
+	case <-m.mounted:
+	case <-ctx.Done():
+		s.release(m.path)
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if m.err != nil {
+		s.release(m.path)
+		return nil, m.err
+	}
+	return m, nil
+}
+
+// release releases a reference on the mount at path, and unmounts it if it
+// was the last reference of a dropped mount.
+func (s *sharedMounts) release(path string) error {
+	s.mutex.Lock()
+	m := s.find(func(m *shareMount) bool { return m.path == path })
+	if m == nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("no shared internal mount on %s", path)
+	}
+	m.refs--
+	m.lastUsed = time.Now()
+	unmount := m.refs == 0 && m.dropped
+	if unmount {
+		s.remove(m)
+	}
+	s.mutex.Unlock()
+
+	if unmount {
+		return s.provisioner.unmount(m.key.String(), m.path)
+	}
+	return nil
+}
+
+// find returns the first mount matching match. It must be called with the
+// mutex held.
+func (s *sharedMounts) find(match func(m *shareMount) bool) *shareMount {
+	for _, m := range s.mounts {
+		if match(m) {
+			return m
+		}
+	}
+	return nil
+}
+
+// remove forgets m. It must be called with the mutex held.
+func (s *sharedMounts) remove(m *shareMount) {
+	mounts := s.mounts[:0]
+	for _, other := range s.mounts {
+		if other != m {
+			mounts = append(mounts, other)
+		}
+	}
+	s.mounts = mounts
+}
+
+// run checks the shared mounts every interval until ctx is done.
+func (s *sharedMounts) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx, time.Now())
+		}
+	}
+}
+
+// check unmounts the mounts unused for the idle timeout, and drops the
+// unhealthy ones: the ones whose server is unreachable or which are corrupted.
+// The dropped mounts still in use are unmounted once released.
+func (s *sharedMounts) check(ctx context.Context, now time.Time) {
+	s.mutex.Lock()
+	var idle, mounted []*shareMount
+	for _, m := range s.mounts {
+		if m.dropped || !m.isMounted() {
+			continue
+		}
+		if m.refs == 0 && now.Sub(m.lastUsed) >= s.idleTimeout {
+			idle = append(idle, m)
+			continue
+		}
+		mounted = append(mounted, m)
+	}
+	for _, m := range idle {
+		s.remove(m)
+	}
+	s.mutex.Unlock()
+
+	for _, m := range idle {
+		klog.V(2).Infof("unmounting shared internal mount of %s on %s, unused since %v", m.key, m.path, m.lastUsed)
+		if err := s.provisioner.unmount(m.key.String(), m.path); err != nil {
+			klog.Warningf("failed to unmount idle shared internal mount on %s: %v", m.path, err)
+		}
+	}
+
+	// the mounts are checked without the mutex held, a corrupted mount may
+	// take a while to stat
+	for _, m := range mounted {
+		var reason string
+		if m.ip != "" {
+			if err := s.provisioner.probe(ctx, m.ip); err != nil {
+				reason = fmt.Sprintf("NFS server %s is unreachable: %v", m.ip, err)
+			}
+		}
+		if reason == "" && checkCorruptedMount(m.path) {
+			reason = "mount is corrupted"
+		}
+		if reason == "" {
+			continue
+		}
+
+		klog.Warningf("dropping shared internal mount of %s on %s: %s", m.key, m.path, reason)
+		s.mutex.Lock()
+		m.dropped = true
+		unmount := m.refs == 0
+		if unmount {
+			s.remove(m)
+		}
+		s.mutex.Unlock()
+		if unmount {
+			if err := s.provisioner.unmount(m.key.String(), m.path); err != nil {
+				klog.Warningf("failed to unmount shared internal mount on %s: %v", m.path, err)
+			}
+		}
+	}
+}
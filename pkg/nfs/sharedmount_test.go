@@ -0,0 +1,160 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	mount "k8s.io/mount-utils"
+)
+
+func newTestSharedMounts(t *testing.T) (*sharedMounts, *mount.FakeMounter) {
+	p, fake := newTestProvisionMounter(nil)
+	return newSharedMounts(p, t.TempDir(), time.Minute), fake
+}
+
+func TestSharedMountsAcquire(t *testing.T) {
+	s, fake := newTestSharedMounts(t)
+	ctx := context.Background()
+	params := &nodeVolumeParams{baseDir: "/share", mountOptions: []string{"vers=4.1"}}
+
+	var wg sync.WaitGroup
+	paths := make([]string, 10)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m, err := s.acquire(ctx, "vol", testServer, params)
+			assert.NoError(t, err)
+			paths[i] = m.path
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, fake.MountPoints, 1)
+	for _, path := range paths {
+		assert.Equal(t, fake.MountPoints[0].Path, path)
+	}
+	assert.Equal(t, 10, s.mounts[0].refs)
+
+	// other options, other mount
+	other, err := s.acquire(ctx, "vol", testServer, &nodeVolumeParams{baseDir: "/share", mountOptions: []string{"vers=3"}})
+	assert.NoError(t, err)
+	assert.NotEqual(t, paths[0], other.path)
+	assert.Len(t, fake.MountPoints, 2)
+
+	for _, path := range append(paths, other.path) {
+		assert.NoError(t, s.release(path))
+	}
+	// the unused mounts are kept until they are idle
+	assert.Len(t, fake.MountPoints, 2)
+	assert.Error(t, s.release(filepath.Join(s.dir, "unknown")))
+}
+
+func TestSharedMountsAcquireFailure(t *testing.T) {
+	s, fake := newTestSharedMounts(t)
+	s.provisioner.ips = func() []string { return []string{"10.0.0.1"} }
+	s.provisioner.probe = func(_ context.Context, _ string) error { return errors.New("connection refused") }
+	params := &nodeVolumeParams{baseDir: "/share"}
+
+	_, err := s.acquire(context.Background(), "vol", testServer, params)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Empty(t, s.mounts)
+	assert.Empty(t, fake.MountPoints)
+
+	// the next request mounts the share again
+	s.provisioner.probe = func(_ context.Context, _ string) error { return nil }
+	m, err := s.acquire(context.Background(), "vol", testServer, params)
+	assert.NoError(t, err)
+	assert.Equal(t, []mount.MountPoint{{Device: "10.0.0.1:/share", Path: m.path, Type: "nfs", Opts: []string{}}}, fake.MountPoints)
+}
+
+func TestSharedMountsCheck(t *testing.T) {
+	s, fake := newTestSharedMounts(t)
+	s.provisioner.ips = func() []string { return []string{"10.0.0.1"} }
+	unreachable := false
+	s.provisioner.probe = func(_ context.Context, _ string) error {
+		if unreachable {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	ctx := context.Background()
+	params := &nodeVolumeParams{baseDir: "/share"}
+
+	idle, err := s.acquire(ctx, "vol", testServer, params)
+	assert.NoError(t, err)
+	assert.NoError(t, s.release(idle.path))
+	s.check(ctx, time.Now())
+	assert.Len(t, fake.MountPoints, 1, "recently used mount unmounted")
+	s.check(ctx, time.Now().Add(2*time.Minute))
+	assert.Empty(t, fake.MountPoints, "idle mount not unmounted")
+	assert.Empty(t, s.mounts)
+
+	// an unhealthy mount in use is no longer handed out, and unmounted once
+	// released
+	busy, err := s.acquire(ctx, "vol", testServer, params)
+	assert.NoError(t, err)
+	unreachable = true
+	s.check(ctx, time.Now())
+	assert.Len(t, fake.MountPoints, 1)
+	unreachable = false
+	replacement, err := s.acquire(ctx, "vol", testServer, params)
+	assert.NoError(t, err)
+	assert.NotEqual(t, busy.path, replacement.path)
+	assert.Len(t, fake.MountPoints, 2)
+	assert.NoError(t, s.release(busy.path))
+	assert.Equal(t, []mount.MountPoint{{Device: "10.0.0.1:/share", Path: replacement.path, Type: "nfs"}}, fake.MountPoints)
+
+	// an unused corrupted mount is unmounted right away
+	assert.NoError(t, s.release(replacement.path))
+	origCheckCorruptedMount := checkCorruptedMount
+	checkCorruptedMount = func(path string) bool { return path == replacement.path }
+	t.Cleanup(func() { checkCorruptedMount = origCheckCorruptedMount })
+	s.check(ctx, time.Now())
+	assert.Empty(t, fake.MountPoints)
+	assert.Empty(t, s.mounts)
+}
+
+func TestInternalMountShared(t *testing.T) {
+	cs := initTestController(t)
+	cs.Driver.workingMountDir = t.TempDir()
+	cs.sharedMounts = newSharedMounts(cs.provisioner, cs.Driver.workingMountDir, time.Minute)
+	fake := cs.provisioner.mounter.(*mount.FakeMounter)
+	ctx := context.Background()
+
+	vol1 := &nfsVolume{id: "vol1", server: testServer, baseDir: testBaseDir, subDir: "vol1"}
+	vol2 := &nfsVolume{id: "vol2", server: testServer, baseDir: testBaseDir, subDir: "vol2"}
+	path1, err := cs.internalMount(ctx, vol1, map[string]string{paramSubDir: "vol1"}, nil)
+	assert.NoError(t, err)
+	path2, err := cs.internalMount(ctx, vol2, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, path1, path2)
+	assert.Equal(t, filepath.Join(path1, "vol2"), getInternalVolumePath(path2, vol2))
+	assert.Len(t, fake.MountPoints, 1)
+
+	assert.NoError(t, cs.internalUnmount(ctx, vol1, path1))
+	assert.NoError(t, cs.internalUnmount(ctx, vol2, path2))
+	assert.Len(t, fake.MountPoints, 1)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/driverconfig"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// shares returns the shares of the driver configuration.
+func (n *Driver) shares() []*driverconfig.Share {
+	if n.config == nil {
+		return nil
+	}
+	return n.config.Get().Shares
+}
+
+// mountConfiguredShare mounts the i-th share of the driver configuration in
+// the controller for an operation on the whole share, named by op, and
+// returns its path with the function unmounting it.
+func (cs *ControllerServer) mountConfiguredShare(ctx context.Context, op string, i int, share *driverconfig.Share) (string, func(), error) {
+	vol := &nfsVolume{
+		server:  share.Server,
+		baseDir: share.Share,
+		// the mount directory when the internal mounts are not shared
+		uuid: fmt.Sprintf("%s-%d", op, i),
+	}
+	vol.id = getVolumeIDFromNfsVol(vol)
+	if acquired := cs.Driver.volumeLocks.TryAcquire(vol.uuid); !acquired {
+		return "", nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, vol.uuid)
+	}
+
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{MountFlags: share.MountOptions},
+		},
+	}
+	sharePath, err := cs.internalMount(ctx, vol, nil, volCap)
+	if err != nil {
+		cs.Driver.volumeLocks.Release(vol.uuid)
+		return "", nil, status.Errorf(codes.Internal, "failed to mount nfs server %s:%s: %v", share.Server, share.Share, err)
+	}
+	return sharePath, func() {
+		if err := cs.internalUnmount(ctx, vol, sharePath); err != nil {
+			klog.Warningf("failed to unmount nfs server: %v", err)
+		}
+		cs.Driver.volumeLocks.Release(vol.uuid)
+	}, nil
+}
@@ -0,0 +1,404 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// event reasons reported on the node for stale mount repairs
+	staleMountDetectedReason      = "StaleNFSMountDetected"
+	staleMountRemountedReason     = "StaleNFSMountRemounted"
+	staleMountRemountFailedReason = "StaleNFSMountRemountFailed"
+)
+
+// corruptedDirTimeout bounds the checks of the mounts, a stat of a hard NFS
+// mount whose server is unreachable hangs. It is a variable so that tests can
+// shorten it.
+var corruptedDirTimeout = 10 * time.Second
+
+// corruptedDirCheck is a check of a directory in progress.
+type corruptedDirCheck struct {
+	done      chan struct{}
+	corrupted bool
+}
+
+// corruptedDirChecks are the checks in progress by directory, a check hung on
+// a dead mount is shared by the later checks of the directory instead of
+// starting a goroutine each.
+var corruptedDirChecks sync.Map
+
+// checkCorruptedDir returns whether a directory is a corrupted mount, or an
+// error if the check does not complete within timeout.
+func checkCorruptedDir(dir string, timeout time.Duration) (bool, error) {
+	c := &corruptedDirCheck{done: make(chan struct{})}
+	if existing, loaded := corruptedDirChecks.LoadOrStore(dir, c); loaded {
+		c = existing.(*corruptedDirCheck)
+	} else {
+		check := checkCorruptedMount
+		go func() {
+			c.corrupted = check(dir)
+			corruptedDirChecks.Delete(dir)
+			close(c.done)
+		}()
+	}
+	select {
+	case <-c.done:
+		return c.corrupted, nil
+	case <-time.After(timeout):
+		return false, fmt.Errorf("checking %s did not complete within %v, its NFS server may be unreachable", dir, timeout)
+	}
+}
+
+// stagedVolume is a volume mounted at a staging path by NodeStageVolume,
+// along with the targets it is bind mounted on.
+type stagedVolume struct {
+	volumeID     string
+	stagingPath  string
+	ip           string
+	baseDir      string
+	mountOptions []string
+	// targets maps the target paths to their bind mount
+	targets map[string]publishedTarget
+}
+
+// publishedTarget is a bind mount of a staged volume made by NodePublishVolume.
+type publishedTarget struct {
+	subDir           string
+	readOnly         bool
+	mountPermissions uint64
+}
+
+// stagedVolumes tracks the volumes staged by the node server, keyed by
+// staging path, so that stale mounts can be remounted. It only knows about
+// the volumes staged or published since the plugin started.
+type stagedVolumes struct {
+	mutex   sync.Mutex
+	volumes map[string]*stagedVolume
+}
+
+func newStagedVolumes() *stagedVolumes {
+	return &stagedVolumes{volumes: map[string]*stagedVolume{}}
+}
+
+func (s *stagedVolumes) stage(v *stagedVolume) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if existing, ok := s.volumes[v.stagingPath]; ok {
+		v.targets = existing.targets
+	}
+	if v.targets == nil {
+		v.targets = map[string]publishedTarget{}
+	}
+	s.volumes[v.stagingPath] = v
+}
+
+// adopt tracks a volume staged before the plugin started, unless it was
+// staged again since, and returns true if it was added.
+func (s *stagedVolumes) adopt(v *stagedVolume) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.volumes[v.stagingPath]; ok {
+		return false
+	}
+	if v.targets == nil {
+		v.targets = map[string]publishedTarget{}
+	}
+	s.volumes[v.stagingPath] = v
+	return true
+}
+
+func (s *stagedVolumes) unstage(stagingPath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.volumes, stagingPath)
+}
+
+func (s *stagedVolumes) publish(stagingPath, targetPath string, t publishedTarget) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.volumes[stagingPath]; ok {
+		v.targets[targetPath] = t
+	}
+}
+
+func (s *stagedVolumes) unpublish(targetPath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, v := range s.volumes {
+		delete(v.targets, targetPath)
+	}
+}
+
+// getTarget returns the bind mount of a staged volume at targetPath.
+func (s *stagedVolumes) getTarget(targetPath string) (publishedTarget, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, v := range s.volumes {
+		if t, ok := v.targets[targetPath]; ok {
+			return t, true
+		}
+	}
+	return publishedTarget{}, false
+}
+
+// getStagedTarget returns the staging path of the volume bind mounted at
+// targetPath, along with the bind mount.
+func (s *stagedVolumes) getStagedTarget(targetPath string) (string, publishedTarget, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for stagingPath, v := range s.volumes {
+		if t, ok := v.targets[targetPath]; ok {
+			return stagingPath, t, true
+		}
+	}
+	return "", publishedTarget{}, false
+}
+
+// get returns a copy of the staged volume at stagingPath.
+func (s *stagedVolumes) get(stagingPath string) (*stagedVolume, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok := s.volumes[stagingPath]
+	if !ok {
+		return nil, false
+	}
+	return v.copy(), true
+}
+
+// list returns a copy of every staged volume.
+func (s *stagedVolumes) list() []*stagedVolume {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	volumes := make([]*stagedVolume, 0, len(s.volumes))
+	for _, v := range s.volumes {
+		volumes = append(volumes, v.copy())
+	}
+	return volumes
+}
+
+func (v *stagedVolume) copy() *stagedVolume {
+	c := *v
+	c.mountOptions = append([]string{}, v.mountOptions...)
+	c.targets = make(map[string]publishedTarget, len(v.targets))
+	for path, t := range v.targets {
+		c.targets[path] = t
+	}
+	return &c
+}
+
+// setIP records the IP a staged volume was remounted with.
+func (s *stagedVolumes) setIP(stagingPath, ip string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.volumes[stagingPath]; ok {
+		v.ip = ip
+	}
+}
+
+// newInClusterClient returns a kube client for the node server.
+func newInClusterClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return clientset, nil
+}
+
+// nodeIPGetter returns a function reading the NFS server IP currently
+// assigned to the node by the LB controller from the node annotation.
+func nodeIPGetter(clientset kubernetes.Interface, nodeName string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		node, err := clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		return node.Annotations[lbcontroller.NodeAnnotation], nil
+	}
+}
+
+// newNodeEventRecorder returns a recorder for events about the node.
+func newNodeEventRecorder(clientset kubernetes.Interface, driverName, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName, Host: nodeName})
+}
+
+// recordNodeEvent logs an event and reports it on the node if a recorder is set.
+func (ns *NodeServer) recordNodeEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if eventType == v1.EventTypeWarning {
+		klog.Warningf("%s: %s", reason, message)
+	} else {
+		klog.Infof("%s: %s", reason, message)
+	}
+	if ns.recorder == nil {
+		return
+	}
+	// kubelet uses the node name as UID for the events about the node
+	node := &v1.ObjectReference{Kind: "Node", Name: ns.Driver.nodeID, UID: types.UID(ns.Driver.nodeID)}
+	ns.recorder.Event(node, eventType, reason, message)
+}
+
+// remountStagedVolume replaces the corrupted staging mount of a volume, using
+// the IP currently assigned to the node if it changed, and bind mounts the
+// new staging mount again on the corrupted targets of the volume.
+// The caller holds the staging path lock of the volume, the targets are not
+// bind mounted again if they cannot be checked.
+func (ns *NodeServer) remountStagedVolume(ctx context.Context, v *stagedVolume) error {
+	ip := v.ip
+	if ns.getNodeIP != nil {
+		newIP, err := ns.getNodeIP(ctx)
+		if err != nil {
+			klog.Warningf("failed to get the NFS server IP assigned to node %s, remounting volume %s with %s: %v", ns.Driver.nodeID, v.volumeID, ip, err)
+		} else if newIP != "" {
+			ip = newIP
+		}
+	}
+
+	if err := ns.cleanupMountPoint(v.volumeID, v.stagingPath); err != nil {
+		ns.recordNodeEvent(v1.EventTypeWarning, staleMountRemountFailedReason, "failed to unmount stale staging path %s of volume %s: %v", v.stagingPath, v.volumeID, err)
+		return err
+	}
+	source := getNFSSource(ip, v.baseDir, "")
+	if err := ns.mountNFS(ctx, v.volumeID, source, v.stagingPath, v.mountOptions, stagingPathPermissions); err != nil {
+		ns.recordNodeEvent(v1.EventTypeWarning, staleMountRemountFailedReason, "failed to remount volume %s from %s on %s: %v", v.volumeID, source, v.stagingPath, err)
+		return err
+	}
+	ns.stagedVolumes.setIP(v.stagingPath, ip)
+
+	var rebound int
+	for targetPath, t := range v.targets {
+		corrupted, err := checkCorruptedDir(targetPath, corruptedDirTimeout)
+		if err != nil {
+			ns.recordNodeEvent(v1.EventTypeWarning, staleMountRemountFailedReason, "failed to check target %s of volume %s: %v", targetPath, v.volumeID, err)
+			continue
+		}
+		if !corrupted {
+			continue
+		}
+		if err := ns.cleanupMountPoint(v.volumeID, targetPath); err != nil {
+			ns.recordNodeEvent(v1.EventTypeWarning, staleMountRemountFailedReason, "failed to unmount stale target %s of volume %s: %v", targetPath, v.volumeID, err)
+			continue
+		}
+		if err := ns.bindMount(v.volumeID, v.stagingPath, targetPath, t); err != nil {
+			ns.recordNodeEvent(v1.EventTypeWarning, staleMountRemountFailedReason, "failed to bind mount volume %s on %s again: %v", v.volumeID, targetPath, err)
+			continue
+		}
+		rebound++
+	}
+
+	if ip != v.ip {
+		ns.recordNodeEvent(v1.EventTypeNormal, staleMountRemountedReason, "remounted stale volume %s on %s with newly assigned IP %s (was %s), %d target(s) bind mounted again", v.volumeID, v.stagingPath, ip, v.ip, rebound)
+	} else {
+		ns.recordNodeEvent(v1.EventTypeNormal, staleMountRemountedReason, "remounted stale volume %s on %s with IP %s, %d target(s) bind mounted again", v.volumeID, v.stagingPath, ip, rebound)
+	}
+	return nil
+}
+
+// repairStaleMounts remounts the staged volumes whose staging mount or bind
+// mounts are corrupted, for example with ESTALE after a failover of the NFS
+// server. The mounts are checked without the volume locks, so that a mount
+// hung on an unreachable server does not block the operations on the volume,
+// and are skipped if the check times out. Volumes with an operation in
+// progress are checked on the next run.
+func (ns *NodeServer) repairStaleMounts(ctx context.Context) {
+	for _, v := range ns.stagedVolumes.list() {
+		corrupted, err := checkCorruptedDir(v.stagingPath, corruptedDirTimeout)
+		if err != nil {
+			klog.Warningf("skipping the stale mount checks of volume %s: %v", v.volumeID, err)
+			continue
+		}
+		if !corrupted {
+			ns.rebindStaleTargets(v)
+			continue
+		}
+
+		lockKey := fmt.Sprintf("%s-%s", v.volumeID, v.stagingPath)
+		if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+			continue
+		}
+		klog.Warningf("staging path %s of volume %s is corrupted", v.stagingPath, v.volumeID)
+		_ = ns.remountStagedVolume(ctx, v)
+		ns.Driver.volumeLocks.Release(lockKey)
+	}
+}
+
+// rebindStaleTargets bind mounts a healthy staging mount again on its
+// corrupted targets.
+func (ns *NodeServer) rebindStaleTargets(v *stagedVolume) {
+	for targetPath, t := range v.targets {
+		corrupted, err := checkCorruptedDir(targetPath, corruptedDirTimeout)
+		if err != nil {
+			klog.Warningf("skipping the stale mount check of target %s of volume %s: %v", targetPath, v.volumeID, err)
+			continue
+		}
+		if !corrupted {
+			continue
+		}
+		lockKey := fmt.Sprintf("%s-%s", v.volumeID, targetPath)
+		if acquired := ns.Driver.volumeLocks.TryAcquire(lockKey); !acquired {
+			continue
+		}
+		err = ns.cleanupMountPoint(v.volumeID, targetPath)
+		if err == nil {
+			err = ns.bindMount(v.volumeID, v.stagingPath, targetPath, t)
+		}
+		if err != nil {
+			ns.recordNodeEvent(v1.EventTypeWarning, staleMountRemountFailedReason, "failed to bind mount volume %s on stale target %s again: %v", v.volumeID, targetPath, err)
+		} else {
+			ns.recordNodeEvent(v1.EventTypeNormal, staleMountRemountedReason, "bind mounted volume %s on stale target %s again", v.volumeID, targetPath)
+		}
+		ns.Driver.volumeLocks.Release(lockKey)
+	}
+}
+
+// runStaleMountChecks checks the staged volumes for stale mounts every
+// interval until ctx is done.
+func (ns *NodeServer) runStaleMountChecks(ctx context.Context, interval time.Duration) {
+	klog.V(2).Infof("checking staged volumes for stale mounts every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ns.repairStaleMounts(ctx)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/lbcontroller"
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/test/utils/testutil"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestStagedVolumes(t *testing.T) {
+	s := newStagedVolumes()
+	s.stage(&stagedVolume{volumeID: "vol_1", stagingPath: "/staging/1", ip: "10.0.0.1"})
+	s.stage(&stagedVolume{volumeID: "vol_2", stagingPath: "/staging/2", ip: "10.0.0.1"})
+	s.publish("/staging/1", "/target/a", publishedTarget{subDir: "a"})
+	s.publish("/staging/1", "/target/b", publishedTarget{subDir: "b", readOnly: true})
+	// publishing from an unknown staging path is ignored
+	s.publish("/staging/3", "/target/c", publishedTarget{})
+
+	v, ok := s.get("/staging/1")
+	assert.True(t, ok)
+	assert.Len(t, v.targets, 2)
+	assert.Equal(t, publishedTarget{subDir: "b", readOnly: true}, v.targets["/target/b"])
+
+	// staging again, as after a kubelet restart, keeps the targets
+	s.stage(&stagedVolume{volumeID: "vol_1", stagingPath: "/staging/1", ip: "10.0.0.2"})
+	s.unpublish("/target/a")
+	v, ok = s.get("/staging/1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.2", v.ip)
+	assert.Len(t, v.targets, 1)
+
+	// the returned volume is a copy
+	v.targets["/target/d"] = publishedTarget{}
+	s.setIP("/staging/1", "10.0.0.3")
+	v, _ = s.get("/staging/1")
+	assert.Len(t, v.targets, 1)
+	assert.Equal(t, "10.0.0.3", v.ip)
+
+	s.unstage("/staging/1")
+	_, ok = s.get("/staging/1")
+	assert.False(t, ok)
+	assert.Len(t, s.list(), 1)
+}
+
+func TestRemountStagedVolume(t *testing.T) {
+	stagingPath := testutil.GetWorkDirPath("staging_remount", t)
+	defer os.RemoveAll(stagingPath)
+
+	tests := []struct {
+		desc          string
+		getNodeIP     func(ctx context.Context) (string, error)
+		expectedIP    string
+		expectedEvent string
+	}{
+		{
+			desc:          "no kube client",
+			expectedIP:    "10.0.0.1",
+			expectedEvent: "Normal StaleNFSMountRemounted remounted stale volume vol_1 on " + stagingPath + " with IP 10.0.0.1",
+		},
+		{
+			desc:          "newly assigned IP",
+			getNodeIP:     func(_ context.Context) (string, error) { return "10.0.0.2", nil },
+			expectedIP:    "10.0.0.2",
+			expectedEvent: "Normal StaleNFSMountRemounted remounted stale volume vol_1 on " + stagingPath + " with newly assigned IP 10.0.0.2 (was 10.0.0.1)",
+		},
+		{
+			desc:          "failure to get the assigned IP",
+			getNodeIP:     func(_ context.Context) (string, error) { return "", errors.New("fake error") },
+			expectedIP:    "10.0.0.1",
+			expectedEvent: "Normal StaleNFSMountRemounted remounted stale volume vol_1 on " + stagingPath + " with IP 10.0.0.1",
+		},
+	}
+
+	for _, tc := range tests {
+		ns, err := getTestNodeServer()
+		assert.NoError(t, err)
+		recorder := record.NewFakeRecorder(10)
+		ns.recorder = recorder
+		ns.getNodeIP = tc.getNodeIP
+		ns.stagedVolumes.stage(&stagedVolume{volumeID: "vol_1", stagingPath: stagingPath, ip: "10.0.0.1", baseDir: "/share"})
+
+		v, _ := ns.stagedVolumes.get(stagingPath)
+		err = ns.remountStagedVolume(context.Background(), v)
+		assert.NoError(t, err, tc.desc)
+
+		v, _ = ns.stagedVolumes.get(stagingPath)
+		assert.Equal(t, tc.expectedIP, v.ip, tc.desc)
+		event := <-recorder.Events
+		assert.True(t, strings.HasPrefix(event, tc.expectedEvent), "%s: unexpected event %q", tc.desc, event)
+	}
+}
+
+func TestNodeIPGetter(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "node-1",
+			Annotations: map[string]string{lbcontroller.NodeAnnotation: "10.0.0.1"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(node)
+
+	ip, err := nodeIPGetter(clientset, "node-1")(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", ip)
+
+	_, err = nodeIPGetter(clientset, "node-2")(context.Background())
+	assert.Error(t, err)
+}
+
+func TestCheckCorruptedDir(t *testing.T) {
+	defer func(check func(string) bool) { checkCorruptedMount = check }(checkCorruptedMount)
+	unblock := make(chan struct{})
+	var calls atomic.Int32
+	checkCorruptedMount = func(path string) bool {
+		calls.Add(1)
+		<-unblock
+		return path == "/staging/stale"
+	}
+
+	// a hung check times out, and is shared by the next checks
+	_, err := checkCorruptedDir("/staging/stale", 10*time.Millisecond)
+	assert.Error(t, err)
+	_, err = checkCorruptedDir("/staging/stale", 10*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+
+	close(unblock)
+	corrupted, err := checkCorruptedDir("/staging/stale", time.Second)
+	assert.NoError(t, err)
+	assert.True(t, corrupted)
+	corrupted, err = checkCorruptedDir("/staging/healthy", time.Second)
+	assert.NoError(t, err)
+	assert.False(t, corrupted)
+}
+
+func TestRepairStaleMountsHung(t *testing.T) {
+	defer func(check func(string) bool, timeout time.Duration) {
+		checkCorruptedMount = check
+		corruptedDirTimeout = timeout
+	}(checkCorruptedMount, corruptedDirTimeout)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	checkCorruptedMount = func(_ string) bool {
+		<-unblock
+		return true
+	}
+	corruptedDirTimeout = 10 * time.Millisecond
+
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	ns.stagedVolumes.stage(&stagedVolume{volumeID: "vol_1", stagingPath: "/staging/hung", ip: "10.0.0.1"})
+	ns.stagedVolumes.publish("/staging/hung", "/target/hung", publishedTarget{})
+
+	// the hung mounts are skipped without holding the locks of the volume
+	ns.repairStaleMounts(context.Background())
+	for _, lockKey := range []string{"vol_1-/staging/hung", "vol_1-/target/hung"} {
+		assert.True(t, ns.Driver.volumeLocks.TryAcquire(lockKey), lockKey)
+		ns.Driver.volumeLocks.Release(lockKey)
+	}
+}
@@ -0,0 +1,437 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/nfs-lb-csi-driver/pkg/supervisor"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// keys of the node stage or publish secrets of TLS volumes, the ones of
+	// the kubernetes.io/tls secrets
+	tlsSecretCA   = "ca.crt"
+	tlsSecretCert = "tls.crt"
+	tlsSecretKey  = "tls.key"
+
+	// the xprtsec volume attribute and mount option
+	paramXprtsec = "xprtsec"
+	xprtsecNone  = "none"
+	xprtsecTLS   = "tls"
+	xprtsecMTLS  = "mtls"
+)
+
+// ErrTLSUnsupported is returned by TLSDaemon when the kernel of the node does
+// not support NFS over TLS.
+var ErrTLSUnsupported = errors.New("NFS over TLS is not supported on this node")
+
+var (
+	kernelReleasePath = "/proc/sys/kernel/osrelease"
+	// the first kernel release with the xprtsec mount option
+	tlsMinKernelRelease = [2]int{6, 5}
+)
+
+// xprtsecPolicy returns the TLS policy of the xprtsec mount option, false if
+// the volume is not mounted with TLS.
+func xprtsecPolicy(mountOptions []string) (string, bool) {
+	policy := ""
+	for _, opt := range mountOptions {
+		for _, o := range strings.Split(opt, ",") {
+			// the last xprtsec option wins, as for mount
+			if strings.HasPrefix(o, paramXprtsec+"=") {
+				policy = strings.TrimPrefix(o, paramXprtsec+"=")
+			}
+		}
+	}
+	switch policy {
+	case xprtsecTLS, xprtsecMTLS:
+		return policy, true
+	}
+	return "", false
+}
+
+// validateXprtsec checks the value of the xprtsec volume attribute.
+func validateXprtsec(v string) error {
+	switch v {
+	case "", xprtsecNone, xprtsecTLS, xprtsecMTLS:
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q, must be %s, %s or %s", paramXprtsec, v, xprtsecNone, xprtsecTLS, xprtsecMTLS)
+}
+
+// checkTLSKernel returns an error if the running kernel does not support the
+// xprtsec mount option.
+func checkTLSKernel() error {
+	content, err := os.ReadFile(kernelReleasePath)
+	if err != nil {
+		return fmt.Errorf("failed to read the kernel release: %v", err)
+	}
+	release := strings.TrimSpace(string(content))
+	major, minor, err := parseKernelRelease(release)
+	if err != nil {
+		return err
+	}
+	if major < tlsMinKernelRelease[0] || (major == tlsMinKernelRelease[0] && minor < tlsMinKernelRelease[1]) {
+		return fmt.Errorf("NFS over TLS requires Linux %d.%d or later, the node runs %s", tlsMinKernelRelease[0], tlsMinKernelRelease[1], release)
+	}
+	return nil
+}
+
+// parseKernelRelease returns the major and minor version of a kernel release
+// such as 6.5.0-1025-gke.
+func parseKernelRelease(release string) (int, int, error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	// the minor version may be followed by a suffix without a patch version
+	minorDigits := parts[1]
+	if i := strings.IndexFunc(minorDigits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minorDigits = minorDigits[:i]
+	}
+	minor, err := strconv.Atoi(minorDigits)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	return major, minor, nil
+}
+
+// parseCertificates returns the certificates of a PEM bundle.
+func parseCertificates(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// tlsVolume are the TLS credentials of a volume mounted at path.
+type tlsVolume struct {
+	path string
+	ca   []byte
+	// cert and key are the client certificate of mtls volumes
+	cert []byte
+	key  []byte
+}
+
+// tlsCredentials manage the TLS credentials of the volumes mounted on the
+// node, from the CA bundle and client certificate of their secrets, in a
+// directory shared with tlshd:
+//
+//	tlshd.conf      the configuration of tlshd, pointing to the files below
+//	ca.crt          the trust store of tlshd, the CA bundle of the volumes
+//	tls.crt         the client certificate of tlshd
+//	tls.key         the private key of the client certificate
+//	volumes/<key>/  the path, CA and client certificate of a volume, to
+//	                restore them when the plugin restarts
+//
+// tlshd reads its configuration once, but the files on every handshake. It
+// has a single trust store and presents a single client certificate for all
+// the servers, so the TLS volumes mounted on a node must use the same CA
+// bundle, and the mtls volumes the same client certificate, for the CA of a
+// volume not to be trusted for the servers of another.
+type tlsCredentials struct {
+	dir     string
+	mutex   sync.Mutex
+	volumes map[string]*tlsVolume
+}
+
+func newTLSCredentials(dir string) (*tlsCredentials, error) {
+	if err := ensureTLSDir(dir); err != nil {
+		return nil, err
+	}
+	c := &tlsCredentials{dir: dir, volumes: map[string]*tlsVolume{}}
+
+	volumeDirs, err := os.ReadDir(filepath.Join(dir, "volumes"))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range volumeDirs {
+		v, err := loadTLSVolume(filepath.Join(dir, "volumes", d.Name()))
+		if err != nil {
+			klog.Warningf("failed to restore the TLS credentials in %s: %v", d.Name(), err)
+			continue
+		}
+		c.volumes[v.path] = v
+	}
+	if err := c.writeFiles(); err != nil {
+		return nil, err
+	}
+	klog.V(2).Infof("restored the TLS credentials of %d volume(s) from %s", len(c.volumes), dir)
+	return c, nil
+}
+
+// ensureTLSDir creates the directories and the configuration of tlshd, and
+// empty credentials if there are none.
+func ensureTLSDir(dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, "volumes"), 0700); err != nil {
+		return err
+	}
+	conf := fmt.Sprintf(`[authenticate.client]
+x509.truststore=%s
+x509.certificate=%s
+x509.private_key=%s
+`, filepath.Join(dir, tlsSecretCA), filepath.Join(dir, tlsSecretCert), filepath.Join(dir, tlsSecretKey))
+	if err := writeFileAtomic(filepath.Join(dir, "tlshd.conf"), []byte(conf), 0644); err != nil {
+		return err
+	}
+	for _, name := range []string{tlsSecretCA, tlsSecretCert, tlsSecretKey} {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			if err := writeFileAtomic(file, nil, 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func loadTLSVolume(dir string) (*tlsVolume, error) {
+	path, err := os.ReadFile(filepath.Join(dir, "path"))
+	if err != nil {
+		return nil, err
+	}
+	v := &tlsVolume{path: string(path)}
+	for name, content := range map[string]*[]byte{tlsSecretCA: &v.ca, tlsSecretCert: &v.cert, tlsSecretKey: &v.key} {
+		if *content, err = os.ReadFile(filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// install installs the credentials of the volume mounted at path with the
+// xprtsec policy from its secrets, before it is mounted.
+func (c *tlsCredentials) install(path, policy string, secrets map[string]string) error {
+	v := &tlsVolume{
+		path: path,
+		ca:   []byte(secrets[tlsSecretCA]),
+		cert: []byte(secrets[tlsSecretCert]),
+		key:  []byte(secrets[tlsSecretKey]),
+	}
+	if len(v.ca) == 0 {
+		return status.Errorf(codes.InvalidArgument, "xprtsec=%s requires a %q in the node stage or publish secrets", policy, tlsSecretCA)
+	}
+	if _, err := parseCertificates(v.ca); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid %s secret: %v", tlsSecretCA, err)
+	}
+	hasCert := len(v.cert) > 0 || len(v.key) > 0
+	switch {
+	case policy == xprtsecMTLS && !hasCert:
+		return status.Errorf(codes.InvalidArgument, "xprtsec=%s requires a %q and %q in the node stage or publish secrets", policy, tlsSecretCert, tlsSecretKey)
+	case policy != xprtsecMTLS && hasCert:
+		return status.Errorf(codes.InvalidArgument, "a %q or %q secret requires xprtsec=%s", tlsSecretCert, tlsSecretKey, xprtsecMTLS)
+	case hasCert:
+		if _, err := tls.X509KeyPair(v.cert, v.key); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid %s and %s secrets: %v", tlsSecretCert, tlsSecretKey, err)
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for p, other := range c.volumes {
+		if p == path {
+			continue
+		}
+		if !bytes.Equal(other.ca, v.ca) {
+			return status.Errorf(codes.FailedPrecondition, "the volume mounted at %s on this node uses another CA bundle: the TLS volumes of a node must use the same CA bundle", p)
+		}
+		if hasCert && len(other.cert) > 0 && !bytes.Equal(other.cert, v.cert) {
+			return status.Errorf(codes.FailedPrecondition, "the volume mounted at %s on this node uses another client certificate: the mtls volumes of a node must use the same client certificate", p)
+		}
+	}
+
+	volumeDir := filepath.Join(c.dir, "volumes", credentialsKey(path))
+	if err := os.MkdirAll(volumeDir, 0700); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	files := map[string][]byte{
+		"path":        []byte(path),
+		tlsSecretCA:   v.ca,
+		tlsSecretCert: v.cert,
+		tlsSecretKey:  v.key,
+	}
+	for name, content := range files {
+		if err := writeFileAtomic(filepath.Join(volumeDir, name), content, 0600); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	c.volumes[path] = v
+	if err := c.writeFiles(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	klog.V(2).Infof("installed the TLS credentials for %s with xprtsec=%s", path, policy)
+	return nil
+}
+
+// uninstall removes the credentials of the volume mounted at path.
+func (c *tlsCredentials) uninstall(path string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.volumes[path]; !ok {
+		return nil
+	}
+	delete(c.volumes, path)
+	if err := c.writeFiles(); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := os.RemoveAll(filepath.Join(c.dir, "volumes", credentialsKey(path))); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	klog.V(2).Infof("removed the TLS credentials of %s", path)
+	return nil
+}
+
+// writeFiles writes the trust store of tlshd with the CA bundle of the
+// volumes, and the client certificate of the mtls volumes. It must be called with the
+// mutex held.
+func (c *tlsCredentials) writeFiles() error {
+	paths := make([]string, 0, len(c.volumes))
+	for p := range c.volumes {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var ca, cert, key []byte
+	seen := map[string]bool{}
+	for _, p := range paths {
+		v := c.volumes[p]
+		if !seen[string(v.ca)] {
+			seen[string(v.ca)] = true
+			ca = append(ca, v.ca...)
+			if len(ca) > 0 && ca[len(ca)-1] != '\n' {
+				ca = append(ca, '\n')
+			}
+		}
+		if len(v.cert) > 0 {
+			cert, key = v.cert, v.key
+		}
+	}
+	// the key is written before the certificate, which is written last, so
+	// that a handshake sees a matching pair once the certificate is updated
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{{tlsSecretCA, ca}, {tlsSecretKey, key}, {tlsSecretCert, cert}} {
+		if err := writeFileAtomic(filepath.Join(c.dir, f.name), f.content, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupTLS checks that the node supports the xprtsec mount option of a
+// volume mounted at path, and installs the TLS credentials from its secrets.
+func (ns *NodeServer) setupTLS(path string, mountOptions []string, secrets map[string]string) error {
+	policy, isTLS := xprtsecPolicy(mountOptions)
+	_, hasCA := secrets[tlsSecretCA]
+	_, hasCert := secrets[tlsSecretCert]
+	if !isTLS {
+		if hasCA || hasCert {
+			return status.Errorf(codes.InvalidArgument, "a %q or %q secret requires the xprtsec=%s or %s mount option", tlsSecretCA, tlsSecretCert, xprtsecTLS, xprtsecMTLS)
+		}
+		return nil
+	}
+	if err := checkTLSKernel(); err != nil {
+		return status.Errorf(codes.FailedPrecondition, "xprtsec=%s is not supported on node %s: %v", policy, ns.Driver.nodeID, err)
+	}
+	if ns.tls == nil {
+		if hasCA || hasCert {
+			return status.Errorf(codes.FailedPrecondition, "TLS credentials from secrets are not enabled on node %s", ns.Driver.nodeID)
+		}
+		// the node may be configured for TLS by other means
+		return nil
+	}
+	return ns.tls.install(path, policy, secrets)
+}
+
+// cleanupTLS removes the TLS credentials of a volume mounted at path.
+func (ns *NodeServer) cleanupTLS(path string) error {
+	if ns.tls == nil {
+		return nil
+	}
+	return ns.tls.uninstall(path)
+}
+
+// cleanupTLSAfterFailure removes the TLS credentials of a volume which failed
+// to mount at path, unless it was already mounted.
+func (ns *NodeServer) cleanupTLSAfterFailure(path string) {
+	if ns.tls == nil {
+		return
+	}
+	if notMnt, err := ns.mounter.IsLikelyNotMountPoint(path); err == nil && !notMnt {
+		return
+	}
+	if err := ns.tls.uninstall(path); err != nil {
+		klog.Warningf("failed to remove the TLS credentials of %s: %v", path, err)
+	}
+}
+
+// TLSDaemon prepares the directory of the TLS credentials of the volumes and
+// returns the tlshd daemon using them. It returns ErrTLSUnsupported if the
+// kernel is too old, the node server then rejects the TLS volumes.
+func TLSDaemon(dir string) (supervisor.Daemon, error) {
+	if err := checkTLSKernel(); err != nil {
+		return supervisor.Daemon{}, fmt.Errorf("%w: %v", ErrTLSUnsupported, err)
+	}
+	tlshd := supervisor.TLSHandshakeDaemon(filepath.Join(dir, "tlshd.conf"))
+	if _, err := exec.LookPath(tlshd.Command); err != nil {
+		return supervisor.Daemon{}, fmt.Errorf("%s is not installed, it is provided by the ktls-utils package: %w", tlshd.Command, err)
+	}
+	if err := ensureTLSDir(dir); err != nil {
+		return supervisor.Daemon{}, err
+	}
+	return tlshd, nil
+}
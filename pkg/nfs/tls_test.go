@@ -0,0 +1,225 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// buildCertificate returns a self-signed PEM certificate and its PEM key.
+func buildCertificate(t *testing.T, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// setKernelRelease makes checkTLSKernel see the kernel release.
+func setKernelRelease(t *testing.T, release string) {
+	file := filepath.Join(t.TempDir(), "osrelease")
+	assert.NoError(t, os.WriteFile(file, []byte(release+"\n"), 0600))
+	origKernelReleasePath := kernelReleasePath
+	kernelReleasePath = file
+	t.Cleanup(func() { kernelReleasePath = origKernelReleasePath })
+}
+
+func TestXprtsecPolicy(t *testing.T) {
+	tests := []struct {
+		mountOptions   []string
+		expectedPolicy string
+		expectedOK     bool
+	}{
+		{mountOptions: []string{"nfsvers=4.2", "xprtsec=tls"}, expectedPolicy: "tls", expectedOK: true},
+		{mountOptions: []string{"hard,xprtsec=mtls"}, expectedPolicy: "mtls", expectedOK: true},
+		{mountOptions: []string{"xprtsec=tls", "xprtsec=none"}},
+		{mountOptions: []string{"nfsvers=4.2"}},
+	}
+
+	for _, test := range tests {
+		policy, ok := xprtsecPolicy(test.mountOptions)
+		assert.Equal(t, test.expectedPolicy, policy, "%v", test.mountOptions)
+		assert.Equal(t, test.expectedOK, ok, "%v", test.mountOptions)
+	}
+}
+
+func TestCheckTLSKernel(t *testing.T) {
+	tests := []struct {
+		release     string
+		expectedErr string
+	}{
+		{release: "6.5.0-1025-gke"},
+		{release: "6.10.3"},
+		{release: "7.0"},
+		{release: "6.6-rc1"},
+		{release: "6.1.100+", expectedErr: "NFS over TLS requires Linux 6.5 or later, the node runs 6.1.100+"},
+		{release: "5.15.0", expectedErr: "NFS over TLS requires Linux 6.5 or later, the node runs 5.15.0"},
+		{release: "linux", expectedErr: "invalid kernel release \"linux\""},
+	}
+
+	for _, test := range tests {
+		setKernelRelease(t, test.release)
+		err := checkTLSKernel()
+		if test.expectedErr == "" {
+			assert.NoError(t, err, test.release)
+		} else {
+			assert.EqualError(t, err, test.expectedErr, test.release)
+		}
+	}
+}
+
+func TestTLSDaemon(t *testing.T) {
+	// tlshd is skipped on the kernels without TLS, rather than failing the
+	// node driver
+	setKernelRelease(t, "5.15.0")
+	_, err := TLSDaemon(t.TempDir())
+	assert.ErrorIs(t, err, ErrTLSUnsupported)
+
+	// without the tlshd binary, --tls-dir is refused
+	setKernelRelease(t, "6.8.0")
+	t.Setenv("PATH", t.TempDir())
+	_, err = TLSDaemon(t.TempDir())
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrTLSUnsupported)
+}
+
+func TestTLSCredentials(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newTLSCredentials(dir)
+	assert.NoError(t, err)
+	readFile := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		return string(content)
+	}
+	conf := readFile("tlshd.conf")
+	assert.Contains(t, conf, "x509.truststore="+filepath.Join(dir, tlsSecretCA))
+	assert.Contains(t, conf, "x509.certificate="+filepath.Join(dir, tlsSecretCert))
+	assert.Empty(t, readFile(tlsSecretCA))
+
+	ca1, _ := buildCertificate(t, "ca1")
+	ca2, _ := buildCertificate(t, "ca2")
+	cert, key := buildCertificate(t, "client")
+	otherCert, otherKey := buildCertificate(t, "other")
+
+	assert.NoError(t, c.install("/staging/1", xprtsecTLS, map[string]string{tlsSecretCA: ca1}))
+	assert.NoError(t, c.install("/staging/2", xprtsecMTLS, map[string]string{tlsSecretCA: ca1, tlsSecretCert: cert, tlsSecretKey: key}))
+	// the same CA bundle is written once
+	assert.NoError(t, c.install("/staging/3", xprtsecTLS, map[string]string{tlsSecretCA: ca1}))
+	assert.Equal(t, ca1, readFile(tlsSecretCA))
+	assert.Equal(t, cert, readFile(tlsSecretCert))
+	assert.Equal(t, key, readFile(tlsSecretKey))
+
+	invalid := []struct {
+		desc         string
+		policy       string
+		secrets      map[string]string
+		expectedCode codes.Code
+	}{
+		{desc: "no CA", policy: xprtsecTLS, secrets: map[string]string{}, expectedCode: codes.InvalidArgument},
+		{desc: "invalid CA", policy: xprtsecTLS, secrets: map[string]string{tlsSecretCA: "not a certificate"}, expectedCode: codes.InvalidArgument},
+		{desc: "mtls without certificate", policy: xprtsecMTLS, secrets: map[string]string{tlsSecretCA: ca1}, expectedCode: codes.InvalidArgument},
+		{desc: "tls with certificate", policy: xprtsecTLS, secrets: map[string]string{tlsSecretCA: ca1, tlsSecretCert: cert, tlsSecretKey: key}, expectedCode: codes.InvalidArgument},
+		{desc: "mismatched key", policy: xprtsecMTLS, secrets: map[string]string{tlsSecretCA: ca1, tlsSecretCert: cert, tlsSecretKey: otherKey}, expectedCode: codes.InvalidArgument},
+		{desc: "another client certificate", policy: xprtsecMTLS, secrets: map[string]string{tlsSecretCA: ca1, tlsSecretCert: otherCert, tlsSecretKey: otherKey}, expectedCode: codes.FailedPrecondition},
+		{desc: "another CA bundle", policy: xprtsecTLS, secrets: map[string]string{tlsSecretCA: ca2}, expectedCode: codes.FailedPrecondition},
+		{desc: "another CA bundle with the same client certificate", policy: xprtsecMTLS, secrets: map[string]string{tlsSecretCA: ca2, tlsSecretCert: cert, tlsSecretKey: key}, expectedCode: codes.FailedPrecondition},
+	}
+	for _, test := range invalid {
+		err := c.install("/staging/4", test.policy, test.secrets)
+		assert.Equal(t, test.expectedCode, status.Code(err), test.desc)
+	}
+
+	// the credentials are restored after a restart
+	c, err = newTLSCredentials(dir)
+	assert.NoError(t, err)
+	assert.Len(t, c.volumes, 3)
+	assert.Equal(t, ca1, readFile(tlsSecretCA))
+
+	// the client certificate is removed with the last mtls volume
+	assert.NoError(t, c.uninstall("/staging/2"))
+	assert.NoDirExists(t, filepath.Join(dir, "volumes", credentialsKey("/staging/2")))
+	assert.Equal(t, ca1, readFile(tlsSecretCA))
+	assert.Empty(t, readFile(tlsSecretCert))
+	assert.Empty(t, readFile(tlsSecretKey))
+	// unknown paths are ignored
+	assert.NoError(t, c.uninstall("/staging/2"))
+
+	// another client certificate can be used once no volume uses the previous one
+	assert.NoError(t, c.install("/staging/4", xprtsecMTLS, map[string]string{tlsSecretCA: ca1, tlsSecretCert: otherCert, tlsSecretKey: otherKey}))
+	assert.Equal(t, otherCert, readFile(tlsSecretCert))
+
+	// and another CA bundle once no volume uses the previous one
+	for _, p := range []string{"/staging/1", "/staging/3", "/staging/4"} {
+		assert.NoError(t, c.uninstall(p))
+	}
+	assert.NoError(t, c.install("/staging/5", xprtsecTLS, map[string]string{tlsSecretCA: ca2}))
+	assert.Equal(t, ca2, readFile(tlsSecretCA))
+}
+
+func TestSetupTLS(t *testing.T) {
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	ca, _ := buildCertificate(t, "ca")
+	secrets := map[string]string{tlsSecretCA: ca}
+	xprtsec := []string{"nfsvers=4.2", "xprtsec=tls"}
+	setKernelRelease(t, "6.8.0")
+
+	// without TLS credentials from secrets, the node may be set up for TLS by
+	// other means
+	assert.NoError(t, ns.setupTLS("/target", xprtsec, nil))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(ns.setupTLS("/target", xprtsec, secrets)))
+	assert.Equal(t, codes.InvalidArgument, status.Code(ns.setupTLS("/target", []string{"nfsvers=4.2"}, secrets)))
+	assert.NoError(t, ns.setupTLS("/target", nil, nil))
+
+	ns.tls, err = newTLSCredentials(t.TempDir())
+	assert.NoError(t, err)
+	assert.Equal(t, codes.InvalidArgument, status.Code(ns.setupTLS("/target", xprtsec, nil)))
+	assert.NoError(t, ns.setupTLS("/target", xprtsec, secrets))
+	assert.Contains(t, ns.tls.volumes, "/target")
+	assert.NoError(t, ns.cleanupTLS("/target"))
+	assert.NotContains(t, ns.tls.volumes, "/target")
+
+	setKernelRelease(t, "5.15.0")
+	err = ns.setupTLS("/target", xprtsec, secrets)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.ErrorContains(t, err, "NFS over TLS requires Linux 6.5 or later")
+	assert.NotContains(t, ns.tls.volumes, "/target")
+}
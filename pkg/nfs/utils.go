@@ -30,19 +30,20 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 
 	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
 	netutil "k8s.io/utils/net"
 )
 
 //nolint:revive
 const (
 	separator                       = "#"
-	delete                          = "delete"
+	deletePolicy                    = "delete"
 	retain                          = "retain"
 	archive                         = "archive"
 	volumeOperationAlreadyExistsFmt = "An operation with the given Volume ID %s already exists"
 )
 
-var supportedOnDeleteValues = []string{"", delete, retain, archive}
+var supportedOnDeleteValues = []string{"", deletePolicy, retain, archive}
 
 func validateOnDeleteValue(onDelete string) error {
 	for _, v := range supportedOnDeleteValues {
@@ -62,12 +63,23 @@ func NewDefaultIdentityServer(d *Driver) *IdentityServer {
 
 func NewControllerServer(d *Driver) *ControllerServer {
 	c := &ControllerServer{
-		Driver: d,
+		Driver:   d,
+		metadata: newMetadataCache(),
 	}
 
 	if d.ipList != nil && len(d.ipList) != 0 {
-		c.LBController = lbcontroller.NewLBController(d.ipList)
+		c.LBController = lbcontroller.NewLBController(d.name, d.ipList, d.lbStrategy, d.loadNamespace)
+	}
+
+	var mounter mount.Interface = mount.New("")
+	if d.nativeMount {
+		mounter = newNativeMounter(mounter)
+	}
+	c.provisioner = newProvisionMounter(mounter, d.mountTimeout, c.serverIPs)
+	if d.internalMountIdleTimeout > 0 {
+		c.sharedMounts = newSharedMounts(c.provisioner, d.workingMountDir, d.internalMountIdleTimeout)
 	}
+	c.capacity = newCapacityCache(d.capacityRefreshInterval)
 
 	return c
 }
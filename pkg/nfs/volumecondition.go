@@ -0,0 +1,152 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+	mount "k8s.io/mount-utils"
+)
+
+const (
+	// serverProbeTimeout bounds the connection to the NFS port of a server
+	serverProbeTimeout = 2 * time.Second
+	volumeHealthyMsg   = "volume is healthy"
+	// volumeNotPublishedMsg is the condition of a volume served by no IP
+	volumeNotPublishedMsg = "volume is not published on any node"
+)
+
+var (
+	// nfsServerPort is the port probed to check that a NFS server is reachable
+	nfsServerPort = "2049"
+	// mountInfoPath is the mountinfo file used to look up the mounts of volumes
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// probeNFSServer checks that a TCP connection to the NFS port of server can
+// be opened.
+func probeNFSServer(ctx context.Context, server string) error {
+	ctx, cancel := context.WithTimeout(ctx, serverProbeTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(strings.Trim(server, "[]"), nfsServerPort))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// getServerFromMountSource returns the server of a server:/share mount source.
+func getServerFromMountSource(source string) (string, bool) {
+	i := strings.LastIndex(source, ":/")
+	if i <= 0 {
+		return "", false
+	}
+	return strings.Trim(source[:i], "[]"), true
+}
+
+// findMountInfo returns the mountinfo entry of the mount at path.
+func findMountInfo(path string) (*mount.MountInfo, error) {
+	infos, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	// the last entry is the visible one when mounts are stacked
+	for i := len(infos) - 1; i >= 0; i-- {
+		if infos[i].MountPoint == path {
+			return &infos[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// abnormalCondition returns an abnormal volume condition.
+func abnormalCondition(messageFmt string, args ...interface{}) *csi.VolumeCondition {
+	return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf(messageFmt, args...)}
+}
+
+// getVolumeCondition checks the mount of a volume at volumePath for
+// unreachable NFS servers and unexpected read only mounts. It only reads the
+// mountinfo so that it does not block on a hung mount, stale file handles are
+// detected when collecting the volume stats.
+func (ns *NodeServer) getVolumeCondition(ctx context.Context, volumePath string) *csi.VolumeCondition {
+	info, err := findMountInfo(volumePath)
+	if err != nil {
+		klog.V(4).Infof("failed to look up the mount of %s: %v", volumePath, err)
+		return &csi.VolumeCondition{Message: volumeHealthyMsg}
+	}
+	if info == nil {
+		return &csi.VolumeCondition{Message: volumeHealthyMsg}
+	}
+
+	if server, ok := getServerFromMountSource(info.Source); ok {
+		if err := probeNFSServer(ctx, server); err != nil {
+			return abnormalCondition("NFS server %s is unreachable: %v", server, err)
+		}
+	}
+
+	readOnly := false
+	for _, opt := range info.MountOptions {
+		if opt == "ro" {
+			readOnly = true
+		}
+	}
+	if readOnly {
+		if t, ok := ns.stagedVolumes.getTarget(volumePath); ok && !t.readOnly {
+			return abnormalCondition("volume published read-write is mounted read-only on %s", volumePath)
+		}
+	}
+	return &csi.VolumeCondition{Message: volumeHealthyMsg}
+}
+
+// getServersCondition returns the condition of a volume served by servers,
+// abnormal if any of them cannot be reached. The servers are probed in
+// parallel.
+func getServersCondition(ctx context.Context, servers []string) *csi.VolumeCondition {
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			errs[i] = probeNFSServer(ctx, server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	var unreachable []string
+	for i, err := range errs {
+		if err != nil {
+			klog.V(4).Infof("NFS server %s is unreachable: %v", servers[i], err)
+			unreachable = append(unreachable, servers[i])
+		}
+	}
+	if len(unreachable) > 0 {
+		return abnormalCondition("%d of %d NFS servers unreachable: %s", len(unreachable), len(servers), strings.Join(unreachable, ", "))
+	}
+	return &csi.VolumeCondition{Message: volumeHealthyMsg}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeNFSServer listens on a local port used as NFS port by the probes until
+// the returned function is called.
+func fakeNFSServer(t *testing.T) func() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	origPort := nfsServerPort
+	_, nfsServerPort, _ = net.SplitHostPort(listener.Addr().String())
+	return func() {
+		listener.Close()
+		nfsServerPort = origPort
+	}
+}
+
+func TestGetServerFromMountSource(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected string
+		ok       bool
+	}{
+		{source: "10.0.0.1:/share", expected: "10.0.0.1", ok: true},
+		{source: "10.0.0.1:/share/subdir", expected: "10.0.0.1", ok: true},
+		{source: "[fd00::1]:/share", expected: "fd00::1", ok: true},
+		{source: "nfs-server.default.svc.cluster.local:/", expected: "nfs-server.default.svc.cluster.local", ok: true},
+		{source: "/dev/sda1"},
+		{source: "tmpfs"},
+	}
+
+	for _, test := range tests {
+		server, ok := getServerFromMountSource(test.source)
+		assert.Equal(t, test.ok, ok, test.source)
+		assert.Equal(t, test.expected, server, test.source)
+	}
+}
+
+func TestGetServersCondition(t *testing.T) {
+	stop := fakeNFSServer(t)
+	defer stop()
+
+	tests := []struct {
+		desc     string
+		servers  []string
+		expected *csi.VolumeCondition
+	}{
+		{
+			desc:     "reachable server",
+			servers:  []string{"127.0.0.1"},
+			expected: &csi.VolumeCondition{Message: volumeHealthyMsg},
+		},
+		{
+			desc:     "no server",
+			expected: &csi.VolumeCondition{Message: volumeHealthyMsg},
+		},
+		{
+			desc:     "unreachable server",
+			servers:  []string{"127.0.0.1", "127.0.0.2"},
+			expected: &csi.VolumeCondition{Abnormal: true, Message: "1 of 2 NFS servers unreachable: 127.0.0.2"},
+		},
+	}
+
+	for _, test := range tests {
+		condition := getServersCondition(context.Background(), test.servers)
+		assert.Equal(t, test.expected, condition, test.desc)
+	}
+}
+
+func TestGetVolumeCondition(t *testing.T) {
+	stop := fakeNFSServer(t)
+	defer stop()
+
+	dir := t.TempDir()
+	healthyPath := filepath.Join(dir, "healthy")
+	unreachablePath := filepath.Join(dir, "unreachable")
+	readOnlyPath := filepath.Join(dir, "readonly")
+	readWritePath := filepath.Join(dir, "readwrite")
+	notMountedPath := filepath.Join(dir, "notmounted")
+	mountInfo := fmt.Sprintf(`100 25 0:50 / %s rw,relatime shared:1 - nfs 127.0.0.1:/share rw,vers=3
+101 25 0:51 / %s rw,relatime shared:1 - nfs 127.0.0.2:/share rw,vers=3
+102 25 0:50 /subdir %s ro,relatime shared:1 - nfs 127.0.0.1:/share rw,vers=3
+103 25 0:50 /subdir %s ro,relatime shared:1 - nfs 127.0.0.1:/share rw,vers=3
+`, healthyPath, unreachablePath, readOnlyPath, readWritePath)
+	mountInfoFile := filepath.Join(dir, "mountinfo")
+	assert.NoError(t, os.WriteFile(mountInfoFile, []byte(mountInfo), 0600))
+	origMountInfoPath := mountInfoPath
+	mountInfoPath = mountInfoFile
+	defer func() { mountInfoPath = origMountInfoPath }()
+
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	ns.stagedVolumes.stage(&stagedVolume{volumeID: "vol_1", stagingPath: healthyPath})
+	ns.stagedVolumes.publish(healthyPath, readOnlyPath, publishedTarget{readOnly: true})
+	ns.stagedVolumes.publish(healthyPath, readWritePath, publishedTarget{readOnly: false})
+
+	tests := []struct {
+		desc     string
+		path     string
+		expected *csi.VolumeCondition
+	}{
+		{
+			desc:     "healthy mount",
+			path:     healthyPath,
+			expected: &csi.VolumeCondition{Message: volumeHealthyMsg},
+		},
+		{
+			desc:     "unreachable server",
+			path:     unreachablePath,
+			expected: &csi.VolumeCondition{Abnormal: true},
+		},
+		{
+			desc:     "read only target published read only",
+			path:     readOnlyPath,
+			expected: &csi.VolumeCondition{Message: volumeHealthyMsg},
+		},
+		{
+			desc:     "read only target published read write",
+			path:     readWritePath,
+			expected: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume published read-write is mounted read-only on %s", readWritePath)},
+		},
+		{
+			desc:     "path not mounted",
+			path:     notMountedPath,
+			expected: &csi.VolumeCondition{Message: volumeHealthyMsg},
+		},
+	}
+
+	for _, test := range tests {
+		condition := ns.getVolumeCondition(context.Background(), test.path)
+		assert.Equal(t, test.expected.GetAbnormal(), condition.GetAbnormal(), test.desc)
+		if test.expected.GetMessage() != "" {
+			assert.Equal(t, test.expected.GetMessage(), condition.GetMessage(), test.desc)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// volumeIDPrefix is the prefix of the versioned volume IDs. A server address
+// cannot start with it: host names have no colon and IPv6 addresses are
+// hexadecimal, so the IDs without it are in the legacy formats.
+const volumeIDPrefix = "v2:"
+
+// The fields of the versioned volume IDs, encoded as key=value and joined
+// with separator after volumeIDPrefix, in this order. The keys are one letter
+// long to keep the IDs compact. The values may be paths of any depth, the
+// escape character and separator are percent-encoded in them. A new field
+// gets a new key, the fields of newer versions are ignored when parsing.
+//
+// sample volume ID:
+//
+//	v2:s=nfs-server.default.svc.cluster.local#b=gpfs/fs1#d=team-a/pvc-4bcbf944-b6f7-4bd0-b50f-3c3dd00efc64#o=retain#p=pool-a
+const (
+	idKeyServer     = "s"
+	idKeyBaseDir    = "b"
+	idKeySubDir     = "d"
+	idKeyUUID       = "u"
+	idKeyOnDelete   = "o"
+	idKeyServerPool = "p"
+)
+
+var idValueEscaper = strings.NewReplacer("%", "%25", separator, url.PathEscape(separator))
+
+// Given a nfsVolume, return a CSI volume id in the versioned format. Empty
+// fields are left out.
+func getVolumeIDFromNfsVol(vol *nfsVolume) string {
+	// as in the legacy IDs, only the retain and archive policies are recorded
+	var onDelete string
+	if strings.EqualFold(vol.onDelete, retain) || strings.EqualFold(vol.onDelete, archive) {
+		onDelete = vol.onDelete
+	}
+	fields := []struct{ key, value string }{
+		{idKeyServer, strings.Trim(vol.server, "/")},
+		{idKeyBaseDir, strings.Trim(vol.baseDir, "/")},
+		{idKeySubDir, strings.Trim(vol.subDir, "/")},
+		{idKeyUUID, vol.uuid},
+		{idKeyOnDelete, onDelete},
+		{idKeyServerPool, vol.serverPool},
+	}
+	var elements []string
+	for _, f := range fields {
+		if f.value != "" {
+			elements = append(elements, f.key+"="+idValueEscaper.Replace(f.value))
+		}
+	}
+	return volumeIDPrefix + strings.Join(elements, separator)
+}
+
+// parseVolumeID returns the nfsVolume of a CSI volume id in the versioned
+// format.
+func parseVolumeID(id string) (*nfsVolume, error) {
+	vol := &nfsVolume{id: id}
+	for _, element := range strings.Split(strings.TrimPrefix(id, volumeIDPrefix), separator) {
+		key, value, found := strings.Cut(element, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid element %q in volume ID %s", element, id)
+		}
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid element %q in volume ID %s: %v", element, id, err)
+		}
+		switch key {
+		case idKeyServer:
+			vol.server = value
+		case idKeyBaseDir:
+			if err := checkVolumePath(value); err != nil {
+				return nil, fmt.Errorf("invalid base directory in volume ID %s: %v", id, err)
+			}
+			vol.baseDir = value
+		case idKeySubDir:
+			if err := checkVolumePath(value); err != nil {
+				return nil, fmt.Errorf("invalid subdirectory in volume ID %s: %v", id, err)
+			}
+			vol.subDir = value
+		case idKeyUUID:
+			vol.uuid = value
+		case idKeyOnDelete:
+			vol.onDelete = value
+		case idKeyServerPool:
+			vol.serverPool = value
+		}
+	}
+	if vol.server == "" {
+		return nil, fmt.Errorf("volume ID %s has no server", id)
+	}
+	return vol, nil
+}
+
+// checkVolumePath returns an error if a path of a volume ID is absolute or
+// has a ".." element, the paths are relative to the share and the base
+// directory and must stay inside them.
+func checkVolumePath(p string) error {
+	if path.IsAbs(p) {
+		return fmt.Errorf("path %q is absolute", p)
+	}
+	for _, element := range strings.Split(p, "/") {
+		if element == ".." {
+			return fmt.Errorf("path %q has a %q element", p, "..")
+		}
+	}
+	return nil
+}
+
+// isProvisionedVolumeID returns whether a CSI volume id is the one of a volume
+// provisioned by the driver, rather than of a static volume.
+func isProvisionedVolumeID(id string) bool {
+	return strings.HasPrefix(id, volumeIDPrefix) || len(strings.Split(id, separator)) == totalIDElements
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetVolumeIDFromNfsVol(t *testing.T) {
+	tests := []struct {
+		desc       string
+		vol        *nfsVolume
+		expectedID string
+	}{
+		{
+			desc:       "defaults",
+			vol:        &nfsVolume{server: testServer, baseDir: "/" + testBaseDir, subDir: testCSIVolume, onDelete: deletePolicy},
+			expectedID: "v2:s=test-server#b=test-base-dir#d=volume-name",
+		},
+		{
+			desc: "all fields",
+			vol: &nfsVolume{
+				server:     testServer,
+				baseDir:    "/gpfs/fs1/",
+				subDir:     "team-a/" + testCSIVolume,
+				uuid:       "pv-name",
+				onDelete:   retain,
+				serverPool: "pool-a",
+			},
+			expectedID: "v2:s=test-server#b=gpfs/fs1#d=team-a/volume-name#u=pv-name#o=retain#p=pool-a",
+		},
+		{
+			desc:       "escaped values",
+			vol:        &nfsVolume{server: testServer, baseDir: testBaseDir, subDir: "dir#1%"},
+			expectedID: "v2:s=test-server#b=test-base-dir#d=dir%231%25",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			id := getVolumeIDFromNfsVol(test.vol)
+			assert.Equal(t, test.expectedID, id)
+
+			// the ID parses back to the volume
+			vol, err := getNfsVolFromID(id)
+			assert.NoError(t, err)
+			assert.Equal(t, id, vol.id)
+			assert.Equal(t, test.vol.subDir, vol.subDir)
+			assert.Equal(t, test.vol.uuid, vol.uuid)
+			assert.Equal(t, test.vol.serverPool, vol.serverPool)
+		})
+	}
+}
+
+func TestGetNfsVolFromID(t *testing.T) {
+	tests := []struct {
+		desc        string
+		id          string
+		expectedVol *nfsVolume
+		expectErr   bool
+	}{
+		{
+			desc: "versioned",
+			id:   "v2:s=test-server#b=gpfs/fs1#d=team-a/volume-name#u=pv-name#o=archive#p=pool-a",
+			expectedVol: &nfsVolume{
+				id:         "v2:s=test-server#b=gpfs/fs1#d=team-a/volume-name#u=pv-name#o=archive#p=pool-a",
+				server:     testServer,
+				baseDir:    "gpfs/fs1",
+				subDir:     "team-a/volume-name",
+				uuid:       "pv-name",
+				onDelete:   archive,
+				serverPool: "pool-a",
+			},
+		},
+		{
+			desc: "versioned with a field of a newer version",
+			id:   "v2:s=test-server#b=test-base-dir#d=volume-name#z=future",
+			expectedVol: &nfsVolume{
+				id:      "v2:s=test-server#b=test-base-dir#d=volume-name#z=future",
+				server:  testServer,
+				baseDir: testBaseDir,
+				subDir:  testCSIVolume,
+			},
+		},
+		{
+			desc:      "versioned without server",
+			id:        "v2:b=test-base-dir#d=volume-name",
+			expectErr: true,
+		},
+		{
+			desc:      "versioned with an invalid element",
+			id:        "v2:s=test-server#test-base-dir",
+			expectErr: true,
+		},
+		{
+			desc:      "versioned with a parent subdirectory",
+			id:        "v2:s=test-server#b=test-base-dir#d=../other-base-dir",
+			expectErr: true,
+		},
+		{
+			desc:      "versioned with a nested parent subdirectory",
+			id:        "v2:s=test-server#b=test-base-dir#d=team-a/../../etc",
+			expectErr: true,
+		},
+		{
+			desc:      "versioned with an escaped parent subdirectory",
+			id:        "v2:s=test-server#b=test-base-dir#d=%2E%2E",
+			expectErr: true,
+		},
+		{
+			desc:      "versioned with an absolute subdirectory",
+			id:        "v2:s=test-server#b=test-base-dir#d=/etc",
+			expectErr: true,
+		},
+		{
+			desc:      "versioned with a parent base directory",
+			id:        "v2:s=test-server#b=gpfs/..#d=volume-name",
+			expectErr: true,
+		},
+		{
+			desc:      "versioned with an absolute base directory",
+			id:        "v2:s=test-server#b=%2Fgpfs#d=volume-name",
+			expectErr: true,
+		},
+		{
+			desc: "versioned with dots in the subdirectory",
+			id:   "v2:s=test-server#b=test-base-dir#d=..volume-name..",
+			expectedVol: &nfsVolume{
+				id:      "v2:s=test-server#b=test-base-dir#d=..volume-name..",
+				server:  testServer,
+				baseDir: testBaseDir,
+				subDir:  "..volume-name..",
+			},
+		},
+		{
+			desc:      "versioned with an invalid escape",
+			id:        "v2:s=test-server#d=dir%2",
+			expectErr: true,
+		},
+		{
+			desc: "legacy",
+			id:   newTestVolumeOnDeleteRetain,
+			expectedVol: &nfsVolume{
+				id:       newTestVolumeOnDeleteRetain,
+				server:   testServer,
+				baseDir:  testBaseDir,
+				subDir:   testCSIVolume,
+				uuid:     "uuid",
+				onDelete: retain,
+			},
+		},
+		{
+			desc: "legacy with a nested baseDir",
+			id:   testVolumeIDNested,
+			expectedVol: &nfsVolume{
+				id:      testVolumeIDNested,
+				server:  testServer,
+				baseDir: testBaseDirNested,
+				subDir:  testCSIVolume,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			vol, err := getNfsVolFromID(test.id)
+			if test.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expectedVol, vol)
+		})
+	}
+}
+
+func TestIsProvisionedVolumeID(t *testing.T) {
+	assert.True(t, isProvisionedVolumeID(v2TestVolumeID))
+	assert.True(t, isProvisionedVolumeID(newTestVolumeID))
+	assert.False(t, isProvisionedVolumeID(testVolumeID))
+	assert.False(t, isProvisionedVolumeID("vol-1"))
+}
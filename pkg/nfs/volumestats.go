@@ -0,0 +1,231 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/volume"
+	mount "k8s.io/mount-utils"
+)
+
+const defaultVolStatsTimeout = 5 * time.Second
+
+var (
+	// errVolumeStatsTimeout is returned when the stats of a volume could not be
+	// collected in time, usually because its NFS server does not respond.
+	errVolumeStatsTimeout = errors.New("volume stats collection timed out")
+	// errStaleVolume is returned for a volume path with a stale file handle.
+	errStaleVolume = errors.New("stale NFS file handle")
+)
+
+// volumeStats are the usage of a volume collected at a given time.
+type volumeStats struct {
+	usage       []*csi.VolumeUsage
+	collectedAt time.Time
+}
+
+// volumeStatsWorker collects the stats of a volume, running at most one
+// collection at a time so that a hung mount does not pile up goroutines.
+type volumeStatsWorker struct {
+	mutex sync.Mutex
+	// done is closed when the running collection returns, nil when idle
+	done    chan struct{}
+	started time.Time
+	// result and err are the outcome of the last collection
+	result *volumeStats
+	err    error
+	// last are the last stats collected successfully
+	last *volumeStats
+}
+
+// volumeStatsCollector collects volume stats in the background, with one
+// worker per volume.
+type volumeStatsCollector struct {
+	mutex   sync.Mutex
+	workers map[string]*volumeStatsWorker
+	// getUsage returns the usage of the volume mounted at path
+	getUsage func(path string) ([]*csi.VolumeUsage, error)
+}
+
+func newVolumeStatsCollector() *volumeStatsCollector {
+	return &volumeStatsCollector{
+		workers:  map[string]*volumeStatsWorker{},
+		getUsage: getVolumeUsage,
+	}
+}
+
+func (c *volumeStatsCollector) worker(key string) *volumeStatsWorker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w, ok := c.workers[key]
+	if !ok {
+		w = &volumeStatsWorker{}
+		c.workers[key] = w
+	}
+	return w
+}
+
+// forget drops the worker of a volume that is no longer published. A running
+// collection is left to finish.
+func (c *volumeStatsCollector) forget(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.workers, key)
+}
+
+// collect returns the stats of the volume mounted at path, starting a
+// collection unless one is already running. If the collection does not
+// return within timeout, the last stats collected successfully, nil if
+// none, are returned with errVolumeStatsTimeout.
+func (c *volumeStatsCollector) collect(ctx context.Context, key, path string, timeout time.Duration) (*volumeStats, error) {
+	w := c.worker(key)
+
+	w.mutex.Lock()
+	if w.done == nil {
+		done := make(chan struct{})
+		w.done = done
+		w.started = time.Now()
+		go func() {
+			usage, err := c.getUsage(path)
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			w.result, w.err = nil, err
+			if err == nil {
+				w.result = &volumeStats{usage: usage, collectedAt: time.Now()}
+				w.last = w.result
+			}
+			w.done = nil
+			close(done)
+		}()
+	}
+	done, started := w.done, w.started
+	w.mutex.Unlock()
+
+	// a collection hung since earlier calls is not waited for again
+	wait := timeout - time.Since(started)
+	if wait < 0 {
+		wait = 0
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		return w.result, w.err
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.last, fmt.Errorf("%w: statfs on %s has not returned after %v", errVolumeStatsTimeout, path, time.Since(started).Round(time.Second))
+}
+
+// volumeStatsKey returns the key of the stats of a volume published at path,
+// the same volume may be published on several paths of a node.
+func volumeStatsKey(volumeID, path string) string {
+	return fmt.Sprintf("%s#%s", volumeID, path)
+}
+
+// withStatsAge returns the condition with the age of stats that were not
+// collected by the current call appended to its message.
+func withStatsAge(condition *csi.VolumeCondition, stats *volumeStats) *csi.VolumeCondition {
+	return &csi.VolumeCondition{
+		Abnormal: condition.GetAbnormal(),
+		Message:  fmt.Sprintf("%s (stats collected %v ago)", condition.GetMessage(), time.Since(stats.collectedAt).Round(time.Second)),
+	}
+}
+
+// getVolStatsTimeout returns how long NodeGetVolumeStats waits for the stats
+// of a volume.
+func (n *Driver) getVolStatsTimeout() time.Duration {
+	if n.volStatsTimeout <= 0 {
+		return defaultVolStatsTimeout
+	}
+	return n.volStatsTimeout
+}
+
+// getVolumeUsage returns the bytes and inodes usage of the volume mounted at path.
+func getVolumeUsage(path string) ([]*csi.VolumeUsage, error) {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "path %s does not exist", path)
+		}
+		if mount.IsCorruptedMnt(err) {
+			klog.Warningf("volume path %s is corrupted: %v", path, err)
+			return nil, errStaleVolume
+		}
+		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", path, err)
+	}
+
+	volumeMetrics, err := volume.NewMetricsStatFS(path).GetMetrics()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get metrics: %v", err)
+	}
+
+	available, ok := volumeMetrics.Available.AsInt64()
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to transform volume available size(%v)", volumeMetrics.Available)
+	}
+	capacity, ok := volumeMetrics.Capacity.AsInt64()
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to transform volume capacity size(%v)", volumeMetrics.Capacity)
+	}
+	used, ok := volumeMetrics.Used.AsInt64()
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to transform volume used size(%v)", volumeMetrics.Used)
+	}
+
+	inodesFree, ok := volumeMetrics.InodesFree.AsInt64()
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes free(%v)", volumeMetrics.InodesFree)
+	}
+	inodes, ok := volumeMetrics.Inodes.AsInt64()
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes(%v)", volumeMetrics.Inodes)
+	}
+	inodesUsed, ok := volumeMetrics.InodesUsed.AsInt64()
+	if !ok {
+		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
+	}
+
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Available: available,
+			Total:     capacity,
+			Used:      used,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Available: inodesFree,
+			Total:     inodes,
+			Used:      inodesUsed,
+		},
+	}, nil
+}
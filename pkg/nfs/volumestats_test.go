@@ -0,0 +1,109 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeStatsCollector(t *testing.T) {
+	usage := []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 100, Used: 10, Available: 90}}
+	unblock := make(chan struct{})
+	var calls atomic.Int32
+	var hang atomic.Bool
+
+	c := newVolumeStatsCollector()
+	c.getUsage = func(_ string) ([]*csi.VolumeUsage, error) {
+		calls.Add(1)
+		if hang.Load() {
+			<-unblock
+		}
+		return usage, nil
+	}
+	ctx := context.Background()
+
+	// a responsive mount returns fresh stats
+	stats, err := c.collect(ctx, "vol_1", "/path", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, usage, stats.usage)
+	last := stats
+
+	// a hung mount returns the last stats with a timeout
+	hang.Store(true)
+	stats, err = c.collect(ctx, "vol_1", "/path", 10*time.Millisecond)
+	assert.True(t, errors.Is(err, errVolumeStatsTimeout))
+	assert.Equal(t, last, stats)
+
+	// the hung collection is not started again nor waited for
+	start := time.Now()
+	_, err = c.collect(ctx, "vol_1", "/path", time.Second)
+	assert.True(t, errors.Is(err, errVolumeStatsTimeout))
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// a volume without stats yet returns none
+	stats, err = c.collect(ctx, "vol_2", "/path", 10*time.Millisecond)
+	assert.True(t, errors.Is(err, errVolumeStatsTimeout))
+	assert.Nil(t, stats)
+
+	// fresh stats are returned again once the mount responds
+	hang.Store(false)
+	close(unblock)
+	assert.Eventually(t, func() bool {
+		stats, err := c.collect(ctx, "vol_1", "/path", time.Second)
+		return err == nil && stats != last
+	}, time.Second, 10*time.Millisecond)
+
+	// errors are returned as is
+	c.getUsage = func(_ string) ([]*csi.VolumeUsage, error) { return nil, errStaleVolume }
+	c.forget("vol_1")
+	_, err = c.collect(ctx, "vol_1", "/path", time.Second)
+	assert.Equal(t, errStaleVolume, err)
+}
+
+func TestNodeGetVolumeStatsTimeout(t *testing.T) {
+	ns, err := getTestNodeServer()
+	assert.NoError(t, err)
+	ns.Driver.volStatsTimeout = 10 * time.Millisecond
+	unblock := make(chan struct{})
+	defer close(unblock)
+	ns.volumeStats.getUsage = func(_ string) ([]*csi.VolumeUsage, error) {
+		<-unblock
+		return nil, nil
+	}
+
+	resp, err := ns.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: "/hung/path"})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.GetUsage())
+	assert.True(t, resp.GetVolumeCondition().GetAbnormal())
+	assert.True(t, strings.Contains(resp.GetVolumeCondition().GetMessage(), "statfs on /hung/path has not returned"))
+}
+
+func TestWithStatsAge(t *testing.T) {
+	stats := &volumeStats{collectedAt: time.Now().Add(-2 * time.Minute)}
+	condition := withStatsAge(&csi.VolumeCondition{Message: volumeHealthyMsg}, stats)
+	assert.False(t, condition.GetAbnormal())
+	assert.Equal(t, "volume is healthy (stats collected 2m0s ago)", condition.GetMessage())
+}
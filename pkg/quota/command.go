@@ -0,0 +1,80 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Command actions, passed as the last argument of the command.
+const (
+	actionSet    = "set"
+	actionRemove = "remove"
+)
+
+// Command is a backend running a command to set the quotas, with the set or
+// remove action as last argument, and the volume in the environment:
+//
+//	QUOTA_VOLUME_ID, QUOTA_SERVER, QUOTA_SHARE, QUOTA_SUBDIR, QUOTA_PATH
+//	QUOTA_BYTES, for the set action
+//
+// The command must succeed when the quota is already set or removed.
+type Command struct {
+	command []string
+}
+
+// NewCommand returns a backend running command.
+func NewCommand(command []string) *Command {
+	return &Command{command: command}
+}
+
+// SetQuota runs the command with the set action.
+func (c *Command) SetQuota(ctx context.Context, volume *Volume, bytes int64) error {
+	return c.run(ctx, actionSet, volume, "QUOTA_BYTES="+strconv.FormatInt(bytes, 10))
+}
+
+// RemoveQuota runs the command with the remove action.
+func (c *Command) RemoveQuota(ctx context.Context, volume *Volume) error {
+	return c.run(ctx, actionRemove, volume)
+}
+
+func (c *Command) run(ctx context.Context, action string, volume *Volume, env ...string) error {
+	args := append(append([]string{}, c.command[1:]...), action)
+	cmd := exec.CommandContext(ctx, c.command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"QUOTA_VOLUME_ID="+volume.ID,
+		"QUOTA_SERVER="+volume.Server,
+		"QUOTA_SHARE="+volume.Share,
+		"QUOTA_SUBDIR="+volume.SubDir,
+		"QUOTA_PATH="+volume.Path,
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	klog.V(4).Infof("running quota command %s for volume %s", strings.Join(cmd.Args, " "), volume.ID)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("quota command %s for volume %s failed: %v, output: %s", strings.Join(cmd.Args, " "), volume.ID, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
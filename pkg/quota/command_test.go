@@ -0,0 +1,61 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testQuotaScript records its arguments and environment in the file named
+// by its first argument, and fails for the volumes named fail.
+const testQuotaScript = `#!/bin/sh
+out=$1
+shift
+echo "$@ $QUOTA_VOLUME_ID $QUOTA_SERVER $QUOTA_SHARE $QUOTA_SUBDIR $QUOTA_PATH $QUOTA_BYTES" > "$out"
+if [ "$QUOTA_VOLUME_ID" = fail ]; then
+	echo "no such fileset" >&2
+	exit 1
+fi
+`
+
+func TestCommand(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "quota.sh")
+	assert.NoError(t, os.WriteFile(script, []byte(testQuotaScript), 0700))
+	out := filepath.Join(dir, "out")
+	c := NewCommand([]string{script, out, "--fileset"})
+	ctx := context.Background()
+	volume := &Volume{ID: "vol", Server: "10.0.0.1", Share: "/gpfs", SubDir: "pvc-a", Path: "/tmp/share/pvc-a"}
+
+	read := func() string {
+		b, err := os.ReadFile(out)
+		assert.NoError(t, err)
+		return string(b)
+	}
+	assert.NoError(t, c.SetQuota(ctx, volume, 1<<30))
+	assert.Equal(t, "--fileset set vol 10.0.0.1 /gpfs pvc-a /tmp/share/pvc-a 1073741824\n", read())
+	assert.NoError(t, c.RemoveQuota(ctx, volume))
+	assert.Equal(t, "--fileset remove vol 10.0.0.1 /gpfs pvc-a /tmp/share/pvc-a \n", read())
+
+	err := c.SetQuota(ctx, &Volume{ID: "fail"}, 1<<30)
+	assert.ErrorContains(t, err, "no such fileset")
+}
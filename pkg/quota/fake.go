@@ -0,0 +1,66 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"sync"
+)
+
+// Fake is a backend keeping the quotas in memory, for tests.
+type Fake struct {
+	mutex sync.Mutex
+	// Quotas are the quotas of the volumes by volume ID.
+	Quotas map[string]int64
+	// Err is returned by the calls if set.
+	Err error
+}
+
+// NewFake returns a fake backend without quotas.
+func NewFake() *Fake {
+	return &Fake{Quotas: map[string]int64{}}
+}
+
+// SetQuota records the quota of volume.
+func (f *Fake) SetQuota(_ context.Context, volume *Volume, bytes int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Quotas[volume.ID] = bytes
+	return nil
+}
+
+// RemoveQuota forgets the quota of volume.
+func (f *Fake) RemoveQuota(_ context.Context, volume *Volume) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	delete(f.Quotas, volume.ID)
+	return nil
+}
+
+// Get returns the quota of a volume, and whether it is set.
+func (f *Fake) Get(volumeID string) (int64, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	bytes, ok := f.Quotas[volumeID]
+	return bytes, ok
+}
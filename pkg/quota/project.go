@@ -0,0 +1,276 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// the project IDs of the volumes are allocated in this range, above the
+	// IDs usually set by hand in /etc/projid
+	projectIDMin = 1 << 16
+	projectIDMax = 1 << 31
+	// maxProjectIDProbes is how many IDs are tried when the ID of a volume is
+	// used by another project
+	maxProjectIDProbes = 1000
+)
+
+// projectQuota is the quota and usage of a project.
+type projectQuota struct {
+	// limit is the hard limit in bytes, none if zero
+	limit  int64
+	space  int64
+	inodes int64
+}
+
+// inUse returns whether the project has a limit or files.
+func (q *projectQuota) inUse() bool {
+	return q.limit != 0 || q.space != 0 || q.inodes != 0
+}
+
+// projectQuotas are the filesystem calls of the project backend.
+type projectQuotas interface {
+	// projectID returns the project ID of the directory at path, zero if none.
+	projectID(path string) (uint32, error)
+	// setProjectID sets the project ID of the directory at path, inherited by
+	// the files created in it.
+	setProjectID(path string, id uint32) error
+	// quota returns the quota of project id on the filesystem of path.
+	quota(path string, id uint32) (*projectQuota, error)
+	// setLimit sets the hard limit of project id on the filesystem of path,
+	// removing it if zero.
+	setLimit(path string, id uint32, bytes int64) error
+}
+
+// Project is a backend setting Linux project quotas on an XFS or ext4
+// filesystem mounted by the controller on root, the filesystem exported by
+// the NFS server. The filesystem must be mounted with project quotas
+// enabled, prjquota. Every volume gets its own project ID, derived from its
+// volume ID and recorded on its subdirectory.
+type Project struct {
+	root string
+	// mutex serializes the allocation of the project IDs
+	mutex  sync.Mutex
+	quotas projectQuotas
+}
+
+// NewProject returns a backend setting the project quotas of the volumes in
+// the filesystem mounted on root.
+func NewProject(root string) *Project {
+	return &Project{root: root, quotas: linuxProjectQuotas{}}
+}
+
+// path returns the subdirectory of a volume in the filesystem.
+func (p *Project) path(volume *Volume) string {
+	return filepath.Join(p.root, volume.Share, volume.SubDir)
+}
+
+// SetQuota sets the project ID of the subdirectory of a volume, allocating
+// it if needed, and limits the project to bytes.
+func (p *Project) SetQuota(_ context.Context, volume *Volume, bytes int64) error {
+	path := p.path(volume)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	id, err := p.quotas.projectID(path)
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		if id, err = p.allocateID(path, volume.ID); err != nil {
+			return err
+		}
+		if err = p.quotas.setProjectID(path, id); err != nil {
+			return err
+		}
+		klog.V(2).Infof("set project ID %d on %s for volume %s", id, path, volume.ID)
+	}
+	if err = p.quotas.setLimit(path, id, bytes); err != nil {
+		return err
+	}
+	klog.V(2).Infof("set quota of project %d of volume %s to %d bytes", id, volume.ID, bytes)
+	return nil
+}
+
+// RemoveQuota removes the limit of the project of a volume. Its files stay
+// accounted to the project, which is not allocated again until they are
+// gone.
+func (p *Project) RemoveQuota(_ context.Context, volume *Volume) error {
+	path := p.path(volume)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	id, err := p.quotas.projectID(path)
+	if err != nil || id == 0 {
+		return err
+	}
+	if err = p.quotas.setLimit(path, id, 0); err != nil {
+		return err
+	}
+	klog.V(2).Infof("removed quota of project %d of volume %s", id, volume.ID)
+	return nil
+}
+
+// allocateID returns an unused project ID for a volume, starting from the
+// hash of its ID. It must be called with the mutex held.
+func (p *Project) allocateID(path, volumeID string) (uint32, error) {
+	h := fnv.New32a()
+	h.Write([]byte(volumeID))
+	start := h.Sum32() % (projectIDMax - projectIDMin)
+	for i := uint32(0); i < maxProjectIDProbes; i++ {
+		id := projectIDMin + (start+i)%(projectIDMax-projectIDMin)
+		q, err := p.quotas.quota(path, id)
+		if err != nil {
+			return 0, err
+		}
+		if !q.inUse() {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no unused project ID found for volume %s after %d attempts", volumeID, maxProjectIDProbes)
+}
+
+// The filesystem ioctls and quotactl commands, not defined by
+// golang.org/x/sys/unix.
+const (
+	fsIocFsGetXattr    = 0x801c581f // FS_IOC_FSGETXATTR
+	fsIocFsSetXattr    = 0x401c5820 // FS_IOC_FSSETXATTR
+	fsXflagProjInherit = 0x200      // FS_XFLAG_PROJINHERIT
+	qGetQuota          = 0x800007   // Q_GETQUOTA
+	qSetQuota          = 0x800008   // Q_SETQUOTA
+	prjQuota           = 2          // PRJQUOTA
+	qifBLimits         = 1          // QIF_BLIMITS
+	qifDQBlkSize       = 1024       // QIF_DQBLKSIZE
+)
+
+// fsxattr is struct fsxattr of linux/fs.h.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// ifDqblk is struct if_dqblk of linux/quota.h.
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+// linuxProjectQuotas are the project quota calls of Linux, quotactl_fd
+// requires Linux 5.14 or later.
+type linuxProjectQuotas struct{}
+
+func (linuxProjectQuotas) getXattr(dir *os.File) (*fsxattr, error) {
+	attr := &fsxattr{}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return nil, fmt.Errorf("failed to get the attributes of %s: %w", dir.Name(), errno)
+	}
+	return attr, nil
+}
+
+func (q linuxProjectQuotas) projectID(path string) (uint32, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+	attr, err := q.getXattr(dir)
+	if err != nil {
+		return 0, err
+	}
+	return attr.projid, nil
+}
+
+func (q linuxProjectQuotas) setProjectID(path string, id uint32) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	attr, err := q.getXattr(dir)
+	if err != nil {
+		return err
+	}
+	attr.projid = id
+	attr.xflags |= fsXflagProjInherit
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dir.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(attr))); errno != 0 {
+		return fmt.Errorf("failed to set project ID %d on %s: %w", id, path, errno)
+	}
+	return nil
+}
+
+func quotactl(path string, cmd int, id uint32, dqblk *ifDqblk) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	_, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, dir.Fd(), uintptr(cmd<<8|prjQuota), uintptr(id), uintptr(unsafe.Pointer(dqblk)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (linuxProjectQuotas) quota(path string, id uint32) (*projectQuota, error) {
+	dqblk := &ifDqblk{}
+	if err := quotactl(path, qGetQuota, id, dqblk); err != nil {
+		// XFS has no quota for the projects never used
+		if errors.Is(err, unix.ENOENT) {
+			return &projectQuota{}, nil
+		}
+		return nil, fmt.Errorf("failed to get the quota of project %d on %s: %w", id, path, err)
+	}
+	return &projectQuota{
+		limit:  int64(dqblk.bhardlimit) * qifDQBlkSize,
+		space:  int64(dqblk.curspace),
+		inodes: int64(dqblk.curinodes),
+	}, nil
+}
+
+func (linuxProjectQuotas) setLimit(path string, id uint32, bytes int64) error {
+	blocks := (bytes + qifDQBlkSize - 1) / qifDQBlkSize
+	dqblk := &ifDqblk{bhardlimit: uint64(blocks), valid: qifBLimits}
+	if err := quotactl(path, qSetQuota, id, dqblk); err != nil {
+		return fmt.Errorf("failed to set the quota of project %d on %s: %w", id, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProjectQuotas keeps the project IDs of the directories and the quotas
+// of the projects in memory.
+type fakeProjectQuotas struct {
+	ids    map[string]uint32
+	quotas map[uint32]*projectQuota
+}
+
+func (f *fakeProjectQuotas) projectID(path string) (uint32, error) {
+	return f.ids[path], nil
+}
+
+func (f *fakeProjectQuotas) setProjectID(path string, id uint32) error {
+	f.ids[path] = id
+	return nil
+}
+
+func (f *fakeProjectQuotas) quota(_ string, id uint32) (*projectQuota, error) {
+	if q, ok := f.quotas[id]; ok {
+		return q, nil
+	}
+	return &projectQuota{}, nil
+}
+
+func (f *fakeProjectQuotas) setLimit(_ string, id uint32, bytes int64) error {
+	q, err := f.quota("", id)
+	if err != nil {
+		return err
+	}
+	q.limit = bytes
+	f.quotas[id] = q
+	return nil
+}
+
+func TestProject(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"share/pvc-a", "share/pvc-b"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0750))
+	}
+	fake := &fakeProjectQuotas{ids: map[string]uint32{}, quotas: map[uint32]*projectQuota{}}
+	p := NewProject(root)
+	p.quotas = fake
+	ctx := context.Background()
+	volumeA := &Volume{ID: "vol-a", Share: "/share", SubDir: "pvc-a"}
+	pathA := filepath.Join(root, "share/pvc-a")
+
+	assert.NoError(t, p.SetQuota(ctx, volumeA, 1<<30))
+	idA := fake.ids[pathA]
+	assert.GreaterOrEqual(t, idA, uint32(projectIDMin))
+	assert.Equal(t, int64(1<<30), fake.quotas[idA].limit)
+
+	// expansion keeps the project ID
+	assert.NoError(t, p.SetQuota(ctx, volumeA, 2<<30))
+	assert.Equal(t, idA, fake.ids[pathA])
+	assert.Equal(t, int64(2<<30), fake.quotas[idA].limit)
+
+	// a volume whose ID hashes to a used project gets the next one
+	volumeB := &Volume{ID: "vol-a", Share: "/share", SubDir: "pvc-b"}
+	assert.NoError(t, p.SetQuota(ctx, volumeB, 1<<30))
+	assert.Equal(t, idA+1, fake.ids[filepath.Join(root, "share/pvc-b")])
+
+	// the project keeps its files after its quota is removed
+	fake.quotas[idA].space = 4096
+	assert.NoError(t, p.RemoveQuota(ctx, volumeA))
+	assert.Equal(t, &projectQuota{space: 4096}, fake.quotas[idA])
+	id, err := p.allocateID(pathA, "vol-a")
+	assert.NoError(t, err)
+	assert.Equal(t, idA+2, id)
+
+	// removing the quota of a deleted volume is a no-op
+	assert.NoError(t, p.RemoveQuota(ctx, &Volume{ID: "vol-c", Share: "/share", SubDir: "pvc-c"}))
+}
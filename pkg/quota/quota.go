@@ -0,0 +1,89 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package quota enforces the capacity of the subdirectory volumes with the
+// quotas of the filesystem backing the NFS shares.
+package quota
+
+import (
+	"context"
+	"fmt"
+)
+
+// Volume is a subdirectory volume.
+type Volume struct {
+	ID string
+	// Server, Share and SubDir locate the subdirectory of the volume on the
+	// NFS server.
+	Server string
+	Share  string
+	SubDir string
+	// Path is the subdirectory of the volume in the share mounted by the
+	// controller.
+	Path string
+}
+
+// Backend sets the quotas of the subdirectory volumes. The calls are
+// idempotent, they are retried until they succeed.
+type Backend interface {
+	// SetQuota limits the size of a volume to bytes. It is called when the
+	// volume is created and expanded.
+	SetQuota(ctx context.Context, volume *Volume, bytes int64) error
+	// RemoveQuota removes the limit of a volume. It is called before the
+	// volume is deleted or archived, the subdirectory may be gone already.
+	RemoveQuota(ctx context.Context, volume *Volume) error
+}
+
+// Backends.
+const (
+	// BackendNone disables the quotas.
+	BackendNone = "none"
+	// BackendProject sets Linux project quotas on an XFS or ext4 filesystem
+	// mounted by the controller.
+	BackendProject = "project"
+	// BackendCommand runs a command, usually a vendor CLI such as GPFS
+	// mmsetquota or a wrapper around it.
+	BackendCommand = "command"
+)
+
+// Options configure the backends.
+type Options struct {
+	// ProjectRoot is the directory the filesystem exporting the shares is
+	// mounted on, for the project backend.
+	ProjectRoot string
+	// Command is the command of the command backend, with its arguments.
+	Command []string
+}
+
+// NewBackend returns the backend of a kind, nil for BackendNone.
+func NewBackend(kind string, options Options) (Backend, error) {
+	switch kind {
+	case "", BackendNone:
+		return nil, nil
+	case BackendProject:
+		if options.ProjectRoot == "" {
+			return nil, fmt.Errorf("the %s quota backend requires a project root", kind)
+		}
+		return NewProject(options.ProjectRoot), nil
+	case BackendCommand:
+		if len(options.Command) == 0 {
+			return nil, fmt.Errorf("the %s quota backend requires a command", kind)
+		}
+		return NewCommand(options.Command), nil
+	default:
+		return nil, fmt.Errorf("unknown quota backend %q, must be one of [%s %s %s]", kind, BackendNone, BackendProject, BackendCommand)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package quota
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBackend(t *testing.T) {
+	tests := []struct {
+		desc        string
+		kind        string
+		options     Options
+		expected    Backend
+		expectedErr bool
+	}{
+		{
+			desc: "default",
+		},
+		{
+			desc: "none",
+			kind: BackendNone,
+		},
+		{
+			desc:     "project",
+			kind:     BackendProject,
+			options:  Options{ProjectRoot: "/exports"},
+			expected: NewProject("/exports"),
+		},
+		{
+			desc:        "project without root",
+			kind:        BackendProject,
+			expectedErr: true,
+		},
+		{
+			desc:     "command",
+			kind:     BackendCommand,
+			options:  Options{Command: []string{"/bin/quota.sh", "--fileset"}},
+			expected: NewCommand([]string{"/bin/quota.sh", "--fileset"}),
+		},
+		{
+			desc:        "command without command",
+			kind:        BackendCommand,
+			expectedErr: true,
+		},
+		{
+			desc:        "unknown",
+			kind:        "gpfs",
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			backend, err := NewBackend(test.kind, test.options)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, backend)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const localhost = "127.0.0.1"
+
+// NFSClientDaemons returns the helper daemons needed by NFSv3 clients:
+// rpcbind, and rpc.statd for NLM locking.
+//
+// If statd is already running, for example because of an existing NFS mount
+// on the node, starting another one fails. A statd that answers a NULL call
+// through the portmapper is monitored instead of started.
+func NFSClientDaemons() []Daemon {
+	portmapperAddr := net.JoinHostPort(localhost, fmt.Sprint(portmapperPort))
+	rpcbindServing := func(ctx context.Context) error {
+		_, err := GetPort(ctx, portmapperAddr, portmapperProgram, portmapperVersion, IPProtoUDP)
+		return err
+	}
+	statdServing := func(ctx context.Context) error {
+		return PingRegistered(ctx, localhost, StatdProgram, StatdVersion)
+	}
+
+	return []Daemon{
+		{
+			Name:    "rpcbind",
+			Command: "rpcbind",
+			// -f: stay in the foreground, -w: warm start from the registrations
+			// saved on exit, so that a restart keeps statd registered.
+			Args:    []string{"-f", "-w"},
+			Running: servingToRunning(rpcbindServing),
+			Ready:   rpcbindServing,
+		},
+		{
+			Name:    "rpc.statd",
+			Command: "rpc.statd",
+			// -F: stay in the foreground
+			Args:    []string{"-F"},
+			Running: servingToRunning(statdServing),
+			Ready:   statdServing,
+		},
+	}
+}
+
+func servingToRunning(serving func(ctx context.Context) error) func(ctx context.Context) (bool, error) {
+	return func(ctx context.Context) (bool, error) {
+		return serving(ctx) == nil, nil
+	}
+}
+
+// GSSDaemon returns rpc.gssd, which obtains the Kerberos credentials of the
+// NFS mounts with the sec=krb5, krb5i or krb5p option from keytab, stores
+// them in ccacheDir and reads its Kerberos configuration from krb5Conf.
+//
+// rpc.gssd does not register with the portmapper, a rpc.gssd process seen in
+// /proc is monitored instead of started.
+func GSSDaemon(keytab, ccacheDir, krb5Conf string) Daemon {
+	return Daemon{
+		Name:    "rpc.gssd",
+		Command: "rpc.gssd",
+		// -f: stay in the foreground
+		Args: []string{"-f", "-k", keytab, "-d", ccacheDir},
+		Env:  []string{"KRB5_CONFIG=" + krb5Conf},
+		Running: func(_ context.Context) (bool, error) {
+			return processRunning("/proc", "rpc.gssd")
+		},
+	}
+}
+
+// processRunning returns true if a process with the given command name is
+// listed in procRoot.
+func processRunning(procRoot, comm string) (bool, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); err != nil {
+			continue
+		}
+		// processes may exit while they are listed
+		content, err := os.ReadFile(filepath.Join(procRoot, e.Name(), "comm"))
+		if err == nil && strings.TrimSpace(string(content)) == comm {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TLSHandshakeDaemon returns tlshd, which performs the TLS handshakes of the
+// NFS mounts with the xprtsec=tls or mtls option for the kernel, with the
+// configuration in conf.
+//
+// tlshd does not register with the portmapper, a tlshd process seen in /proc
+// is monitored instead of started.
+func TLSHandshakeDaemon(conf string) Daemon {
+	return Daemon{
+		Name:    "tlshd",
+		Command: "tlshd",
+		// -s: log to stderr
+		Args: []string{"-c", conf, "-s"},
+		Running: func(_ context.Context) (bool, error) {
+			return processRunning("/proc", "tlshd")
+		},
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessRunning(t *testing.T) {
+	procRoot := t.TempDir()
+	for dir, comm := range map[string]string{
+		"1":    "systemd\n",
+		"42":   "rpc.gssd\n",
+		"self": "rpc.statd\n",
+	} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(procRoot, dir), 0750))
+		assert.NoError(t, os.WriteFile(filepath.Join(procRoot, dir, "comm"), []byte(comm), 0600))
+	}
+	// a process which exited while being listed
+	assert.NoError(t, os.MkdirAll(filepath.Join(procRoot, "43"), 0750))
+
+	tests := []struct {
+		comm     string
+		expected bool
+	}{
+		{comm: "rpc.gssd", expected: true},
+		{comm: "systemd", expected: true},
+		// only process directories are looked at
+		{comm: "rpc.statd", expected: false},
+		{comm: "rpc.idmapd", expected: false},
+	}
+	for _, test := range tests {
+		running, err := processRunning(procRoot, test.comm)
+		assert.NoError(t, err, test.comm)
+		assert.Equal(t, test.expected, running, test.comm)
+	}
+
+	_, err := processRunning(filepath.Join(procRoot, "missing"), "rpc.gssd")
+	assert.Error(t, err)
+}
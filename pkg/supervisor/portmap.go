@@ -0,0 +1,186 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ONC RPC and portmapper constants, see RFC 5531 and RFC 1833.
+const (
+	rpcVersion          = 2
+	rpcMsgCall          = 0
+	rpcMsgReply         = 1
+	rpcReplyAccepted    = 0
+	rpcAcceptSuccess    = 0
+	portmapperProgram   = 100000
+	portmapperVersion   = 2
+	portmapperGetPort   = 3
+	portmapperPort      = 111
+	IPProtoTCP          = 6
+	IPProtoUDP          = 17
+	StatdProgram        = 100024
+	StatdVersion        = 1
+	defaultRPCCallLimit = 2 * time.Second
+)
+
+// GetPort asks the portmapper at addr for the port of the given RPC program,
+// version and protocol. A zero port means the program is not registered.
+func GetPort(ctx context.Context, addr string, prog, vers, proto uint32) (uint32, error) {
+	results, err := call(ctx, addr, portmapperProgram, portmapperVersion, portmapperGetPort, prog, vers, proto, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(results) < 4 {
+		return 0, errors.New("short portmapper reply")
+	}
+	return binary.BigEndian.Uint32(results), nil
+}
+
+// Ping calls the NULL procedure of the RPC program served over UDP at addr.
+func Ping(ctx context.Context, addr string, prog, vers uint32) error {
+	_, err := call(ctx, addr, prog, vers, 0)
+	return err
+}
+
+// PingRegistered looks up the UDP port of the RPC program in the portmapper
+// at host:111 and calls its NULL procedure, like "rpcinfo -T udp host prog vers".
+func PingRegistered(ctx context.Context, host string, prog, vers uint32) error {
+	port, err := GetPort(ctx, net.JoinHostPort(host, fmt.Sprint(portmapperPort)), prog, vers, IPProtoUDP)
+	if err != nil {
+		return err
+	}
+	if port == 0 {
+		return fmt.Errorf("program %d version %d is not registered", prog, vers)
+	}
+	return Ping(ctx, net.JoinHostPort(host, fmt.Sprint(port)), prog, vers)
+}
+
+// call makes an RPC call over UDP and returns the encoded results.
+func call(ctx context.Context, addr string, prog, vers, proc uint32, args ...uint32) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRPCCallLimit)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	xid := rand.Uint32() //nolint:gosec
+	if _, err := conn.Write(encodeCall(xid, prog, vers, proc, args...)); err != nil {
+		return nil, fmt.Errorf("failed to send RPC call to %s: %w", addr, err)
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RPC reply from %s: %w", addr, err)
+		}
+		results, replyXID, err := decodeReply(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		// ignore late replies to earlier calls
+		if replyXID == xid {
+			return results, nil
+		}
+	}
+}
+
+// encodeCall encodes an RPC call message with AUTH_NONE credentials.
+func encodeCall(xid, prog, vers, proc uint32, args ...uint32) []byte {
+	fields := []uint32{
+		xid,
+		rpcMsgCall,
+		rpcVersion,
+		prog,
+		vers,
+		proc,
+		0, 0, // credential: AUTH_NONE, no body
+		0, 0, // verifier: AUTH_NONE, no body
+	}
+	fields = append(fields, args...)
+	b := make([]byte, 4*len(fields))
+	for i, f := range fields {
+		binary.BigEndian.PutUint32(b[4*i:], f)
+	}
+	return b
+}
+
+// decodeReply decodes an accepted RPC reply message and returns the encoded
+// results and the transaction id of the reply.
+func decodeReply(b []byte) ([]byte, uint32, error) {
+	next := func() (uint32, error) {
+		if len(b) < 4 {
+			return 0, errors.New("short RPC reply")
+		}
+		v := binary.BigEndian.Uint32(b)
+		b = b[4:]
+		return v, nil
+	}
+
+	xid, err := next()
+	if err != nil {
+		return nil, 0, err
+	}
+	if msgType, err := next(); err != nil {
+		return nil, 0, err
+	} else if msgType != rpcMsgReply {
+		return nil, 0, fmt.Errorf("unexpected RPC message type %d", msgType)
+	}
+	if replyStat, err := next(); err != nil {
+		return nil, 0, err
+	} else if replyStat != rpcReplyAccepted {
+		return nil, 0, fmt.Errorf("RPC call denied with status %d", replyStat)
+	}
+	// skip the verifier flavor and body
+	if _, err := next(); err != nil {
+		return nil, 0, err
+	}
+	verfLen, err := next()
+	if err != nil {
+		return nil, 0, err
+	}
+	padded := (verfLen + 3) &^ 3
+	if uint32(len(b)) < padded {
+		return nil, 0, errors.New("short RPC reply")
+	}
+	b = b[padded:]
+	if acceptStat, err := next(); err != nil {
+		return nil, 0, err
+	} else if acceptStat != rpcAcceptSuccess {
+		return nil, 0, fmt.Errorf("RPC call failed with status %d", acceptStat)
+	}
+	return b, xid, nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRPCServer answers RPC calls over UDP, replying with acceptStat and, for
+// portmapper GETPORT calls, the port registered for the requested program.
+func fakeRPCServer(t *testing.T, acceptStat uint32, ports map[uint32]uint32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			call := buf[:n]
+			word := func(i int) uint32 { return binary.BigEndian.Uint32(call[4*i:]) }
+			reply := []uint32{word(0), rpcMsgReply, rpcReplyAccepted, 0, 0, acceptStat}
+			if word(3) == portmapperProgram && word(5) == portmapperGetPort {
+				reply = append(reply, ports[word(10)])
+			}
+			b := make([]byte, 4*len(reply))
+			for i, f := range reply {
+				binary.BigEndian.PutUint32(b[4*i:], f)
+			}
+			_, _ = conn.WriteTo(b, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestGetPort(t *testing.T) {
+	tests := []struct {
+		desc         string
+		acceptStat   uint32
+		prog         uint32
+		expectedPort uint32
+		expectErr    bool
+	}{
+		{
+			desc:         "registered program",
+			prog:         StatdProgram,
+			expectedPort: 662,
+		},
+		{
+			desc:         "unregistered program",
+			prog:         100003,
+			expectedPort: 0,
+		},
+		{
+			desc:       "call not accepted",
+			acceptStat: 1,
+			prog:       StatdProgram,
+			expectErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		addr := fakeRPCServer(t, test.acceptStat, map[uint32]uint32{StatdProgram: 662})
+		port, err := GetPort(context.Background(), addr, test.prog, StatdVersion, IPProtoUDP)
+		if test.expectErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, test.expectedPort, port, test.desc)
+	}
+}
+
+func TestPing(t *testing.T) {
+	addr := fakeRPCServer(t, rpcAcceptSuccess, nil)
+	assert.NoError(t, Ping(context.Background(), addr, StatdProgram, StatdVersion))
+
+	// nothing listening
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closedAddr := conn.LocalAddr().String()
+	conn.Close()
+	assert.Error(t, Ping(context.Background(), closedAddr, StatdProgram, StatdVersion))
+}
+
+func TestDecodeReply(t *testing.T) {
+	tests := []struct {
+		desc            string
+		reply           []uint32
+		expectedResults []byte
+		expectErr       bool
+	}{
+		{
+			desc:            "accepted with verifier body",
+			reply:           []uint32{7, rpcMsgReply, rpcReplyAccepted, 1, 4, 0xdeadbeef, rpcAcceptSuccess, 111},
+			expectedResults: []byte{0, 0, 0, 111},
+		},
+		{
+			desc:      "call message",
+			reply:     []uint32{7, rpcMsgCall},
+			expectErr: true,
+		},
+		{
+			desc:      "denied",
+			reply:     []uint32{7, rpcMsgReply, 1, 0},
+			expectErr: true,
+		},
+		{
+			desc:      "short verifier",
+			reply:     []uint32{7, rpcMsgReply, rpcReplyAccepted, 1, 8, 0},
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		b := make([]byte, 4*len(test.reply))
+		for i, f := range test.reply {
+			binary.BigEndian.PutUint32(b[4*i:], f)
+		}
+		results, xid, err := decodeReply(b)
+		if test.expectErr {
+			assert.Error(t, err, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		assert.Equal(t, uint32(7), xid, test.desc)
+		assert.Equal(t, test.expectedResults, results, test.desc)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package supervisor starts, monitors and restarts the helper daemons the
+// node plugin depends on, such as rpcbind and rpc.statd.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// State of a supervised daemon.
+type State string
+
+const (
+	// StateStarting means the daemon has not been started yet.
+	StateStarting State = "Starting"
+	// StateRunning means the daemon process started by the supervisor is running.
+	StateRunning State = "Running"
+	// StateExternal means an instance not started by the supervisor is serving.
+	StateExternal State = "External"
+	// StateBackoff means the daemon exited or failed to start and is waiting to be restarted.
+	StateBackoff State = "Backoff"
+	// StateStopped means the supervisor was stopped.
+	StateStopped State = "Stopped"
+)
+
+const (
+	defaultInitialBackoff  = time.Second
+	defaultMaxBackoff      = time.Minute
+	defaultStableRunPeriod = time.Minute
+	defaultMonitorInterval = 10 * time.Second
+	defaultReadyTimeout    = 30 * time.Second
+	defaultStopTimeout     = 10 * time.Second
+)
+
+// Daemon describes a process managed by the Supervisor.
+type Daemon struct {
+	// Name identifies the daemon in logs and status.
+	Name string
+	// Command and Args run the daemon in the foreground.
+	Command string
+	Args    []string
+	// Env is added to the environment of the plugin for the daemon.
+	Env []string
+	// Running, if set, reports whether an instance not started by the
+	// supervisor is already serving. Such an instance is monitored instead of
+	// started, and the daemon is started once it goes away.
+	Running func(ctx context.Context) (bool, error)
+	// Ready, if set, returns nil once the daemon is serving. The daemons are
+	// started in order, each one after the previous one is ready.
+	Ready func(ctx context.Context) error
+}
+
+// Status is the observed state of a supervised daemon.
+type Status struct {
+	Name      string
+	State     State
+	PID       int
+	Restarts  int
+	LastError string
+	Since     time.Time
+}
+
+// Options tune the restart behaviour of the Supervisor.
+type Options struct {
+	// InitialBackoff is the delay before the first restart of a daemon,
+	// doubled on every consecutive failure up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// StableRunPeriod is how long a daemon must run for its backoff to be reset.
+	StableRunPeriod time.Duration
+	// MonitorInterval is how often an external instance is checked.
+	MonitorInterval time.Duration
+	// ReadyTimeout bounds how long the next daemon waits for the previous one to be ready.
+	ReadyTimeout time.Duration
+	// StopTimeout is how long a daemon has to exit after SIGTERM before it is killed.
+	StopTimeout time.Duration
+}
+
+// Supervisor runs a set of daemons and restarts them with backoff when they exit.
+type Supervisor struct {
+	opts    Options
+	daemons []*daemon
+}
+
+type daemon struct {
+	spec   Daemon
+	mutex  sync.Mutex
+	status Status
+}
+
+// New returns a Supervisor for the given daemons, zero options take the defaults.
+func New(opts Options, daemons ...Daemon) *Supervisor {
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.StableRunPeriod <= 0 {
+		opts.StableRunPeriod = defaultStableRunPeriod
+	}
+	if opts.MonitorInterval <= 0 {
+		opts.MonitorInterval = defaultMonitorInterval
+	}
+	if opts.ReadyTimeout <= 0 {
+		opts.ReadyTimeout = defaultReadyTimeout
+	}
+	if opts.StopTimeout <= 0 {
+		opts.StopTimeout = defaultStopTimeout
+	}
+
+	s := &Supervisor{opts: opts}
+	for _, spec := range daemons {
+		s.daemons = append(s.daemons, &daemon{
+			spec:   spec,
+			status: Status{Name: spec.Name, State: StateStarting, Since: time.Now()},
+		})
+	}
+	return s
+}
+
+// Run starts the daemons in order and supervises them until ctx is done, then
+// stops them and returns once they have exited.
+func (s *Supervisor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, d := range s.daemons {
+		wg.Add(1)
+		go func(d *daemon) {
+			defer wg.Done()
+			s.supervise(ctx, d)
+		}(d)
+		s.waitReady(ctx, d)
+	}
+	wg.Wait()
+}
+
+// Status returns the status of every daemon.
+func (s *Supervisor) Status() []Status {
+	statuses := make([]Status, 0, len(s.daemons))
+	for _, d := range s.daemons {
+		d.mutex.Lock()
+		statuses = append(statuses, d.status)
+		d.mutex.Unlock()
+	}
+	return statuses
+}
+
+// Check returns an error listing the daemons that are not running.
+func (s *Supervisor) Check() error {
+	var down []string
+	for _, st := range s.Status() {
+		if st.State == StateRunning || st.State == StateExternal {
+			continue
+		}
+		msg := fmt.Sprintf("%s is %s", st.Name, st.State)
+		if st.LastError != "" {
+			msg = fmt.Sprintf("%s (%s)", msg, st.LastError)
+		}
+		down = append(down, msg)
+	}
+	if len(down) > 0 {
+		return errors.New(strings.Join(down, ", "))
+	}
+	return nil
+}
+
+func (s *Supervisor) waitReady(ctx context.Context, d *daemon) {
+	if d.spec.Ready == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.opts.ReadyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	var err error
+	for {
+		if err = d.spec.Ready(ctx); err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			klog.Warningf("%s is not ready after %v, starting the next daemon anyway: %v", d.spec.Name, s.opts.ReadyTimeout, err)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// supervise runs a single daemon until ctx is done.
+func (s *Supervisor) supervise(ctx context.Context, d *daemon) {
+	backoff := s.opts.InitialBackoff
+	for ctx.Err() == nil {
+		if d.spec.Running != nil {
+			running, err := d.spec.Running(ctx)
+			if err != nil {
+				klog.V(4).Infof("failed to check for a running %s, starting it: %v", d.spec.Name, err)
+			}
+			if running {
+				d.setState(StateExternal, 0, nil)
+				sleep(ctx, s.opts.MonitorInterval)
+				continue
+			}
+		}
+
+		started := time.Now()
+		err := s.runOnce(ctx, d)
+		if ctx.Err() != nil {
+			break
+		}
+
+		if time.Since(started) >= s.opts.StableRunPeriod {
+			backoff = s.opts.InitialBackoff
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		klog.Warningf("%s stopped: %v, restarting in %v", d.spec.Name, err, backoff)
+		d.setState(StateBackoff, 0, err)
+		d.mutex.Lock()
+		d.status.Restarts++
+		d.mutex.Unlock()
+
+		sleep(ctx, backoff)
+		backoff *= 2
+		if backoff > s.opts.MaxBackoff {
+			backoff = s.opts.MaxBackoff
+		}
+	}
+	d.setState(StateStopped, 0, nil)
+}
+
+// runOnce starts the daemon and waits for it to exit.
+func (s *Supervisor) runOnce(ctx context.Context, d *daemon) error {
+	cmd := exec.CommandContext(ctx, d.spec.Command, d.spec.Args...)
+	if len(d.spec.Env) > 0 {
+		cmd.Env = append(os.Environ(), d.spec.Env...)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		klog.V(4).Infof("sending SIGTERM to %s (PID %d)", d.spec.Name, cmd.Process.Pid)
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = s.opts.StopTimeout
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start: %w", err)
+	}
+	klog.V(2).Infof("%s started with PID %d", d.spec.Name, cmd.Process.Pid)
+	d.setState(StateRunning, cmd.Process.Pid, nil)
+	return cmd.Wait()
+}
+
+func (d *daemon) setState(state State, pid int, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.status.State != state {
+		d.status.Since = time.Now()
+		if state != StateBackoff {
+			klog.V(2).Infof("%s is %s", d.spec.Name, state)
+		}
+	}
+	d.status.State = state
+	d.status.PID = pid
+	if err != nil {
+		d.status.LastError = err.Error()
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2024 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testOptions = Options{
+	InitialBackoff:  10 * time.Millisecond,
+	MaxBackoff:      20 * time.Millisecond,
+	MonitorInterval: 10 * time.Millisecond,
+	ReadyTimeout:    time.Second,
+	StopTimeout:     time.Second,
+}
+
+// runSupervisor runs s until the returned stop function is called.
+func runSupervisor(s *Supervisor) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestSupervisorRestartsExitedDaemon(t *testing.T) {
+	s := New(testOptions, Daemon{Name: "crashing", Command: "true"})
+	stop := runSupervisor(s)
+
+	assert.Eventually(t, func() bool {
+		return s.Status()[0].Restarts >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stop()
+	st := s.Status()[0]
+	assert.Equal(t, StateStopped, st.State)
+	assert.Equal(t, "exited", st.LastError)
+	assert.Error(t, s.Check())
+}
+
+func TestSupervisorRunningDaemon(t *testing.T) {
+	s := New(testOptions, Daemon{Name: "sleeper", Command: "sleep", Args: []string{"60"}})
+	stop := runSupervisor(s)
+
+	assert.Eventually(t, func() bool {
+		return s.Check() == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	st := s.Status()[0]
+	assert.Equal(t, StateRunning, st.State)
+	assert.NotZero(t, st.PID)
+	assert.Zero(t, st.Restarts)
+
+	// stopping terminates the daemon
+	stop()
+	assert.Equal(t, StateStopped, s.Status()[0].State)
+}
+
+func TestSupervisorStartFailure(t *testing.T) {
+	s := New(testOptions, Daemon{Name: "missing", Command: "/does/not/exist"})
+	stop := runSupervisor(s)
+	defer stop()
+
+	assert.Eventually(t, func() bool {
+		return s.Status()[0].Restarts >= 1
+	}, 5*time.Second, 10*time.Millisecond)
+	err := s.Check()
+	assert.ErrorContains(t, err, "missing is")
+	assert.ErrorContains(t, err, "failed to start")
+}
+
+func TestSupervisorExternalDaemon(t *testing.T) {
+	var external atomic.Bool
+	external.Store(true)
+	s := New(testOptions, Daemon{
+		Name:    "statd",
+		Command: "sleep",
+		Args:    []string{"60"},
+		Running: func(_ context.Context) (bool, error) { return external.Load(), nil },
+	})
+	stop := runSupervisor(s)
+	defer stop()
+
+	assert.Eventually(t, func() bool {
+		return s.Status()[0].State == StateExternal
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, s.Check())
+	assert.Zero(t, s.Status()[0].PID)
+
+	// the daemon is started once the external instance goes away
+	external.Store(false)
+	assert.Eventually(t, func() bool {
+		return s.Status()[0].State == StateRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotZero(t, s.Status()[0].PID)
+}
+
+func TestSupervisorStartsInOrder(t *testing.T) {
+	var firstReady atomic.Bool
+	var startedBeforeReady atomic.Bool
+	s := New(testOptions,
+		Daemon{
+			Name:    "first",
+			Command: "sleep",
+			Args:    []string{"60"},
+			Ready: func(_ context.Context) error {
+				firstReady.Store(true)
+				return nil
+			},
+		},
+		Daemon{
+			Name:    "second",
+			Command: "sleep",
+			Args:    []string{"60"},
+			Running: func(_ context.Context) (bool, error) {
+				startedBeforeReady.Store(!firstReady.Load())
+				return false, nil
+			},
+		},
+	)
+	stop := runSupervisor(s)
+	defer stop()
+
+	assert.Eventually(t, func() bool {
+		return s.Check() == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, startedBeforeReady.Load())
+}
+
+func TestSupervisorDaemonEnv(t *testing.T) {
+	// the daemon exits unless the variable is set
+	s := New(testOptions, Daemon{
+		Name:    "env",
+		Command: "sh",
+		Args:    []string{"-c", `test "$GREETING" = hello && exec sleep 60`},
+		Env:     []string{"GREETING=hello"},
+	})
+	stop := runSupervisor(s)
+	defer stop()
+
+	assert.Eventually(t, func() bool {
+		return s.Check() == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, StateRunning, s.Status()[0].State)
+	assert.Zero(t, s.Status()[0].Restarts)
+}